@@ -0,0 +1,72 @@
+package common
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// BandwidthLimit is a token bucket that limits the number of bytes
+// per second that can cross the connections sharing it. A limit
+// of zero means unlimited.
+type BandwidthLimit struct {
+	limiter        *rate.Limiter
+	bytesPerSecond uint64
+	mutex          sync.Mutex
+}
+
+// NewBandwidthLimit is a constructor for the BandwidthLimit struct.
+// It takes in the number of bytes per second allowed, where zero
+// means unlimited.
+func NewBandwidthLimit(bytesPerSecond uint64) *BandwidthLimit {
+	b := new(BandwidthLimit)
+	b.limiter = rate.NewLimiter(rate.Inf, 0)
+	b.SetLimit(bytesPerSecond)
+	return b
+}
+
+// GetLimit returns the number of bytes per second allowed, or
+// zero if the limit is disabled.
+func (b *BandwidthLimit) GetLimit() uint64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.bytesPerSecond
+}
+
+// SetLimit will change the number of bytes per second allowed.
+// The change applies to connections that are already running.
+func (b *BandwidthLimit) SetLimit(bytesPerSecond uint64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.bytesPerSecond = bytesPerSecond
+	if bytesPerSecond == 0 {
+		b.limiter.SetLimit(rate.Inf)
+		return
+	}
+	b.limiter.SetBurst(int(bytesPerSecond))
+	b.limiter.SetLimit(rate.Limit(bytesPerSecond))
+}
+
+// Wait will block until size bytes are allowed through the
+// limit or ctx is cancelled.
+func (b *BandwidthLimit) Wait(ctx context.Context, size int) error {
+	for size > 0 {
+		// The limiter can only hand out up to a burst at a time
+		chunk := size
+		if burst := b.limiter.Burst(); burst > 0 && chunk > burst {
+			chunk = burst
+		}
+		if err := b.limiter.WaitN(ctx, chunk); err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			// The limit changed underneath us, try again
+			continue
+		}
+		size -= chunk
+	}
+	return nil
+}
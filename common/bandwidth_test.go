@@ -0,0 +1,37 @@
+package common
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBandwidthLimitUnlimited(t *testing.T) {
+	limit := NewBandwidthLimit(0)
+
+	start := time.Now()
+	limit.Wait(context.Background(), 10*1024*1024)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("unlimited Wait took %s", elapsed)
+	}
+}
+
+func TestBandwidthLimitThrottles(t *testing.T) {
+	limit := NewBandwidthLimit(1000)
+
+	start := time.Now()
+	limit.Wait(context.Background(), 1500)
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("Wait for 1500 bytes at 1000 B/s took %s", elapsed)
+	}
+}
+
+func TestBandwidthLimitCancel(t *testing.T) {
+	limit := NewBandwidthLimit(10)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := limit.Wait(ctx, 100); err == nil {
+		t.Errorf("Wait on cancelled context returned nil")
+	}
+}
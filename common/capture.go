@@ -0,0 +1,308 @@
+package common
+
+import (
+	"bufio"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CaptureBacklog is the number of packets queued for a capture's
+// writer before connections wait on the disk.
+const CaptureBacklog = 256
+
+// Capture records the data carried by tunneled connections to a
+// pcapng file. Only the payloads cross the tunnel, so the TCP and
+// UDP headers are synthesized from the addresses of each
+// connection's local socket, including a handshake when the
+// capture first sees a connection and a FIN or RST when it ends.
+// Packets are written to the file by a separate goroutine so that
+// connections never wait on the disk while holding the capture.
+type Capture struct {
+	id      string
+	path    string
+	file    *os.File
+	buffer  *bufio.Writer
+	writer  *pcapngWriter
+	queue   chan capturedPacket
+	done    chan struct{}
+	err     error
+	streams map[*Connection]*captureStream
+	packets atomic.Uint64
+	bytes   atomic.Uint64
+	closed  bool
+	mutex   sync.Mutex
+}
+
+// capturedPacket is a packet waiting to be written to the file.
+type capturedPacket struct {
+	timestamp   time.Time
+	data        []byte
+	payloadSize int
+}
+
+// captureStream is the state of a single connection in a capture.
+// The peer is the far end of the connection's local socket and the
+// gateway is this endpoint.
+type captureStream struct {
+	peer       packetEndpoint
+	gateway    packetEndpoint
+	datagram   bool
+	peerSeq    uint32
+	gatewaySeq uint32
+	peerFin    bool
+	gatewayFin bool
+}
+
+// NewCapture is a constructor for the Capture struct. It creates
+// the pcapng file at the provided path.
+func NewCapture(id string, path string) (*Capture, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	c := new(Capture)
+	c.id = id
+	c.path = path
+	c.file = file
+	c.buffer = bufio.NewWriter(file)
+	c.streams = make(map[*Connection]*captureStream)
+	if c.writer, err = newPcapngWriter(c.buffer); err == nil {
+		err = c.buffer.Flush()
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	c.queue = make(chan capturedPacket, CaptureBacklog)
+	c.done = make(chan struct{})
+	go c.run()
+	return c, nil
+}
+
+// run writes queued packets to the file, flushing whenever the
+// queue runs empty, until the capture is closed.
+func (c *Capture) run() {
+	defer close(c.done)
+
+	for packet := range c.queue {
+		if c.err != nil {
+			continue
+		}
+		err := c.writer.writePacket(packet.timestamp, packet.data)
+		if err == nil && len(c.queue) == 0 {
+			err = c.buffer.Flush()
+		}
+		if err != nil {
+			log.Printf("[!] Capture %s failed to write: %s", c.id, err)
+			c.err = err
+			continue
+		}
+		c.packets.Add(1)
+		c.bytes.Add(uint64(packet.payloadSize))
+	}
+	if c.err == nil {
+		c.err = c.buffer.Flush()
+	}
+}
+
+// GetID returns the ID of the capture.
+func (c *Capture) GetID() string {
+	return c.id
+}
+
+// GetPath returns the path of the capture's pcapng file.
+func (c *Capture) GetPath() string {
+	return c.path
+}
+
+// GetStats returns the number of packets written to the capture
+// and the number of payload bytes they carried.
+func (c *Capture) GetStats() (uint64, uint64) {
+	return c.packets.Load(), c.bytes.Load()
+}
+
+// Close will stop the capture, wait for the queued packets to be
+// written and close its file. Connections that are still open are
+// left without a FIN.
+func (c *Capture) Close() error {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.streams = nil
+	close(c.queue)
+	c.mutex.Unlock()
+
+	<-c.done
+	err := c.err
+	if closeErr := c.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// recordData will write the data carried by conn as one or more
+// packets. fromPeer is true for data read from the local socket.
+func (c *Capture) recordData(conn *Connection, fromPeer bool, data []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stream := c.getStream(conn)
+	if stream == nil {
+		return
+	}
+
+	if stream.datagram {
+		if len(data) > maxCapturedPayload {
+			data = data[:maxCapturedPayload]
+		}
+		src, dst := stream.direction(fromPeer)
+		c.writePacket(buildUDPPacket(src, dst, data), len(data))
+		return
+	}
+
+	for len(data) > 0 {
+		size := len(data)
+		if size > maxCapturedPayload {
+			size = maxCapturedPayload
+		}
+		c.writeSegment(stream, fromPeer, tcpFlagPsh|tcpFlagAck, data[:size])
+		data = data[size:]
+	}
+}
+
+// recordFin will write a FIN for the side of conn that finished
+// sending. fromPeer is true if the local socket finished.
+func (c *Capture) recordFin(conn *Connection, fromPeer bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stream := c.getStream(conn)
+	if stream == nil || stream.datagram {
+		return
+	}
+
+	if fromPeer && !stream.peerFin {
+		stream.peerFin = true
+		c.writeSegment(stream, true, tcpFlagFin|tcpFlagAck, nil)
+	} else if !fromPeer && !stream.gatewayFin {
+		stream.gatewayFin = true
+		c.writeSegment(stream, false, tcpFlagFin|tcpFlagAck, nil)
+	}
+}
+
+// recordClose will forget about conn, writing a RST if it was
+// closed before both sides finished sending.
+func (c *Capture) recordClose(conn *Connection) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stream, ok := c.streams[conn]
+	if !ok {
+		return
+	}
+	delete(c.streams, conn)
+
+	if !stream.datagram && !(stream.peerFin && stream.gatewayFin) {
+		c.writeSegment(stream, false, tcpFlagRst|tcpFlagAck, nil)
+	}
+}
+
+// getStream returns the state of conn in the capture, writing a
+// handshake if this is the first time it is seen. It returns nil
+// once the capture is closed.
+func (c *Capture) getStream(conn *Connection) *captureStream {
+	if c.closed {
+		return nil
+	}
+	if stream, ok := c.streams[conn]; ok {
+		return stream
+	}
+
+	stream := new(captureStream)
+	stream.peer = newPacketEndpoint(conn.Conn.RemoteAddr())
+	stream.gateway = newPacketEndpoint(conn.Conn.LocalAddr())
+	stream.datagram = conn.datagram
+	c.streams[conn] = stream
+
+	if !stream.datagram {
+		stream.peerSeq = rand.Uint32()
+		stream.gatewaySeq = rand.Uint32()
+
+		// The side that opened the connection sends the SYN
+		initiator := !conn.dialed
+		src, dst := stream.direction(initiator)
+		c.writePacket(buildTCPPacket(src, dst, stream.seq(initiator), 0,
+			tcpFlagSyn, nil), 0)
+		c.writePacket(buildTCPPacket(dst, src, stream.seq(!initiator),
+			stream.seq(initiator)+1, tcpFlagSyn|tcpFlagAck, nil), 0)
+		stream.peerSeq++
+		stream.gatewaySeq++
+		c.writeSegment(stream, initiator, tcpFlagAck, nil)
+	}
+	return stream
+}
+
+// writeSegment writes a TCP segment from one side of a stream and
+// advances that side's sequence number.
+func (c *Capture) writeSegment(stream *captureStream, fromPeer bool,
+	flags byte, payload []byte) {
+
+	src, dst := stream.direction(fromPeer)
+	packet := buildTCPPacket(src, dst, stream.seq(fromPeer),
+		stream.seq(!fromPeer), flags, payload)
+	c.writePacket(packet, len(payload))
+
+	advance := uint32(len(payload))
+	if flags&tcpFlagFin != 0 {
+		advance++
+	}
+	if fromPeer {
+		stream.peerSeq += advance
+	} else {
+		stream.gatewaySeq += advance
+	}
+}
+
+// writePacket queues a packet for the writer. Errors writing it are
+// logged rather than interrupting the connection.
+func (c *Capture) writePacket(packet []byte, payloadSize int) {
+	c.queue <- capturedPacket{time.Now(), packet, payloadSize}
+}
+
+// direction returns the source and destination of a packet sent by
+// the peer or by the gateway.
+func (s *captureStream) direction(fromPeer bool) (packetEndpoint, packetEndpoint) {
+	if fromPeer {
+		return s.peer, s.gateway
+	}
+	return s.gateway, s.peer
+}
+
+// seq returns the next sequence number of the peer or gateway.
+func (s *captureStream) seq(peer bool) uint32 {
+	if peer {
+		return s.peerSeq
+	}
+	return s.gatewaySeq
+}
+
+// newPacketEndpoint returns the address and port of addr. Addresses
+// that are not IP, such as those of in memory pipes, are captured
+// as the unspecified address.
+func newPacketEndpoint(addr net.Addr) packetEndpoint {
+	ip, port := AddrToIPPort(addr)
+	if ip == nil {
+		ip = net.IPv4zero
+	}
+	return packetEndpoint{ip: ip, port: uint16(port)}
+}
@@ -0,0 +1,102 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readPcapngPackets returns the packets of every enhanced packet
+// block in a pcapng file.
+func readPcapngPackets(t *testing.T, path string) [][]byte {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binary.LittleEndian.Uint32(data) != pcapngSectionHeaderBlock ||
+		binary.LittleEndian.Uint32(data[8:]) != pcapngByteOrderMagic {
+		t.Fatal("missing section header block")
+	}
+
+	var packets [][]byte
+	for len(data) > 0 {
+		blockType := binary.LittleEndian.Uint32(data)
+		length := binary.LittleEndian.Uint32(data[4:])
+		if binary.LittleEndian.Uint32(data[length-4:]) != length {
+			t.Fatalf("block lengths do not match")
+		}
+		if blockType == pcapngEnhancedPacketBlock {
+			size := binary.LittleEndian.Uint32(data[20:])
+			packets = append(packets, data[28:28+size])
+		}
+		data = data[length:]
+	}
+	return packets
+}
+
+func TestCaptureSynthesizesTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	local, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+
+	path := filepath.Join(t.TempDir(), "test.pcapng")
+	capture, err := NewCapture("test", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := NewConnection(local)
+	conn.SetCapture(capture)
+	conn.captureData(true, []byte("request"))
+	conn.captureData(false, []byte("response"))
+	conn.captureFin(true)
+	conn.captureFin(false)
+	capture.recordClose(conn)
+	if err := capture.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A handshake, the two payloads and a FIN from each side
+	packets := readPcapngPackets(t, path)
+	if len(packets) != 7 {
+		t.Fatalf("expected 7 packets, got %d", len(packets))
+	}
+	if count, size := capture.GetStats(); count != 7 || size != 15 {
+		t.Fatalf("unexpected stats: %d packets, %d bytes", count, size)
+	}
+
+	request := packets[3]
+	if ipChecksum(request[:20], 0) != 0 {
+		t.Errorf("invalid IP header checksum")
+	}
+	if !bytes.Equal(request[40:], []byte("request")) {
+		t.Errorf("unexpected payload: %q", request[40:])
+	}
+
+	// The request comes from the far end of the local socket
+	peerPort := uint16(local.RemoteAddr().(*net.TCPAddr).Port)
+	if binary.BigEndian.Uint16(request[20:]) != peerPort {
+		t.Errorf("unexpected source port: %d", binary.BigEndian.Uint16(request[20:]))
+	}
+
+	// The response acknowledges the request
+	response := packets[4]
+	requestSeq := binary.BigEndian.Uint32(request[24:])
+	if binary.BigEndian.Uint32(response[28:]) != requestSeq+uint32(len("request")) {
+		t.Errorf("response does not acknowledge the request")
+	}
+	if response[33] != tcpFlagPsh|tcpFlagAck || packets[5][33] != tcpFlagFin|tcpFlagAck {
+		t.Errorf("unexpected flags")
+	}
+}
@@ -0,0 +1,99 @@
+package common
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/golang/snappy"
+)
+
+const (
+	CompressionNone = iota
+	CompressionSnappy
+)
+
+// CompressionStats tracks how many bytes of tunneled data were
+// carried and how many bytes they took up on the wire.
+type CompressionStats struct {
+	uncompressedBytes uint64
+	compressedBytes   uint64
+}
+
+// CompressionName returns a printable name for a compression
+// algorithm.
+func CompressionName(algorithm uint32) string {
+	switch algorithm {
+	case CompressionNone:
+		return "none"
+	case CompressionSnappy:
+		return "snappy"
+	}
+	return "unknown"
+}
+
+// ParseCompression converts a compression algorithm name into
+// its constant.
+func ParseCompression(name string) (uint32, error) {
+	switch name {
+	case "", "none":
+		return CompressionNone, nil
+	case "snappy":
+		return CompressionSnappy, nil
+	}
+	return CompressionNone, fmt.Errorf("unsupported compression: %s", name)
+}
+
+// SupportsCompression returns true if this build is able to
+// compress and decompress with the provided algorithm.
+func SupportsCompression(algorithm uint32) bool {
+	return algorithm == CompressionNone || algorithm == CompressionSnappy
+}
+
+// compress will compress data with the provided algorithm.
+func compress(algorithm uint32, data []byte) []byte {
+	switch algorithm {
+	case CompressionSnappy:
+		return snappy.Encode(nil, data)
+	}
+	return data
+}
+
+// decompress will decompress data with the provided algorithm.
+// Data that would decompress to more than maxSize bytes is refused
+// before anything is allocated for it.
+func decompress(algorithm uint32, data []byte, maxSize int) ([]byte, error) {
+	switch algorithm {
+	case CompressionNone:
+		return data, nil
+	case CompressionSnappy:
+		size, err := snappy.DecodedLen(data)
+		if err != nil {
+			return nil, err
+		}
+		if size > maxSize {
+			return nil, fmt.Errorf("decompressed size %d exceeds %d bytes",
+				size, maxSize)
+		}
+		return snappy.Decode(nil, data)
+	}
+	return nil, fmt.Errorf("unsupported compression: %d", algorithm)
+}
+
+// add records a message that carried uncompressed bytes of
+// data in compressed bytes on the wire.
+func (s *CompressionStats) add(uncompressed int, compressed int) {
+	atomic.AddUint64(&s.uncompressedBytes, uint64(uncompressed))
+	atomic.AddUint64(&s.compressedBytes, uint64(compressed))
+}
+
+// GetCompressedBytes returns the number of bytes sent or
+// received on the wire.
+func (s *CompressionStats) GetCompressedBytes() uint64 {
+	return atomic.LoadUint64(&s.compressedBytes)
+}
+
+// GetUncompressedBytes returns the number of bytes of tunneled
+// data that were sent or received.
+func (s *CompressionStats) GetUncompressedBytes() uint64 {
+	return atomic.LoadUint64(&s.uncompressedBytes)
+}
@@ -1,51 +1,249 @@
 package common
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	cs "github.com/hotnops/gTunnel/grpc/client"
 )
 
+// DefaultReceiveWindow is the number of bytes a connection will
+// accept from the remote side before they are written to the
+// local socket. Both ends of a connection use the same window, and
+// a window of 0 turns flow control off for endpoints that do not
+// support it.
+const DefaultReceiveWindow = 256 * 1024
+
+// MaxChunkSize is the largest amount of data read from the local
+// socket and sent in a single BytesMessage.
+const MaxChunkSize = 4096
+
+// MaxDatagramSize is the largest UDP payload that will be
+// carried over a datagram connection.
+const MaxDatagramSize = 65535
+
 // A structure to handle the TCP connection
 // and map them to the gRPC byte stream.
 type Connection struct {
-	ID          string
-	TCPConn     net.TCPConn
-	Kill        chan bool
-	Status      int32
-	Connected   chan bool
-	ingressData chan *cs.BytesMessage
-	egressData  chan *cs.BytesMessage
-	byteStream  ByteStream
-	bytesTx     uint64
-	bytesRx     uint64
-	remoteClose bool
-	mutex       sync.Mutex
-}
-
-// NewConnection is a constructor function for Connection.
-func NewConnection(tcpConn net.TCPConn) *Connection {
+	ID            string
+	Conn          net.Conn
+	Kill          chan bool
+	Status        int32
+	Connected     chan bool
+	started       chan bool
+	remoteAddress string
+	ingressData   chan *cs.BytesMessage
+	egressData    chan *cs.BytesMessage
+	byteStream    ByteStream
+	stats         TrafficStats
+	sharedStats   []*TrafficStats
+	startTime     time.Time
+	localFin      bool
+	remoteFin     bool
+	readErr       error
+	err           error
+	datagram      bool
+	dialed        bool
+	capture       atomic.Pointer[Capture]
+	recorder      ConnectionRecorder
+	compression   uint32
+	compStats     *CompressionStats
+	limits        []*BandwidthLimit
+	ctx           context.Context
+	cancel        context.CancelFunc
+	lastActivity  int64
+	receiveWindow uint32
+	unacked       uint32
+	sendCredit    uint32
+	creditClosed  bool
+	creditCond    *sync.Cond
+	creditMutex   sync.Mutex
+	sendMutex     sync.Mutex
+	mutex         sync.Mutex
+}
+
+// ConnectionRecorder keeps a record of everything sent over the
+// connections it is set on. RecordStart is called with the
+// connection's mutex held, so the remote address is passed in.
+type ConnectionRecorder interface {
+	RecordStart(conn *Connection, remoteAddress string)
+	RecordData(conn *Connection, fromLocal bool, data []byte)
+	RecordFin(conn *Connection, fromLocal bool)
+	RecordClose(conn *Connection)
+}
+
+// NewConnection is a constructor function for Connection. UDP
+// connections are carried as datagrams, everything else as a
+// stream of bytes.
+func NewConnection(conn net.Conn) *Connection {
 	c := new(Connection)
-	c.TCPConn = tcpConn
+	c.Conn = conn
+	switch conn.(type) {
+	case *net.UDPConn, *udpSession:
+		c.datagram = true
+	}
+	c.startTime = time.Now()
+	c.touch()
 	c.Status = 0
 	c.Connected = make(chan bool)
+	c.started = make(chan bool)
 	c.Kill = make(chan bool)
+	c.receiveWindow = DefaultReceiveWindow
+	c.creditCond = sync.NewCond(&c.creditMutex)
+	c.ctx, c.cancel = context.WithCancel(context.Background())
 
 	return c
 }
 
+// addRx records bytes read from the local socket.
+func (c *Connection) addRx(size int) {
+	c.stats.addRx(size)
+	for _, stats := range c.sharedStats {
+		stats.addRx(size)
+	}
+}
+
+// addTx records bytes written to the local socket.
+func (c *Connection) addTx(size int) {
+	c.stats.addTx(size)
+	for _, stats := range c.sharedStats {
+		stats.addTx(size)
+	}
+}
+
+// addCredit is called when the remote side grants more
+// bytes to be sent over the byte stream.
+func (c *Connection) addCredit(credit uint32) {
+	c.creditMutex.Lock()
+	defer c.creditMutex.Unlock()
+
+	c.sendCredit += credit
+	c.creditCond.Broadcast()
+}
+
 // Close will close a TCP connection and close the
 // Kill channel.
 func (c *Connection) Close() {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	c.TCPConn.Close()
+	c.Conn.Close()
+	c.cancel()
 	if c.Status != ConnectionStatusClosed {
 		close(c.Kill)
 		c.Status = ConnectionStatusClosed
+		if capture := c.capture.Load(); capture != nil {
+			capture.recordClose(c)
+		}
+		if c.recorder != nil {
+			c.recorder.RecordClose(c)
+		}
+	}
+
+	c.creditMutex.Lock()
+	c.creditClosed = true
+	c.creditCond.Broadcast()
+	c.creditMutex.Unlock()
+}
+
+// CloseWithError will close the connection and record
+// the reason it was closed.
+func (c *Connection) CloseWithError(err error) {
+	c.mutex.Lock()
+	c.err = err
+	c.mutex.Unlock()
+
+	c.Close()
+}
+
+// consumeData is called after data from the remote side has been
+// written to the local socket. Once half of the receive window
+// has been consumed, the consumed bytes are granted back to the
+// remote side.
+func (c *Connection) consumeData(size uint32) {
+	if c.receiveWindow == 0 {
+		return
+	}
+	c.unacked += size
+	if c.unacked < c.receiveWindow/2 {
+		return
+	}
+	c.sendCreditMessage(c.unacked)
+	c.unacked = 0
+}
+
+// Err returns the reason the connection was closed, if any.
+func (c *Connection) Err() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.err == nil {
+		return fmt.Errorf("connection closed")
 	}
+	return c.err
+}
+
+// GetCapture returns the capture the connection's data is
+// recorded to, or nil if it is not being captured.
+func (c *Connection) GetCapture() *Capture {
+	return c.capture.Load()
+}
+
+// IsDatagram returns true if the connection is carried as
+// datagrams rather than a stream of bytes.
+func (c *Connection) IsDatagram() bool {
+	return c.datagram
+}
+
+// IsDialed returns true if this endpoint dialed the local socket,
+// rather than accepting it.
+func (c *Connection) IsDialed() bool {
+	return c.dialed
+}
+
+// GetLastActivity returns the last time data crossed
+// the connection in either direction.
+func (c *Connection) GetLastActivity() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastActivity))
+}
+
+// GetRemoteAddress returns the address the remote endpoint
+// connected to, if it is known.
+func (c *Connection) GetRemoteAddress() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.remoteAddress
+}
+
+// GetReceiveWindow returns the maximum number of bytes that the
+// remote side can have in flight to this connection.
+func (c *Connection) GetReceiveWindow() uint32 {
+	return c.receiveWindow
+}
+
+// GetSendCredit returns the number of bytes that can currently
+// be sent to the remote side.
+func (c *Connection) GetSendCredit() uint32 {
+	c.creditMutex.Lock()
+	defer c.creditMutex.Unlock()
+
+	return c.sendCredit
+}
+
+// GetStartTime returns the time the connection was created.
+func (c *Connection) GetStartTime() time.Time {
+	return c.startTime
+}
+
+// GetStats returns the byte counters for the connection.
+func (c *Connection) GetStats() *TrafficStats {
+	return &c.stats
 }
 
 // GetStream will return the byteStream for a connection
@@ -53,57 +251,87 @@ func (c *Connection) GetStream() ByteStream {
 	return c.byteStream
 }
 
+// captureData will record data to the connection's capture and
+// recording, if it has them. fromLocal is true for data read from
+// the local socket.
+func (c *Connection) captureData(fromLocal bool, data []byte) {
+	if capture := c.capture.Load(); capture != nil {
+		capture.recordData(c, fromLocal, data)
+	}
+	if c.recorder != nil {
+		c.recorder.RecordData(c, fromLocal, data)
+	}
+}
+
+// captureFin will record to the connection's capture and recording,
+// if it has them, that one side is done sending.
+func (c *Connection) captureFin(fromLocal bool) {
+	if capture := c.capture.Load(); capture != nil {
+		capture.recordFin(c, fromLocal)
+	}
+	if c.recorder != nil {
+		c.recorder.RecordFin(c, fromLocal)
+	}
+}
+
+// closeRead will shut down the reading side of the local
+// socket if it supports half-close.
+func (c *Connection) closeRead() {
+	closeRead(c.Conn)
+}
+
+// closeWrite will shut down the writing side of the local
+// socket if it supports half-close.
+func (c *Connection) closeWrite() {
+	closeWrite(c.Conn)
+}
+
+// finish records that one direction of the connection is done
+// and closes the connection once both directions are done.
+func (c *Connection) finish(direction *bool) {
+	c.mutex.Lock()
+	*direction = true
+	done := c.localFin && c.remoteFin
+	c.mutex.Unlock()
+
+	if done {
+		c.Close()
+	}
+}
+
 // handleEgressData will listen on the locally
 // connected TCP socket and send the data over the gRPC stream.
 func (c *Connection) handleEgressData() {
 	inputChan := make(chan []byte, 4096)
 
-	go func(t net.TCPConn) {
-		for {
-			bytes := make([]byte, 4096)
-			bytesRead, err := t.Read(bytes)
-			if err != nil {
-				if !c.remoteClose {
-					break
-				}
-			}
-			inputChan <- bytes[:bytesRead]
-			if err != nil {
-				break
-			}
-		}
-		if inputChan != nil {
-			close(inputChan)
-		}
-	}(c.TCPConn)
+	if c.datagram {
+		go c.readDatagrams(inputChan)
+	} else {
+		go c.readStream(inputChan)
+	}
 
 	for {
 		select {
 		case bytes, ok := <-inputChan:
 			if !ok {
-				inputChan = nil
-				break
-			}
-			message := new(cs.BytesMessage)
-			message.Content = bytes
-
-			c.byteStream.Send(message)
-			if len(message.Content) == 0 {
-				inputChan = nil
-				break
+				if c.readErr == io.EOF {
+					// The local side is done sending, but it may
+					// still be reading what the remote side sends.
+					c.sendControlMessage(ByteStreamFin)
+					c.captureFin(true)
+					c.closeRead()
+					c.finish(&c.localFin)
+				} else {
+					c.Reset()
+				}
+				return
 			}
+			c.captureData(true, bytes)
+			c.send(c.newDataMessage(bytes))
 		case <-c.Kill:
-			inputChan = nil
-			break
-		}
-		if inputChan == nil {
-			if !c.remoteClose {
-				c.SendCloseMessage()
-			}
-			break
+			return
 		}
 	}
-	c.Close()
 }
 
 // handleIngressData will handle all incoming messages
@@ -116,64 +344,336 @@ func (c *Connection) handleIngressData() {
 	go func(s ByteStream) {
 		for {
 			message, err := s.Recv()
-			if err != nil {
+			if err == ErrReceiveWindowExceeded {
+				c.Reset()
+				return
+			} else if err != nil {
 				c.Close()
-				break
+				return
+			}
+			select {
+			case inputChan <- message:
+			case <-c.Kill:
+				return
 			}
-			inputChan <- message
-		}
-		if inputChan != nil {
-			close(inputChan)
 		}
 	}(c.byteStream)
 
 	for {
 		select {
-		case bytesMessage, ok := <-inputChan:
-			if !ok {
-				inputChan = nil
-				break
-			}
+		case bytesMessage := <-inputChan:
 			if bytesMessage == nil {
-				inputChan = nil
-				break
-			} else if len(bytesMessage.Content) == 0 {
-				c.remoteClose = true
-				inputChan = nil
-				break
-			} else {
-				bytesSent, err := c.TCPConn.Write(bytesMessage.Content)
+				return
+			}
+
+			switch bytesMessage.Operation {
+			case ByteStreamCredit:
+				c.addCredit(bytesMessage.Credit)
+			case ByteStreamFin:
+				// The remote side is done sending, so pass the
+				// half-close on to the local socket.
+				c.captureFin(false)
+				c.closeWrite()
+				c.finish(&c.remoteFin)
+			case ByteStreamRst:
+				c.Close()
+				return
+			default:
+				// Endpoints without flow control signal a close
+				// with an empty message. They are never sent
+				// credit, which they would read as a close.
+				if len(bytesMessage.Content) == 0 {
+					c.Close()
+					return
+				}
+				content, err := decompress(bytesMessage.Compression,
+					bytesMessage.Content, c.maxMessageSize())
 				if err != nil {
-					c.SendCloseMessage()
-					inputChan = nil
-					break
-				} else {
-					c.bytesTx += uint64(bytesSent)
+					c.Reset()
+					return
+				}
+				if c.compStats != nil {
+					c.compStats.add(len(content), len(bytesMessage.Content))
 				}
+				if c.throttle(len(content)) != nil {
+					return
+				}
+				c.captureData(false, content)
+				bytesSent, err := c.Conn.Write(content)
+				c.touch()
+				if err != nil {
+					c.Reset()
+					return
+				}
+				c.addTx(bytesSent)
+				c.consumeData(uint32(bytesSent))
 			}
 		case <-c.Kill:
-			inputChan = nil
+			return
+		}
+	}
+}
+
+// isIdle returns true if no data has crossed the connection
+// in either direction for longer than UDPSessionTimeout.
+func (c *Connection) isIdle() bool {
+	return time.Since(c.GetLastActivity()) > UDPSessionTimeout
+}
+
+// maxMessageSize returns the most data a single message from
+// the remote side can carry.
+func (c *Connection) maxMessageSize() int {
+	if c.datagram {
+		return MaxDatagramSize
+	}
+	return MaxChunkSize
+}
+
+// newDataMessage builds a message carrying data read from the
+// local socket. The data is compressed if the connection has
+// compression enabled and compressing makes it smaller.
+func (c *Connection) newDataMessage(data []byte) *cs.BytesMessage {
+	message := new(cs.BytesMessage)
+	message.Content = data
+
+	if c.compression != CompressionNone {
+		compressed := compress(c.compression, data)
+		if len(compressed) < len(data) {
+			message.Content = compressed
+			message.Compression = c.compression
+		}
+	}
+	if c.compStats != nil {
+		c.compStats.add(len(data), len(message.Content))
+	}
+	return message
+}
+
+// readDatagrams will read whole datagrams from the local socket
+// so that their boundaries are preserved over the byte stream.
+// Datagrams are dropped rather than queued when the remote side
+// has not granted enough credit, and the connection expires once
+// it has been idle for UDPSessionTimeout.
+func (c *Connection) readDatagrams(inputChan chan []byte) {
+	for {
+		c.Conn.SetReadDeadline(time.Now().Add(UDPSessionTimeout))
+		bytes := make([]byte, MaxDatagramSize)
+		bytesRead, err := c.Conn.Read(bytes)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() && !c.isIdle() {
+				continue
+			}
+			c.readErr = err
+			break
+		}
+		// Older endpoints treat a zero sized message as a
+		// close, so empty datagrams are not carried.
+		if bytesRead == 0 || !c.tryTakeCredit(uint32(bytesRead)) {
+			continue
+		}
+		if c.throttle(bytesRead) != nil {
+			c.readErr = net.ErrClosed
+			break
+		}
+		c.touch()
+		c.addRx(bytesRead)
+		inputChan <- bytes[:bytesRead]
+	}
+	close(inputChan)
+}
+
+// readStream will read from the local socket whenever the
+// remote side has granted credit to send data.
+func (c *Connection) readStream(inputChan chan []byte) {
+	for {
+		size := c.waitForCredit(MaxChunkSize)
+		if size == 0 {
+			c.readErr = net.ErrClosed
 			break
 		}
-		if inputChan == nil {
+		bytes := make([]byte, size)
+		bytesRead, err := c.Conn.Read(bytes)
+		c.takeCredit(uint32(bytesRead))
+		if bytesRead > 0 {
+			c.touch()
+			if c.throttle(bytesRead) != nil {
+				c.readErr = net.ErrClosed
+				break
+			}
+			c.addRx(bytesRead)
+			inputChan <- bytes[:bytesRead]
+		}
+		if err != nil {
+			c.readErr = err
 			break
 		}
 	}
+	close(inputChan)
+}
+
+// Reset will abort the connection in both directions and
+// notify the remote endpoint.
+func (c *Connection) Reset() {
+	c.mutex.Lock()
+	closed := c.Status == ConnectionStatusClosed
+	c.mutex.Unlock()
+
+	if !closed {
+		c.sendControlMessage(ByteStreamRst)
+	}
+	c.Close()
+}
+
+// sendControlMessage will send a message with the provided
+// operation and no content to the remote endpoint.
+func (c *Connection) sendControlMessage(operation int32) {
+	message := new(cs.BytesMessage)
+	message.Operation = operation
+	c.send(message)
+}
+
+// sendCreditMessage will grant the remote endpoint
+// permission to send the provided number of bytes.
+func (c *Connection) sendCreditMessage(credit uint32) {
+	creditMessage := new(cs.BytesMessage)
+	creditMessage.Operation = ByteStreamCredit
+	creditMessage.Credit = credit
+	c.send(creditMessage)
+}
+
+// send will write a message to the byte stream. gRPC streams
+// do not allow concurrent sends, so all writes go through here.
+func (c *Connection) send(message *cs.BytesMessage) error {
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+
+	return c.byteStream.Send(message)
+}
+
+// SetBandwidthLimits will set the bandwidth limits that
+// the connection's data must pass through in both directions.
+func (c *Connection) SetBandwidthLimits(limits ...*BandwidthLimit) {
+	c.limits = limits
+}
+
+// SetSharedStats will set additional counters, such as the
+// tunnel's and the client's totals, that the connection's
+// traffic is added to.
+func (c *Connection) SetSharedStats(stats ...*TrafficStats) {
+	c.sharedStats = stats
+}
+
+// SetCapture will record the connection's data to the provided
+// capture. A nil capture stops recording.
+func (c *Connection) SetCapture(capture *Capture) {
+	c.capture.Store(capture)
+}
+
+// SetCompression will set the algorithm used to compress data
+// sent by the connection and where its compression statistics
+// are recorded.
+func (c *Connection) SetCompression(algorithm uint32, stats *CompressionStats) {
+	c.compression = algorithm
+	c.compStats = stats
+}
+
+// SetDatagram sets whether the connection is carried as
+// datagrams rather than a stream of bytes.
+func (c *Connection) SetDatagram(datagram bool) {
+	c.datagram = datagram
+}
 
+// SetReceiveWindow will set the maximum number of bytes that
+// the remote side can have in flight to this connection. A
+// window of 0 turns flow control off.
+func (c *Connection) SetReceiveWindow(size uint32) {
+	c.receiveWindow = size
 }
 
-// SendCloseMessage will send a zero sized
-// message to the remote endpoint, indicating
-// that a TCP connection has been closed locally.
-func (c *Connection) SendCloseMessage() {
-	closeMessage := new(cs.BytesMessage)
-	closeMessage.Content = make([]byte, 0)
-	c.byteStream.Send(closeMessage)
+// SetRemoteAddress sets the address the remote endpoint
+// connected to.
+func (c *Connection) SetRemoteAddress(address string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.remoteAddress = address
 }
 
-// SetStream will set the byteStream for a connection
+// SetStream will set the byteStream for a connection. A
+// multiplexed stream queues no more than the receive window.
 func (c *Connection) SetStream(s ByteStream) {
 	c.byteStream = s
+	if muxed, ok := s.(*MuxedByteStream); ok {
+		muxed.SetReceiveWindow(c.receiveWindow)
+	}
+}
+
+// takeCredit removes the provided number of bytes from the
+// available send credit.
+func (c *Connection) takeCredit(size uint32) {
+	if c.receiveWindow == 0 {
+		return
+	}
+	c.creditMutex.Lock()
+	defer c.creditMutex.Unlock()
+
+	c.sendCredit -= size
+}
+
+// throttle will block until size bytes are allowed through
+// every bandwidth limit of the connection. An error is returned
+// if the connection is closed while waiting.
+func (c *Connection) throttle(size int) error {
+	for _, limit := range c.limits {
+		if err := limit.Wait(c.ctx, size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// touch records that data has crossed the connection.
+func (c *Connection) touch() {
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+}
+
+// tryTakeCredit removes the provided number of bytes from the
+// available send credit if enough credit is available.
+func (c *Connection) tryTakeCredit(size uint32) bool {
+	if c.receiveWindow == 0 {
+		return true
+	}
+	c.creditMutex.Lock()
+	defer c.creditMutex.Unlock()
+
+	if c.sendCredit < size {
+		return false
+	}
+	c.sendCredit -= size
+	return true
+}
+
+// waitForCredit will block until the remote side has granted
+// credit to send data. It returns the number of bytes, up to max,
+// that can be sent or zero if the connection has been closed.
+// Without flow control, max bytes can always be sent.
+func (c *Connection) waitForCredit(max uint32) uint32 {
+	c.creditMutex.Lock()
+	defer c.creditMutex.Unlock()
+
+	if c.receiveWindow == 0 && !c.creditClosed {
+		return max
+	}
+	for c.sendCredit == 0 && !c.creditClosed {
+		c.creditCond.Wait()
+	}
+	if c.creditClosed {
+		return 0
+	}
+	if c.sendCredit < max {
+		return c.sendCredit
+	}
+	return max
 }
 
 // Start will start two goroutines for handling the TCP socket
@@ -184,6 +684,16 @@ func (c *Connection) Start() {
 
 	if c.Status == ConnectionStatusCreated {
 		c.Status = ConnectionStatusConnected
+		// Both ends use the same window, so each starts out able
+		// to send a full window without waiting for a grant. The
+		// first datagram of a UDP session is sent right away.
+		c.creditMutex.Lock()
+		c.sendCredit = c.receiveWindow
+		c.creditMutex.Unlock()
+		close(c.started)
+		if c.recorder != nil {
+			c.recorder.RecordStart(c, c.remoteAddress)
+		}
 		go c.handleIngressData()
 		go c.handleEgressData()
 	}
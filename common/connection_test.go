@@ -0,0 +1,240 @@
+package common
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	cs "github.com/hotnops/gTunnel/grpc/client"
+)
+
+// newTCPPair returns both ends of a loopback TCP connection.
+func newTCPPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer ln.Close()
+
+	local, err := net.DialTCP("tcp", nil, ln.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	remote, err := ln.AcceptTCP()
+	if err != nil {
+		t.Fatalf("Accept failed: %s", err)
+	}
+	return local, remote
+}
+
+// recvData returns the next data message sent by the connection,
+// skipping over credit messages.
+func recvData(t *testing.T, peer *pipeStream) *cs.BytesMessage {
+	for {
+		select {
+		case m := <-peer.in:
+			if m.Operation != ByteStreamCredit {
+				return m
+			}
+		case <-time.After(time.Second):
+			return nil
+		}
+	}
+}
+
+func TestConnectionStopsAtCreditLimit(t *testing.T) {
+	local, remote := newTCPPair(t)
+	defer remote.Close()
+
+	stream, peer := newPipeStreams()
+	conn := NewConnection(local)
+	conn.SetReceiveWindow(10)
+	conn.SetStream(stream)
+	conn.Start()
+	defer conn.Close()
+
+	// The peer's window is granted from the start
+	remote.Write(make([]byte, 100))
+
+	m := recvData(t, peer)
+	if m == nil || len(m.Content) != 10 {
+		t.Fatalf("first message = %v; want 10 bytes", m)
+	}
+	if m := recvData(t, peer); m != nil {
+		t.Fatalf("received %d bytes without credit", len(m.Content))
+	}
+
+	peer.Send(&cs.BytesMessage{Operation: ByteStreamCredit, Credit: 90})
+
+	m = recvData(t, peer)
+	if m == nil || len(m.Content) != 90 {
+		t.Fatalf("second message = %v; want 90 bytes", m)
+	}
+}
+
+func TestConnectionGrantsConsumedCredit(t *testing.T) {
+	local, remote := newTCPPair(t)
+	defer remote.Close()
+
+	stream, peer := newPipeStreams()
+	conn := NewConnection(local)
+	conn.SetReceiveWindow(8)
+	conn.SetStream(stream)
+	conn.Start()
+	defer conn.Close()
+
+	peer.Send(&cs.BytesMessage{Content: []byte("abcd")})
+
+	var m *cs.BytesMessage
+	select {
+	case m = <-peer.in:
+	case <-time.After(time.Second):
+		t.Fatalf("no credit granted after consuming data")
+	}
+	if m.Operation != ByteStreamCredit || m.Credit != 4 {
+		t.Errorf("grant = %v; want 4 bytes of credit", m)
+	}
+}
+
+func TestConnectionWithoutFlowControl(t *testing.T) {
+	local, remote := newTCPPair(t)
+	defer remote.Close()
+
+	stream, peer := newPipeStreams()
+	conn := NewConnection(local)
+	conn.SetReceiveWindow(0)
+	conn.SetStream(stream)
+	conn.Start()
+	defer conn.Close()
+
+	// Data is sent without credit, and none is granted, since
+	// the peer would read an empty message as a close
+	remote.Write([]byte("data"))
+	select {
+	case m := <-peer.in:
+		if m.Operation != ByteStreamData || string(m.Content) != "data" {
+			t.Fatalf("first message = %v; want the data", m)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no data sent without flow control")
+	}
+
+	peer.Send(&cs.BytesMessage{Content: []byte("reply")})
+	reply := make([]byte, 5)
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := remote.Read(reply); err != nil || string(reply) != "reply" {
+		t.Fatalf("reply = %q, %v", reply, err)
+	}
+	select {
+	case m := <-peer.in:
+		t.Errorf("sent %v without flow control", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestConnectionHalfClose(t *testing.T) {
+	local, app := newTCPPair(t)
+	defer app.Close()
+
+	stream, peer := newPipeStreams()
+	conn := NewConnection(local)
+	conn.SetStream(stream)
+	conn.Start()
+	defer conn.Close()
+	peer.Send(&cs.BytesMessage{Operation: ByteStreamCredit, Credit: 64})
+
+	// The local application is done sending
+	app.CloseWrite()
+
+	m := recvData(t, peer)
+	if m == nil || m.Operation != ByteStreamFin {
+		t.Fatalf("message after local half-close = %v; want FIN", m)
+	}
+
+	// The remote side can still deliver data
+	peer.Send(&cs.BytesMessage{Content: []byte("response")})
+	buf := make([]byte, 64)
+	app.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := app.Read(buf)
+	if err != nil || string(buf[:n]) != "response" {
+		t.Fatalf("read after half-close = %s, %v; want response", buf[:n], err)
+	}
+
+	peer.Send(&cs.BytesMessage{Operation: ByteStreamFin})
+
+	select {
+	case <-conn.Kill:
+	case <-time.After(time.Second):
+		t.Fatalf("connection not closed after both sides finished")
+	}
+}
+
+func TestConnectionCompressesData(t *testing.T) {
+	local, app := newTCPPair(t)
+	defer app.Close()
+
+	stats := new(CompressionStats)
+	stream, peer := newPipeStreams()
+	conn := NewConnection(local)
+	conn.SetCompression(CompressionSnappy, stats)
+	conn.SetStream(stream)
+	conn.Start()
+	defer conn.Close()
+	peer.Send(&cs.BytesMessage{Operation: ByteStreamCredit, Credit: 1024})
+
+	data := make([]byte, 1024)
+	app.Write(data)
+
+	m := recvData(t, peer)
+	if m == nil || m.Compression != CompressionSnappy {
+		t.Fatalf("message = %v; want snappy compressed data", m)
+	}
+	content, err := decompress(m.Compression, m.Content, MaxChunkSize)
+	if err != nil || len(content) != len(data) {
+		t.Fatalf("decompressed %d bytes, %v; want %d", len(content), err, len(data))
+	}
+	if _, err := decompress(m.Compression, m.Content, len(data)-1); err == nil {
+		t.Errorf("decompressed past the size limit")
+	}
+	if stats.GetCompressedBytes() >= stats.GetUncompressedBytes() {
+		t.Errorf("compressed %d bytes into %d", stats.GetUncompressedBytes(),
+			stats.GetCompressedBytes())
+	}
+}
+
+func TestConnectionCountsBytes(t *testing.T) {
+	local, app := newTCPPair(t)
+	defer app.Close()
+
+	shared := new(TrafficStats)
+	stream, peer := newPipeStreams()
+	conn := NewConnection(local)
+	conn.SetSharedStats(shared)
+	conn.SetStream(stream)
+	conn.Start()
+	defer conn.Close()
+	peer.Send(&cs.BytesMessage{Operation: ByteStreamCredit, Credit: 1024})
+
+	app.Write([]byte("request"))
+	recvData(t, peer)
+
+	peer.Send(&cs.BytesMessage{Content: []byte("response!")})
+	app.SetReadDeadline(time.Now().Add(time.Second))
+	app.Read(make([]byte, 64))
+
+	// The counters are updated after the write completes
+	for i := 0; i < 100 && shared.GetBytesTx() != 9; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got := conn.GetStats().GetBytesRx(); got != 7 {
+		t.Errorf("bytes rx = %d; want 7", got)
+	}
+	if got := conn.GetStats().GetBytesTx(); got != 9 {
+		t.Errorf("bytes tx = %d; want 9", got)
+	}
+	if shared.GetBytesRx() != 7 || shared.GetBytesTx() != 9 {
+		t.Errorf("shared stats = %d/%d; want 7/9", shared.GetBytesRx(),
+			shared.GetBytesTx())
+	}
+}
@@ -8,6 +8,10 @@ const (
 	EndpointCtrlSocksProxyAck
 	EndpointCtrlSocksKill
 	EndpointCtrlDeleteTunnel
+	EndpointCtrlAck
+	EndpointCtrlHTTPProxy
+	EndpointCtrlHTTPProxyKill
+	EndpointCtrlPolicy
 )
 
 const (
@@ -15,10 +19,19 @@ const (
 	TunnelDirectionReverse
 )
 
+const (
+	TunnelProtocolTCP = iota
+	TunnelProtocolUDP
+	// Echo sessions opened by a VPN, which only dynamic tunnels
+	// carry
+	TunnelProtocolICMP
+)
+
 const (
 	TunnelCtrlConnect = iota
 	TunnelCtrlAck
 	TunnelCtrlDisconnect
+	TunnelCtrlReject
 )
 
 const (
@@ -26,3 +39,38 @@ const (
 	ConnectionStatusConnected
 	ConnectionStatusClosed
 )
+
+// Capabilities a gClient advertises when it opens its endpoint
+// control stream, so that the gServer only uses features the
+// client understands.
+const (
+	CapabilityFlowControl = 1 << iota
+	// The client reads the 4 or 16 byte address fields rather
+	// than only the IPv4 uint32 fields
+	CapabilityIPAddresses
+	// The client can dial TunnelProtocolICMP echo sessions
+	CapabilityICMP
+)
+
+// SupportedCapabilities are the capabilities of this build.
+const SupportedCapabilities = CapabilityFlowControl | CapabilityIPAddresses |
+	CapabilityICMP
+
+const (
+	ByteStreamData = iota
+	ByteStreamOpen
+	ByteStreamCredit
+	ByteStreamFin
+	ByteStreamRst
+)
+
+// DefaultVPNDevice is the name of the TUN device a VPN creates
+// unless another one is set.
+const DefaultVPNDevice = "gtun0"
+
+// DefaultVPNMTU is the MTU of a VPN's TUN device unless another one
+// is set.
+const DefaultVPNMTU = 1500
+
+// VPNIDSize is the length of generated VPN IDs.
+const VPNIDSize = 8
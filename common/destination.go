@@ -0,0 +1,281 @@
+package common
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cs "github.com/hotnops/gTunnel/grpc/client"
+)
+
+const (
+	DestinationStrategyFailover = iota
+	DestinationStrategyRoundRobin
+	DestinationStrategyRandom
+)
+
+// DestinationRetryInterval is how long a destination that failed
+// is tried after the others, so a destination that is down does not
+// slow down every new connection.
+const DestinationRetryInterval = 30 * time.Second
+
+// DestinationStrategyName returns a printable name for a
+// destination strategy.
+func DestinationStrategyName(strategy uint32) string {
+	switch strategy {
+	case DestinationStrategyFailover:
+		return "failover"
+	case DestinationStrategyRoundRobin:
+		return "roundrobin"
+	case DestinationStrategyRandom:
+		return "random"
+	}
+	return "unknown"
+}
+
+// ParseDestinationStrategy converts a destination strategy name
+// into its constant.
+func ParseDestinationStrategy(name string) (uint32, error) {
+	switch name {
+	case "", "failover":
+		return DestinationStrategyFailover, nil
+	case "roundrobin":
+		return DestinationStrategyRoundRobin, nil
+	case "random":
+		return DestinationStrategyRandom, nil
+	}
+	return DestinationStrategyFailover, fmt.Errorf("unsupported destination strategy: %s", name)
+}
+
+// DestinationHealth is the record of the connections made to a
+// destination. A destination is healthy until a connection to it
+// fails, and again once one succeeds.
+type DestinationHealth struct {
+	Healthy     bool
+	Successes   uint64
+	Failures    uint64
+	LastError   string
+	LastFailure time.Time
+}
+
+// TunnelDestination is one of the addresses a tunnel forwards its
+// connections to. The host is an IP address or a hostname, which is
+// resolved by the endpoint that dials it.
+type TunnelDestination struct {
+	Host   string
+	Port   uint32
+	health DestinationHealth
+	mutex  sync.Mutex
+}
+
+// NewTunnelDestination is a constructor for the TunnelDestination
+// struct.
+func NewTunnelDestination(host string, port uint32) *TunnelDestination {
+	d := new(TunnelDestination)
+	d.Host = host
+	d.Port = port
+	d.health.Healthy = true
+	return d
+}
+
+// ParseTunnelDestination parses a destination written as host or
+// host:port. The defaultPort is used when no port is given.
+func ParseTunnelDestination(destination string,
+	defaultPort uint32) (*TunnelDestination, error) {
+
+	if net.ParseIP(destination) != nil {
+		return NewTunnelDestination(destination, defaultPort), nil
+	}
+
+	host, portString, err := net.SplitHostPort(destination)
+	if err != nil {
+		return NewTunnelDestination(destination, defaultPort), nil
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil || port == 0 {
+		return nil, fmt.Errorf("invalid destination port: %s", destination)
+	}
+	return NewTunnelDestination(host, uint32(port)), nil
+}
+
+// String returns the destination as host:port.
+func (d *TunnelDestination) String() string {
+	return net.JoinHostPort(d.Host, strconv.Itoa(int(d.Port)))
+}
+
+// GetHealth returns the record of the connections made to the
+// destination.
+func (d *TunnelDestination) GetHealth() DestinationHealth {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.health
+}
+
+// recordAttempt updates the health of the destination with the
+// result of a connection to it. An empty err is a success.
+func (d *TunnelDestination) recordAttempt(err string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if err == "" {
+		d.health.Healthy = true
+		d.health.Successes++
+		return
+	}
+	d.health.Healthy = false
+	d.health.Failures++
+	d.health.LastError = err
+	d.health.LastFailure = time.Now()
+}
+
+// isDown returns true if the destination failed recently enough
+// to be tried after the others.
+func (d *TunnelDestination) isDown() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return !d.health.Healthy &&
+		time.Since(d.health.LastFailure) < DestinationRetryInterval
+}
+
+// DestinationSet is the ordered list of destinations of a tunnel.
+// Each new connection tries the destinations one after the other,
+// in an order chosen by the strategy, until one of them connects.
+type DestinationSet struct {
+	destinations []*TunnelDestination
+	strategy     uint32
+	next         atomic.Uint32
+}
+
+// NewDestinationSet is a constructor for the DestinationSet struct.
+func NewDestinationSet(destinations []*TunnelDestination,
+	strategy uint32) *DestinationSet {
+
+	s := new(DestinationSet)
+	s.destinations = destinations
+	s.strategy = strategy
+	return s
+}
+
+// NewDestinationSetFromMessage returns the destinations carried by
+// an endpoint control message, or nil if it carries none.
+func NewDestinationSetFromMessage(message *cs.EndpointControlMessage) *DestinationSet {
+	if len(message.Destinations) == 0 {
+		return nil
+	}
+
+	var destinations []*TunnelDestination
+	for _, destination := range message.Destinations {
+		destinations = append(destinations,
+			NewTunnelDestination(destination.Host, destination.Port))
+	}
+	return NewDestinationSet(destinations, message.DestinationStrategy)
+}
+
+// GetDestinations returns the destinations in the order they were
+// configured.
+func (s *DestinationSet) GetDestinations() []*TunnelDestination {
+	return s.destinations
+}
+
+// GetStrategy returns the strategy used to order the destinations.
+func (s *DestinationSet) GetStrategy() uint32 {
+	return s.strategy
+}
+
+// ToMessage returns the destinations as carried by an endpoint
+// control message.
+func (s *DestinationSet) ToMessage() []*cs.TunnelDestination {
+	var destinations []*cs.TunnelDestination
+	for _, destination := range s.destinations {
+		message := new(cs.TunnelDestination)
+		message.Host = destination.Host
+		message.Port = destination.Port
+		destinations = append(destinations, message)
+	}
+	return destinations
+}
+
+// order returns the indexes of the destinations in the order a new
+// connection should try them. Destinations that are down are moved
+// to the end, keeping the order chosen by the strategy.
+func (s *DestinationSet) order() []int {
+	count := len(s.destinations)
+	order := make([]int, count)
+
+	switch s.strategy {
+	case DestinationStrategyRoundRobin:
+		start := int(s.next.Add(1)-1) % count
+		for i := range order {
+			order[i] = (start + i) % count
+		}
+	case DestinationStrategyRandom:
+		copy(order, rand.Perm(count))
+	default:
+		for i := range order {
+			order[i] = i
+		}
+	}
+
+	var up, down []int
+	for _, i := range order {
+		if s.destinations[i].isDown() {
+			down = append(down, i)
+		} else {
+			up = append(up, i)
+		}
+	}
+	return append(up, down...)
+}
+
+// dial will try each destination with the provided dial function
+// until one of them connects, updating their health as it goes. It
+// returns the attempts that were made so that the remote endpoint
+// can update its own view of the destinations' health.
+func (s *DestinationSet) dial(dial func(*TunnelDestination) (net.Conn, error)) (
+	net.Conn, []*cs.DestinationAttempt, error) {
+
+	var attempts []*cs.DestinationAttempt
+	var lastErr error
+	for _, i := range s.order() {
+		destination := s.destinations[i]
+		attempt := new(cs.DestinationAttempt)
+		attempt.Index = uint32(i)
+		attempts = append(attempts, attempt)
+
+		conn, err := dial(destination)
+		if err == nil {
+			destination.recordAttempt("")
+			return conn, attempts, nil
+		}
+
+		attempt.ErrorMessage = err.Error()
+		destination.recordAttempt(attempt.ErrorMessage)
+		if len(s.destinations) > 1 {
+			log.Printf("[!] Destination %s failed: %s", destination, err)
+		}
+		lastErr = err
+	}
+
+	if len(s.destinations) == 1 {
+		return nil, attempts, lastErr
+	}
+	return nil, attempts, fmt.Errorf("all %d destinations failed, last error: %s",
+		len(s.destinations), lastErr)
+}
+
+// recordAttempts updates the health of the destinations with the
+// attempts made by the remote endpoint.
+func (s *DestinationSet) recordAttempts(attempts []*cs.DestinationAttempt) {
+	for _, attempt := range attempts {
+		if int(attempt.Index) < len(s.destinations) {
+			s.destinations[attempt.Index].recordAttempt(attempt.ErrorMessage)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package common
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// dialDestinations returns a dial function for a DestinationSet
+// that fails for the provided hosts and records the hosts tried.
+func dialDestinations(failing map[string]bool,
+	tried *[]string) func(*TunnelDestination) (net.Conn, error) {
+
+	return func(d *TunnelDestination) (net.Conn, error) {
+		*tried = append(*tried, d.Host)
+		if failing[d.Host] {
+			return nil, errors.New("connection refused")
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	}
+}
+
+func TestDestinationSetFailover(t *testing.T) {
+	set := NewDestinationSet([]*TunnelDestination{
+		NewTunnelDestination("a", 80),
+		NewTunnelDestination("b", 80),
+		NewTunnelDestination("c", 80)},
+		DestinationStrategyFailover)
+
+	var tried []string
+	conn, attempts, err := set.dial(dialDestinations(map[string]bool{"a": true}, &tried))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if len(attempts) != 2 || attempts[0].ErrorMessage == "" || attempts[1].ErrorMessage != "" {
+		t.Fatalf("unexpected attempts: %v", attempts)
+	}
+
+	health := set.GetDestinations()[0].GetHealth()
+	if health.Healthy || health.Failures != 1 || health.LastError != "connection refused" {
+		t.Fatalf("unexpected health for a: %+v", health)
+	}
+	if health := set.GetDestinations()[1].GetHealth(); !health.Healthy || health.Successes != 1 {
+		t.Fatalf("unexpected health for b: %+v", health)
+	}
+
+	// A destination that just failed is tried last
+	tried = nil
+	_, _, err = set.dial(dialDestinations(map[string]bool{"b": true, "c": true}, &tried))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tried) != 3 || tried[0] != "b" || tried[2] != "a" {
+		t.Fatalf("unexpected order: %v", tried)
+	}
+
+	_, attempts, err = set.dial(dialDestinations(map[string]bool{"a": true, "b": true, "c": true}, &tried))
+	if err == nil || len(attempts) != 3 {
+		t.Fatalf("expected every destination to fail, got %v and %d attempts", err, len(attempts))
+	}
+}
+
+func TestDestinationSetRoundRobin(t *testing.T) {
+	set := NewDestinationSet([]*TunnelDestination{
+		NewTunnelDestination("a", 80),
+		NewTunnelDestination("b", 80),
+		NewTunnelDestination("c", 80)},
+		DestinationStrategyRoundRobin)
+
+	var tried []string
+	for i := 0; i < 4; i++ {
+		conn, _, err := set.dial(dialDestinations(nil, &tried))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	if len(tried) != 4 || tried[0] != "a" || tried[1] != "b" || tried[2] != "c" || tried[3] != "a" {
+		t.Fatalf("unexpected order: %v", tried)
+	}
+}
+
+func TestParseTunnelDestination(t *testing.T) {
+	tests := []struct {
+		destination string
+		host        string
+		port        uint32
+	}{
+		{"10.0.0.1", "10.0.0.1", 22},
+		{"10.0.0.1:8080", "10.0.0.1", 8080},
+		{"example.com", "example.com", 22},
+		{"[::1]:8080", "::1", 8080},
+		{"::1", "::1", 22},
+	}
+	for _, test := range tests {
+		destination, err := ParseTunnelDestination(test.destination, 22)
+		if err != nil {
+			t.Fatalf("%s: %s", test.destination, err)
+		}
+		if destination.Host != test.host || destination.Port != test.port {
+			t.Fatalf("%s: got %s", test.destination, destination)
+		}
+	}
+
+	if _, err := ParseTunnelDestination("example.com:http", 22); err == nil {
+		t.Fatal("expected an invalid port to fail")
+	}
+}
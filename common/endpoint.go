@@ -13,7 +13,11 @@ type Endpoint struct {
 	Id                 string
 	killClient         chan bool
 	tunnels            map[string]*Tunnel
+	socksServers       map[string]*SocksServer
+	httpProxies        map[string]*HTTPProxyServer
+	policy             *Policy
 	endpointCtrlStream chan cs.EndpointControlMessage
+	stats              TrafficStats
 }
 
 type gInterface interface {
@@ -33,6 +37,9 @@ func NewEndpoint() *Endpoint {
 	e.Id = ""
 	e.endpointCtrlStream = make(chan cs.EndpointControlMessage)
 	e.tunnels = make(map[string]*Tunnel)
+	e.socksServers = make(map[string]*SocksServer)
+	e.httpProxies = make(map[string]*HTTPProxyServer)
+	e.policy = NewPolicy()
 	return e
 }
 
@@ -42,6 +49,56 @@ func (e *Endpoint) AddTunnel(id string, t *Tunnel) {
 	e.tunnels[id] = t
 }
 
+// AddSocksServer adds a socks server to the list of socks
+// servers maintained by the endpoint
+func (e *Endpoint) AddSocksServer(id string, s *SocksServer) {
+	e.socksServers[id] = s
+}
+
+// GetPolicy returns the policy deciding which destinations
+// the endpoint may connect to.
+func (e *Endpoint) GetPolicy() *Policy {
+	return e.policy
+}
+
+// GetSocksServer will take in a socks server ID string as an
+// argument and return the corresponding SocksServer pointer.
+func (e *Endpoint) GetSocksServer(id string) (*SocksServer, bool) {
+	s, ok := e.socksServers[id]
+	return s, ok
+}
+
+// GetSocksServers returns all of the socks servers
+// maintained by the endpoint
+func (e *Endpoint) GetSocksServers() map[string]*SocksServer {
+	return e.socksServers
+}
+
+// AddHTTPProxy adds an http proxy to the list of http proxies
+// maintained by the endpoint
+func (e *Endpoint) AddHTTPProxy(id string, h *HTTPProxyServer) {
+	e.httpProxies[id] = h
+}
+
+// GetHTTPProxy will take in an http proxy ID string as an
+// argument and return the corresponding HTTPProxyServer pointer.
+func (e *Endpoint) GetHTTPProxy(id string) (*HTTPProxyServer, bool) {
+	h, ok := e.httpProxies[id]
+	return h, ok
+}
+
+// GetHTTPProxies returns all of the http proxies
+// maintained by the endpoint
+func (e *Endpoint) GetHTTPProxies() map[string]*HTTPProxyServer {
+	return e.httpProxies
+}
+
+// GetStats returns the byte counters for every
+// tunnel on the endpoint.
+func (e *Endpoint) GetStats() *TrafficStats {
+	return &e.stats
+}
+
 // GetTunnel will take in a tunnel ID string as an argument
 // and return a Tunnel pointer of the corresponding ID.
 func (e *Endpoint) GetTunnel(tunID string) (*Tunnel, bool) {
@@ -66,6 +123,12 @@ func (e *Endpoint) Stop() {
 	for id, _ := range e.tunnels {
 		e.StopAndDeleteTunnel(id)
 	}
+	for id := range e.socksServers {
+		e.StopAndDeleteSocksServer(id)
+	}
+	for id := range e.httpProxies {
+		e.StopAndDeleteHTTPProxy(id)
+	}
 	close(e.endpointCtrlStream)
 }
 
@@ -81,3 +144,29 @@ func (e *Endpoint) StopAndDeleteTunnel(tunID string) bool {
 	delete(e.tunnels, tunID)
 	return true
 }
+
+// StopAndDeleteSocksServer takes in a socks server ID as an
+// argument, stops the socks server and removes it from the
+// endpoint. Returns true if successful and false otherwise.
+func (e *Endpoint) StopAndDeleteSocksServer(id string) bool {
+	s, ok := e.socksServers[id]
+	if !ok {
+		return false
+	}
+	s.Stop()
+	delete(e.socksServers, id)
+	return true
+}
+
+// StopAndDeleteHTTPProxy takes in an http proxy ID as an
+// argument, stops the http proxy and removes it from the
+// endpoint. Returns true if successful and false otherwise.
+func (e *Endpoint) StopAndDeleteHTTPProxy(id string) bool {
+	h, ok := e.httpProxies[id]
+	if !ok {
+		return false
+	}
+	h.Stop()
+	delete(e.httpProxies, id)
+	return true
+}
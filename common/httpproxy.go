@@ -0,0 +1,260 @@
+package common
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync/atomic"
+)
+
+// hopHeaders are the headers that apply to a single connection
+// and are not forwarded by the http proxy.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// HTTPProxyServer is a structure that handles starting and stopping
+// an http proxy on the gClient or the gServer. It supports CONNECT
+// requests as well as plain requests for absolute URIs.
+type HTTPProxyServer struct {
+	ProxyServer
+	transport *http.Transport
+}
+
+// NewHTTPProxyServer is a constructor for the HTTPProxyServer
+// struct. It takes in an ID and a port as arguments, the port
+// being where the http proxy listens. The proxy listens on
+// 127.0.0.1 unless a bind address is set.
+func NewHTTPProxyServer(id string, port uint32) *HTTPProxyServer {
+	h := new(HTTPProxyServer)
+	h.init(id, port)
+	h.transport = &http.Transport{
+		Proxy: nil,
+		DialContext: func(ctx context.Context, network string,
+			address string) (net.Conn, error) {
+			return h.dial(network, address)
+		},
+		DisableCompression: true,
+	}
+	return h
+}
+
+// SetDial will change how the http proxy connects to the
+// requested destinations. By default they are dialed directly.
+func (h *HTTPProxyServer) SetDial(dial DialFunc) {
+	h.dialFunc = dial
+}
+
+// Start will start the http proxy.
+func (h *HTTPProxyServer) Start() bool {
+	return h.start(h.serve)
+}
+
+// Stop will stop the http proxy and close every connection.
+func (h *HTTPProxyServer) Stop() {
+	h.ProxyServer.Stop()
+	h.transport.CloseIdleConnections()
+}
+
+// serve will handle the requests of a single http proxy client
+// until the connection is closed.
+func (h *HTTPProxyServer) serve(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+
+	for {
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			if err != io.EOF {
+				h.reply(conn, req, http.StatusBadRequest)
+			}
+			return
+		}
+
+		if !h.authorized(req) {
+			resp := newHTTPProxyResponse(req, http.StatusProxyAuthRequired)
+			resp.Header.Set("Proxy-Authenticate", `Basic realm="gTunnel"`)
+			resp.Write(conn)
+			return
+		}
+
+		if req.Method == http.MethodConnect {
+			h.connect(&bufferedConn{Conn: conn, reader: reader}, req)
+			return
+		}
+
+		if !h.forward(conn, req) {
+			return
+		}
+	}
+}
+
+// authorized returns true if the request carries the proxy's
+// credentials, or if none are required.
+func (h *HTTPProxyServer) authorized(req *http.Request) bool {
+	if h.username == "" {
+		return true
+	}
+
+	authorization := req.Header.Get("Proxy-Authorization")
+	encoded, ok := strings.CutPrefix(authorization, "Basic ")
+	if !ok {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return false
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return false
+	}
+
+	usernameMatch := subtle.ConstantTimeCompare([]byte(username), []byte(h.username))
+	passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(h.password))
+	return usernameMatch&passwordMatch == 1
+}
+
+// connect will dial the requested host and relay data between
+// it and the proxy client.
+func (h *HTTPProxyServer) connect(conn net.Conn, req *http.Request) {
+	record := h.newRequest(conn, "http", "connect", req.Host)
+	target, err := h.dial("tcp", req.Host)
+	if err != nil {
+		log.Printf("[!] http proxy connect to %s failed: %s", req.Host, err)
+		h.logRequest(record, err)
+		h.reply(conn, req, httpStatusForError(err))
+		return
+	}
+	defer target.Close()
+	record.ResolvedAddress = ResolvedAddress(target)
+
+	_, err = fmt.Fprintf(conn, "HTTP/%d.%d 200 Connection established\r\n\r\n",
+		req.ProtoMajor, req.ProtoMinor)
+	if err == nil {
+		record.BytesSent, record.BytesReceived = PipeConnections(conn, target)
+	}
+	h.logRequest(record, err)
+}
+
+// forward will send a request for an absolute URI to its
+// destination and copy the response back to the proxy client.
+// It returns false once the connection should be closed.
+func (h *HTTPProxyServer) forward(conn net.Conn, req *http.Request) bool {
+	if !req.URL.IsAbs() {
+		h.reply(conn, req, http.StatusBadRequest)
+		return false
+	}
+
+	record := h.newRequest(conn, "http", strings.ToLower(req.Method), req.URL.Host)
+	req.RequestURI = ""
+	removeHopHeaders(req.Header)
+
+	// Record where the request went and how much of it was sent
+	body := &countingReader{reader: req.Body}
+	if req.Body != nil {
+		req.Body = body
+	}
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			record.ResolvedAddress = ResolvedAddress(info.Conn)
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	resp, err := h.transport.RoundTrip(req)
+	record.BytesSent = body.count.Load()
+	if err != nil {
+		log.Printf("[!] http proxy request to %s failed: %s", req.URL, err)
+		h.logRequest(record, err)
+		h.reply(conn, req, httpStatusForError(err))
+		return false
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	response := &countingReader{reader: resp.Body}
+	resp.Body = response
+	err = resp.Write(conn)
+	record.BytesReceived = response.count.Load()
+	h.logRequest(record, err)
+	if err != nil {
+		return false
+	}
+	return !req.Close && !resp.Close
+}
+
+// reply will send an empty response with the provided status.
+func (h *HTTPProxyServer) reply(conn net.Conn, req *http.Request, status int) {
+	resp := newHTTPProxyResponse(req, status)
+	resp.Close = true
+	resp.Write(conn)
+}
+
+// httpStatusForError maps a dial error to a response status.
+func httpStatusForError(err error) int {
+	var policyErr *PolicyError
+	if errors.As(err, &policyErr) {
+		return http.StatusForbidden
+	}
+	return http.StatusBadGateway
+}
+
+// newHTTPProxyResponse returns an empty response to req with the
+// provided status.
+func newHTTPProxyResponse(req *http.Request, status int) *http.Response {
+	resp := new(http.Response)
+	resp.StatusCode = status
+	resp.ProtoMajor = 1
+	resp.ProtoMinor = 1
+	resp.Request = req
+	resp.Header = make(http.Header)
+	return resp
+}
+
+// countingReader is an io.ReadCloser that counts the bytes
+// read from it.
+type countingReader struct {
+	reader io.ReadCloser
+	count  atomic.Uint64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.reader.Read(b)
+	r.count.Add(uint64(n))
+	return n, err
+}
+
+func (r *countingReader) Close() error {
+	return r.reader.Close()
+}
+
+// removeHopHeaders removes the headers that only apply to a
+// single connection, including any named by the Connection
+// header.
+func removeHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			header.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
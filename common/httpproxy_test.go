@@ -0,0 +1,93 @@
+package common
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// startHTTPProxy starts an http proxy on an ephemeral port.
+func startHTTPProxy(t *testing.T, username string, password string) *HTTPProxyServer {
+	h := NewHTTPProxyServer("test", 0)
+	h.SetCredentials(username, password)
+	if !h.Start() {
+		t.Fatalf("failed to start http proxy")
+	}
+	return h
+}
+
+func TestHTTPProxyConnect(t *testing.T) {
+	echo := startTCPEcho(t)
+	defer echo.Close()
+	h := startHTTPProxy(t, "", "")
+	defer h.Stop()
+
+	conn, err := net.Dial("tcp", h.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte("CONNECT " + echo.Addr().String() + " HTTP/1.1\r\n" +
+		"Host: " + echo.Addr().String() + "\r\n\r\n"))
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT response = %v, %v; want 200", resp, err)
+	}
+
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(reader, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("echo = %q, %v; want hello", buf, err)
+	}
+}
+
+func TestHTTPProxyForwardsAbsoluteURI(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Proxy-Authorization") != "" {
+				t.Errorf("proxy credentials forwarded to the destination")
+			}
+			io.WriteString(w, "hello from "+r.URL.Path)
+		}))
+	defer backend.Close()
+	h := startHTTPProxy(t, "user", "secret")
+	defer h.Stop()
+
+	proxyURL, _ := url.Parse("http://user:secret@" + h.listener.Addr().String())
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get(backend.URL + "/path")
+	if err != nil {
+		t.Fatalf("Get failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "hello from /path" {
+		t.Errorf("response = %d %q; want 200 hello from /path", resp.StatusCode, body)
+	}
+}
+
+func TestHTTPProxyRequiresAuthentication(t *testing.T) {
+	h := startHTTPProxy(t, "user", "secret")
+	defer h.Stop()
+
+	proxyURL, _ := url.Parse("http://user:wrong@" + h.listener.Addr().String())
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := client.Get("http://127.0.0.1:1/")
+	if err != nil {
+		t.Fatalf("Get failed: %s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Errorf("status = %d; want %d", resp.StatusCode, http.StatusProxyAuthRequired)
+	}
+}
@@ -0,0 +1,160 @@
+package common
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	icmpProtocolIPv4 = 1
+	icmpProtocolIPv6 = 58
+)
+
+// dialICMP opens an echo session with the host in address, whose
+// port is ignored. Each datagram written to the returned connection
+// is an ICMP echo request and each datagram read from it is an echo
+// reply from the host. Unprivileged ping sockets are used where the
+// system allows them and raw sockets, which need privileges,
+// otherwise.
+func dialICMP(network string, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	remote, err := net.ResolveIPAddr("ip", host)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	c := new(icmpConn)
+	c.remote = remote
+	listens := [][2]string{{"udp6", "::"}, {"ip6:ipv6-icmp", "::"}}
+	c.protocol = icmpProtocolIPv6
+	if remote.IP.To4() != nil {
+		listens = [][2]string{{"udp4", "0.0.0.0"}, {"ip4:icmp", "0.0.0.0"}}
+		c.protocol = icmpProtocolIPv4
+	}
+
+	for _, listen := range listens {
+		c.conn, err = icmp.ListenPacket(listen[0], listen[1])
+		if err != nil {
+			continue
+		}
+		// Ping sockets are addressed by UDP address and replace
+		// the echo identifier with their port
+		if addr, ok := c.conn.LocalAddr().(*net.UDPAddr); ok {
+			c.dst = &net.UDPAddr{IP: remote.IP, Zone: remote.Zone}
+			c.id.Store(int32(addr.Port))
+			c.datagram = true
+		} else {
+			c.dst = remote
+		}
+		return c, nil
+	}
+	return nil, fmt.Errorf("failed to open an icmp socket: %s", err)
+}
+
+// icmpConn is an echo session with a single host.
+type icmpConn struct {
+	conn     *icmp.PacketConn
+	remote   *net.IPAddr
+	dst      net.Addr
+	protocol int
+	datagram bool
+	// The identifier replies are expected to carry
+	id atomic.Int32
+}
+
+// Write sends an echo request. Any other message is refused.
+func (c *icmpConn) Write(b []byte) (int, error) {
+	message, err := icmp.ParseMessage(c.protocol, b)
+	if err != nil {
+		return 0, err
+	}
+	echo, ok := message.Body.(*icmp.Echo)
+	if !ok || (message.Type != ipv4.ICMPTypeEcho &&
+		message.Type != ipv6.ICMPTypeEchoRequest) {
+		return 0, fmt.Errorf("only icmp echo requests are carried")
+	}
+	if !c.datagram {
+		c.id.Store(int32(echo.ID))
+	}
+
+	// Marshalling fills in the ICMPv4 checksum. The kernel fills
+	// in the ICMPv6 one, which covers the IP addresses.
+	data, err := message.Marshal(nil)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.conn.WriteTo(data, c.dst); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Read returns the next echo reply from the host, skipping any
+// other ICMP messages the socket receives.
+func (c *icmpConn) Read(b []byte) (int, error) {
+	buffer := make([]byte, MaxDatagramSize)
+	for {
+		n, peer, err := c.conn.ReadFrom(buffer)
+		if err != nil {
+			return 0, err
+		}
+		if !c.fromRemote(peer) {
+			continue
+		}
+		message, err := icmp.ParseMessage(c.protocol, buffer[:n])
+		if err != nil {
+			continue
+		}
+		echo, ok := message.Body.(*icmp.Echo)
+		if !ok || (message.Type != ipv4.ICMPTypeEchoReply &&
+			message.Type != ipv6.ICMPTypeEchoReply) ||
+			int32(echo.ID) != c.id.Load() {
+			continue
+		}
+		return copy(b, buffer[:n]), nil
+	}
+}
+
+// fromRemote returns true if peer is the host of the session.
+func (c *icmpConn) fromRemote(peer net.Addr) bool {
+	switch addr := peer.(type) {
+	case *net.UDPAddr:
+		return addr.IP.Equal(c.remote.IP)
+	case *net.IPAddr:
+		return addr.IP.Equal(c.remote.IP)
+	}
+	return false
+}
+
+func (c *icmpConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *icmpConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *icmpConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *icmpConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *icmpConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *icmpConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,47 @@
+package common
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+func TestDialICMPEcho(t *testing.T) {
+	conn, err := dialICMP("icmp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("icmp sockets are not allowed: %s", err)
+	}
+	defer conn.Close()
+
+	request := icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: 7, Seq: 1, Data: []byte("ping")},
+	}
+	data, _ := request.Marshal(nil)
+	if _, err := conn.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buffer := make([]byte, MaxDatagramSize)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := icmp.ParseMessage(icmpProtocolIPv4, buffer[:n])
+	if err != nil || reply.Type != ipv4.ICMPTypeEchoReply {
+		t.Fatalf("unexpected reply: %v, %v", reply, err)
+	}
+	if echo := reply.Body.(*icmp.Echo); echo.Seq != 1 || string(echo.Data) != "ping" {
+		t.Errorf("unexpected echo: %+v", echo)
+	}
+
+	// Anything but an echo request is refused
+	request.Type = ipv4.ICMPTypeTimestamp
+	data, _ = request.Marshal(nil)
+	if _, err := conn.Write(data); err == nil {
+		t.Errorf("wrote a timestamp request")
+	}
+}
@@ -0,0 +1,97 @@
+package common
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/time/rate"
+)
+
+// ListenerLimits restrict the connections accepted by a tunnel's
+// listener. An empty AllowedSources accepts every source and a
+// MaxConnections or MaxAcceptRate of 0 means unlimited. The
+// accept rate is in connections per second.
+type ListenerLimits struct {
+	AllowedSources []*net.IPNet
+	MaxConnections uint32
+	MaxAcceptRate  uint32
+}
+
+// ParseSources parses a list of CIDRs. A plain IP address is
+// treated as a single host.
+func ParseSources(sources []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, source := range sources {
+		if ip := net.ParseIP(source); ip != nil {
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			networks = append(networks,
+				&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source: %s", source)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// FormatSources returns a list of networks as CIDRs.
+func FormatSources(networks []*net.IPNet) []string {
+	var sources []string
+	for _, network := range networks {
+		sources = append(sources, network.String())
+	}
+	return sources
+}
+
+// listenerGuard enforces a tunnel's ListenerLimits.
+type listenerGuard struct {
+	limits  ListenerLimits
+	limiter *rate.Limiter
+}
+
+// newListenerGuard is a constructor for the listenerGuard struct.
+func newListenerGuard(limits ListenerLimits) *listenerGuard {
+	g := new(listenerGuard)
+	g.limits = limits
+	if limits.MaxAcceptRate != 0 {
+		g.limiter = rate.NewLimiter(rate.Limit(limits.MaxAcceptRate),
+			int(limits.MaxAcceptRate))
+	}
+	return g
+}
+
+// admit returns an error explaining why a connection from source
+// must be rejected, given the number of connections already open.
+func (g *listenerGuard) admit(source net.Addr, connections int) error {
+	if len(g.limits.AllowedSources) != 0 {
+		ip, _ := AddrToIPPort(source)
+		allowed := false
+		for _, network := range g.limits.AllowedSources {
+			if ip != nil && network.Contains(ip) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("rejected connection from %s: source not allowed", source)
+		}
+	}
+
+	if g.limits.MaxConnections != 0 && connections >= int(g.limits.MaxConnections) {
+		return fmt.Errorf("rejected connection from %s: maximum of %d connections reached",
+			source, g.limits.MaxConnections)
+	}
+
+	if g.limiter != nil && !g.limiter.Allow() {
+		return fmt.Errorf("rejected connection from %s: accept rate of %d per second exceeded",
+			source, g.limits.MaxAcceptRate)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package common
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseSources(t *testing.T) {
+	networks, err := ParseSources([]string{"10.0.0.0/8", "192.168.1.5", "fd00::/8"})
+	if err != nil {
+		t.Fatalf("ParseSources failed: %s", err)
+	}
+	want := []string{"10.0.0.0/8", "192.168.1.5/32", "fd00::/8"}
+	got := FormatSources(networks)
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("source %d = %s; want %s", i, got[i], want[i])
+		}
+	}
+
+	if _, err := ParseSources([]string{"10.0.0.0/33"}); err == nil {
+		t.Errorf("ParseSources accepted an invalid CIDR")
+	}
+}
+
+func TestListenerGuardAdmit(t *testing.T) {
+	sources, _ := ParseSources([]string{"10.0.0.0/8"})
+	guard := newListenerGuard(ListenerLimits{
+		AllowedSources: sources,
+		MaxConnections: 2,
+		MaxAcceptRate:  3,
+	})
+
+	inside := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 4000}
+	outside := &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 4000}
+
+	if err := guard.admit(outside, 0); err == nil {
+		t.Errorf("admitted a source outside of the allowlist")
+	}
+
+	// The rate allows a burst of 3 before refusing
+	for i := 0; i < 3; i++ {
+		if err := guard.admit(inside, 0); err != nil {
+			t.Fatalf("connection %d rejected: %s", i, err)
+		}
+	}
+	if err := guard.admit(inside, 0); err == nil {
+		t.Errorf("admitted a connection over the accept rate")
+	}
+}
+
+func TestListenerGuardUnlimited(t *testing.T) {
+	guard := newListenerGuard(ListenerLimits{})
+	addr := &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 4000}
+	for i := 0; i < 100; i++ {
+		if err := guard.admit(addr, i); err != nil {
+			t.Fatalf("connection %d rejected: %s", i, err)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	cs "github.com/hotnops/gTunnel/grpc/client"
+)
+
+// ErrReceiveWindowExceeded is returned by a multiplexed
+// connection's stream when the remote side sent more data than
+// the connection's receive window allows.
+var ErrReceiveWindowExceeded = fmt.Errorf("receive window exceeded")
+
+// MuxStream carries the byte streams of many connections
+// over a single gRPC stream. Each message is keyed by its
+// tunnel ID and connection ID.
+type MuxStream struct {
+	stream    ByteStream
+	streams   map[string]*MuxedByteStream
+	Done      chan bool
+	mutex     sync.Mutex
+	sendMutex sync.Mutex
+}
+
+// MuxedByteStream is a ByteStream for a single connection
+// carried by a MuxStream. Each connection queues its own
+// messages so that a slow connection never holds up the
+// shared stream. The data queued is bounded by the receive
+// window, since the remote side may only send what the
+// connection granted it.
+type MuxedByteStream struct {
+	mux           *MuxStream
+	tunnelID      string
+	connectionID  string
+	queue         []*cs.BytesMessage
+	queuedBytes   uint32
+	receiveWindow uint32
+	err           error
+	cond          *sync.Cond
+	mutex         sync.Mutex
+}
+
+// NewMuxStream is a constructor for the MuxStream struct. It
+// takes in the gRPC stream that will carry all connections.
+func NewMuxStream(s ByteStream) *MuxStream {
+	m := new(MuxStream)
+	m.stream = s
+	m.streams = make(map[string]*MuxedByteStream)
+	m.Done = make(chan bool)
+	return m
+}
+
+func muxKey(tunnelID string, connID string) string {
+	return tunnelID + "/" + connID
+}
+
+// Open will register a new connection with the mux and
+// return the ByteStream that represents it.
+func (m *MuxStream) Open(tunnelID string, connID string) *MuxedByteStream {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	key := muxKey(tunnelID, connID)
+	if s, ok := m.streams[key]; ok {
+		return s
+	}
+
+	s := new(MuxedByteStream)
+	s.mux = m
+	s.tunnelID = tunnelID
+	s.connectionID = connID
+	s.cond = sync.NewCond(&s.mutex)
+	m.streams[key] = s
+	return s
+}
+
+// Connect will register a new connection with the mux and
+// notify the remote side that the connection stream is open.
+func (m *MuxStream) Connect(tunnelID string, connID string) (*MuxedByteStream, error) {
+	s := m.Open(tunnelID, connID)
+
+	openMessage := new(cs.BytesMessage)
+	openMessage.Operation = ByteStreamOpen
+	if err := s.Send(openMessage); err != nil {
+		m.Remove(tunnelID, connID)
+		return nil, err
+	}
+	return s, nil
+}
+
+// Remove will unregister a connection from the mux. Any
+// pending Recv on its stream will return io.EOF.
+func (m *MuxStream) Remove(tunnelID string, connID string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	key := muxKey(tunnelID, connID)
+	if s, ok := m.streams[key]; ok {
+		s.close()
+		delete(m.streams, key)
+	}
+}
+
+// Run is the loop function responsible for receiving messages
+// from the shared gRPC stream and delivering them to the
+// appropriate connection. It never waits on a connection.
+// onOpen is called for every connection the remote side opens.
+func (m *MuxStream) Run(onOpen func(tunnelID string, connID string)) error {
+	defer m.stop()
+
+	for {
+		message, err := m.stream.Recv()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if message.Operation == ByteStreamOpen {
+			if onOpen != nil {
+				onOpen(message.TunnelId, message.ConnectionId)
+			}
+			continue
+		}
+
+		m.mutex.Lock()
+		s, ok := m.streams[muxKey(message.TunnelId, message.ConnectionId)]
+		m.mutex.Unlock()
+
+		if ok {
+			s.deliver(message)
+		}
+	}
+}
+
+// send will write a message to the shared gRPC stream.
+func (m *MuxStream) send(message *cs.BytesMessage) error {
+	m.sendMutex.Lock()
+	defer m.sendMutex.Unlock()
+
+	return m.stream.Send(message)
+}
+
+// stop will close every connection stream carried by the mux.
+func (m *MuxStream) stop() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for key, s := range m.streams {
+		s.close()
+		delete(m.streams, key)
+	}
+	close(m.Done)
+}
+
+func (s *MuxedByteStream) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.fail(io.EOF)
+}
+
+// fail will drop the queued messages and make Recv return err.
+// The caller must hold the mutex.
+func (s *MuxedByteStream) fail(err error) {
+	if s.err != nil {
+		return
+	}
+	s.err = err
+	s.queue = nil
+	s.queuedBytes = 0
+	s.cond.Broadcast()
+}
+
+// deliver will queue a message received for the connection.
+// A connection whose remote side sends more than the receive
+// window is failed rather than allowed to grow its queue.
+func (s *MuxedByteStream) deliver(message *cs.BytesMessage) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.err != nil {
+		return
+	}
+	size := uint32(len(message.Content))
+	if s.receiveWindow != 0 && s.queuedBytes+size > s.receiveWindow {
+		s.fail(ErrReceiveWindowExceeded)
+		return
+	}
+	s.queue = append(s.queue, message)
+	s.queuedBytes += size
+	s.cond.Signal()
+}
+
+// Send will tag the message with the connection's IDs and
+// write it to the shared stream.
+func (s *MuxedByteStream) Send(message *cs.BytesMessage) error {
+	message.TunnelId = s.tunnelID
+	message.ConnectionId = s.connectionID
+	return s.mux.send(message)
+}
+
+// Recv will return the next message for the connection.
+func (s *MuxedByteStream) Recv() (*cs.BytesMessage, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for len(s.queue) == 0 && s.err == nil {
+		s.cond.Wait()
+	}
+	if s.err != nil {
+		return nil, s.err
+	}
+	message := s.queue[0]
+	s.queue[0] = nil
+	s.queue = s.queue[1:]
+	s.queuedBytes -= uint32(len(message.Content))
+	return message, nil
+}
+
+// SetReceiveWindow will set the most data, in bytes, that can
+// be queued for the connection. Zero does not bound the queue.
+func (s *MuxedByteStream) SetReceiveWindow(size uint32) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.receiveWindow = size
+}
@@ -0,0 +1,185 @@
+package common
+
+import (
+	"io"
+	"runtime"
+	"testing"
+	"time"
+
+	cs "github.com/hotnops/gTunnel/grpc/client"
+)
+
+// pipeStream is an in-memory ByteStream used to connect
+// two MuxStreams together.
+type pipeStream struct {
+	in  chan *cs.BytesMessage
+	out chan *cs.BytesMessage
+}
+
+func newPipeStreams() (*pipeStream, *pipeStream) {
+	a := make(chan *cs.BytesMessage, 16)
+	b := make(chan *cs.BytesMessage, 16)
+	return &pipeStream{in: a, out: b}, &pipeStream{in: b, out: a}
+}
+
+func (p *pipeStream) Send(m *cs.BytesMessage) error {
+	p.out <- m
+	return nil
+}
+
+func (p *pipeStream) Recv() (*cs.BytesMessage, error) {
+	m, ok := <-p.in
+	if !ok {
+		return nil, io.EOF
+	}
+	return m, nil
+}
+
+func TestMuxStreamRoutesByConnection(t *testing.T) {
+	left, right := newPipeStreams()
+	client := NewMuxStream(left)
+	server := NewMuxStream(right)
+
+	opened := make(chan string, 2)
+	go client.Run(nil)
+	go server.Run(func(tunnelID string, connID string) {
+		server.Open(tunnelID, connID)
+		opened <- connID
+	})
+
+	first, err := client.Connect("tun", "first")
+	if err != nil {
+		t.Fatalf("Connect failed: %s", err)
+	}
+	second, err := client.Connect("tun", "second")
+	if err != nil {
+		t.Fatalf("Connect failed: %s", err)
+	}
+	<-opened
+	<-opened
+
+	second.Send(&cs.BytesMessage{Content: []byte("two")})
+	first.Send(&cs.BytesMessage{Content: []byte("one")})
+
+	got, _ := server.Open("tun", "first").Recv()
+	if string(got.Content) != "one" {
+		t.Errorf("first stream = %s; want one", got.Content)
+	}
+	got, _ = server.Open("tun", "second").Recv()
+	if string(got.Content) != "two" {
+		t.Errorf("second stream = %s; want two", got.Content)
+	}
+}
+
+func TestMuxStreamRemove(t *testing.T) {
+	left, _ := newPipeStreams()
+	mux := NewMuxStream(left)
+
+	s := mux.Open("tun", "conn")
+	mux.Remove("tun", "conn")
+
+	if _, err := s.Recv(); err != io.EOF {
+		t.Errorf("Recv after Remove = %v; want io.EOF", err)
+	}
+}
+
+func TestMuxStreamSlowConnectionDoesNotBlock(t *testing.T) {
+	left, right := newPipeStreams()
+	mux := NewMuxStream(right)
+	go mux.Run(nil)
+
+	slow := mux.Open("tun", "slow")
+	slow.SetReceiveWindow(1024)
+	fast := mux.Open("tun", "fast")
+
+	// Nothing reads the slow stream while more messages than
+	// the shared stream buffers are sent to it
+	for i := 0; i < 100; i++ {
+		left.Send(&cs.BytesMessage{TunnelId: "tun", ConnectionId: "slow",
+			Content: []byte("x")})
+	}
+	left.Send(&cs.BytesMessage{TunnelId: "tun", ConnectionId: "fast",
+		Content: []byte("fast")})
+
+	got, err := fast.Recv()
+	if err != nil || string(got.Content) != "fast" {
+		t.Fatalf("fast stream = %v, %v; want fast", got, err)
+	}
+
+	// Sending past the window fails the slow stream
+	left.Send(&cs.BytesMessage{TunnelId: "tun", ConnectionId: "slow",
+		Content: make([]byte, 1024)})
+	left.Send(&cs.BytesMessage{TunnelId: "tun", ConnectionId: "fast",
+		Content: []byte("sync")})
+	fast.Recv()
+	if _, err := slow.Recv(); err != ErrReceiveWindowExceeded {
+		t.Errorf("Recv past the window = %v; want ErrReceiveWindowExceeded", err)
+	}
+}
+
+// muxStreamHandler is a ConnectionStreamHandler that carries every
+// connection of a tunnel over a MuxStream, as the gClient does.
+type muxStreamHandler struct {
+	mux *MuxStream
+}
+
+func (h *muxStreamHandler) GetByteStream(tunnel *Tunnel,
+	ctrlMessage *cs.TunnelControlMessage) ByteStream {
+	s, err := h.mux.Connect(ctrlMessage.TunnelId, ctrlMessage.ConnectionId)
+	if err != nil {
+		return nil
+	}
+	return s
+}
+
+func (h *muxStreamHandler) Acknowledge(tunnel *Tunnel,
+	ctrlMessage *cs.TunnelControlMessage) ByteStream {
+	return h.mux.Open(ctrlMessage.TunnelId, ctrlMessage.ConnectionId)
+}
+
+func (h *muxStreamHandler) CloseStream(tunnel *Tunnel, connID string) {
+	h.mux.Remove(tunnel.GetID(), connID)
+}
+
+func TestMuxStreamReleasesClosedConnections(t *testing.T) {
+	left, right := newPipeStreams()
+	client := NewMuxStream(left)
+	server := NewMuxStream(right)
+	go client.Run(nil)
+	go server.Run(func(tunnelID string, connID string) {
+		server.Open(tunnelID, connID)
+	})
+
+	tunnel := NewTunnel("tun", TunnelDirectionForward, nil, 0, nil, 0)
+	tunnel.ConnectionHandler = &muxStreamHandler{mux: client}
+	baseline := runtime.NumGoroutine()
+
+	for i := 0; i < 50; i++ {
+		local, remote := Pipe()
+		gConn := NewConnection(remote)
+		tunnel.AddConnection(gConn)
+		gConn.SetStream(tunnel.ConnectionHandler.GetByteStream(tunnel,
+			&cs.TunnelControlMessage{TunnelId: "tun", ConnectionId: gConn.ID}))
+		gConn.Start()
+
+		gConn.Close()
+		local.Close()
+	}
+
+	// Every closed connection gives back its stream and goroutines
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		client.mutex.Lock()
+		streams := len(client.streams)
+		client.mutex.Unlock()
+		goroutines := runtime.NumGoroutine()
+		if streams == 0 && goroutines <= baseline {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d streams and %d goroutines left; want 0 and %d",
+				streams, goroutines, baseline)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
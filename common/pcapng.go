@@ -0,0 +1,192 @@
+package common
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	pcapngSectionHeaderBlock   = 0x0a0d0d0a
+	pcapngInterfaceBlock       = 0x00000001
+	pcapngEnhancedPacketBlock  = 0x00000006
+	pcapngByteOrderMagic       = 0x1a2b3c4d
+	pcapngLinkTypeRaw          = 101
+	pcapngSectionLengthUnknown = 0xffffffffffffffff
+
+	ipProtocolTCP = 6
+	ipProtocolUDP = 17
+
+	tcpFlagFin = 0x01
+	tcpFlagSyn = 0x02
+	tcpFlagRst = 0x04
+	tcpFlagPsh = 0x08
+	tcpFlagAck = 0x10
+
+	// The largest payload that fits in a single synthesized packet
+	maxCapturedPayload = 65535 - 40 - 20
+)
+
+// pcapngWriter writes packets to a pcapng file with a single
+// interface. Packets are raw IPv4 or IPv6 with no link layer
+// header and timestamps are in microseconds.
+type pcapngWriter struct {
+	w io.Writer
+}
+
+// newPcapngWriter is a constructor for the pcapngWriter struct. It
+// writes the section header and the interface description.
+func newPcapngWriter(w io.Writer) (*pcapngWriter, error) {
+	p := new(pcapngWriter)
+	p.w = w
+
+	section := binary.LittleEndian.AppendUint32(nil, pcapngByteOrderMagic)
+	section = binary.LittleEndian.AppendUint16(section, 1)
+	section = binary.LittleEndian.AppendUint16(section, 0)
+	section = binary.LittleEndian.AppendUint64(section, pcapngSectionLengthUnknown)
+	if err := p.writeBlock(pcapngSectionHeaderBlock, section); err != nil {
+		return nil, err
+	}
+
+	// A snap length of 0 means packets are never truncated
+	iface := binary.LittleEndian.AppendUint16(nil, pcapngLinkTypeRaw)
+	iface = binary.LittleEndian.AppendUint16(iface, 0)
+	iface = binary.LittleEndian.AppendUint32(iface, 0)
+	if err := p.writeBlock(pcapngInterfaceBlock, iface); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// writePacket writes a single packet captured at the provided time.
+func (p *pcapngWriter) writePacket(timestamp time.Time, packet []byte) error {
+	micros := uint64(timestamp.UnixMicro())
+	body := binary.LittleEndian.AppendUint32(nil, 0)
+	body = binary.LittleEndian.AppendUint32(body, uint32(micros>>32))
+	body = binary.LittleEndian.AppendUint32(body, uint32(micros))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(packet)))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(packet)))
+	body = append(body, packet...)
+	return p.writeBlock(pcapngEnhancedPacketBlock, body)
+}
+
+// writeBlock writes a block with the provided type and body,
+// padding the body to 32 bits.
+func (p *pcapngWriter) writeBlock(blockType uint32, body []byte) error {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	length := uint32(len(body) + 12)
+
+	block := binary.LittleEndian.AppendUint32(nil, blockType)
+	block = binary.LittleEndian.AppendUint32(block, length)
+	block = append(block, body...)
+	block = binary.LittleEndian.AppendUint32(block, length)
+	_, err := p.w.Write(block)
+	return err
+}
+
+// packetEndpoint is the address and port of one side of a
+// synthesized packet.
+type packetEndpoint struct {
+	ip   net.IP
+	port uint16
+}
+
+// buildTCPPacket returns an IP packet carrying a TCP segment with
+// the provided sequence numbers, flags and payload.
+func buildTCPPacket(src packetEndpoint, dst packetEndpoint, seq uint32,
+	ack uint32, flags byte, payload []byte) []byte {
+
+	segment := binary.BigEndian.AppendUint16(nil, src.port)
+	segment = binary.BigEndian.AppendUint16(segment, dst.port)
+	segment = binary.BigEndian.AppendUint32(segment, seq)
+	segment = binary.BigEndian.AppendUint32(segment, ack)
+	segment = append(segment, 5<<4, flags)
+	segment = binary.BigEndian.AppendUint16(segment, 65535)
+	segment = append(segment, 0, 0, 0, 0)
+	segment = append(segment, payload...)
+
+	checksum := transportChecksum(src.ip, dst.ip, ipProtocolTCP, segment)
+	binary.BigEndian.PutUint16(segment[16:], checksum)
+	return buildIPPacket(src.ip, dst.ip, ipProtocolTCP, segment)
+}
+
+// buildUDPPacket returns an IP packet carrying a UDP datagram.
+func buildUDPPacket(src packetEndpoint, dst packetEndpoint, payload []byte) []byte {
+	datagram := binary.BigEndian.AppendUint16(nil, src.port)
+	datagram = binary.BigEndian.AppendUint16(datagram, dst.port)
+	datagram = binary.BigEndian.AppendUint16(datagram, uint16(8+len(payload)))
+	datagram = append(datagram, 0, 0)
+	datagram = append(datagram, payload...)
+
+	checksum := transportChecksum(src.ip, dst.ip, ipProtocolUDP, datagram)
+	if checksum == 0 {
+		checksum = 0xffff
+	}
+	binary.BigEndian.PutUint16(datagram[6:], checksum)
+	return buildIPPacket(src.ip, dst.ip, ipProtocolUDP, datagram)
+}
+
+// buildIPPacket returns an IPv4 packet if both addresses are IPv4,
+// otherwise an IPv6 packet.
+func buildIPPacket(src net.IP, dst net.IP, protocol byte, payload []byte) []byte {
+	if src.To4() != nil && dst.To4() != nil {
+		header := []byte{0x45, 0}
+		header = binary.BigEndian.AppendUint16(header, uint16(20+len(payload)))
+		// No identification, don't fragment
+		header = append(header, 0, 0, 0x40, 0, 64, protocol, 0, 0)
+		header = append(header, src.To4()...)
+		header = append(header, dst.To4()...)
+		binary.BigEndian.PutUint16(header[10:], ipChecksum(header, 0))
+		return append(header, payload...)
+	}
+
+	header := []byte{0x60, 0, 0, 0}
+	header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	header = append(header, protocol, 64)
+	header = append(header, src.To16()...)
+	header = append(header, dst.To16()...)
+	return append(header, payload...)
+}
+
+// transportChecksum returns the TCP or UDP checksum of a segment,
+// which covers a pseudo header of the IP addresses.
+func transportChecksum(src net.IP, dst net.IP, protocol byte, segment []byte) uint16 {
+	var pseudo []byte
+	if src.To4() != nil && dst.To4() != nil {
+		pseudo = append(pseudo, src.To4()...)
+		pseudo = append(pseudo, dst.To4()...)
+		pseudo = append(pseudo, 0, protocol)
+		pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(len(segment)))
+	} else {
+		pseudo = append(pseudo, src.To16()...)
+		pseudo = append(pseudo, dst.To16()...)
+		pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(segment)))
+		pseudo = append(pseudo, 0, 0, 0, protocol)
+	}
+	return ipChecksum(segment, onesComplementSum(pseudo, 0))
+}
+
+// onesComplementSum adds data to a ones' complement sum as 16 bit words.
+func onesComplementSum(data []byte, initial uint32) uint32 {
+	total := initial
+	for i := 0; i+1 < len(data); i += 2 {
+		total += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if len(data)%2 == 1 {
+		total += uint32(data[len(data)-1]) << 8
+	}
+	return total
+}
+
+// ipChecksum returns the internet checksum of data, starting from
+// a partial sum.
+func ipChecksum(data []byte, initial uint32) uint16 {
+	total := onesComplementSum(data, initial)
+	for total>>16 != 0 {
+		total = total&0xffff + total>>16
+	}
+	return ^uint16(total)
+}
@@ -0,0 +1,101 @@
+package common
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// errHalfCloseUnsupported is returned when shutting down one side
+// of a connection that does not support half-close.
+var errHalfCloseUnsupported = errors.New("connection does not support half-close")
+
+// halfCloser is a connection that can shut down reading or writing
+// on its own, such as a TCP socket or one end of a Pipe.
+type halfCloser interface {
+	CloseRead() error
+	CloseWrite() error
+}
+
+// closeRead will shut down the reading side of conn if it supports
+// half-close.
+func closeRead(conn net.Conn) error {
+	if c, ok := conn.(halfCloser); ok {
+		return c.CloseRead()
+	}
+	return errHalfCloseUnsupported
+}
+
+// closeWrite will shut down the writing side of conn if it supports
+// half-close.
+func closeWrite(conn net.Conn) error {
+	if c, ok := conn.(halfCloser); ok {
+		return c.CloseWrite()
+	}
+	return errHalfCloseUnsupported
+}
+
+// Pipe returns the two ends of an in memory connection. It behaves
+// like net.Pipe, but either end can shut down its writing side with
+// CloseWrite and keep reading what the other end sends, so a FIN
+// carried over a tunnel reaches whatever is on the other end.
+func Pipe() (net.Conn, net.Conn) {
+	aReader, bWriter := net.Pipe()
+	bReader, aWriter := net.Pipe()
+	return &pipeConn{reader: aReader, writer: aWriter},
+		&pipeConn{reader: bReader, writer: bWriter}
+}
+
+// pipeConn is one end of a Pipe. Each direction is a separate
+// net.Pipe, which keeps its write boundaries and deadlines.
+type pipeConn struct {
+	reader net.Conn
+	writer net.Conn
+}
+
+func (p *pipeConn) Read(b []byte) (int, error) {
+	return p.reader.Read(b)
+}
+
+func (p *pipeConn) Write(b []byte) (int, error) {
+	return p.writer.Write(b)
+}
+
+// Close will shut down both directions of the pipe.
+func (p *pipeConn) Close() error {
+	p.reader.Close()
+	return p.writer.Close()
+}
+
+// CloseRead will shut down the reading side, failing writes made
+// by the other end.
+func (p *pipeConn) CloseRead() error {
+	return p.reader.Close()
+}
+
+// CloseWrite will shut down the writing side, so that the other end
+// reads io.EOF once it has read everything already written.
+func (p *pipeConn) CloseWrite() error {
+	return p.writer.Close()
+}
+
+func (p *pipeConn) LocalAddr() net.Addr {
+	return p.reader.LocalAddr()
+}
+
+func (p *pipeConn) RemoteAddr() net.Addr {
+	return p.reader.RemoteAddr()
+}
+
+func (p *pipeConn) SetDeadline(t time.Time) error {
+	p.reader.SetReadDeadline(t)
+	return p.writer.SetWriteDeadline(t)
+}
+
+func (p *pipeConn) SetReadDeadline(t time.Time) error {
+	return p.reader.SetReadDeadline(t)
+}
+
+func (p *pipeConn) SetWriteDeadline(t time.Time) error {
+	return p.writer.SetWriteDeadline(t)
+}
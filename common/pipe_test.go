@@ -0,0 +1,40 @@
+package common
+
+import (
+	"io"
+	"testing"
+)
+
+func TestPipeConnectionsPassesHalfClose(t *testing.T) {
+	client, clientProxy := Pipe()
+	targetProxy, target := Pipe()
+	defer client.Close()
+	defer target.Close()
+
+	done := make(chan struct{})
+	go func() {
+		PipeConnections(clientProxy, targetProxy)
+		close(done)
+	}()
+
+	go func() {
+		client.Write([]byte("request"))
+		closeWrite(client)
+	}()
+
+	// The target sees the client finish sending and can still answer
+	request, err := io.ReadAll(target)
+	if err != nil || string(request) != "request" {
+		t.Fatalf("unexpected request: %q, %v", request, err)
+	}
+	go func() {
+		target.Write([]byte("response"))
+		closeWrite(target)
+	}()
+
+	response, err := io.ReadAll(client)
+	if err != nil || string(response) != "response" {
+		t.Fatalf("unexpected response: %q, %v", response, err)
+	}
+	<-done
+}
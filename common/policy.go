@@ -0,0 +1,325 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	cs "github.com/hotnops/gTunnel/grpc/client"
+)
+
+// PolicyRule allows or denies the destinations it matches. A
+// rule matches a destination when every criteria it sets
+// matches: the resolved address is in Network, the requested
+// hostname matches Hostname and the port is between PortStart
+// and PortEnd. Hostnames starting with "*." match any subdomain.
+type PolicyRule struct {
+	Allow     bool
+	Network   *net.IPNet
+	Hostname  string
+	PortStart uint32
+	PortEnd   uint32
+}
+
+// PolicyError is returned when a destination is denied by a
+// policy. Rule is nil when no rule matched and the policy
+// denies by default.
+type PolicyError struct {
+	Destination string
+	Rule        *PolicyRule
+	Index       int
+}
+
+func (e *PolicyError) Error() string {
+	if e.Rule == nil {
+		return fmt.Sprintf("destination %s denied by default policy", e.Destination)
+	}
+	return fmt.Sprintf("destination %s denied by policy rule %d: %s",
+		e.Destination, e.Index+1, e.Rule)
+}
+
+// Policy decides which destinations an endpoint may connect to.
+// Rules are evaluated in order and the first match decides.
+// Destinations that match no rule are allowed unless the policy
+// denies by default. The zero value allows everything.
+type Policy struct {
+	rules       []*PolicyRule
+	defaultDeny bool
+	mutex       sync.RWMutex
+}
+
+// NewPolicy is a constructor for the Policy struct. The new
+// policy allows every destination.
+func NewPolicy() *Policy {
+	return new(Policy)
+}
+
+// NewPolicyRule is a constructor for the PolicyRule struct. An
+// empty cidr or hostname matches every destination, as does a
+// portStart and portEnd of 0.
+func NewPolicyRule(allow bool, cidr string, hostname string,
+	portStart uint32, portEnd uint32) (*PolicyRule, error) {
+
+	r := new(PolicyRule)
+	r.Allow = allow
+	r.Hostname = strings.ToLower(hostname)
+	if cidr != "" {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		r.Network = network
+	}
+	if portEnd == 0 {
+		portEnd = portStart
+	}
+	if portEnd < portStart || portEnd > 65535 {
+		return nil, fmt.Errorf("invalid policy rule ports: %d-%d", portStart, portEnd)
+	}
+	r.PortStart = portStart
+	r.PortEnd = portEnd
+	return r, nil
+}
+
+// NewPolicyRuleFromMessage returns the rule carried by an
+// endpoint control message.
+func NewPolicyRuleFromMessage(message *cs.PolicyRule) (*PolicyRule, error) {
+	return NewPolicyRule(message.Allow, message.Cidr, message.Hostname,
+		message.PortStart, message.PortEnd)
+}
+
+// GetCIDR returns the network the rule matches, or an empty
+// string if it matches every address.
+func (r *PolicyRule) GetCIDR() string {
+	if r.Network == nil {
+		return ""
+	}
+	return r.Network.String()
+}
+
+// ToMessage returns the rule as carried by an endpoint control
+// message.
+func (r *PolicyRule) ToMessage() *cs.PolicyRule {
+	message := new(cs.PolicyRule)
+	message.Allow = r.Allow
+	message.Cidr = r.GetCIDR()
+	message.Hostname = r.Hostname
+	message.PortStart = r.PortStart
+	message.PortEnd = r.PortEnd
+	return message
+}
+
+// ParsePolicyRule parses a rule written as an action followed by
+// its criteria, for example "allow cidr=10.0.0.0/8 port=80-443"
+// or "deny host=*.example.com".
+func ParsePolicyRule(rule string) (*PolicyRule, error) {
+	fields := strings.Fields(rule)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty policy rule")
+	}
+
+	var allow bool
+	switch fields[0] {
+	case "allow":
+		allow = true
+	case "deny":
+	default:
+		return nil, fmt.Errorf("policy rule must start with allow or deny: %s", rule)
+	}
+
+	var cidr, hostname string
+	var portStart, portEnd uint64
+	for _, field := range fields[1:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid policy rule criteria: %s", field)
+		}
+		switch key {
+		case "cidr":
+			cidr = value
+		case "host":
+			hostname = value
+		case "port":
+			start, end, _ := strings.Cut(value, "-")
+			var err error
+			if portStart, err = strconv.ParseUint(start, 10, 16); err != nil {
+				return nil, fmt.Errorf("invalid policy rule port: %s", value)
+			}
+			if end != "" {
+				if portEnd, err = strconv.ParseUint(end, 10, 16); err != nil {
+					return nil, fmt.Errorf("invalid policy rule port: %s", value)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("unknown policy rule criteria: %s", key)
+		}
+	}
+	return NewPolicyRule(allow, cidr, hostname, uint32(portStart), uint32(portEnd))
+}
+
+// String returns the rule in the form read by ParsePolicyRule.
+func (r *PolicyRule) String() string {
+	fields := []string{"deny"}
+	if r.Allow {
+		fields[0] = "allow"
+	}
+	if r.Network != nil {
+		fields = append(fields, "cidr="+r.GetCIDR())
+	}
+	if r.Hostname != "" {
+		fields = append(fields, "host="+r.Hostname)
+	}
+	if r.PortStart != 0 || r.PortEnd != 0 {
+		port := strconv.Itoa(int(r.PortStart))
+		if r.PortEnd != r.PortStart {
+			port += "-" + strconv.Itoa(int(r.PortEnd))
+		}
+		fields = append(fields, "port="+port)
+	}
+	return strings.Join(fields, " ")
+}
+
+// match reports whether the rule matches a destination. known is
+// false if the rule depends on an address that was not provided.
+func (r *PolicyRule) match(host string, ip net.IP, port uint32) (matched bool, known bool) {
+	if (r.PortStart != 0 || r.PortEnd != 0) && (port < r.PortStart || port > r.PortEnd) {
+		return false, true
+	}
+	if r.Hostname != "" && !matchHostname(r.Hostname, host) {
+		return false, true
+	}
+	if r.Network != nil {
+		if ip == nil {
+			return false, false
+		}
+		return r.Network.Contains(ip), true
+	}
+	return true, true
+}
+
+// matchHostname reports whether host matches a rule's hostname.
+func matchHostname(pattern string, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	return host == pattern
+}
+
+// GetRules returns the policy's rules and whether it denies
+// destinations that match none of them.
+func (p *Policy) GetRules() ([]*PolicyRule, bool) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	return p.rules, p.defaultDeny
+}
+
+// SetRules replaces the policy's rules.
+func (p *Policy) SetRules(rules []*PolicyRule, defaultDeny bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.rules = rules
+	p.defaultDeny = defaultDeny
+}
+
+// Check returns a PolicyError if the policy denies the
+// destination. The ip is the address host resolved to, or nil
+// if it has not been resolved yet. Rules that need the address
+// can not be decided without it, so an unresolved destination
+// that reaches one is allowed and left to be checked once it is
+// resolved. A nil policy allows everything.
+func (p *Policy) Check(host string, ip net.IP, port uint32) error {
+	if p == nil {
+		return nil
+	}
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	destination := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	for i, rule := range p.rules {
+		matched, known := rule.match(host, ip, port)
+		if !known {
+			return nil
+		}
+		if !matched {
+			continue
+		}
+		if rule.Allow {
+			return nil
+		}
+		return &PolicyError{Destination: destination, Rule: rule, Index: i}
+	}
+
+	if p.defaultDeny {
+		return &PolicyError{Destination: destination}
+	}
+	return nil
+}
+
+// Dial resolves the host in address and connects to the first of
+// its addresses that the policy allows. If none are allowed, the
+// PolicyError of the first is returned. The "icmp" network opens
+// an echo session with the host instead of a socket.
+func (p *Policy) Dial(network string, address string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: DialTimeout}
+	dial := dialer.Dial
+	if network == "icmp" {
+		dial = dialICMP
+	}
+	if p.isEmpty() {
+		return dial(network, address)
+	}
+
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %s", portString)
+	}
+
+	ips, err := net.DefaultResolver.LookupIP(context.Background(), "ip", host)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+
+	var policyErr, dialErr error
+	for _, ip := range ips {
+		if err := p.Check(host, ip, uint32(port)); err != nil {
+			if policyErr == nil {
+				policyErr = err
+			}
+			continue
+		}
+
+		conn, err := dial(network, net.JoinHostPort(ip.String(), portString))
+		if err == nil {
+			return conn, nil
+		}
+		dialErr = err
+	}
+
+	if dialErr != nil {
+		return nil, dialErr
+	}
+	return nil, policyErr
+}
+
+// isEmpty returns true if the policy allows everything.
+func (p *Policy) isEmpty() bool {
+	if p == nil {
+		return true
+	}
+
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	return len(p.rules) == 0 && !p.defaultDeny
+}
@@ -0,0 +1,142 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParsePolicyRule(t *testing.T) {
+	tests := []string{
+		"allow cidr=10.0.0.0/8 port=80-443",
+		"deny host=*.example.com",
+		"allow port=22",
+		"deny",
+	}
+
+	for _, test := range tests {
+		rule, err := ParsePolicyRule(test)
+		if err != nil {
+			t.Errorf("ParsePolicyRule(%q) failed: %s", test, err)
+			continue
+		}
+		if rule.String() != test {
+			t.Errorf("ParsePolicyRule(%q).String() = %q", test, rule)
+		}
+	}
+
+	for _, test := range []string{"permit", "allow port=443-80", "deny cidr=10.0.0.0"} {
+		if _, err := ParsePolicyRule(test); err == nil {
+			t.Errorf("ParsePolicyRule(%q) succeeded; want error", test)
+		}
+	}
+}
+
+func TestPolicyCheck(t *testing.T) {
+	var rules []*PolicyRule
+	for _, rule := range []string{
+		"deny host=*.prod.example.com",
+		"deny cidr=10.0.5.0/24",
+		"allow cidr=10.0.0.0/8 port=1-1024",
+		"allow host=intranet.example.com",
+	} {
+		r, _ := ParsePolicyRule(rule)
+		rules = append(rules, r)
+	}
+	policy := NewPolicy()
+	policy.SetRules(rules, true)
+
+	tests := []struct {
+		host    string
+		ip      net.IP
+		port    uint32
+		allowed bool
+		rule    int
+	}{
+		{"db.prod.example.com", nil, 443, false, 1},
+		{"10.0.5.3", net.ParseIP("10.0.5.3"), 80, false, 2},
+		{"10.1.2.3", net.ParseIP("10.1.2.3"), 80, true, 0},
+		{"10.1.2.3", net.ParseIP("10.1.2.3"), 8080, false, -1},
+		{"INTRANET.example.com.", net.ParseIP("192.168.1.1"), 8080, true, 0},
+		{"192.168.1.1", net.ParseIP("192.168.1.1"), 80, false, -1},
+		// Left to be checked once resolved
+		{"unresolved.example.com", nil, 80, true, 0},
+	}
+
+	for _, test := range tests {
+		err := policy.Check(test.host, test.ip, test.port)
+		if (err == nil) != test.allowed {
+			t.Errorf("Check(%s, %d) = %v; want allowed %t", test.host, test.port,
+				err, test.allowed)
+			continue
+		}
+
+		var policyErr *PolicyError
+		if errors.As(err, &policyErr) {
+			if test.rule == -1 && policyErr.Rule != nil {
+				t.Errorf("Check(%s, %d) matched rule %d; want default",
+					test.host, test.port, policyErr.Index+1)
+			} else if test.rule > 0 && policyErr.Index+1 != test.rule {
+				t.Errorf("Check(%s, %d) = %s; want rule %d", test.host, test.port,
+					err, test.rule)
+			}
+		}
+	}
+}
+
+func TestSocksServerEnforcesPolicy(t *testing.T) {
+	echo := startTCPEcho(t)
+	defer echo.Close()
+
+	rule, _ := ParsePolicyRule("deny cidr=127.0.0.0/8")
+	policy := NewPolicy()
+	policy.SetRules([]*PolicyRule{rule}, false)
+
+	s := NewSocksServer("test", 0)
+	s.SetPolicy(policy)
+	if !s.Start() {
+		t.Fatalf("failed to start socks server")
+	}
+	defer s.Stop()
+
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte{socks5Version, 1, socks5AuthNone})
+	conn.Write(append([]byte{socks5Version, socks5CmdConnect, 0},
+		encodeSocks5Addr(echo.Addr())...))
+
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[3] != socks5NotAllowed {
+		t.Errorf("reply = %v, %v; want not allowed", reply, err)
+	}
+}
+
+func TestProxyPolicyKeepsDial(t *testing.T) {
+	rule, _ := ParsePolicyRule("deny cidr=10.0.0.0/8")
+	policy := NewPolicy()
+	policy.SetRules([]*PolicyRule{rule}, false)
+
+	var dialed []string
+	s := NewSocksServer("test", 0)
+	s.SetDial(func(network string, address string) (net.Conn, error) {
+		dialed = append(dialed, address)
+		return nil, fmt.Errorf("not connected")
+	})
+	s.SetPolicy(policy)
+
+	s.dial("tcp", "192.0.2.1:80")
+	if _, err := s.dial("tcp", "10.0.0.1:80"); err == nil {
+		t.Errorf("dialed a destination the policy denies")
+	}
+	if len(dialed) != 1 || dialed[0] != "192.0.2.1:80" {
+		t.Errorf("dial function was given %v; want 192.0.2.1:80", dialed)
+	}
+}
@@ -0,0 +1,121 @@
+package common
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// ProxyRequest is the record of a single request made through
+// a socks or http proxy.
+type ProxyRequest struct {
+	ProxyID         string
+	Protocol        string
+	Command         string
+	Source          string
+	Host            string
+	ResolvedAddress string
+	BytesSent       uint64
+	BytesReceived   uint64
+	StartTime       time.Time
+	Duration        time.Duration
+	Error           string
+}
+
+// RequestLogFunc is called once a proxied request is finished.
+type RequestLogFunc func(request *ProxyRequest)
+
+// newRequest returns a record of a request made by the proxy
+// client on conn, starting now.
+func (p *ProxyServer) newRequest(conn net.Conn, protocol string,
+	command string, host string) *ProxyRequest {
+
+	request := new(ProxyRequest)
+	request.ProxyID = p.id
+	request.Protocol = protocol
+	request.Command = command
+	request.Source = conn.RemoteAddr().String()
+	request.Host = host
+	request.StartTime = time.Now()
+	return request
+}
+
+// logRequest will finish the record of a request with its
+// result and hand it to the request log, if one is set.
+func (p *ProxyServer) logRequest(request *ProxyRequest, err error) {
+	request.Duration = time.Since(request.StartTime)
+	if err != nil {
+		request.Error = err.Error()
+	}
+	if p.requestLog != nil {
+		p.requestLog(request)
+	}
+}
+
+// ResolvedAddress returns the address a proxied connection
+// reached.
+func ResolvedAddress(conn net.Conn) string {
+	if addr := conn.RemoteAddr(); addr != nil {
+		return addr.String()
+	}
+	return ""
+}
+
+// PipeConnections copies data in both directions between a
+// proxy client and its destination until both are done. When one
+// side finishes sending, the half-close is passed on to the other
+// so that it can still answer. It returns the number of bytes
+// sent to and received from the destination.
+func PipeConnections(client net.Conn, target net.Conn) (uint64, uint64) {
+	sent := make(chan pipeResult, 1)
+	received := make(chan pipeResult, 1)
+
+	go func() {
+		received <- copyHalf(client, target)
+	}()
+
+	go func() {
+		sent <- copyHalf(target, client)
+	}()
+
+	// Unless the first side to finish could be half-closed, there
+	// is nothing left to relay
+	var sentResult, receivedResult pipeResult
+	var halfClosed bool
+	select {
+	case sentResult = <-sent:
+		halfClosed = sentResult.halfClosed
+	case receivedResult = <-received:
+		halfClosed = receivedResult.halfClosed
+	}
+	if !halfClosed {
+		client.Close()
+		target.Close()
+	}
+	select {
+	case sentResult = <-sent:
+	case receivedResult = <-received:
+	}
+	client.Close()
+	target.Close()
+
+	return uint64(sentResult.bytes), uint64(receivedResult.bytes)
+}
+
+// pipeResult is the outcome of copying one direction of a proxied
+// connection.
+type pipeResult struct {
+	bytes      int64
+	halfClosed bool
+}
+
+// copyHalf copies from src to dst until src is done sending and
+// then shuts down the writing side of dst. halfClosed is false if
+// the copy failed or dst does not support half-close.
+func copyHalf(dst net.Conn, src net.Conn) pipeResult {
+	n, err := io.Copy(dst, src)
+	if err != nil {
+		return pipeResult{bytes: n}
+	}
+	return pipeResult{bytes: n, halfClosed: closeWrite(dst) == nil}
+}
@@ -0,0 +1,268 @@
+package common
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DialFunc connects to an address on the named network.
+type DialFunc func(network string, address string) (net.Conn, error)
+
+// ProxyServer holds what every proxy served on behalf of a gClient
+// has in common: its ID, where it listens, the credentials clients
+// must present and the connections it is serving. It is embedded
+// by the socks and http proxy servers.
+type ProxyServer struct {
+	id          string
+	remote      bool
+	listener    net.Listener
+	connections map[net.Conn]bool
+	servePort   uint32
+	bindAddress net.IP
+	username    string
+	password    string
+	dialFunc    DialFunc
+	policy      *Policy
+	requestLog  RequestLogFunc
+	stats       TrafficStats
+	mutex       sync.Mutex
+}
+
+// init sets up the proxy with its ID and port. The proxy listens
+// on 127.0.0.1 unless a bind address is set, and dials
+// destinations directly unless a dial function is set.
+func (p *ProxyServer) init(id string, port uint32) {
+	p.id = id
+	p.servePort = port
+	p.bindAddress = net.IPv4(127, 0, 0, 1)
+	p.connections = make(map[net.Conn]bool)
+}
+
+// SetBindAddress will set the address on which the proxy listens.
+func (p *ProxyServer) SetBindAddress(ip net.IP) {
+	p.bindAddress = ip
+}
+
+// SetCredentials will require proxy clients to authenticate
+// with the provided username and password. An empty username
+// disables authentication.
+func (p *ProxyServer) SetCredentials(username string, password string) {
+	p.username = username
+	p.password = password
+}
+
+// SetRequestLog will set the function that every request
+// made through the proxy is reported to once it is finished.
+func (p *ProxyServer) SetRequestLog(requestLog RequestLogFunc) {
+	p.requestLog = requestLog
+}
+
+// SetPolicy will check the destinations the proxy connects to
+// against the provided policy before they are dialed.
+func (p *ProxyServer) SetPolicy(policy *Policy) {
+	p.policy = policy
+}
+
+// dial connects to a destination requested by a proxy client.
+// Without a dial function, the policy resolves the destination
+// and only direct connections to the addresses it allows are made.
+// A dial function is only given destinations the policy allows
+// before they are resolved.
+func (p *ProxyServer) dial(network string, address string) (net.Conn, error) {
+	if p.dialFunc == nil {
+		if p.policy != nil {
+			return p.policy.Dial(network, address)
+		}
+		d := net.Dialer{Timeout: 10 * time.Second}
+		return d.Dial(network, address)
+	}
+
+	if p.policy != nil {
+		host, portString, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		port, err := strconv.Atoi(portString)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.policy.Check(host, net.ParseIP(host), uint32(port)); err != nil {
+			return nil, err
+		}
+	}
+	return p.dialFunc(network, address)
+}
+
+// SetRemote marks the proxy as running on the remote endpoint.
+// A remote proxy is only a record and is never started locally.
+func (p *ProxyServer) SetRemote(remote bool) {
+	p.remote = remote
+}
+
+// IsRemote returns true if the proxy runs on the remote endpoint.
+func (p *ProxyServer) IsRemote() bool {
+	return p.remote
+}
+
+// GetID returns the ID of the proxy.
+func (p *ProxyServer) GetID() string {
+	return p.id
+}
+
+// GetPort returns the port on which the proxy listens.
+func (p *ProxyServer) GetPort() uint32 {
+	return p.servePort
+}
+
+// GetBindAddress returns the address on which the proxy listens.
+func (p *ProxyServer) GetBindAddress() net.IP {
+	return p.bindAddress
+}
+
+// GetUsername returns the username proxy clients must
+// authenticate with, or an empty string if none is required.
+func (p *ProxyServer) GetUsername() string {
+	return p.username
+}
+
+// GetPassword returns the password proxy clients must
+// authenticate with.
+func (p *ProxyServer) GetPassword() string {
+	return p.password
+}
+
+// GetConnectionCount returns the number of proxy clients
+// currently connected.
+func (p *ProxyServer) GetConnectionCount() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return len(p.connections)
+}
+
+// GetStats returns the number of bytes exchanged with
+// proxy clients.
+func (p *ProxyServer) GetStats() *TrafficStats {
+	return &p.stats
+}
+
+// start will listen on the proxy's address and hand every
+// client connection to serve. The connection is closed once
+// serve returns.
+func (p *ProxyServer) start(serve func(conn net.Conn)) bool {
+	var err error
+	address := net.JoinHostPort(ipString(p.bindAddress),
+		strconv.Itoa(int(p.servePort)))
+	p.listener, err = net.Listen("tcp", address)
+
+	if err != nil {
+		return false
+	}
+
+	go func() {
+		for {
+			conn, err := p.listener.Accept()
+			if err != nil {
+				break
+			}
+			go p.track(conn, serve)
+		}
+	}()
+	return true
+}
+
+// track records a client connection for as long as it is
+// being served.
+func (p *ProxyServer) track(conn net.Conn, serve func(conn net.Conn)) {
+	p.mutex.Lock()
+	p.connections[conn] = true
+	p.mutex.Unlock()
+
+	defer func() {
+		conn.Close()
+		p.mutex.Lock()
+		delete(p.connections, conn)
+		p.mutex.Unlock()
+	}()
+
+	serve(&countedConn{Conn: conn, stats: &p.stats})
+}
+
+// Stop will close the proxy's listener and every client
+// connection.
+func (p *ProxyServer) Stop() {
+	if p.listener == nil {
+		return
+	}
+	p.listener.Close()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for conn := range p.connections {
+		conn.Close()
+	}
+}
+
+// bufferedConn is a net.Conn whose reads are served from a
+// buffered reader, so that peeked bytes are not lost.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *bufferedConn) CloseRead() error {
+	return closeRead(c.Conn)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// countedConn is a net.Conn that records the bytes read
+// from and written to it.
+type countedConn struct {
+	net.Conn
+	stats *TrafficStats
+}
+
+// NewCountedConn returns a net.Conn that records the bytes read
+// from and written to conn in stats.
+func NewCountedConn(conn net.Conn, stats *TrafficStats) net.Conn {
+	return &countedConn{Conn: conn, stats: stats}
+}
+
+func (c *countedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.stats.addRx(n)
+	return n, err
+}
+
+func (c *countedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.stats.addTx(n)
+	return n, err
+}
+
+func (c *countedConn) CloseRead() error {
+	return closeRead(c.Conn)
+}
+
+func (c *countedConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// ipString formats an IP for use in an address, where a nil IP
+// means all addresses.
+func ipString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
@@ -0,0 +1,53 @@
+package common
+
+import "fmt"
+
+const (
+	RecordingFormatRaw = iota
+	RecordingFormatAsciicast
+)
+
+const (
+	RecordingDirectionBoth = iota
+	RecordingDirectionSource
+	RecordingDirectionDestination
+)
+
+// RecordingFormatName returns the name of a recording export
+// format.
+func RecordingFormatName(format uint32) string {
+	switch format {
+	case RecordingFormatRaw:
+		return "raw"
+	case RecordingFormatAsciicast:
+		return "asciicast"
+	}
+	return "unknown"
+}
+
+// ParseRecordingFormat returns the export format with the provided
+// name.
+func ParseRecordingFormat(name string) (uint32, error) {
+	switch name {
+	case "raw":
+		return RecordingFormatRaw, nil
+	case "asciicast":
+		return RecordingFormatAsciicast, nil
+	}
+	return 0, fmt.Errorf("invalid format %s. Should be 'raw' or 'asciicast'", name)
+}
+
+// ParseRecordingDirection returns the direction with the provided
+// name.
+func ParseRecordingDirection(name string) (uint32, error) {
+	switch name {
+	case "both":
+		return RecordingDirectionBoth, nil
+	case "source":
+		return RecordingDirectionSource, nil
+	case "destination":
+		return RecordingDirectionDestination, nil
+	}
+	return 0, fmt.Errorf("invalid direction %s. Should be 'both', 'source' or 'destination'",
+		name)
+}
@@ -0,0 +1,206 @@
+package common
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	socks4Version = 0x04
+
+	socks4CmdConnect = 0x01
+	socks4CmdBind    = 0x02
+
+	socks4ReplyVersion = 0x00
+	socks4Granted      = 0x5a
+	socks4Rejected     = 0x5b
+
+	// User IDs and socks 4a hostnames are null terminated, this
+	// is the longest accepted.
+	socks4MaxStringLength = 255
+)
+
+// socks4Request is a socks v4 or v4a request. The address is a
+// hostname for v4a requests.
+type socks4Request struct {
+	protocol string
+	command  byte
+	address  string
+}
+
+// socks4Conn handles a single socks v4 or v4a client connection.
+// The reader is the one the connection is read through.
+type socks4Conn struct {
+	server *SocksServer
+	conn   net.Conn
+	reader io.ByteReader
+}
+
+// serve will read the socks client's request and carry it out.
+func (s *socks4Conn) serve() error {
+	request, err := readSocks4Request(s.reader)
+	if err != nil {
+		return err
+	}
+
+	// Socks v4 has no way to carry a password
+	if s.server.username != "" {
+		s.reply(socks4Rejected, nil)
+		return fmt.Errorf("rejected unauthenticated %s client", request.protocol)
+	}
+
+	switch request.command {
+	case socks4CmdConnect:
+		return s.connect(request)
+	case socks4CmdBind:
+		return s.bind(request)
+	}
+
+	s.reply(socks4Rejected, nil)
+	return fmt.Errorf("unsupported socks command: %d", request.command)
+}
+
+// connect will dial the requested destination and relay data
+// between it and the socks client.
+func (s *socks4Conn) connect(request *socks4Request) (err error) {
+	record := s.server.newRequest(s.conn, request.protocol, "connect",
+		request.address)
+	defer func() { s.server.logRequest(record, err) }()
+
+	target, err := s.server.dial("tcp", request.address)
+	if err != nil {
+		s.reply(socks4Rejected, nil)
+		return err
+	}
+	defer target.Close()
+	record.ResolvedAddress = ResolvedAddress(target)
+
+	if err := s.reply(socks4Granted, target.LocalAddr()); err != nil {
+		return err
+	}
+	s.conn.SetDeadline(time.Time{})
+
+	record.BytesSent, record.BytesReceived = PipeConnections(s.conn, target)
+	return nil
+}
+
+// bind will listen for a single incoming connection from the
+// requested peer. The first reply carries the listening address
+// and the second the address of the connecting peer.
+func (s *socks4Conn) bind(request *socks4Request) (err error) {
+	record := s.server.newRequest(s.conn, request.protocol, "bind",
+		request.address)
+	defer func() { s.server.logRequest(record, err) }()
+
+	if s.server.listen == nil {
+		s.reply(socks4Rejected, nil)
+		return fmt.Errorf("socks bind is not supported by this server")
+	}
+
+	listener, err := s.server.listen("tcp", request.address)
+	if err != nil {
+		s.reply(socks4Rejected, nil)
+		return err
+	}
+	defer listener.Close()
+
+	if err := s.reply(socks4Granted, listener.Addr()); err != nil {
+		return err
+	}
+	s.conn.SetDeadline(time.Time{})
+
+	peer, err := acceptPeer(listener, request.address)
+	if err != nil {
+		s.reply(socks4Rejected, nil)
+		return err
+	}
+	defer peer.Close()
+	listener.Close()
+	record.ResolvedAddress = ResolvedAddress(peer)
+
+	if err := s.reply(socks4Granted, peer.RemoteAddr()); err != nil {
+		return err
+	}
+
+	record.BytesSent, record.BytesReceived = PipeConnections(s.conn, peer)
+	return nil
+}
+
+// reply sends a socks v4 reply with the provided status and
+// address. Addresses that are not IPv4 are sent as 0.0.0.0:0.
+func (s *socks4Conn) reply(status byte, addr net.Addr) error {
+	ip, port := AddrToIPPort(addr)
+	ip4 := ip.To4()
+	if ip4 == nil {
+		ip4 = net.IPv4zero.To4()
+		port = 0
+	}
+
+	message := []byte{socks4ReplyVersion, status}
+	message = binary.BigEndian.AppendUint16(message, uint16(port))
+	message = append(message, ip4...)
+	_, err := s.conn.Write(message)
+	return err
+}
+
+// readSocks4Request reads a socks v4 or v4a request from r.
+func readSocks4Request(r io.ByteReader) (*socks4Request, error) {
+	header := make([]byte, 8)
+	for i := range header {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		header[i] = b
+	}
+	if header[0] != socks4Version {
+		return nil, fmt.Errorf("unsupported socks version: %d", header[0])
+	}
+
+	// The user ID is not used for anything
+	if _, err := readSocks4String(r); err != nil {
+		return nil, err
+	}
+
+	request := new(socks4Request)
+	request.protocol = "socks4"
+	request.command = header[1]
+	port := strconv.Itoa(int(binary.BigEndian.Uint16(header[2:4])))
+	ip := net.IP(header[4:8])
+
+	// An address of 0.0.0.x with a non-zero x means the hostname
+	// follows the user ID
+	if ip[0] == 0 && ip[1] == 0 && ip[2] == 0 && ip[3] != 0 {
+		host, err := readSocks4String(r)
+		if err != nil {
+			return nil, err
+		}
+		request.protocol = "socks4a"
+		request.address = net.JoinHostPort(host, port)
+	} else {
+		request.address = net.JoinHostPort(ip.String(), port)
+	}
+	return request, nil
+}
+
+// readSocks4String reads a null terminated string from r.
+func readSocks4String(r io.ByteReader) (string, error) {
+	var value []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == 0 {
+			return string(value), nil
+		}
+		if len(value) == socks4MaxStringLength {
+			return "", fmt.Errorf("socks string is too long")
+		}
+		value = append(value, b)
+	}
+}
@@ -0,0 +1,132 @@
+package common
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// socks4Connect sends a socks v4 connect request to the socks
+// server. If host is set, the request is sent as socks v4a.
+func socks4Connect(t *testing.T, s *SocksServer, host string,
+	addr *net.TCPAddr) (net.Conn, byte) {
+
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	request := []byte{socks4Version, socks4CmdConnect}
+	request = binary.BigEndian.AppendUint16(request, uint16(addr.Port))
+	if host != "" {
+		request = append(request, 0, 0, 0, 1)
+	} else {
+		request = append(request, addr.IP.To4()...)
+	}
+	request = append(request, "user\x00"...)
+	if host != "" {
+		request = append(request, host+"\x00"...)
+	}
+	conn.Write(request)
+
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("failed to read reply: %s", err)
+	}
+	return conn, reply[1]
+}
+
+func TestSocks4Connect(t *testing.T) {
+	echo := startTCPEcho(t)
+	defer echo.Close()
+	s := startSocksServer(t)
+	defer s.Stop()
+
+	echoAddr := echo.Addr().(*net.TCPAddr)
+	tests := []struct {
+		name string
+		host string
+	}{
+		{"socks4", ""},
+		{"socks4a", "localhost"},
+	}
+
+	for _, test := range tests {
+		conn, status := socks4Connect(t, s, test.host, echoAddr)
+		if status != socks4Granted {
+			t.Fatalf("%s: reply status = %d; want granted", test.name, status)
+		}
+
+		conn.Write([]byte("hello"))
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+			t.Errorf("%s: echo = %q, %v; want hello", test.name, buf, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestSocks4RejectedWithCredentials(t *testing.T) {
+	echo := startTCPEcho(t)
+	defer echo.Close()
+	s := NewSocksServer("test", 0)
+	s.SetCredentials("user", "secret")
+	if !s.Start() {
+		t.Fatalf("failed to start socks server")
+	}
+	defer s.Stop()
+
+	conn, status := socks4Connect(t, s, "", echo.Addr().(*net.TCPAddr))
+	defer conn.Close()
+	if status != socks4Rejected {
+		t.Errorf("reply status = %d; want rejected", status)
+	}
+}
+
+func TestSocksServerLogsRequests(t *testing.T) {
+	echo := startTCPEcho(t)
+	defer echo.Close()
+	s := NewSocksServer("test", 0)
+	requests := make(chan *ProxyRequest, 2)
+	s.SetRequestLog(func(request *ProxyRequest) {
+		requests <- request
+	})
+	if !s.Start() {
+		t.Fatalf("failed to start socks server")
+	}
+	defer s.Stop()
+
+	echoAddr := echo.Addr().(*net.TCPAddr)
+	conn, _ := socks4Connect(t, s, "localhost", echoAddr)
+	conn.Write([]byte("hello"))
+	io.ReadFull(conn, make([]byte, 5))
+	conn.Close()
+
+	request := <-requests
+	wantHost := net.JoinHostPort("localhost", strconv.Itoa(echoAddr.Port))
+	if request.Protocol != "socks4a" || request.Host != wantHost ||
+		request.ResolvedAddress != echoAddr.String() {
+		t.Errorf("request = %s %s (%s); want socks4a %s (%s)", request.Protocol,
+			request.Host, request.ResolvedAddress, wantHost, echoAddr)
+	}
+	if request.BytesSent != 5 || request.BytesReceived != 5 || request.Error != "" {
+		t.Errorf("request sent %d, received %d, error %q; want 5, 5 and none",
+			request.BytesSent, request.BytesReceived, request.Error)
+	}
+
+	// Nothing listens on the port of a closed listener
+	closed := startTCPEcho(t)
+	closed.Close()
+	conn, status := socks4Connect(t, s, "", closed.Addr().(*net.TCPAddr))
+	conn.Close()
+	if status != socks4Rejected {
+		t.Errorf("reply status = %d; want rejected", status)
+	}
+	if request := <-requests; request.Error == "" {
+		t.Errorf("failed request was logged without an error")
+	}
+}
@@ -0,0 +1,522 @@
+package common
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone         = 0x00
+	socks5AuthPassword     = 0x02
+	socks5AuthNoAcceptable = 0xff
+
+	socks5PasswordVersion = 0x01
+	socks5PasswordSuccess = 0x00
+	socks5PasswordFailure = 0x01
+
+	socks5CmdConnect      = 0x01
+	socks5CmdBind         = 0x02
+	socks5CmdUDPAssociate = 0x03
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5Succeeded          = 0x00
+	socks5GeneralFailure     = 0x01
+	socks5NotAllowed         = 0x02
+	socks5HostUnreachable    = 0x04
+	socks5ConnectionRefused  = 0x05
+	socks5CmdNotSupported    = 0x07
+	socks5AddrNotSupported   = 0x08
+	socks5BindAcceptTimeout  = 2 * time.Minute
+	socks5UDPHeaderMinLength = 10
+)
+
+// socks5Request is the command sent by a socks client after
+// negotiating authentication.
+type socks5Request struct {
+	command byte
+	address string
+}
+
+// socks5Conn handles a single socks v5 client connection.
+type socks5Conn struct {
+	server *SocksServer
+	conn   net.Conn
+}
+
+// serve will negotiate with the socks client and then carry
+// out its request.
+func (s *socks5Conn) serve() error {
+	if err := s.negotiate(); err != nil {
+		return err
+	}
+
+	request, err := readSocks5Request(s.conn)
+	if err != nil {
+		if errors.Is(err, errSocks5AddrNotSupported) {
+			s.reply(socks5AddrNotSupported, nil)
+		}
+		return err
+	}
+
+	switch request.command {
+	case socks5CmdConnect:
+		return s.connect(request)
+	case socks5CmdBind:
+		return s.bind(request)
+	case socks5CmdUDPAssociate:
+		return s.associate(request)
+	}
+
+	s.reply(socks5CmdNotSupported, nil)
+	return fmt.Errorf("unsupported socks command: %d", request.command)
+}
+
+// negotiate reads the client's supported authentication
+// methods and selects one.
+func (s *socks5Conn) negotiate() error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(s.conn, header); err != nil {
+		return err
+	}
+	if header[0] != socks5Version {
+		return fmt.Errorf("unsupported socks version: %d", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(s.conn, methods); err != nil {
+		return err
+	}
+
+	required := byte(socks5AuthNone)
+	if s.server.username != "" {
+		required = socks5AuthPassword
+	}
+
+	for _, method := range methods {
+		if method == required {
+			if _, err := s.conn.Write([]byte{socks5Version, required}); err != nil {
+				return err
+			}
+			if required == socks5AuthPassword {
+				return s.authenticate()
+			}
+			return nil
+		}
+	}
+
+	s.conn.Write([]byte{socks5Version, socks5AuthNoAcceptable})
+	return fmt.Errorf("no acceptable socks authentication method")
+}
+
+// authenticate performs the username/password subnegotiation
+// described in RFC 1929.
+func (s *socks5Conn) authenticate() error {
+	version := make([]byte, 1)
+	if _, err := io.ReadFull(s.conn, version); err != nil {
+		return err
+	}
+	if version[0] != socks5PasswordVersion {
+		return fmt.Errorf("unsupported socks password version: %d", version[0])
+	}
+
+	username, err := readSocks5String(s.conn)
+	if err != nil {
+		return err
+	}
+	password, err := readSocks5String(s.conn)
+	if err != nil {
+		return err
+	}
+
+	usernameMatch := subtle.ConstantTimeCompare(username, []byte(s.server.username))
+	passwordMatch := subtle.ConstantTimeCompare(password, []byte(s.server.password))
+	if usernameMatch&passwordMatch != 1 {
+		s.conn.Write([]byte{socks5PasswordVersion, socks5PasswordFailure})
+		return fmt.Errorf("socks authentication failed for user: %s", username)
+	}
+
+	_, err = s.conn.Write([]byte{socks5PasswordVersion, socks5PasswordSuccess})
+	return err
+}
+
+// connect will dial the requested destination and relay data
+// between it and the socks client.
+func (s *socks5Conn) connect(request *socks5Request) (err error) {
+	record := s.server.newRequest(s.conn, "socks5", "connect", request.address)
+	defer func() { s.server.logRequest(record, err) }()
+
+	target, err := s.server.dial("tcp", request.address)
+	if err != nil {
+		s.reply(socks5ReplyForError(err), nil)
+		return err
+	}
+	defer target.Close()
+	record.ResolvedAddress = ResolvedAddress(target)
+
+	if err := s.reply(socks5Succeeded, target.LocalAddr()); err != nil {
+		return err
+	}
+	s.conn.SetDeadline(time.Time{})
+
+	record.BytesSent, record.BytesReceived = PipeConnections(s.conn, target)
+	return nil
+}
+
+// bind will listen for a single incoming connection on behalf
+// of the socks client from the host in its request. The first
+// reply carries the listening address and the second the address
+// of the connecting peer.
+func (s *socks5Conn) bind(request *socks5Request) (err error) {
+	record := s.server.newRequest(s.conn, "socks5", "bind", request.address)
+	defer func() { s.server.logRequest(record, err) }()
+
+	if s.server.listen == nil {
+		s.reply(socks5CmdNotSupported, nil)
+		return fmt.Errorf("socks bind is not supported by this server")
+	}
+
+	listener, err := s.server.listen("tcp", request.address)
+	if err != nil {
+		s.reply(socks5GeneralFailure, nil)
+		return err
+	}
+	defer listener.Close()
+
+	if err := s.reply(socks5Succeeded, listener.Addr()); err != nil {
+		return err
+	}
+	s.conn.SetDeadline(time.Time{})
+
+	peer, err := acceptPeer(listener, request.address)
+	if err != nil {
+		s.reply(socks5GeneralFailure, nil)
+		return err
+	}
+	defer peer.Close()
+	listener.Close()
+	record.ResolvedAddress = ResolvedAddress(peer)
+
+	if err := s.reply(socks5Succeeded, peer.RemoteAddr()); err != nil {
+		return err
+	}
+
+	record.BytesSent, record.BytesReceived = PipeConnections(s.conn, peer)
+	return nil
+}
+
+// associate will relay UDP datagrams for the socks client until
+// its control connection is closed.
+func (s *socks5Conn) associate(request *socks5Request) error {
+	localIP, _ := AddrToIPPort(s.conn.LocalAddr())
+	relayConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		s.reply(socks5GeneralFailure, nil)
+		return err
+	}
+
+	if err := s.reply(socks5Succeeded, relayConn.LocalAddr()); err != nil {
+		relayConn.Close()
+		return err
+	}
+
+	association := new(socks5Association)
+	association.server = s.server
+	association.conn = s.conn
+	association.relayConn = relayConn
+	association.targets = make(map[string]*socks5Target)
+
+	// Only accept datagrams from the host that owns the
+	// control connection.
+	association.clientIP, _ = AddrToIPPort(s.conn.RemoteAddr())
+	go association.run()
+
+	// The association lasts as long as the control connection
+	s.conn.SetDeadline(time.Time{})
+	io.Copy(io.Discard, s.conn)
+	association.close()
+	return nil
+}
+
+// reply sends a socks v5 reply with the provided status and
+// bound address.
+func (s *socks5Conn) reply(status byte, addr net.Addr) error {
+	message := []byte{socks5Version, status, 0x00}
+	message = append(message, encodeSocks5Addr(addr)...)
+	_, err := s.conn.Write(message)
+	return err
+}
+
+// socks5Association relays datagrams between a socks client and
+// the destinations it addresses through a UDP ASSOCIATE request.
+type socks5Association struct {
+	server     *SocksServer
+	conn       net.Conn
+	relayConn  *net.UDPConn
+	clientIP   net.IP
+	clientAddr *net.UDPAddr
+	targets    map[string]*socks5Target
+	closed     bool
+	mutex      sync.Mutex
+}
+
+// socks5Target is a destination of a UDP association. It is
+// logged as a single request once the association is closed.
+type socks5Target struct {
+	conn     net.Conn
+	record   *ProxyRequest
+	sent     atomic.Uint64
+	received atomic.Uint64
+}
+
+// run reads datagrams from the socks client and sends them to
+// their destinations.
+func (a *socks5Association) run() {
+	buffer := make([]byte, MaxDatagramSize)
+	for {
+		bytesRead, addr, err := a.relayConn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		if !addr.IP.Equal(a.clientIP) {
+			continue
+		}
+
+		a.server.stats.addRx(bytesRead)
+
+		address, header, data, err := parseSocks5Datagram(buffer[:bytesRead])
+		if err != nil {
+			continue
+		}
+
+		a.mutex.Lock()
+		a.clientAddr = addr
+		a.mutex.Unlock()
+
+		target, err := a.getTarget(address, header)
+		if err != nil {
+			continue
+		}
+		if n, err := target.conn.Write(data); err == nil {
+			target.sent.Add(uint64(n))
+		}
+	}
+}
+
+// getTarget returns the connection for a destination, dialing
+// it on first use.
+func (a *socks5Association) getTarget(address string,
+	header []byte) (*socks5Target, error) {
+
+	a.mutex.Lock()
+	target, ok := a.targets[address]
+	a.mutex.Unlock()
+	if ok {
+		return target, nil
+	}
+
+	record := a.server.newRequest(a.conn, "socks5", "udp", address)
+	conn, err := a.server.dial("udp", address)
+	if err != nil {
+		a.server.logRequest(record, err)
+		return nil, err
+	}
+	record.ResolvedAddress = ResolvedAddress(conn)
+
+	a.mutex.Lock()
+	if a.closed {
+		a.mutex.Unlock()
+		conn.Close()
+		return nil, fmt.Errorf("association closed")
+	}
+	target = &socks5Target{conn: conn, record: record}
+	a.targets[address] = target
+	a.mutex.Unlock()
+
+	// Replies are tagged with the destination as the client
+	// addressed it.
+	header = append([]byte{}, header...)
+	go func() {
+		buffer := make([]byte, MaxDatagramSize)
+		for {
+			bytesRead, err := conn.Read(buffer)
+			if err != nil {
+				return
+			}
+			target.received.Add(uint64(bytesRead))
+
+			a.mutex.Lock()
+			clientAddr := a.clientAddr
+			a.mutex.Unlock()
+
+			datagram := append(append([]byte{}, header...), buffer[:bytesRead]...)
+			if n, err := a.relayConn.WriteToUDP(datagram, clientAddr); err == nil {
+				a.server.stats.addTx(n)
+			}
+		}
+	}()
+
+	return target, nil
+}
+
+// close will stop relaying, close every destination and log
+// the traffic exchanged with each of them.
+func (a *socks5Association) close() {
+	a.mutex.Lock()
+	a.closed = true
+	targets := a.targets
+	a.targets = make(map[string]*socks5Target)
+	a.mutex.Unlock()
+
+	a.relayConn.Close()
+	for _, target := range targets {
+		target.conn.Close()
+		target.record.BytesSent = target.sent.Load()
+		target.record.BytesReceived = target.received.Load()
+		a.server.logRequest(target.record, nil)
+	}
+}
+
+var errSocks5AddrNotSupported = errors.New("unsupported socks address type")
+
+// readSocks5String reads a length prefixed string from r.
+func readSocks5String(r io.Reader) ([]byte, error) {
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return nil, err
+	}
+	value := make([]byte, length[0])
+	if _, err := io.ReadFull(r, value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// readSocks5Request reads a socks v5 request from r.
+func readSocks5Request(r io.Reader) (*socks5Request, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socks5Version {
+		return nil, fmt.Errorf("unsupported socks version: %d", header[0])
+	}
+
+	address, err := readSocks5Addr(r)
+	if err != nil {
+		return nil, err
+	}
+
+	request := new(socks5Request)
+	request.command = header[1]
+	request.address = address
+	return request, nil
+}
+
+// readSocks5Addr reads an address type, address and port from r.
+// It returns the address as host:port.
+func readSocks5Addr(r io.Reader) (string, error) {
+	addrType := make([]byte, 1)
+	if _, err := io.ReadFull(r, addrType); err != nil {
+		return "", err
+	}
+
+	var host []byte
+	switch addrType[0] {
+	case socks5AddrIPv4:
+		host = make([]byte, net.IPv4len)
+	case socks5AddrIPv6:
+		host = make([]byte, net.IPv6len)
+	case socks5AddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return "", err
+		}
+		host = make([]byte, length[0])
+	default:
+		return "", errSocks5AddrNotSupported
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, host); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", err
+	}
+
+	hostString := string(host)
+	if addrType[0] != socks5AddrDomain {
+		hostString = net.IP(host).String()
+	}
+	portString := strconv.Itoa(int(binary.BigEndian.Uint16(port)))
+	return net.JoinHostPort(hostString, portString), nil
+}
+
+// encodeSocks5Addr encodes an address for a socks v5 reply. A
+// nil address is encoded as 0.0.0.0:0.
+func encodeSocks5Addr(addr net.Addr) []byte {
+	ip, port := AddrToIPPort(addr)
+	if ip == nil {
+		ip = net.IPv4zero
+	}
+
+	var encoded []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		encoded = append([]byte{socks5AddrIPv4}, ip4...)
+	} else {
+		encoded = append([]byte{socks5AddrIPv6}, ip.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(encoded, uint16(port))
+}
+
+// parseSocks5Datagram splits a datagram sent to a UDP relay into
+// its destination, its header and its data. Fragmented datagrams
+// are not supported.
+func parseSocks5Datagram(datagram []byte) (string, []byte, []byte, error) {
+	if len(datagram) < socks5UDPHeaderMinLength {
+		return "", nil, nil, fmt.Errorf("short socks datagram")
+	}
+	if datagram[2] != 0 {
+		return "", nil, nil, fmt.Errorf("fragmented socks datagram")
+	}
+
+	reader := bytes.NewReader(datagram[3:])
+	address, err := readSocks5Addr(reader)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	headerLength := len(datagram) - reader.Len()
+	return address, datagram[:headerLength], datagram[headerLength:], nil
+}
+
+// socks5ReplyForError maps a dial error to a socks reply status.
+func socks5ReplyForError(err error) byte {
+	var policyErr *PolicyError
+	if errors.As(err, &policyErr) {
+		return socks5NotAllowed
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		var dnsErr *net.DNSError
+		if errors.As(opErr.Err, &dnsErr) {
+			return socks5HostUnreachable
+		}
+		return socks5ConnectionRefused
+	}
+	return socks5GeneralFailure
+}
@@ -0,0 +1,367 @@
+package common
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startTCPEcho starts a TCP server that echoes everything it reads.
+func startTCPEcho(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return ln
+}
+
+// startUDPEcho starts a UDP server that echoes every datagram.
+func startUDPEcho(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP failed: %s", err)
+	}
+	go func() {
+		buffer := make([]byte, MaxDatagramSize)
+		for {
+			n, addr, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buffer[:n], addr)
+		}
+	}()
+	return conn
+}
+
+// startSocksServer starts a socks server on an ephemeral port.
+func startSocksServer(t *testing.T) *SocksServer {
+	s := NewSocksServer("test", 0)
+	if !s.Start() {
+		t.Fatalf("failed to start socks server")
+	}
+	return s
+}
+
+// socks5Dial connects to the socks server and sends a request
+// for the provided command and address. It returns the control
+// connection and the bound address from the reply.
+func socks5Dial(t *testing.T, s *SocksServer, command byte,
+	addr net.Addr) (net.Conn, net.Addr) {
+
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte{socks5Version, 1, socks5AuthNone})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != socks5AuthNone {
+		t.Fatalf("method selection = %v, %v", reply, err)
+	}
+
+	request := append([]byte{socks5Version, command, 0}, encodeSocks5Addr(addr)...)
+	conn.Write(request)
+	return conn, readSocks5Reply(t, conn)
+}
+
+// readSocks5Reply reads a reply and fails the test unless it
+// succeeded.
+func readSocks5Reply(t *testing.T, conn net.Conn) net.Addr {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatalf("failed to read reply: %s", err)
+	}
+	if header[1] != socks5Succeeded {
+		t.Fatalf("reply status = %d; want success", header[1])
+	}
+	address, err := readSocks5Addr(conn)
+	if err != nil {
+		t.Fatalf("failed to read bound address: %s", err)
+	}
+	addr, _ := net.ResolveTCPAddr("tcp", address)
+	return addr
+}
+
+func TestSocks5Connect(t *testing.T) {
+	echo := startTCPEcho(t)
+	defer echo.Close()
+	s := startSocksServer(t)
+	defer s.Stop()
+
+	conn, _ := socks5Dial(t, s, socks5CmdConnect, echo.Addr())
+	defer conn.Close()
+
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("echo = %q, %v; want hello", buf, err)
+	}
+}
+
+func TestSocks5UDPAssociate(t *testing.T) {
+	echo := startUDPEcho(t)
+	defer echo.Close()
+	s := startSocksServer(t)
+	defer s.Stop()
+
+	conn, bound := socks5Dial(t, s, socks5CmdUDPAssociate, nil)
+	defer conn.Close()
+	relayAddr := bound.(*net.TCPAddr)
+
+	client, err := net.DialUDP("udp", nil,
+		&net.UDPAddr{IP: relayAddr.IP, Port: relayAddr.Port})
+	if err != nil {
+		t.Fatalf("DialUDP failed: %s", err)
+	}
+	defer client.Close()
+
+	header := append([]byte{0, 0, 0}, encodeSocks5Addr(echo.LocalAddr())...)
+	client.Write(append(header, []byte("ping")...))
+
+	buf := make([]byte, MaxDatagramSize)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatalf("no reply from relay: %s", err)
+	}
+	if !bytes.Equal(buf[:n], append(header, []byte("ping")...)) {
+		t.Errorf("reply = %v; want echo tagged with %s", buf[:n], echo.LocalAddr())
+	}
+}
+
+func TestSocks5Bind(t *testing.T) {
+	s := startSocksServer(t)
+	defer s.Stop()
+
+	peerAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	conn, bound := socks5Dial(t, s, socks5CmdBind, peerAddr)
+	defer conn.Close()
+
+	peer, err := net.Dial("tcp", bound.String())
+	if err != nil {
+		t.Fatalf("failed to connect to bound address %s: %s", bound, err)
+	}
+	defer peer.Close()
+
+	if got := readSocks5Reply(t, conn); got.String() != peer.LocalAddr().String() {
+		t.Errorf("second reply = %s; want %s", got, peer.LocalAddr())
+	}
+
+	peer.Write([]byte("from peer"))
+	buf := make([]byte, 9)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "from peer" {
+		t.Fatalf("read = %q, %v; want from peer", buf, err)
+	}
+}
+
+func TestSocks5BindOnlyAcceptsRequestedPeer(t *testing.T) {
+	s := startSocksServer(t)
+	defer s.Stop()
+
+	peerAddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}
+	conn, bound := socks5Dial(t, s, socks5CmdBind, peerAddr)
+	defer conn.Close()
+
+	// A connection from another host is closed
+	stranger, err := net.Dial("tcp", bound.String())
+	if err != nil {
+		t.Fatalf("failed to connect to bound address %s: %s", bound, err)
+	}
+	defer stranger.Close()
+	stranger.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := stranger.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read from refused peer = %v; want EOF", err)
+	}
+
+	dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: peerAddr.IP}}
+	peer, err := dialer.Dial("tcp", bound.String())
+	if err != nil {
+		t.Fatalf("failed to connect to bound address %s: %s", bound, err)
+	}
+	defer peer.Close()
+
+	if got := readSocks5Reply(t, conn); got.String() != peer.LocalAddr().String() {
+		t.Errorf("second reply = %s; want %s", got, peer.LocalAddr())
+	}
+}
+
+func TestSocksServerRefusesBindWithCustomDial(t *testing.T) {
+	s := NewSocksServer("test", 0)
+	s.SetDial(net.Dial)
+	if !s.Start() {
+		t.Fatalf("failed to start socks server")
+	}
+	defer s.Stop()
+
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte{socks5Version, 1, socks5AuthNone})
+	conn.Write(append([]byte{socks5Version, socks5CmdBind, 0}, encodeSocks5Addr(nil)...))
+
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[3] != socks5CmdNotSupported {
+		t.Errorf("reply = %v, %v; want command not supported", reply, err)
+	}
+}
+
+func TestSocks5PasswordAuthentication(t *testing.T) {
+	echo := startTCPEcho(t)
+	defer echo.Close()
+	s := NewSocksServer("test", 0)
+	s.SetCredentials("user", "secret")
+	if !s.Start() {
+		t.Fatalf("failed to start socks server")
+	}
+	defer s.Stop()
+
+	tests := []struct {
+		password string
+		status   byte
+	}{
+		{"wrong", socks5PasswordFailure},
+		{"secret", socks5PasswordSuccess},
+	}
+
+	for _, test := range tests {
+		conn, err := net.Dial("tcp", s.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial failed: %s", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		conn.Write([]byte{socks5Version, 2, socks5AuthNone, socks5AuthPassword})
+		reply := make([]byte, 2)
+		if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != socks5AuthPassword {
+			t.Fatalf("method selection = %v, %v; want password", reply, err)
+		}
+
+		auth := []byte{socks5PasswordVersion, 4}
+		auth = append(auth, "user"...)
+		auth = append(auth, byte(len(test.password)))
+		auth = append(auth, test.password...)
+		conn.Write(auth)
+		if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != test.status {
+			t.Errorf("password %s: status = %v, %v; want %d", test.password,
+				reply, err, test.status)
+		}
+		conn.Close()
+	}
+}
+
+func TestSocks5RequiresAuthentication(t *testing.T) {
+	s := NewSocksServer("test", 0)
+	s.SetCredentials("user", "secret")
+	if !s.Start() {
+		t.Fatalf("failed to start socks server")
+	}
+	defer s.Stop()
+
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte{socks5Version, 1, socks5AuthNone})
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != socks5AuthNoAcceptable {
+		t.Errorf("method selection = %v, %v; want no acceptable methods", reply, err)
+	}
+}
+
+func TestSocks5ConnectThroughTunnel(t *testing.T) {
+	echo := startTCPEcho(t)
+	defer echo.Close()
+
+	// The socks server runs on the gServer and the gClient dials
+	server := NewTunnel("socks", TunnelDirectionForward, nil, 0, nil, 0)
+	server.SetDynamic(true)
+	client := NewTunnel("socks", TunnelDirectionForward, nil, 0, nil, 0)
+	client.SetDynamic(true)
+	linkTunnels(t, server, client)
+
+	s := NewSocksServer("test", 0)
+	s.SetDial(server.Dial)
+	if !s.Start() {
+		t.Fatalf("failed to start socks server")
+	}
+	defer s.Stop()
+
+	conn, _ := socks5Dial(t, s, socks5CmdConnect, echo.Addr())
+	defer conn.Close()
+
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("echo = %q, %v; want hello", buf, err)
+	}
+	client.mutex.Lock()
+	carried := len(client.connections)
+	client.mutex.Unlock()
+	if carried != 1 {
+		t.Errorf("gClient is carrying %d connections; want 1", carried)
+	}
+}
+
+func TestSocks5ConnectThroughTunnelFails(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	closed.Close()
+
+	server := NewTunnel("socks", TunnelDirectionForward, nil, 0, nil, 0)
+	server.SetDynamic(true)
+	client := NewTunnel("socks", TunnelDirectionForward, nil, 0, nil, 0)
+	client.SetDynamic(true)
+	linkTunnels(t, server, client)
+
+	s := NewSocksServer("test", 0)
+	s.SetDial(server.Dial)
+	if !s.Start() {
+		t.Fatalf("failed to start socks server")
+	}
+	defer s.Stop()
+
+	// The gClient's failure to connect is the socks reply
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte{socks5Version, 1, socks5AuthNone})
+	io.ReadFull(conn, make([]byte, 2))
+	conn.Write(append([]byte{socks5Version, socks5CmdConnect, 0},
+		encodeSocks5Addr(closed.Addr())...))
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("failed to read reply: %s", err)
+	}
+	if reply[1] == socks5Succeeded {
+		t.Errorf("connect to a closed port succeeded")
+	}
+}
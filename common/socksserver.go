@@ -1,59 +1,140 @@
 package common
 
 import (
+	"bufio"
 	"fmt"
+	"log"
 	"net"
 	"time"
-
-	"github.com/fangdingjun/socks-go"
 )
 
+// socksHandshakeTimeout is how long a socks client has to
+// negotiate and send its request. The deadline is lifted once
+// the request is carried out.
+const socksHandshakeTimeout = 30 * time.Second
+
 // SocksServer is a structure that handles starting and stopping
-// a socks v5 proxy on the gClient.
+// a socks v4, v4a and v5 proxy on the gClient or the gServer.
 type SocksServer struct {
-	listener    net.Listener
-	connections []socks.Conn
-	servePort   uint32
+	ProxyServer
+	listen func(network string, peer string) (net.Listener, error)
 }
 
 // NewSocksServer is a constructor for the SocksServer struct.
-// It takes in a port as an argument, wich will be the port on
-// which the socks server listens.
-func NewSocksServer(port uint32) *SocksServer {
+// It takes in an ID and a port as arguments, the port being
+// where the socks server listens. The server listens on
+// 127.0.0.1 unless a bind address is set.
+func NewSocksServer(id string, port uint32) *SocksServer {
 	s := new(SocksServer)
-	s.servePort = port
-	s.connections = make([]socks.Conn, 0)
+	s.init(id, port)
+	s.listen = listenForPeer
 	return s
 }
 
+// SetDial will change how the socks server connects to the
+// requested destinations. By default they are dialed directly.
+// Since a custom dial does not egress from this host, BIND
+// requests are refused once it is set.
+func (s *SocksServer) SetDial(dial DialFunc) {
+	s.dialFunc = dial
+	s.listen = nil
+}
+
 // Start will start the socks server. Simple enough.
 func (s *SocksServer) Start() bool {
-	var err error
-	s.listener, err = net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", s.servePort))
+	return s.start(s.serve)
+}
+
+// serve will handle a single socks client connection, choosing
+// the protocol by the version the client sends first.
+func (s *SocksServer) serve(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	reader := bufio.NewReader(conn)
+	version, err := reader.Peek(1)
+	if err != nil {
+		return
+	}
+	bufferedConn := &bufferedConn{Conn: conn, reader: reader}
+
+	switch version[0] {
+	case socks4Version:
+		handler := &socks4Conn{server: s, conn: bufferedConn, reader: reader}
+		err = handler.serve()
+	case socks5Version:
+		handler := &socks5Conn{server: s, conn: bufferedConn}
+		err = handler.serve()
+	default:
+		err = fmt.Errorf("unsupported socks version: %d", version[0])
+	}
 
 	if err != nil {
-		return false
+		log.Printf("[!] socks request failed: %s", err)
 	}
+}
 
+// listenForPeer will listen on the local address that routes to
+// the provided peer, so that the peer is able to connect to it.
+// An unspecified peer listens on all addresses.
+func listenForPeer(network string, peer string) (net.Listener, error) {
+	var ip net.IP
+	host, _, _ := net.SplitHostPort(peer)
+	if peerIP := net.ParseIP(host); peerIP == nil || !peerIP.IsUnspecified() {
+		if probe, err := net.Dial("udp", peer); err == nil {
+			ip, _ = AddrToIPPort(probe.LocalAddr())
+			probe.Close()
+		}
+	}
+	return net.Listen(network, net.JoinHostPort(ipString(ip), "0"))
+}
+
+// acceptPeer will accept connections on a BIND listener until one
+// comes from the host of the provided address, closing any others.
+// An unspecified host accepts any peer. It gives up once
+// socks5BindAcceptTimeout passes.
+func acceptPeer(listener net.Listener, address string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	var allowed []net.IP
+	if ip := net.ParseIP(host); ip == nil {
+		if allowed, err = net.LookupIP(host); err != nil {
+			return nil, err
+		}
+	} else if !ip.IsUnspecified() {
+		allowed = []net.IP{ip}
+	}
+
+	// Give up on the peer if it never connects
+	accepted := make(chan bool)
+	defer close(accepted)
 	go func() {
-		for {
-			conn, err := s.listener.Accept()
-			if err != nil {
-				break
-			}
-			d := net.Dialer{Timeout: 10 * time.Second}
-			newConn := socks.Conn{Conn: conn, Dial: d.Dial}
-			s.connections = append(s.connections, newConn)
-			go newConn.Serve()
+		timer := time.NewTimer(socks5BindAcceptTimeout)
+		defer timer.Stop()
+
+		select {
+		case <-accepted:
+		case <-timer.C:
+			listener.Close()
 		}
 	}()
-	return true
-}
 
-// Stop - You'll never guess what this does.
-func (s *SocksServer) Stop() {
-	s.listener.Close()
-	for _, conn := range s.connections {
-		conn.Close()
+	for {
+		peer, err := listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if len(allowed) == 0 {
+			return peer, nil
+		}
+		peerIP, _ := AddrToIPPort(peer.RemoteAddr())
+		for _, ip := range allowed {
+			if ip.Equal(peerIP) {
+				return peer, nil
+			}
+		}
+		log.Printf("[!] socks bind refused peer %s, expected %s",
+			peer.RemoteAddr(), host)
+		peer.Close()
 	}
 }
@@ -0,0 +1,46 @@
+package common
+
+import "sync/atomic"
+
+// TrafficStats counts the bytes that crossed one or more
+// connections. Rx is data read from the local socket and sent
+// to the remote side, Tx is data received from the remote side
+// and written to the local socket.
+type TrafficStats struct {
+	bytesRx  uint64
+	bytesTx  uint64
+	rejected uint64
+}
+
+// addRx records bytes read from a local socket.
+func (s *TrafficStats) addRx(size int) {
+	atomic.AddUint64(&s.bytesRx, uint64(size))
+}
+
+// addTx records bytes written to a local socket.
+func (s *TrafficStats) addTx(size int) {
+	atomic.AddUint64(&s.bytesTx, uint64(size))
+}
+
+// addRejected records a connection refused by a listener.
+func (s *TrafficStats) addRejected() {
+	atomic.AddUint64(&s.rejected, 1)
+}
+
+// GetBytesRx returns the number of bytes read from
+// local sockets.
+func (s *TrafficStats) GetBytesRx() uint64 {
+	return atomic.LoadUint64(&s.bytesRx)
+}
+
+// GetBytesTx returns the number of bytes written to
+// local sockets.
+func (s *TrafficStats) GetBytesTx() uint64 {
+	return atomic.LoadUint64(&s.bytesTx)
+}
+
+// GetRejectedConnections returns the number of connections
+// refused by a listener.
+func (s *TrafficStats) GetRejectedConnections() uint64 {
+	return atomic.LoadUint64(&s.rejected)
+}
@@ -1,9 +1,14 @@
 package common
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net"
+	"strconv"
 	"sync"
+	"time"
 
 	cs "github.com/hotnops/gTunnel/grpc/client"
 	"github.com/segmentio/ksuid"
@@ -18,18 +23,41 @@ type ConnectionStreamHandler interface {
 type Tunnel struct {
 	id                string
 	direction         uint32
+	protocol          uint32
 	listenIP          net.IP
 	listenPort        uint32
 	destinationIP     net.IP
+	destinationHost   string
 	destinationPort   uint32
+	destinations      *DestinationSet
+	receiveWindow     uint32
+	compression       uint32
+	compressionStats  CompressionStats
+	bandwidthLimit    *BandwidthLimit
+	sharedLimits      []*BandwidthLimit
+	stats             TrafficStats
+	sharedStats       []*TrafficStats
+	lastError         string
+	dynamic           bool
+	portCount         uint32
+	policy            *Policy
+	dialFunc          DialFunc
+	capture           *Capture
+	recorder          ConnectionRecorder
+	listenerGuard     *listenerGuard
 	connections       map[string]*Connection
-	listeners         []net.TCPListener
+	listeners         []io.Closer
 	Kill              chan bool
 	ctrlStream        TunnelControlStream
 	ConnectionHandler ConnectionStreamHandler
 	mutex             sync.Mutex
+	ctrlMutex         sync.Mutex
 }
 
+// DialTimeout is the amount of time to wait for the remote
+// endpoint to connect a connection opened with Tunnel.Dial.
+const DialTimeout = 30 * time.Second
+
 // NewTunnel is a constructor for the tunnel struct. It takes
 // in id, direction, listenIP, lisetnPort, destinationIP, and
 // destinationPort as parameters.
@@ -46,57 +74,81 @@ func NewTunnel(id string,
 	t.listenPort = listenPort
 	t.destinationIP = destinationIP
 	t.destinationPort = destinationPort
+	t.portCount = 1
+	t.receiveWindow = DefaultReceiveWindow
+	t.bandwidthLimit = NewBandwidthLimit(0)
+	t.listenerGuard = newListenerGuard(ListenerLimits{})
 	t.connections = make(map[string]*Connection)
 	t.Kill = make(chan bool)
-	t.listeners = make([]net.TCPListener, 0)
+	t.listeners = make([]io.Closer, 0)
 	return t
 }
 
 // Addconnection will generate an ID for the connection and
 // add it to the map.
 func (t *Tunnel) AddConnection(c *Connection) {
-	t.mutex.Lock()
-	defer t.mutex.Unlock()
-
 	c.ID = ksuid.New().String()
-	t.connections[c.ID] = c
+	t.trackConnection(c)
 }
 
-// AddListener will start a tcp listener on a specific port and forward
-// all accepted TCP connections to the associated tunnel.
-func (t *Tunnel) AddListener(clientID string) bool {
+// trackConnection will add a connection to the map under its ID.
+// Once the connection closes, the connection handler releases its
+// stream and it is removed, so the map only holds live connections.
+func (t *Tunnel) trackConnection(c *Connection) {
+	t.mutex.Lock()
+	t.connections[c.ID] = c
+	t.mutex.Unlock()
 
-	addr, _ := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d", t.listenIP, t.listenPort))
-	ln, err := net.ListenTCP("tcp", addr)
-	if err != nil {
-		return false
-	}
+	go func() {
+		<-c.Kill
+		if t.ConnectionHandler != nil {
+			t.ConnectionHandler.CloseStream(t, c.ID)
+		}
+		t.RemoveConnection(c.ID)
+	}()
+}
 
-	t.listeners = append(t.listeners, *ln)
+// AddListener will start a tcp or udp listener on each port of the
+// tunnel's listen range and forward all accepted connections to the
+// associated tunnel. For UDP, each source address is accepted as its
+// own connection. Connections that exceed the tunnel's listener
+// limits are rejected.
+func (t *Tunnel) AddListener(clientID string) bool {
 
-	newConns := make(chan *net.TCPConn)
+	newConns := make(chan acceptedConn)
 
-	go func(l *net.TCPListener) {
-		for {
-			c, err := l.AcceptTCP()
-			if err == nil {
-				newConns <- c
-			} else {
-				return
+	for offset := uint32(0); offset < t.portCount; offset++ {
+		if !t.listen(t.listenPort+offset, offset, newConns) {
+			for _, listener := range t.listeners {
+				listener.Close()
 			}
+			t.listeners = nil
+			return false
 		}
-	}(ln)
+	}
+
 	go func() {
 		for {
 			select {
-			case conn := <-newConns:
-				gConn := NewConnection(*conn)
+			case accepted := <-newConns:
+				conn := accepted.conn
+				if err := t.admit(conn); err != nil {
+					t.rejectConnection(conn, err)
+					continue
+				}
+				gConn := t.newConnection(conn)
 				t.AddConnection(gConn)
 				newMessage := new(cs.TunnelControlMessage)
 				newMessage.Operation = TunnelCtrlConnect
 				newMessage.TunnelId = t.id
 				newMessage.ConnectionId = gConn.ID
-				t.ctrlStream.Send(newMessage)
+				newMessage.PortOffset = accepted.offset
+				if err := t.SendControlMessage(newMessage); err != nil {
+					log.Printf("[!] Tunnel %s failed to report a connection: %s",
+						t.id, err)
+					t.RemoveConnection(gConn.ID)
+					gConn.Close()
+				}
 
 			case <-t.Kill:
 				return
@@ -106,6 +158,253 @@ func (t *Tunnel) AddListener(clientID string) bool {
 	return true
 }
 
+// acceptedConn is a connection accepted by one of the tunnel's
+// listeners, along with the offset of the listener's port in the
+// tunnel's port range.
+type acceptedConn struct {
+	conn   net.Conn
+	offset uint32
+}
+
+// listen will start a single tcp or udp listener on the provided
+// port and pass the connections it accepts to newConns.
+func (t *Tunnel) listen(port uint32, offset uint32,
+	newConns chan acceptedConn) bool {
+
+	if t.protocol == TunnelProtocolUDP {
+		addr := &net.UDPAddr{IP: t.listenIP, Port: int(port)}
+		ln, err := newUDPListener(addr)
+		if err != nil {
+			t.setLastError(err.Error())
+			return false
+		}
+
+		t.listeners = append(t.listeners, ln)
+
+		go func(l *udpListener) {
+			for {
+				c, err := l.Accept()
+				if err == nil {
+					newConns <- acceptedConn{conn: c, offset: offset}
+				} else {
+					return
+				}
+			}
+		}(ln)
+	} else {
+		addr := &net.TCPAddr{IP: t.listenIP, Port: int(port)}
+		ln, err := net.ListenTCP("tcp", addr)
+		if err != nil {
+			t.setLastError(err.Error())
+			return false
+		}
+
+		t.listeners = append(t.listeners, ln)
+
+		go func(l *net.TCPListener) {
+			for {
+				c, err := l.AcceptTCP()
+				if err == nil {
+					newConns <- acceptedConn{conn: c, offset: offset}
+				} else {
+					return
+				}
+			}
+		}(ln)
+	}
+	return true
+}
+
+// admit returns an error if the tunnel's listener limits do not
+// allow conn to be accepted. Only connections that are still open
+// count towards the maximum.
+func (t *Tunnel) admit(conn net.Conn) error {
+	t.mutex.Lock()
+	guard := t.listenerGuard
+	connections := len(t.connections)
+	t.mutex.Unlock()
+
+	return guard.admit(conn.RemoteAddr(), connections)
+}
+
+// rejectConnection will close a connection refused by the
+// listener, count it and let the remote side know about it.
+func (t *Tunnel) rejectConnection(conn net.Conn, err error) {
+	conn.Close()
+	log.Printf("[!] Tunnel %s %s", t.id, err)
+	t.stats.addRejected()
+	t.setLastError(err.Error())
+
+	message := new(cs.TunnelControlMessage)
+	message.Operation = TunnelCtrlReject
+	message.TunnelId = t.id
+	message.ErrorMessage = err.Error()
+	t.SendControlMessage(message)
+}
+
+// Dial will open a connection through the tunnel to the provided
+// address, which is dialed by the remote endpoint. The remote
+// endpoint must have the tunnel marked as dynamic. The returned
+// net.Conn carries the connection's data and its RemoteAddr is
+// the address the remote endpoint connected to. For the udp
+// network, every write and read on it is a single datagram. The
+// icmp network carries ICMP echo messages the same way and needs
+// an endpoint with CapabilityICMP.
+func (t *Tunnel) Dial(network string, address string) (net.Conn, error) {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return nil, err
+	}
+
+	protocol := uint32(TunnelProtocolTCP)
+	if network == "udp" {
+		protocol = TunnelProtocolUDP
+	} else if network == "icmp" {
+		protocol = TunnelProtocolICMP
+	}
+
+	// Refuse what can be decided before the remote endpoint
+	// resolves the host
+	if err := t.policy.Check(host, net.ParseIP(host), uint32(port)); err != nil {
+		return nil, err
+	}
+
+	local, remote := Pipe()
+	gConn := t.newConnection(remote)
+	gConn.SetDatagram(protocol != TunnelProtocolTCP)
+	t.AddConnection(gConn)
+
+	message := new(cs.TunnelControlMessage)
+	message.Operation = TunnelCtrlConnect
+	message.TunnelId = t.id
+	message.ConnectionId = gConn.ID
+	message.DestinationHost = host
+	message.DestinationPort = uint32(port)
+	message.Protocol = protocol
+	t.SendControlMessage(message)
+
+	select {
+	case <-gConn.started:
+		return &tunnelConn{Conn: local, remoteAddress: gConn.GetRemoteAddress()}, nil
+	case <-gConn.Kill:
+		local.Close()
+		return nil, gConn.Err()
+	case <-time.After(DialTimeout):
+		gConn.Close()
+		t.RemoveConnection(gConn.ID)
+		local.Close()
+		return nil, fmt.Errorf("timed out connecting to %s", address)
+	}
+}
+
+// tunnelConn is the local end of a connection opened with
+// Tunnel.Dial.
+type tunnelConn struct {
+	net.Conn
+	remoteAddress string
+}
+
+// RemoteAddr returns the address the remote endpoint connected
+// to, or nil if it is not known.
+func (c *tunnelConn) RemoteAddr() net.Addr {
+	if c.remoteAddress == "" {
+		return nil
+	}
+	return tunnelAddr(c.remoteAddress)
+}
+
+func (c *tunnelConn) CloseRead() error {
+	return closeRead(c.Conn)
+}
+
+func (c *tunnelConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// tunnelAddr is an address reached by the remote endpoint.
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string { return "tunnel" }
+func (a tunnelAddr) String() string  { return string(a) }
+
+// dial will connect to one of the destinations of the tunnel
+// using the tunnel's protocol, trying the next destination when
+// one fails. The offset selects the port in each destination's
+// range. A hostname destination is resolved again for every new
+// connection. The attempts made are returned along with the result.
+func (t *Tunnel) dial(offset uint32) (net.Conn, []*cs.DestinationAttempt, error) {
+	if offset >= t.portCount {
+		return nil, nil, fmt.Errorf("port offset %d is outside of the tunnel's %d ports",
+			offset, t.portCount)
+	}
+
+	return t.GetDestinations().dial(func(d *TunnelDestination) (net.Conn, error) {
+		return t.dialAddress(t.protocol, d.Host, d.Port+offset)
+	})
+}
+
+// dialAddress will connect to the provided host and port
+// using the provided protocol, if the tunnel's policy allows it.
+func (t *Tunnel) dialAddress(protocol uint32, host string,
+	port uint32) (net.Conn, error) {
+	address := net.JoinHostPort(host, strconv.Itoa(int(port)))
+
+	network := "tcp"
+	if protocol == TunnelProtocolUDP {
+		network = "udp"
+	} else if protocol == TunnelProtocolICMP {
+		network = "icmp"
+	}
+
+	dial := t.policy.Dial
+	if t.dialFunc != nil {
+		dial = t.dialFunc
+	}
+	conn, err := dial(network, address)
+	if err != nil {
+		if _, ok := err.(*PolicyError); ok {
+			return nil, err
+		}
+		if opErr, ok := err.(*net.OpError); ok {
+			if _, ok := opErr.Err.(*net.DNSError); ok {
+				return nil, fmt.Errorf("failed to resolve %s: %s", host, opErr.Err)
+			}
+		}
+		return nil, fmt.Errorf("failed to connect to %s: %s", address, err)
+	}
+	return conn, nil
+}
+
+// GetID returns the ID of the tunnel.
+func (t *Tunnel) GetID() string {
+	return t.id
+}
+
+// GetBandwidthLimit gets the bandwidth limit shared by
+// all of the tunnel's connections.
+func (t *Tunnel) GetBandwidthLimit() *BandwidthLimit {
+	return t.bandwidthLimit
+}
+
+// GetCompression gets the compression algorithm used
+// for the tunnel's connections.
+func (t *Tunnel) GetCompression() uint32 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.compression
+}
+
+// GetCompressionStats gets the number of bytes carried by
+// the tunnel and their size on the wire.
+func (t *Tunnel) GetCompressionStats() *CompressionStats {
+	return &t.compressionStats
+}
+
 // GetConnection will return a Connection object
 // with the given connection id
 func (t *Tunnel) GetConnection(connID string) *Connection {
@@ -124,21 +423,72 @@ func (t *Tunnel) GetControlStream() TunnelControlStream {
 	return t.ctrlStream
 }
 
+// GetStats returns the byte counters for every connection that
+// has crossed the tunnel.
+func (t *Tunnel) GetStats() *TrafficStats {
+	return &t.stats
+}
+
 // GetDestinationIP gets the destination IP of the tunnel.
 func (t *Tunnel) GetDestinationIP() net.IP {
 	return t.destinationIP
 }
 
+// GetDestinationHost gets the hostname destination of the tunnel,
+// which is empty if the destination is an IP address.
+func (t *Tunnel) GetDestinationHost() string {
+	return t.destinationHost
+}
+
 // GetDestinationPort gets the destination port of the tunnel.
 func (t *Tunnel) GetDestinationPort() uint32 {
 	return t.destinationPort
 }
 
+// GetDestinations gets the destinations of the tunnel. A tunnel
+// that was not given a list has the single destination it was
+// created with.
+func (t *Tunnel) GetDestinations() *DestinationSet {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.destinations == nil {
+		host := t.destinationHost
+		if host == "" {
+			host = t.destinationIP.String()
+		}
+		t.destinations = NewDestinationSet([]*TunnelDestination{
+			NewTunnelDestination(host, t.destinationPort)},
+			DestinationStrategyFailover)
+	}
+	return t.destinations
+}
+
 // GetDirection gets the direction of the tunnel (forward or reverse)
 func (t *Tunnel) GetDirection() uint32 {
 	return t.direction
 }
 
+// GetProtocol gets the protocol of the tunnel (tcp or udp)
+func (t *Tunnel) GetProtocol() uint32 {
+	return t.protocol
+}
+
+// GetLastError gets the most recent connection error
+// reported for the tunnel.
+func (t *Tunnel) GetLastError() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.lastError
+}
+
+// IsDynamic returns true if each connection on the tunnel
+// carries its own destination.
+func (t *Tunnel) IsDynamic() bool {
+	return t.dynamic
+}
+
 // GetListenIP gets the ip address that the tunnel is listening on.
 func (t *Tunnel) GetListenIP() net.IP {
 	return t.listenIP
@@ -149,6 +499,12 @@ func (t *Tunnel) GetListenPort() uint32 {
 	return t.listenPort
 }
 
+// GetReceiveWindow gets the receive window used for
+// each connection in the tunnel.
+func (t *Tunnel) GetReceiveWindow() uint32 {
+	return t.receiveWindow
+}
+
 // GetConnections will return the connection map
 func (t *Tunnel) GetConnections() map[string]*Connection {
 	t.mutex.Lock()
@@ -185,21 +541,45 @@ func (t *Tunnel) handleIngressCtrlMessages() {
 			// handle control message
 			if ctrlMessage.Operation == TunnelCtrlConnect {
 
-				rAddr, _ := net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:%d",
-					t.destinationIP,
-					t.destinationPort))
+				var conn net.Conn
+				var attempts []*cs.DestinationAttempt
+				var err error
 
-				conn, err := net.DialTCP("tcp", nil, rAddr)
+				// Dynamic tunnels carry the destination in each
+				// connect message instead of the tunnel itself
+				if t.dynamic && ctrlMessage.DestinationHost != "" {
+					conn, err = t.dialAddress(ctrlMessage.Protocol,
+						ctrlMessage.DestinationHost,
+						ctrlMessage.DestinationPort)
+				} else {
+					conn, attempts, err = t.dial(ctrlMessage.PortOffset)
+				}
+				ctrlMessage.Attempts = attempts
 
 				if err != nil {
+					// Let the remote side know that the connection
+					// could not be made so it can close its end.
+					t.setLastError(err.Error())
+					ctrlMessage.Operation = TunnelCtrlAck
 					ctrlMessage.ErrorStatus = 1
+					ctrlMessage.ErrorMessage = err.Error()
+					t.SendControlMessage(ctrlMessage)
 				} else {
-					var gConn *Connection
-					if gConn, ok = t.connections[ctrlMessage.ConnectionId]; !ok {
-						gConn = NewConnection(*conn)
+					gConn := t.GetConnection(ctrlMessage.ConnectionId)
+					if gConn == nil {
+						gConn = t.newConnection(conn)
 						gConn.ID = ctrlMessage.ConnectionId
-						t.connections[ctrlMessage.ConnectionId] = gConn
+						gConn.dialed = true
+						// Dialers that bridge to another endpoint
+						// return pipes rather than UDP sockets
+						if t.protocol == TunnelProtocolUDP ||
+							ctrlMessage.Protocol != TunnelProtocolTCP {
+							gConn.SetDatagram(true)
+						}
+						t.trackConnection(gConn)
 					}
+					// The ack tells the remote side where we connected
+					ctrlMessage.RemoteAddress = conn.RemoteAddr().String()
 					stream := t.ConnectionHandler.GetByteStream(t, ctrlMessage)
 					gConn.SetStream(stream)
 					gConn.Start()
@@ -207,7 +587,14 @@ func (t *Tunnel) handleIngressCtrlMessages() {
 				}
 
 			} else if ctrlMessage.Operation == TunnelCtrlAck {
+				t.GetDestinations().recordAttempts(ctrlMessage.Attempts)
 				if ctrlMessage.ErrorStatus != 0 {
+					log.Printf("[!] Tunnel %s connection %s failed: %s",
+						t.id, ctrlMessage.ConnectionId, ctrlMessage.ErrorMessage)
+					t.setLastError(ctrlMessage.ErrorMessage)
+					if conn := t.GetConnection(ctrlMessage.ConnectionId); conn != nil {
+						conn.CloseWithError(errors.New(ctrlMessage.ErrorMessage))
+					}
 					t.RemoveConnection(ctrlMessage.ConnectionId)
 				} else {
 					// Now that we know we are connected, we need to create a new byte
@@ -216,6 +603,7 @@ func (t *Tunnel) handleIngressCtrlMessages() {
 					conn := t.GetConnection(ctrlMessage.ConnectionId)
 
 					if conn != nil {
+						conn.SetRemoteAddress(ctrlMessage.RemoteAddress)
 						// Waiting until the byte stream gets set up
 						conn.SetStream(t.ConnectionHandler.Acknowledge(t, ctrlMessage))
 						if ok {
@@ -225,6 +613,10 @@ func (t *Tunnel) handleIngressCtrlMessages() {
 				}
 			} else if ctrlMessage.Operation == TunnelCtrlDisconnect {
 				t.RemoveConnection(ctrlMessage.ConnectionId)
+			} else if ctrlMessage.Operation == TunnelCtrlReject {
+				// The remote listener refused a connection
+				t.stats.addRejected()
+				t.setLastError(ctrlMessage.ErrorMessage)
 			}
 		case <-t.Kill:
 			break
@@ -235,6 +627,23 @@ func (t *Tunnel) handleIngressCtrlMessages() {
 	}
 }
 
+// newConnection creates a Connection for a local socket with
+// the tunnel's connection settings applied.
+func (t *Tunnel) newConnection(conn net.Conn) *Connection {
+	gConn := NewConnection(conn)
+	gConn.SetReceiveWindow(t.receiveWindow)
+	gConn.SetCompression(t.GetCompression(), &t.compressionStats)
+	gConn.SetBandwidthLimits(append([]*BandwidthLimit{t.bandwidthLimit},
+		t.sharedLimits...)...)
+	gConn.SetSharedStats(append([]*TrafficStats{&t.stats},
+		t.sharedStats...)...)
+	t.mutex.Lock()
+	gConn.SetCapture(t.capture)
+	gConn.recorder = t.recorder
+	t.mutex.Unlock()
+	return gConn
+}
+
 // RemoveConnection will remove the Connection object
 // from the connections map.
 func (t *Tunnel) RemoveConnection(connID string) {
@@ -244,12 +653,187 @@ func (t *Tunnel) RemoveConnection(connID string) {
 	delete(t.connections, connID)
 }
 
+// SetDestinationHost will set a hostname as the destination of
+// the tunnel. The hostname takes precedence over the destination IP.
+func (t *Tunnel) SetDestinationHost(host string) {
+	t.destinationHost = host
+}
+
+// SetDestinations will set the list of destinations that the
+// tunnel's connections are forwarded to. The first destination
+// becomes the tunnel's destination IP or host and port.
+func (t *Tunnel) SetDestinations(destinations *DestinationSet) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.destinations = destinations
+	first := destinations.GetDestinations()[0]
+	if ip := net.ParseIP(first.Host); ip != nil {
+		t.destinationIP = ip
+		t.destinationHost = ""
+	} else {
+		t.destinationHost = first.Host
+	}
+	t.destinationPort = first.Port
+}
+
+// setLastError records the most recent connection error
+// for the tunnel.
+func (t *Tunnel) setLastError(err string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.lastError = err
+}
+
+// SetSharedBandwidthLimits will set limits, such as a per client
+// or server wide limit, that the tunnel's connections share with
+// other tunnels.
+func (t *Tunnel) SetSharedBandwidthLimits(limits ...*BandwidthLimit) {
+	t.sharedLimits = limits
+}
+
+// SetSharedStats will set additional counters, such as the
+// client's totals, that the tunnel's traffic is added to.
+func (t *Tunnel) SetSharedStats(stats ...*TrafficStats) {
+	t.sharedStats = stats
+}
+
+// SetCompression will set the compression algorithm used
+// for the tunnel's connections.
+func (t *Tunnel) SetCompression(algorithm uint32) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.compression = algorithm
+}
+
+// SendControlMessage will send a message on the tunnel's control
+// stream. gRPC streams do not allow concurrent sends, so all
+// control messages go through here.
+func (t *Tunnel) SendControlMessage(message *cs.TunnelControlMessage) error {
+	t.ctrlMutex.Lock()
+	defer t.ctrlMutex.Unlock()
+
+	if t.ctrlStream == nil {
+		return fmt.Errorf("tunnel %s has no control stream", t.id)
+	}
+	return t.ctrlStream.Send(message)
+}
+
+// GetListenerLimits returns the limits on the connections
+// accepted by the tunnel's listener.
+func (t *Tunnel) GetListenerLimits() ListenerLimits {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.listenerGuard.limits
+}
+
+// SetListenerLimits will restrict the connections accepted by the
+// tunnel's listener.
+func (t *Tunnel) SetListenerLimits(limits ListenerLimits) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.listenerGuard = newListenerGuard(limits)
+}
+
+// GetPortCount returns the number of ports in the tunnel's listen
+// and destination ranges.
+func (t *Tunnel) GetPortCount() uint32 {
+	return t.portCount
+}
+
+// SetPortCount will turn the tunnel's listen and destination ports
+// into ranges of the provided size. Each port of the listen range
+// is forwarded to the port at the same offset in the destination
+// range.
+func (t *Tunnel) SetPortCount(count uint32) {
+	if count == 0 {
+		count = 1
+	}
+	t.portCount = count
+}
+
+// GetCapture returns the capture that new connections on the
+// tunnel are recorded to, or nil if the tunnel is not captured.
+func (t *Tunnel) GetCapture() *Capture {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.capture
+}
+
+// SetRecorder will record every connection opened on the tunnel
+// from now on to the provided recorder. A nil recorder stops
+// recording new connections.
+func (t *Tunnel) SetRecorder(recorder ConnectionRecorder) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.recorder = recorder
+}
+
+// SetCapture will record the data of every connection on the
+// tunnel, including those already open, to the provided capture.
+// Open connections that are recorded to a capture of their own are
+// left alone. A nil capture stops recording.
+func (t *Tunnel) SetCapture(capture *Capture) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	previous := t.capture
+	t.capture = capture
+	for _, conn := range t.connections {
+		if conn.GetCapture() == previous {
+			conn.SetCapture(capture)
+		}
+	}
+}
+
+// SetDialFunc will set the function that connects to the tunnel's
+// destinations in place of dialing them on the network. The
+// tunnel's policy is not checked when it is set.
+func (t *Tunnel) SetDialFunc(dial DialFunc) {
+	t.dialFunc = dial
+}
+
+// SetPolicy will set the policy that destinations dialed
+// through the tunnel are checked against.
+func (t *Tunnel) SetPolicy(policy *Policy) {
+	t.policy = policy
+}
+
+// SetDynamic will mark the tunnel as dynamic, meaning that each
+// connection carries its own destination instead of using the
+// tunnel's destination.
+func (t *Tunnel) SetDynamic(dynamic bool) {
+	t.dynamic = dynamic
+}
+
 // SetControlStream will set the provided control stream for
 // the associated tunnel
 func (t *Tunnel) SetControlStream(s TunnelControlStream) {
+	t.ctrlMutex.Lock()
+	defer t.ctrlMutex.Unlock()
+
 	t.ctrlStream = s
 }
 
+// SetProtocol will set the protocol (tcp or udp) used by the
+// tunnel's listeners and dialers.
+func (t *Tunnel) SetProtocol(protocol uint32) {
+	t.protocol = protocol
+}
+
+// SetReceiveWindow will set the maximum number of bytes
+// buffered for each direction of a connection in the tunnel.
+// A window of 0 turns flow control off.
+func (t *Tunnel) SetReceiveWindow(size uint32) {
+	t.receiveWindow = size
+}
+
 // Start receiving control messages for the tunnel
 func (t *Tunnel) Start() {
 	// A thread for handling the established tcp connections
@@ -0,0 +1,365 @@
+package common
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	cs "github.com/hotnops/gTunnel/grpc/client"
+)
+
+// fakeControlStream is a TunnelControlStream that hands the
+// messages sent on it to the test. The tunnel receives the messages
+// written to received, if it is set.
+type fakeControlStream struct {
+	sent     chan *cs.TunnelControlMessage
+	received chan *cs.TunnelControlMessage
+}
+
+func (f *fakeControlStream) Send(message *cs.TunnelControlMessage) error {
+	f.sent <- message
+	return nil
+}
+
+func (f *fakeControlStream) Recv() (*cs.TunnelControlMessage, error) {
+	if f.received == nil {
+		return nil, io.EOF
+	}
+	message, ok := <-f.received
+	if !ok {
+		return nil, io.EOF
+	}
+	return message, nil
+}
+
+// freePortRange returns the first of count consecutive ports that
+// are not in use on 127.0.0.1.
+func freePortRange(t *testing.T, count int) uint32 {
+	for attempt := 0; attempt < 20; attempt++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen failed: %s", err)
+		}
+		first := ln.Addr().(*net.TCPAddr).Port
+		ln.Close()
+
+		free := first+count <= 65536
+		for port := first; free && port < first+count; port++ {
+			probe, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(port))
+			if err != nil {
+				free = false
+				break
+			}
+			probe.Close()
+		}
+		if free {
+			return uint32(first)
+		}
+	}
+	t.Fatalf("no free port range found")
+	return 0
+}
+
+func TestTunnelListensOnPortRange(t *testing.T) {
+	first := freePortRange(t, 3)
+	tunnel := NewTunnel("test", TunnelDirectionForward,
+		net.IPv4(127, 0, 0, 1), first, net.IPv4(127, 0, 0, 1), 9000)
+	tunnel.SetPortCount(3)
+	stream := &fakeControlStream{sent: make(chan *cs.TunnelControlMessage, 1)}
+	tunnel.SetControlStream(stream)
+	if !tunnel.AddListener("client") {
+		t.Fatalf("AddListener failed: %s", tunnel.GetLastError())
+	}
+	defer tunnel.Stop()
+
+	for offset := uint32(0); offset < 3; offset++ {
+		conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(int(first+offset)))
+		if err != nil {
+			t.Fatalf("failed to connect to port %d: %s", first+offset, err)
+		}
+		defer conn.Close()
+
+		select {
+		case message := <-stream.sent:
+			if message.Operation != TunnelCtrlConnect || message.PortOffset != offset {
+				t.Errorf("port %d: message = %v; want connect with offset %d",
+					first+offset, message, offset)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("port %d: no connect message sent", first+offset)
+		}
+	}
+}
+
+func TestTunnelDialOutsideOfPortRange(t *testing.T) {
+	tunnel := NewTunnel("test", TunnelDirectionForward,
+		nil, 0, net.IPv4(127, 0, 0, 1), 9000)
+	tunnel.SetPortCount(2)
+
+	if _, _, err := tunnel.dial(2); err == nil {
+		t.Errorf("dial succeeded for an offset outside of the range")
+	}
+}
+
+func TestTunnelListenerWithoutControlStream(t *testing.T) {
+	port := freePortRange(t, 1)
+	tunnel := NewTunnel("test", TunnelDirectionReverse,
+		net.IPv4(127, 0, 0, 1), port, nil, 0)
+	if !tunnel.AddListener("client") {
+		t.Fatalf("AddListener failed: %s", tunnel.GetLastError())
+	}
+	defer tunnel.Stop()
+
+	// Connections that can not be reported on the control stream
+	// are closed, and so are refused ones
+	for _, limits := range []ListenerLimits{{}, {AllowedSources: []*net.IPNet{
+		{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)}}}} {
+		tunnel.SetListenerLimits(limits)
+		conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(int(port)))
+		if err != nil {
+			t.Fatalf("Dial failed: %s", err)
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("limits %v: read = %v; want EOF", limits, err)
+		}
+	}
+}
+
+// waitForConnections waits until the tunnel holds the provided
+// number of connections.
+func waitForConnections(t *testing.T, tunnel *Tunnel, want int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tunnel.mutex.Lock()
+		count := len(tunnel.connections)
+		tunnel.mutex.Unlock()
+		if count == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("tunnel holds %d connections; want %d", count, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// nextControlMessage returns the next message the tunnel sent on
+// its control stream.
+func nextControlMessage(t *testing.T, stream *fakeControlStream) *cs.TunnelControlMessage {
+	select {
+	case message := <-stream.sent:
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no control message sent")
+		return nil
+	}
+}
+
+func TestTunnelMaxConnectionsCountsOpenConnections(t *testing.T) {
+	port := freePortRange(t, 1)
+	tunnel := NewTunnel("test", TunnelDirectionReverse,
+		net.IPv4(127, 0, 0, 1), port, nil, 0)
+	tunnel.SetListenerLimits(ListenerLimits{MaxConnections: 2})
+	stream := &fakeControlStream{sent: make(chan *cs.TunnelControlMessage, 4)}
+	tunnel.SetControlStream(stream)
+	if !tunnel.AddListener("client") {
+		t.Fatalf("AddListener failed: %s", tunnel.GetLastError())
+	}
+	defer tunnel.Stop()
+	address := "127.0.0.1:" + strconv.Itoa(int(port))
+
+	// Connections that have closed make room for new ones
+	for round := 0; round < 3; round++ {
+		var conns []net.Conn
+		var peers []*pipeStream
+		for i := 0; i < 2; i++ {
+			conn, err := net.Dial("tcp", address)
+			if err != nil {
+				t.Fatalf("Dial failed: %s", err)
+			}
+			defer conn.Close()
+
+			message := nextControlMessage(t, stream)
+			if message.Operation != TunnelCtrlConnect {
+				t.Fatalf("round %d: connection %d was not reported: %v",
+					round, i, message)
+			}
+			s, peer := newPipeStreams()
+			gConn := tunnel.GetConnection(message.ConnectionId)
+			gConn.SetStream(s)
+			gConn.Start()
+			conns = append(conns, conn)
+			peers = append(peers, peer)
+		}
+
+		extra, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatalf("Dial failed: %s", err)
+		}
+		defer extra.Close()
+		if message := nextControlMessage(t, stream); message.Operation != TunnelCtrlReject {
+			t.Fatalf("round %d: connection over the maximum was not rejected: %v",
+				round, message)
+		}
+
+		// Both sides finish sending
+		for i, conn := range conns {
+			conn.Close()
+			peers[i].Send(&cs.BytesMessage{Operation: ByteStreamFin})
+		}
+		waitForConnections(t, tunnel, 0)
+	}
+}
+
+func TestTunnelCompressionSetWhileConnecting(t *testing.T) {
+	tunnel := NewTunnel("test", TunnelDirectionForward, nil, 0, nil, 0)
+
+	// The compression reply can arrive while connections are set up
+	done := make(chan struct{})
+	go func() {
+		tunnel.SetCompression(CompressionSnappy)
+		close(done)
+	}()
+	local, remote := Pipe()
+	defer local.Close()
+	tunnel.newConnection(remote).Close()
+	<-done
+
+	if got := tunnel.GetCompression(); got != CompressionSnappy {
+		t.Errorf("compression = %d; want %d", got, CompressionSnappy)
+	}
+}
+
+func TestTunnelDialsHostnameDestination(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer ln.Close()
+	port := uint32(ln.Addr().(*net.TCPAddr).Port)
+
+	tunnel := NewTunnel("test", TunnelDirectionForward, nil, 0, nil, port)
+	tunnel.SetDestinationHost("localhost")
+	conn, _, err := tunnel.dial(0)
+	if err != nil {
+		t.Fatalf("dial failed: %s", err)
+	}
+	defer conn.Close()
+	if ip, _ := AddrToIPPort(conn.RemoteAddr()); !ip.IsLoopback() {
+		t.Errorf("localhost connected to %s", conn.RemoteAddr())
+	}
+
+	// The policy is checked against the addresses the name resolves to
+	policy := NewPolicy()
+	loopback4, _ := NewPolicyRule(false, "127.0.0.0/8", "", 0, 0)
+	loopback6, _ := NewPolicyRule(false, "::1/128", "", 0, 0)
+	policy.SetRules([]*PolicyRule{loopback4, loopback6}, false)
+	tunnel.SetPolicy(policy)
+	if _, _, err := tunnel.dial(0); err == nil {
+		t.Errorf("dialed a hostname that resolves to a denied address")
+	} else if _, ok := err.(*PolicyError); !ok {
+		t.Errorf("dial error = %v; want a policy error", err)
+	}
+}
+
+func TestTunnelAcksUnresolvableHostname(t *testing.T) {
+	tunnel := NewTunnel("test", TunnelDirectionForward, nil, 0, nil, 80)
+	tunnel.SetDestinationHost("gtunnel-test.invalid")
+	stream := &fakeControlStream{
+		sent:     make(chan *cs.TunnelControlMessage, 1),
+		received: make(chan *cs.TunnelControlMessage, 1),
+	}
+	tunnel.SetControlStream(stream)
+	tunnel.Start()
+	defer close(stream.received)
+
+	stream.received <- &cs.TunnelControlMessage{
+		Operation:    TunnelCtrlConnect,
+		TunnelId:     "test",
+		ConnectionId: "conn",
+	}
+	ack := nextControlMessage(t, stream)
+	if ack.Operation != TunnelCtrlAck || ack.ErrorStatus == 0 ||
+		!strings.Contains(ack.ErrorMessage, "failed to resolve gtunnel-test.invalid") {
+		t.Errorf("ack = %v; want a resolution error", ack)
+	}
+}
+
+// linkedControlStreams returns two TunnelControlStreams that carry
+// messages to each other.
+func linkedControlStreams() (*fakeControlStream, *fakeControlStream) {
+	a := make(chan *cs.TunnelControlMessage, 16)
+	b := make(chan *cs.TunnelControlMessage, 16)
+	return &fakeControlStream{sent: a, received: b},
+		&fakeControlStream{sent: b, received: a}
+}
+
+// serverStreamHandler hands out the multiplexed streams the gClient
+// opens, as the gServer's connection handler does.
+type serverStreamHandler struct {
+	mux *MuxStream
+}
+
+func (h *serverStreamHandler) GetByteStream(tunnel *Tunnel,
+	ctrlMessage *cs.TunnelControlMessage) ByteStream {
+	return nil
+}
+
+func (h *serverStreamHandler) Acknowledge(tunnel *Tunnel,
+	ctrlMessage *cs.TunnelControlMessage) ByteStream {
+	conn := tunnel.GetConnection(ctrlMessage.ConnectionId)
+	<-conn.Connected
+	return conn.GetStream()
+}
+
+func (h *serverStreamHandler) CloseStream(tunnel *Tunnel, connID string) {
+	h.mux.Remove(tunnel.GetID(), connID)
+}
+
+// clientStreamHandler opens a multiplexed stream for each connection
+// it dials and acknowledges it, as the gClient's handler does.
+type clientStreamHandler struct {
+	muxStreamHandler
+}
+
+func (h *clientStreamHandler) GetByteStream(tunnel *Tunnel,
+	ctrlMessage *cs.TunnelControlMessage) ByteStream {
+	s := h.muxStreamHandler.GetByteStream(tunnel, ctrlMessage)
+	ctrlMessage.Operation = TunnelCtrlAck
+	tunnel.SendControlMessage(ctrlMessage)
+	return s
+}
+
+// linkTunnels starts the gServer and gClient ends of a tunnel and
+// carries their control messages and connections in memory.
+func linkTunnels(t *testing.T, server *Tunnel, client *Tunnel) {
+	serverCtrl, clientCtrl := linkedControlStreams()
+	left, right := newPipeStreams()
+	serverMux := NewMuxStream(left)
+	clientMux := NewMuxStream(right)
+	go clientMux.Run(nil)
+	go serverMux.Run(func(tunnelID string, connID string) {
+		if conn := server.GetConnection(connID); conn != nil {
+			conn.SetStream(serverMux.Open(tunnelID, connID))
+			close(conn.Connected)
+		}
+	})
+
+	server.ConnectionHandler = &serverStreamHandler{mux: serverMux}
+	client.ConnectionHandler = &clientStreamHandler{muxStreamHandler{mux: clientMux}}
+	server.SetControlStream(serverCtrl)
+	client.SetControlStream(clientCtrl)
+	server.Start()
+	client.Start()
+	t.Cleanup(func() {
+		server.Stop()
+		client.Stop()
+		close(serverCtrl.sent)
+		close(clientCtrl.sent)
+	})
+}
@@ -0,0 +1,171 @@
+package common
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// UDPSessionTimeout is the amount of time a UDP session can go
+// without traffic before it is closed.
+const UDPSessionTimeout = 60 * time.Second
+
+// UDPSessionBacklog is the number of datagrams queued for a UDP
+// session before further datagrams are dropped.
+const UDPSessionBacklog = 64
+
+// udpListener accepts datagrams on a single UDP socket and
+// demultiplexes them into a session per source address.
+type udpListener struct {
+	conn     *net.UDPConn
+	sessions map[string]*udpSession
+	mutex    sync.Mutex
+}
+
+// udpSession represents the datagrams exchanged with one
+// source address on a udpListener. It implements net.Conn
+// so that it can be carried by a Connection.
+type udpSession struct {
+	listener     *udpListener
+	remoteAddr   *net.UDPAddr
+	datagrams    chan []byte
+	done         chan bool
+	readDeadline time.Time
+	closeOnce    sync.Once
+	mutex        sync.Mutex
+}
+
+// newUDPListener will bind a UDP socket on the provided address.
+func newUDPListener(addr *net.UDPAddr) (*udpListener, error) {
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := new(udpListener)
+	l.conn = conn
+	l.sessions = make(map[string]*udpSession)
+	return l, nil
+}
+
+// Accept will return a session for the next source address
+// that sends a datagram to the listener.
+func (l *udpListener) Accept() (*udpSession, error) {
+	for {
+		bytes := make([]byte, MaxDatagramSize)
+		bytesRead, addr, err := l.conn.ReadFromUDP(bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		l.mutex.Lock()
+		session, ok := l.sessions[addr.String()]
+		if !ok {
+			session = new(udpSession)
+			session.listener = l
+			session.remoteAddr = addr
+			session.datagrams = make(chan []byte, UDPSessionBacklog)
+			session.done = make(chan bool)
+			l.sessions[addr.String()] = session
+		}
+		l.mutex.Unlock()
+
+		// Drop the datagram if the session is not keeping up
+		select {
+		case session.datagrams <- bytes[:bytesRead]:
+		default:
+		}
+
+		if !ok {
+			return session, nil
+		}
+	}
+}
+
+// Close will close the UDP socket and every session on it.
+func (l *udpListener) Close() error {
+	l.mutex.Lock()
+	sessions := make([]*udpSession, 0, len(l.sessions))
+	for _, session := range l.sessions {
+		sessions = append(sessions, session)
+	}
+	l.mutex.Unlock()
+
+	for _, session := range sessions {
+		session.Close()
+	}
+	return l.conn.Close()
+}
+
+// Read will copy the next datagram from the session's source
+// address into b.
+func (s *udpSession) Read(b []byte) (int, error) {
+	s.mutex.Lock()
+	deadline := s.readDeadline
+	s.mutex.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case datagram := <-s.datagrams:
+		return copy(b, datagram), nil
+	case <-s.done:
+		return 0, io.EOF
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+// Write will send b as a single datagram to the session's
+// source address.
+func (s *udpSession) Write(b []byte) (int, error) {
+	return s.listener.conn.WriteToUDP(b, s.remoteAddr)
+}
+
+// Close will remove the session from its listener.
+func (s *udpSession) Close() error {
+	s.closeOnce.Do(func() {
+		s.listener.mutex.Lock()
+		delete(s.listener.sessions, s.remoteAddr.String())
+		s.listener.mutex.Unlock()
+		close(s.done)
+	})
+	return nil
+}
+
+// LocalAddr returns the address of the listening socket.
+func (s *udpSession) LocalAddr() net.Addr {
+	return s.listener.conn.LocalAddr()
+}
+
+// RemoteAddr returns the source address of the session.
+func (s *udpSession) RemoteAddr() net.Addr {
+	return s.remoteAddr
+}
+
+// SetDeadline sets the read deadline for the session. Writes
+// never block.
+func (s *udpSession) SetDeadline(t time.Time) error {
+	return s.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for future Read calls.
+func (s *udpSession) SetReadDeadline(t time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.readDeadline = t
+	return nil
+}
+
+// SetWriteDeadline does nothing since writes never block.
+func (s *udpSession) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,100 @@
+package common
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPListenerSessionPerSource(t *testing.T) {
+	ln, err := newUDPListener(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer ln.Close()
+
+	addr := ln.conn.LocalAddr().(*net.UDPAddr)
+	first, _ := net.DialUDP("udp", nil, addr)
+	defer first.Close()
+	second, _ := net.DialUDP("udp", nil, addr)
+	defer second.Close()
+
+	first.Write([]byte("one"))
+	firstSession, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %s", err)
+	}
+
+	second.Write([]byte("two"))
+	secondSession, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %s", err)
+	}
+
+	buf := make([]byte, MaxDatagramSize)
+	n, _ := firstSession.Read(buf)
+	if string(buf[:n]) != "one" {
+		t.Errorf("first session read %s; want one", buf[:n])
+	}
+	n, _ = secondSession.Read(buf)
+	if string(buf[:n]) != "two" {
+		t.Errorf("second session read %s; want two", buf[:n])
+	}
+
+	secondSession.Write([]byte("reply"))
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	n, err = second.Read(buf)
+	if err != nil || string(buf[:n]) != "reply" {
+		t.Errorf("reply = %s, %v; want reply", buf[:n], err)
+	}
+}
+
+func TestUDPSessionReadDeadline(t *testing.T) {
+	ln, err := newUDPListener(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer ln.Close()
+
+	client, _ := net.DialUDP("udp", nil, ln.conn.LocalAddr().(*net.UDPAddr))
+	defer client.Close()
+	client.Write([]byte("ping"))
+
+	session, _ := ln.Accept()
+	buf := make([]byte, MaxDatagramSize)
+	session.Read(buf)
+
+	session.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err = session.Read(buf)
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Errorf("Read after deadline = %v; want timeout", err)
+	}
+}
+
+func TestUDPConnectionSendsFirstDatagram(t *testing.T) {
+	ln, err := newUDPListener(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	defer ln.Close()
+
+	client, _ := net.DialUDP("udp", nil, ln.conn.LocalAddr().(*net.UDPAddr))
+	defer client.Close()
+	client.Write([]byte("query"))
+	session, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %s", err)
+	}
+
+	// No credit is ever sent by the peer
+	stream, peer := newPipeStreams()
+	conn := NewConnection(session)
+	conn.SetStream(stream)
+	conn.Start()
+	defer conn.Close()
+
+	m := recvData(t, peer)
+	if m == nil || string(m.Content) != "query" {
+		t.Errorf("first datagram = %v; want query", m)
+	}
+}
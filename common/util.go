@@ -1,12 +1,18 @@
 package common
 
 import (
+	cryptorand "crypto/rand"
 	"encoding/binary"
+	"math/big"
 	"math/rand"
 	"net"
 	"time"
 )
 
+// CredentialSize is the constant used for the string size
+// of a generated username or password
+const CredentialSize = 16
+
 // ClientIDSize is the constant used for the string size
 // of a generated client ID
 const ClientIDSize = 8
@@ -15,6 +21,18 @@ const ClientIDSize = 8
 // of a generated tunnel ID
 const TunnelIDSize = 8
 
+// SocksIDSize is the constant used for the string size
+// of a generated socks proxy ID
+const SocksIDSize = 8
+
+// HTTPProxyIDSize is the constant used for the string size
+// of a generated http proxy ID
+const HTTPProxyIDSize = 8
+
+// RequestIDSize is the constant used for the string size
+// of a generated endpoint control request ID
+const RequestIDSize = 8
+
 // GenerateString will generate a random string of length
 // Credit to: https://www.calhoun.io/creating-random-strings-in-go/
 func GenerateString(length int) string {
@@ -30,6 +48,35 @@ func GenerateString(length int) string {
 	return string(b)
 }
 
+// GenerateCredential will generate a random string of length
+// that is suitable for use as a password.
+func GenerateCredential(length int) string {
+	const charset = "abcdefghijklmnopqrstuvwxyz" +
+		"ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	max := big.NewInt(int64(len(charset)))
+
+	b := make([]byte, length)
+	for i := range b {
+		n, err := cryptorand.Int(cryptorand.Reader, max)
+		if err != nil {
+			panic(err)
+		}
+		b[i] = charset[n.Int64()]
+	}
+	return string(b)
+}
+
+// AddrToIPPort returns the IP and port of a TCP or UDP address.
+func AddrToIPPort(addr net.Addr) (net.IP, uint32) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, uint32(a.Port)
+	case *net.UDPAddr:
+		return a.IP, uint32(a.Port)
+	}
+	return net.IPv4zero, 0
+}
+
 // Int32ToIP converts a uint32 to a net.IP
 func Int32ToIP(i uint32) net.IP {
 	ip := make(net.IP, 4)
@@ -37,11 +84,32 @@ func Int32ToIP(i uint32) net.IP {
 	return ip
 }
 
-// IpToInt32 converts a net.IP to a uint32
+// IpToInt32 converts a net.IP to a uint32. IPv6 addresses
+// cannot be represented and are converted to 0.
 // Credit to https://gist.github.com/ammario/ipint.go
 func IpToInt32(ip net.IP) uint32 {
-	if len(ip) == 16 {
-		return binary.BigEndian.Uint32(ip[12:16])
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(ip4)
+}
+
+// BytesToIP converts an address from the wire format into a net.IP.
+// Older peers only send the IPv4 uint32 form of an address, which
+// is used when the bytes form is empty.
+func BytesToIP(b []byte, ipv4 uint32) net.IP {
+	if len(b) == net.IPv4len || len(b) == net.IPv6len {
+		return net.IP(b)
+	}
+	return Int32ToIP(ipv4)
+}
+
+// IPToBytes converts a net.IP into the wire format, which is 4
+// bytes for IPv4 addresses and 16 bytes for IPv6 addresses.
+func IPToBytes(ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
 	}
-	return binary.BigEndian.Uint32(ip)
+	return ip.To16()
 }
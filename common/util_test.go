@@ -0,0 +1,38 @@
+package common
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIPToBytesRoundTrip(t *testing.T) {
+	for _, address := range []string{"10.1.2.3", "::ffff:10.1.2.3", "fe80::1", "2001:db8::10"} {
+		ip := net.ParseIP(address)
+		got := BytesToIP(IPToBytes(ip), 0)
+		if !got.Equal(ip) {
+			t.Errorf("BytesToIP(IPToBytes(%s)) = %s", address, got)
+		}
+	}
+}
+
+func TestIPToBytesLength(t *testing.T) {
+	if got := len(IPToBytes(net.ParseIP("::ffff:10.1.2.3"))); got != net.IPv4len {
+		t.Errorf("mapped IPv4 length = %d; want %d", got, net.IPv4len)
+	}
+	if got := len(IPToBytes(net.ParseIP("2001:db8::10"))); got != net.IPv6len {
+		t.Errorf("IPv6 length = %d; want %d", got, net.IPv6len)
+	}
+}
+
+func TestBytesToIPLegacy(t *testing.T) {
+	got := BytesToIP(nil, IpToInt32(net.ParseIP("192.168.1.1")))
+	if !got.Equal(net.ParseIP("192.168.1.1")) {
+		t.Errorf("BytesToIP(nil, legacy) = %s; want 192.168.1.1", got)
+	}
+}
+
+func TestIpToInt32IPv6(t *testing.T) {
+	if got := IpToInt32(net.ParseIP("2001:db8::10")); got != 0 {
+		t.Errorf("IpToInt32(IPv6) = %d; want 0", got)
+	}
+}
@@ -19,6 +19,7 @@ func GenerateClient(
 	binType string,
 	arch string,
 	proxyServer string,
+	multiplex bool,
 	outputFile string) error {
 
 	token, err := common.GenerateToken()
@@ -44,12 +45,12 @@ func GenerateClient(
 	var loaderFlags = ""
 
 	if platform == "win" {
-		loaderFlags = "-extldflags \"-static\" -s -w -X main.clientToken=%s -X main.serverAddress=%s -X main.serverPort=%d -X main.httpsProxyServer=%s"
+		loaderFlags = "-extldflags \"-static\" -s -w -X main.clientToken=%s -X main.serverAddress=%s -X main.serverPort=%d -X main.httpsProxyServer=%s -X main.multiplexConnections=%t"
 	} else {
-		loaderFlags = "-s -w -X main.clientToken=%s -X main.serverAddress=%s -X main.serverPort=%d -X main.httpsProxyServer=%s"
+		loaderFlags = "-s -w -X main.clientToken=%s -X main.serverAddress=%s -X main.serverPort=%d -X main.httpsProxyServer=%s -X main.multiplexConnections=%t"
 	}
 
-	flagString := fmt.Sprintf(loaderFlags, token, serverAddress, serverPort, proxyServer)
+	flagString := fmt.Sprintf(loaderFlags, token, serverAddress, serverPort, proxyServer, multiplex)
 	var commands []string
 
 	commands = append(commands, "build")
@@ -122,6 +123,9 @@ func main() {
 
 	proxyServer := flag.String("proxy", "", "A proxy server that the client will call through. Empty by default")
 
+	multiplex := flag.Bool("multiplex", true,
+		"Carry all TCP connections over a single gRPC stream instead of one stream per connection")
+
 	flag.Parse()
 
 	platforms := []string{"win", "mac", "linux"}
@@ -167,5 +171,6 @@ func main() {
 		*binType,
 		*arch,
 		*proxyServer,
+		*multiplex,
 		*outputFile)
 }
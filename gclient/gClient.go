@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sync"
+	"time"
 
 	cs "github.com/hotnops/gTunnel/grpc/client"
 	"github.com/segmentio/ksuid"
@@ -21,6 +23,11 @@ var httpProxyServer = ""
 var httpsProxyServer = ""
 var serverAddress = "UNCONFIGURED"
 var serverPort = "" // This needs to be a string to be used with -X
+var multiplexConnections = "true"
+
+// muxRetryDelay is how long the client waits before replacing a
+// multiplexed stream that failed.
+const muxRetryDelay = time.Second
 
 // ClientStreamHandler manages the context and grpc client for
 // a given TCP stream.
@@ -28,16 +35,21 @@ type ClientStreamHandler struct {
 	client     cs.ClientServiceClient
 	gCtx       context.Context
 	ctrlStream common.TunnelControlStream
+	gClient    *gClient
 }
 
 // gClient is a structure that represents a unique gClient
 type gClient struct {
-	endpoint    *common.Endpoint
-	ctrlStream  cs.ClientService_CreateEndpointControlStreamClient
-	grpcClient  cs.ClientServiceClient
-	killClient  chan bool
-	gCtx        context.Context
-	socksServer *common.SocksServer
+	endpoint       *common.Endpoint
+	ctrlStream     cs.ClientService_CreateEndpointControlStreamClient
+	ackStream      cs.ClientService_CreateEndpointAckStreamClient
+	proxyLogStream cs.ClientService_CreateProxyLogStreamClient
+	proxyLogMutex  sync.Mutex
+	grpcClient     cs.ClientServiceClient
+	killClient     chan bool
+	gCtx           context.Context
+	mux            *common.MuxStream
+	muxMutex       sync.Mutex
 }
 
 // Acknowledge is called to indicate that the TCP connection has been
@@ -47,35 +59,125 @@ func (c *ClientStreamHandler) Acknowledge(tunnel *common.Tunnel,
 	return c.GetByteStream(tunnel, ctrlMessage)
 }
 
-// CloseStream does nothing.
-func (c *ClientStreamHandler) CloseStream(tunnel *common.Tunnel, connID string) {}
+// CloseStream is called once a connection has closed. A
+// multiplexed connection is removed from the mux, which ends its
+// pending Recv. Connections with their own stream have nothing
+// to release.
+func (c *ClientStreamHandler) CloseStream(tunnel *common.Tunnel, connID string) {
+	if mux := c.gClient.getMux(); mux != nil {
+		mux.Remove(tunnel.GetID(), connID)
+	}
+}
 
 // GetByteStream is responsible for returning a bi-directional gRPC
 // stream that will be used for relaying TCP data.
 func (c *ClientStreamHandler) GetByteStream(tunnel *common.Tunnel,
 	ctrlMessage *cs.TunnelControlMessage) common.ByteStream {
 
-	stream, err := c.client.CreateConnectionStream(c.gCtx)
-	if err != nil {
-		return nil
-	}
+	var stream common.ByteStream
 
-	// Once byte stream is open, send an initial message
-	// with all the appropriate IDs
-	bytesMessage := new(cs.BytesMessage)
-	bytesMessage.TunnelId = ctrlMessage.TunnelId
-	bytesMessage.ConnectionId = ctrlMessage.ConnectionId
+	if mux := c.gClient.getMux(); mux != nil {
+		muxStream, err := mux.Connect(ctrlMessage.TunnelId,
+			ctrlMessage.ConnectionId)
+		if err != nil {
+			return nil
+		}
+		stream = muxStream
+	} else {
+		connStream, err := c.client.CreateConnectionStream(c.gCtx)
+		if err != nil {
+			return nil
+		}
 
-	stream.Send(bytesMessage)
+		// Once byte stream is open, send an initial message
+		// with all the appropriate IDs
+		bytesMessage := new(cs.BytesMessage)
+		bytesMessage.TunnelId = ctrlMessage.TunnelId
+		bytesMessage.ConnectionId = ctrlMessage.ConnectionId
+
+		connStream.Send(bytesMessage)
+		stream = connStream
+	}
 
 	// Lastly, forward the control message to the
 	// server to indicate we have acknowledged the connection
 	ctrlMessage.Operation = common.TunnelCtrlAck
-	c.ctrlStream.Send(ctrlMessage)
+	tunnel.SendControlMessage(ctrlMessage)
 
 	return stream
 }
 
+// acknowledge will report the result of an endpoint control
+// message back to the server.
+func (c *gClient) acknowledge(message *cs.EndpointControlMessage, err error) {
+	ack := new(cs.EndpointControlMessage)
+	ack.Operation = common.EndpointCtrlAck
+	ack.RequestId = message.RequestId
+	ack.TunnelId = message.TunnelId
+	ack.SocksId = message.SocksId
+	ack.HttpProxyId = message.HttpProxyId
+	if err != nil {
+		ack.ErrorStatus = 1
+		ack.ErrorMessage = err.Error()
+	}
+	c.ackStream.Send(ack)
+}
+
+// getMux returns the stream that multiplexes the client's
+// connections, or nil if each connection opens its own stream.
+func (c *gClient) getMux() *common.MuxStream {
+	c.muxMutex.Lock()
+	defer c.muxMutex.Unlock()
+
+	return c.mux
+}
+
+// runMux will run the multiplexed stream until it fails and then
+// open a new one. The connections it carried are closed. If a new
+// stream can not be opened, connections fall back to opening their
+// own streams.
+func (c *gClient) runMux(mux *common.MuxStream) {
+	for {
+		mux.Run(nil)
+		if c.gCtx.Err() != nil {
+			return
+		}
+
+		time.Sleep(muxRetryDelay)
+		muxStream, err := c.grpcClient.CreateMultiplexStream(c.gCtx)
+		c.muxMutex.Lock()
+		if err != nil {
+			c.mux = nil
+			c.muxMutex.Unlock()
+			return
+		}
+		mux = common.NewMuxStream(muxStream)
+		c.mux = mux
+		c.muxMutex.Unlock()
+	}
+}
+
+// logProxyRequest will report a request made through one of
+// the client's proxies to the server.
+func (c *gClient) logProxyRequest(request *common.ProxyRequest) {
+	message := new(cs.ProxyRequestMessage)
+	message.ProxyId = request.ProxyID
+	message.Protocol = request.Protocol
+	message.Command = request.Command
+	message.Source = request.Source
+	message.Host = request.Host
+	message.ResolvedAddress = request.ResolvedAddress
+	message.BytesSent = request.BytesSent
+	message.BytesReceived = request.BytesReceived
+	message.StartTime = request.StartTime.UnixNano()
+	message.Duration = int64(request.Duration)
+	message.ErrorMessage = request.Error
+
+	c.proxyLogMutex.Lock()
+	defer c.proxyLogMutex.Unlock()
+	c.proxyLogStream.Send(message)
+}
+
 // receiveClientControlMessages is responsible for reading
 // all control messages and dealing with them appropriately.
 func (c *gClient) receiveClientControlMessages() {
@@ -107,20 +209,55 @@ func (c *gClient) receiveClientControlMessages() {
 
 				newTunnel := common.NewTunnel(message.TunnelId,
 					uint32(direction),
-					common.Int32ToIP(message.ListenIp),
+					common.BytesToIP(message.ListenAddress, message.ListenIp),
 					message.ListenPort,
-					common.Int32ToIP(message.DestinationIp),
+					common.BytesToIP(message.DestinationAddress, message.DestinationIp),
 					message.DestinationPort)
 
+				newTunnel.SetProtocol(message.Protocol)
+				newTunnel.SetDestinationHost(message.DestinationHost)
+				newTunnel.SetDynamic(message.Dynamic)
+				newTunnel.SetPortCount(message.PortCount)
+				if direction == common.TunnelDirectionForward {
+					newTunnel.SetPolicy(c.endpoint.GetPolicy())
+					if destinations := common.NewDestinationSetFromMessage(message); destinations != nil {
+						newTunnel.SetDestinations(destinations)
+					}
+				}
+
+				// Agree to the server's compression if we support it
+				if common.SupportsCompression(message.Compression) {
+					newTunnel.SetCompression(message.Compression)
+				}
+
+				// A window of 0 means the server turned flow
+				// control off for the tunnel
+				newTunnel.SetReceiveWindow(message.ReceiveWindow)
+
 				f := new(ClientStreamHandler)
 				f.client = c.grpcClient
 				f.gCtx = c.gCtx
+				f.gClient = c
 
 				if direction == common.TunnelDirectionReverse {
-					newTunnel.AddListener(c.endpoint.Id)
+					sources, err := common.ParseSources(message.AllowedSources)
+					if err != nil {
+						c.acknowledge(message, err)
+						continue
+					}
+					newTunnel.SetListenerLimits(common.ListenerLimits{
+						AllowedSources: sources,
+						MaxConnections: message.MaxConnections,
+						MaxAcceptRate:  message.MaxAcceptRate,
+					})
 				}
 
-				tStream, _ := c.grpcClient.CreateTunnelControlStream(c.gCtx)
+				tStream, err := c.grpcClient.CreateTunnelControlStream(c.gCtx)
+				if err != nil {
+					newTunnel.Stop()
+					c.acknowledge(message, err)
+					continue
+				}
 
 				// Once we have the control stream, set it in our client handler
 				f.ctrlStream = tStream
@@ -131,31 +268,109 @@ func (c *gClient) receiveClientControlMessages() {
 				// to let the server know the ID specifics
 				tMsg := new(cs.TunnelControlMessage)
 				tMsg.TunnelId = message.TunnelId
+				tMsg.Compression = newTunnel.GetCompression()
 				tStream.Send(tMsg)
 
+				// Connections are only accepted once they can be
+				// reported on the control stream
+				if direction == common.TunnelDirectionReverse &&
+					!newTunnel.AddListener(c.endpoint.Id) {
+					tStream.CloseSend()
+					newTunnel.Stop()
+					c.acknowledge(message, fmt.Errorf("failed to listen on port %d: %s",
+						message.ListenPort, newTunnel.GetLastError()))
+					continue
+				}
+
 				c.endpoint.AddTunnel(message.TunnelId, newTunnel)
 				newTunnel.Start()
+				c.acknowledge(message, nil)
 
 			} else if operation == common.EndpointCtrlDeleteTunnel {
-				c.endpoint.StopAndDeleteTunnel(message.TunnelId)
+				var err error
+				if !c.endpoint.StopAndDeleteTunnel(message.TunnelId) {
+					err = fmt.Errorf("tunnel does not exist: %s", message.TunnelId)
+				}
+				c.acknowledge(message, err)
 			} else if operation == common.EndpointCtrlSocksProxy {
-				message.Operation = common.EndpointCtrlSocksProxyAck
-				message.ErrorStatus = 0
-				if c.socksServer != nil {
-					message.ErrorStatus = 1
+				if _, ok := c.endpoint.GetSocksServer(message.SocksId); ok {
+					c.acknowledge(message, fmt.Errorf("socks proxy already exists: %s",
+						message.SocksId))
+					continue
 				}
 
-				c.socksServer = common.NewSocksServer(message.ListenPort)
-				if !c.socksServer.Start() {
-					message.ErrorStatus = 2
+				socksServer := common.NewSocksServer(message.SocksId,
+					message.ListenPort)
+				socksServer.SetCredentials(message.Username, message.Password)
+				socksServer.SetRequestLog(c.logProxyRequest)
+				socksServer.SetPolicy(c.endpoint.GetPolicy())
+				if len(message.ListenAddress) > 0 {
+					socksServer.SetBindAddress(
+						common.BytesToIP(message.ListenAddress, 0))
+				}
+				if !socksServer.Start() {
+					c.acknowledge(message, fmt.Errorf("failed to listen on port: %d",
+						message.ListenPort))
+					continue
 				}
-				//c.ctrlStream.SendMsg(message)
+				c.endpoint.AddSocksServer(message.SocksId, socksServer)
+				c.acknowledge(message, nil)
 			} else if operation == common.EndpointCtrlSocksKill {
-				if c.socksServer != nil {
-					c.socksServer.Stop()
-					c.socksServer = nil
+				var err error
+				if !c.endpoint.StopAndDeleteSocksServer(message.SocksId) {
+					err = fmt.Errorf("socks proxy does not exist: %s", message.SocksId)
+				}
+				c.acknowledge(message, err)
+			} else if operation == common.EndpointCtrlHTTPProxy {
+				if _, ok := c.endpoint.GetHTTPProxy(message.HttpProxyId); ok {
+					c.acknowledge(message, fmt.Errorf("http proxy already exists: %s",
+						message.HttpProxyId))
+					continue
+				}
+
+				proxyServer := common.NewHTTPProxyServer(message.HttpProxyId,
+					message.ListenPort)
+				proxyServer.SetCredentials(message.Username, message.Password)
+				proxyServer.SetRequestLog(c.logProxyRequest)
+				proxyServer.SetPolicy(c.endpoint.GetPolicy())
+				if len(message.ListenAddress) > 0 {
+					proxyServer.SetBindAddress(
+						common.BytesToIP(message.ListenAddress, 0))
+				}
+				if !proxyServer.Start() {
+					c.acknowledge(message, fmt.Errorf("failed to listen on port: %d",
+						message.ListenPort))
+					continue
+				}
+				c.endpoint.AddHTTPProxy(message.HttpProxyId, proxyServer)
+				c.acknowledge(message, nil)
+			} else if operation == common.EndpointCtrlHTTPProxyKill {
+				var err error
+				if !c.endpoint.StopAndDeleteHTTPProxy(message.HttpProxyId) {
+					err = fmt.Errorf("http proxy does not exist: %s", message.HttpProxyId)
+				}
+				c.acknowledge(message, err)
+			} else if operation == common.EndpointCtrlPolicy {
+				var rules []*common.PolicyRule
+				var err error
+				for _, ruleMessage := range message.PolicyRules {
+					var rule *common.PolicyRule
+					if rule, err = common.NewPolicyRuleFromMessage(ruleMessage); err != nil {
+						break
+					}
+					rules = append(rules, rule)
+				}
+				if err == nil {
+					c.endpoint.GetPolicy().SetRules(rules, message.PolicyDefaultDeny)
 				}
+				c.acknowledge(message, err)
 			} else if operation == common.EndpointCtrlDisconnect {
+				c.acknowledge(message, nil)
+				// Wait for the acknowledgement to be delivered
+				c.ackStream.CloseAndRecv()
+				c.proxyLogMutex.Lock()
+				c.proxyLogStream.CloseAndRecv()
+				c.proxyLogMutex.Unlock()
 				close(c.killClient)
 			}
 
@@ -190,7 +405,6 @@ func gclient_main() {
 	gClient := new(gClient)
 	gClient.endpoint = common.NewEndpoint()
 	gClient.killClient = make(chan bool)
-	gClient.socksServer = nil
 
 	serverAddr := fmt.Sprintf("%s:%s", serverAddress, serverPort)
 
@@ -214,12 +428,34 @@ func gclient_main() {
 	}
 
 	conMsg := new(cs.EndpointControlMessage)
+	conMsg.Capabilities = common.SupportedCapabilities
 	gClient.ctrlStream, err = gClient.grpcClient.CreateEndpointControlStream(gClient.gCtx, conMsg)
 
 	if err != nil {
 		return
 	}
 
+	gClient.ackStream, err = gClient.grpcClient.CreateEndpointAckStream(gClient.gCtx)
+
+	if err != nil {
+		return
+	}
+
+	gClient.proxyLogStream, err = gClient.grpcClient.CreateProxyLogStream(gClient.gCtx)
+
+	if err != nil {
+		return
+	}
+
+	if multiplexConnections == "true" {
+		muxStream, err := gClient.grpcClient.CreateMultiplexStream(gClient.gCtx)
+		if err != nil {
+			return
+		}
+		gClient.mux = common.NewMuxStream(muxStream)
+		go gClient.runMux(gClient.mux)
+	}
+
 	go gClient.receiveClientControlMessages()
 	<-gClient.killClient
 }
@@ -8,6 +8,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/hotnops/gTunnel/common"
 	"github.com/hotnops/gTunnel/gserver/gserverlib"
 )
 
@@ -18,6 +19,14 @@ var (
 	clientPort = flag.Int("clientPort", 443, "The server port")
 	adminPort  = flag.Int("adminPort", 1337, "The server port")
 	logfile    = flag.String("logFile", "", "The file where log output will be written")
+	window     = flag.Int("receiveWindow", common.DefaultReceiveWindow,
+		"The maximum number of bytes buffered for each direction of a tunneled connection. 0 turns flow control off")
+	bandwidth = flag.Uint64("bandwidthLimit", 0,
+		"The server wide limit in bytes per second for tunneled traffic. 0 is unlimited")
+	captureDir = flag.String("captureDir", gserverlib.DefaultCaptureDir,
+		"The directory where pcapng files of captured tunnel traffic are written")
+	recordDir = flag.String("recordDir", "",
+		"The directory of the append-only store every tunneled connection is recorded to. Recording is off if empty")
 )
 
 // What it do
@@ -26,6 +35,14 @@ func main() {
 
 	var filePath = ""
 	s := gserverlib.NewGServer()
+	s.SetReceiveWindow(uint32(*window))
+	s.SetBandwidthLimit("", "", *bandwidth)
+	s.SetCaptureDir(*captureDir)
+	if *recordDir != "" {
+		if err := s.SetRecordDir(*recordDir); err != nil {
+			log.Fatalf("[!] Failed to open the recording store: %s", err)
+		}
+	}
 
 	if *logfile == "" {
 		time := strings.ReplaceAll(time.Now().UTC().String(), " ", "")
@@ -1,10 +1,14 @@
 package gserverlib
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"sort"
+	"time"
 
 	"github.com/hotnops/gTunnel/common"
 	as "github.com/hotnops/gTunnel/grpc/admin"
@@ -29,6 +33,78 @@ func NewAdminServiceServer(gServer *GServer) *AdminServiceServer {
 	return adminServer
 }
 
+// BandwidthLimitSet will set the bandwidth limit for a tunnel, a client,
+// or the whole server.
+func (s *AdminServiceServer) BandwidthLimitSet(ctx context.Context,
+	req *as.BandwidthLimitSetRequest) (
+	*as.BandwidthLimitSetResponse, error) {
+	log.Printf("[*] BandwidthLimitSet called")
+
+	err := s.gServer.SetBandwidthLimit(req.ClientId, req.TunnelId,
+		req.BytesPerSecond)
+
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, err.Error())
+	}
+
+	return new(as.BandwidthLimitSetResponse), nil
+}
+
+// CaptureStart will start recording the traffic of a tunnel, or of
+// one of its connections, to a pcapng file on the server.
+func (s *AdminServiceServer) CaptureStart(ctx context.Context,
+	req *as.CaptureStartRequest) (*as.CaptureStartResponse, error) {
+	log.Printf("[*] CaptureStart called")
+
+	endpoint, ok := s.gServer.GetEndpoint(req.ClientId)
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument,
+			fmt.Sprintf("Client_ID %s does not exist", req.ClientId))
+	}
+
+	tunnel, ok := endpoint.GetTunnel(req.TunnelId)
+	if !ok {
+		return nil, status.Error(codes.NotFound,
+			fmt.Sprintf("Tunnel %s does not exist", req.TunnelId))
+	}
+
+	var connection *common.Connection
+	if req.ConnectionId != "" {
+		if connection = tunnel.GetConnection(req.ConnectionId); connection == nil {
+			return nil, status.Error(codes.NotFound,
+				fmt.Sprintf("Connection %s does not exist", req.ConnectionId))
+		}
+	}
+
+	capture, err := s.gServer.captures.Start(tunnel, connection)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, err.Error())
+	}
+
+	resp := new(as.CaptureStartResponse)
+	resp.CaptureId = capture.GetID()
+	resp.Path = capture.GetPath()
+	return resp, nil
+}
+
+// CaptureStop will stop a capture and close its pcapng file.
+func (s *AdminServiceServer) CaptureStop(ctx context.Context,
+	req *as.CaptureStopRequest) (*as.CaptureStopResponse, error) {
+	log.Printf("[*] CaptureStop called")
+
+	capture, err := s.gServer.captures.Stop(req.CaptureId)
+	if capture == nil {
+		return nil, status.Errorf(codes.NotFound, err.Error())
+	} else if err != nil {
+		return nil, status.Errorf(codes.Internal, err.Error())
+	}
+
+	resp := new(as.CaptureStopResponse)
+	resp.Path = capture.GetPath()
+	resp.Packets, resp.Bytes = capture.GetStats()
+	return resp, nil
+}
+
 // ClientRegister will create a gClient binary and send it back in a binary stream.
 func (s *AdminServiceServer) ClientRegister(ctx context.Context, req *as.ClientRegisterRequest) (
 	*as.ClientRegisterResponse, error) {
@@ -57,7 +133,11 @@ func (s *AdminServiceServer) ClientDisconnect(ctx context.Context, req *as.Clien
 
 	id := req.ClientId
 
-	s.gServer.DisconnectEndpoint(id)
+	err := s.gServer.DisconnectEndpoint(id)
+
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, err.Error())
+	}
 
 	resp := new(as.ClientDisconnectResponse)
 
@@ -84,6 +164,13 @@ func (s *AdminServiceServer) ClientList(req *as.ClientListRequest,
 		resp.RemoteAddress = client.remoteAddr
 		resp.Hostname = client.hostname
 		resp.ConnectDate = client.connectDate.String()
+		resp.BandwidthLimit = client.bandwidthLimit.GetLimit()
+		resp.BytesRx = client.endpoint.GetStats().GetBytesRx()
+		resp.BytesTx = client.endpoint.GetStats().GetBytesTx()
+		resp.HopPath = client.hops
+		if len(client.hops) != 0 {
+			resp.ParentId = client.hops[len(client.hops)-1]
+		}
 		stream.Send(resp)
 	}
 
@@ -117,22 +204,58 @@ func (s *AdminServiceServer) ConnectionList(req *as.ConnectionListRequest,
 
 	if len(connections) == 0 {
 		return status.Errorf(codes.OutOfRange,
-			fmt.Sprint("no connections exist for tunnel %s", tunnelID))
+			fmt.Sprintf("no connections exist for tunnel %s", tunnelID))
 	}
 
 	for _, connection := range connections {
 		newCon := new(as.Connection)
-		sourceIP := connection.TCPConn.LocalAddr().(*net.TCPAddr).IP
-		destIP := connection.TCPConn.RemoteAddr().(*net.TCPAddr).IP
+		newCon.Id = connection.ID
+		sourceIP, sourcePort := common.AddrToIPPort(connection.Conn.LocalAddr())
+		destIP, destPort := common.AddrToIPPort(connection.Conn.RemoteAddr())
 		newCon.SourceIp = common.IpToInt32(sourceIP)
-		newCon.SourcePort = uint32(connection.TCPConn.LocalAddr().(*net.TCPAddr).Port)
+		newCon.SourceAddress = common.IPToBytes(sourceIP)
+		newCon.SourcePort = sourcePort
 		newCon.DestinationIp = common.IpToInt32(destIP)
-		newCon.DestinationPort = uint32(connection.TCPConn.RemoteAddr().(*net.TCPAddr).Port)
+		newCon.DestinationAddress = common.IPToBytes(destIP)
+		newCon.DestinationPort = destPort
+		newCon.ReceiveWindow = connection.GetReceiveWindow()
+		newCon.SendCredit = connection.GetSendCredit()
+		newCon.BytesRx = connection.GetStats().GetBytesRx()
+		newCon.BytesTx = connection.GetStats().GetBytesTx()
+		newCon.StartTime = connection.GetStartTime().Format(time.RFC3339)
+		newCon.LastActivity = connection.GetLastActivity().Format(time.RFC3339)
 		stream.Send(newCon)
 	}
 	return nil
 }
 
+// proxyCredentials returns the credentials a proxy should require,
+// generating whatever was not supplied unless authentication is
+// disabled.
+func proxyCredentials(username string, password string,
+	noAuth bool) (string, string) {
+
+	if noAuth {
+		return "", ""
+	}
+	if username == "" {
+		username = common.GenerateCredential(common.CredentialSize)
+	}
+	if password == "" {
+		password = common.GenerateCredential(common.CredentialSize)
+	}
+	return username, password
+}
+
+// bytesToBindAddress converts the bind address of a proxy request,
+// where an empty address means the default.
+func bytesToBindAddress(b []byte) net.IP {
+	if len(b) == 0 {
+		return nil
+	}
+	return common.BytesToIP(b, 0)
+}
+
 // SocksStart will start a Socksv5 proxy server on the provided client ID
 func (s *AdminServiceServer) SocksStart(ctx context.Context,
 	req *as.SocksStartRequest) (
@@ -141,25 +264,33 @@ func (s *AdminServiceServer) SocksStart(ctx context.Context,
 
 	clientID := req.ClientId
 	socksPort := req.SocksPort
+	username, password := proxyCredentials(req.Username, req.Password,
+		req.NoAuth)
+	bindAddress := bytesToBindAddress(req.BindAddress)
 
-	err := s.gServer.StartProxy(clientID, socksPort)
+	socksID, err := s.gServer.StartProxy(clientID, req.SocksId, socksPort,
+		req.ClientSide, bindAddress, username, password)
 
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, err.Error())
 	}
 
-	return new(as.SocksStartResponse), nil
+	resp := new(as.SocksStartResponse)
+	resp.Username = username
+	resp.Password = password
+	resp.SocksId = socksID
+	return resp, nil
 }
 
 // SocksStop will stop a SocksV5 proxy server running on the provided client ID.
 func (s *AdminServiceServer) SocksStop(ctx context.Context,
 	req *as.SocksStopRequest) (
 	*as.SocksStopResponse, error) {
-	log.Printf("[*] SocksStart called")
+	log.Printf("[*] SocksStop called")
 
 	clientID := req.ClientId
 
-	err := s.gServer.StopProxy(clientID)
+	err := s.gServer.StopProxy(clientID, req.SocksId)
 
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, err.Error())
@@ -168,6 +299,388 @@ func (s *AdminServiceServer) SocksStop(ctx context.Context,
 	return new(as.SocksStopResponse), nil
 }
 
+// SocksList will list all socks servers for the provided client ID.
+func (s *AdminServiceServer) SocksList(req *as.SocksListRequest,
+	stream as.AdminService_SocksListServer) error {
+	log.Printf("[*] SocksList called")
+
+	clientID := req.ClientId
+
+	endpoint, ok := s.gServer.GetEndpoint(clientID)
+	if !ok {
+		return status.Error(codes.InvalidArgument,
+			fmt.Sprintf("Client_ID %s does not exist", clientID))
+	}
+
+	for id, socksServer := range endpoint.GetSocksServers() {
+		newSocks := new(as.Socks)
+		newSocks.Id = id
+		newSocks.Port = socksServer.GetPort()
+		newSocks.BindAddress = common.IPToBytes(socksServer.GetBindAddress())
+		newSocks.ClientSide = socksServer.IsRemote()
+		newSocks.Username = socksServer.GetUsername()
+		newSocks.ConnectionCount = uint32(socksServer.GetConnectionCount())
+		newSocks.BytesRx = socksServer.GetStats().GetBytesRx()
+		newSocks.BytesTx = socksServer.GetStats().GetBytesTx()
+
+		stream.Send(newSocks)
+	}
+
+	return nil
+}
+
+// HTTPProxyStart will start an http proxy on the provided client ID
+func (s *AdminServiceServer) HTTPProxyStart(ctx context.Context,
+	req *as.HTTPProxyStartRequest) (
+	*as.HTTPProxyStartResponse, error) {
+	log.Printf("[*] HTTPProxyStart called")
+
+	username, password := proxyCredentials(req.Username, req.Password,
+		req.NoAuth)
+
+	proxyID, err := s.gServer.StartHTTPProxy(req.ClientId, req.ProxyId,
+		req.Port, req.ClientSide, bytesToBindAddress(req.BindAddress),
+		username, password)
+
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, err.Error())
+	}
+
+	resp := new(as.HTTPProxyStartResponse)
+	resp.Username = username
+	resp.Password = password
+	resp.ProxyId = proxyID
+	return resp, nil
+}
+
+// HTTPProxyStop will stop an http proxy running on the provided client ID.
+func (s *AdminServiceServer) HTTPProxyStop(ctx context.Context,
+	req *as.HTTPProxyStopRequest) (
+	*as.HTTPProxyStopResponse, error) {
+	log.Printf("[*] HTTPProxyStop called")
+
+	err := s.gServer.StopHTTPProxy(req.ClientId, req.ProxyId)
+
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, err.Error())
+	}
+
+	return new(as.HTTPProxyStopResponse), nil
+}
+
+// HTTPProxyList will list all http proxies for the provided client ID.
+func (s *AdminServiceServer) HTTPProxyList(req *as.HTTPProxyListRequest,
+	stream as.AdminService_HTTPProxyListServer) error {
+	log.Printf("[*] HTTPProxyList called")
+
+	clientID := req.ClientId
+
+	endpoint, ok := s.gServer.GetEndpoint(clientID)
+	if !ok {
+		return status.Error(codes.InvalidArgument,
+			fmt.Sprintf("Client_ID %s does not exist", clientID))
+	}
+
+	for id, proxyServer := range endpoint.GetHTTPProxies() {
+		newProxy := new(as.HTTPProxy)
+		newProxy.Id = id
+		newProxy.Port = proxyServer.GetPort()
+		newProxy.BindAddress = common.IPToBytes(proxyServer.GetBindAddress())
+		newProxy.ClientSide = proxyServer.IsRemote()
+		newProxy.Username = proxyServer.GetUsername()
+		newProxy.ConnectionCount = uint32(proxyServer.GetConnectionCount())
+		newProxy.BytesRx = proxyServer.GetStats().GetBytesRx()
+		newProxy.BytesTx = proxyServer.GetStats().GetBytesTx()
+
+		stream.Send(newProxy)
+	}
+
+	return nil
+}
+
+// VPNStart will start a VPN for the provided client ID
+func (s *AdminServiceServer) VPNStart(ctx context.Context,
+	req *as.VPNStartRequest) (
+	*as.VPNStartResponse, error) {
+	log.Printf("[*] VPNStart called")
+
+	routes, err := common.ParseSources(req.Routes)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, err.Error())
+	}
+
+	vpnID, err := s.gServer.StartVPN(req.ClientId, req.VpnId, req.Device,
+		req.Mtu, routes)
+
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, err.Error())
+	}
+
+	vpn, _ := s.gServer.GetVPN(req.ClientId, vpnID)
+
+	resp := new(as.VPNStartResponse)
+	resp.VpnId = vpnID
+	resp.Device = vpn.GetDevice()
+	return resp, nil
+}
+
+// VPNStop will stop a VPN running for the provided client ID.
+func (s *AdminServiceServer) VPNStop(ctx context.Context,
+	req *as.VPNStopRequest) (
+	*as.VPNStopResponse, error) {
+	log.Printf("[*] VPNStop called")
+
+	err := s.gServer.StopVPN(req.ClientId, req.VpnId)
+
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, err.Error())
+	}
+
+	return new(as.VPNStopResponse), nil
+}
+
+// VPNList will list all VPNs for the provided client ID.
+func (s *AdminServiceServer) VPNList(req *as.VPNListRequest,
+	stream as.AdminService_VPNListServer) error {
+	log.Printf("[*] VPNList called")
+
+	clientID := req.ClientId
+
+	vpns, ok := s.gServer.GetVPNs(clientID)
+	if !ok {
+		return status.Error(codes.InvalidArgument,
+			fmt.Sprintf("Client_ID %s does not exist", clientID))
+	}
+
+	for id, vpn := range vpns {
+		newVPN := new(as.VPN)
+		newVPN.Id = id
+		newVPN.Device = vpn.GetDevice()
+		newVPN.Mtu = vpn.GetMTU()
+		newVPN.Routes = common.FormatSources(vpn.GetRoutes())
+		newVPN.FlowCount = uint32(vpn.GetFlowCount())
+		newVPN.BytesRx = vpn.GetStats().GetBytesRx()
+		newVPN.BytesTx = vpn.GetStats().GetBytesTx()
+
+		stream.Send(newVPN)
+	}
+
+	return nil
+}
+
+// PolicySet will replace the destination policy enforced for the
+// provided client ID.
+func (s *AdminServiceServer) PolicySet(ctx context.Context,
+	req *as.PolicySetRequest) (*as.PolicySetResponse, error) {
+	log.Printf("[*] PolicySet called")
+
+	var rules []*common.PolicyRule
+	for i, ruleMessage := range req.Rules {
+		rule, err := common.NewPolicyRule(ruleMessage.Allow,
+			ruleMessage.Cidr,
+			ruleMessage.Hostname,
+			ruleMessage.PortStart,
+			ruleMessage.PortEnd)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"policy rule %d: %s", i+1, err)
+		}
+		rules = append(rules, rule)
+	}
+
+	err := s.gServer.SetPolicy(req.ClientId, rules, req.DefaultDeny)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, err.Error())
+	}
+
+	return new(as.PolicySetResponse), nil
+}
+
+// PolicyGet will return the destination policy enforced for the
+// provided client ID.
+func (s *AdminServiceServer) PolicyGet(ctx context.Context,
+	req *as.PolicyGetRequest) (*as.PolicyGetResponse, error) {
+	log.Printf("[*] PolicyGet called")
+
+	endpoint, ok := s.gServer.GetEndpoint(req.ClientId)
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument,
+			fmt.Sprintf("Client_ID %s does not exist", req.ClientId))
+	}
+
+	rules, defaultDeny := endpoint.GetPolicy().GetRules()
+
+	resp := new(as.PolicyGetResponse)
+	resp.DefaultDeny = defaultDeny
+	for _, rule := range rules {
+		ruleMessage := new(as.PolicyRule)
+		ruleMessage.Allow = rule.Allow
+		ruleMessage.Cidr = rule.GetCIDR()
+		ruleMessage.Hostname = rule.Hostname
+		ruleMessage.PortStart = rule.PortStart
+		ruleMessage.PortEnd = rule.PortEnd
+		resp.Rules = append(resp.Rules, ruleMessage)
+	}
+
+	return resp, nil
+}
+
+// ProxyLogList is a gRPC function that will stream the requests
+// made through the socks and http proxies, oldest first.
+func (s *AdminServiceServer) ProxyLogList(req *as.ProxyLogListRequest,
+	stream as.AdminService_ProxyLogListServer) error {
+	log.Printf("[*] ProxyLogList called")
+
+	for _, entry := range s.gServer.proxyLog.List(req.ClientId, req.ProxyId) {
+		request := entry.Request
+		newRequest := new(as.ProxyRequest)
+		newRequest.ClientId = entry.ClientID
+		newRequest.ProxyId = request.ProxyID
+		newRequest.Protocol = request.Protocol
+		newRequest.Command = request.Command
+		newRequest.Source = request.Source
+		newRequest.Host = request.Host
+		newRequest.ResolvedAddress = request.ResolvedAddress
+		newRequest.BytesSent = request.BytesSent
+		newRequest.BytesReceived = request.BytesReceived
+		newRequest.StartTime = request.StartTime.UnixNano()
+		newRequest.Duration = int64(request.Duration)
+		newRequest.ErrorMessage = request.Error
+
+		if err := stream.Send(newRequest); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RecordingList is a gRPC function that will stream the recorded
+// connections matching the request, oldest first.
+func (s *AdminServiceServer) RecordingList(req *as.RecordingListRequest,
+	stream as.AdminService_RecordingListServer) error {
+	log.Printf("[*] RecordingList called")
+
+	recorder := s.gServer.GetRecorder()
+	if recorder == nil {
+		return status.Error(codes.FailedPrecondition, "Recording is not enabled")
+	}
+
+	filter := RecordingFilter{
+		ClientID:     req.ClientId,
+		TunnelID:     req.TunnelId,
+		ConnectionID: req.ConnectionId,
+		Protocol:     req.Protocol,
+		Address:      req.Address,
+	}
+	for _, entry := range recorder.List(filter) {
+		newRecording := new(as.Recording)
+		newRecording.Id = entry.ID
+		newRecording.ClientId = entry.ClientID
+		newRecording.TunnelId = entry.TunnelID
+		newRecording.ConnectionId = entry.ConnectionID
+		newRecording.Protocol = entry.Protocol
+		newRecording.Source = entry.Source
+		newRecording.Destination = entry.Destination
+		newRecording.RemoteAddress = entry.RemoteAddress
+		newRecording.StartTime = entry.StartTime.UnixNano()
+		if entry.IsFinished() {
+			newRecording.EndTime = entry.EndTime.UnixNano()
+		}
+		newRecording.BytesFromSource = entry.BytesFromSource
+		newRecording.BytesFromDestination = entry.BytesFromDestination
+		newRecording.Hash = entry.Hash
+
+		if err := stream.Send(newRecording); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// recordingChunkWriter sends whatever is written to it as recording
+// chunks on an export stream.
+type recordingChunkWriter struct {
+	stream as.AdminService_RecordingExportServer
+}
+
+func (w *recordingChunkWriter) Write(p []byte) (int, error) {
+	chunk := new(as.RecordingChunk)
+	chunk.Data = p
+	if err := w.stream.Send(chunk); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// RecordingExport is a gRPC function that will stream a recorded
+// connection in the requested format.
+func (s *AdminServiceServer) RecordingExport(req *as.RecordingExportRequest,
+	stream as.AdminService_RecordingExportServer) error {
+	log.Printf("[*] RecordingExport called")
+
+	recorder := s.gServer.GetRecorder()
+	if recorder == nil {
+		return status.Error(codes.FailedPrecondition, "Recording is not enabled")
+	}
+	if _, ok := recorder.Get(req.RecordingId); !ok {
+		return status.Error(codes.InvalidArgument,
+			fmt.Sprintf("Recording %s does not exist", req.RecordingId))
+	}
+
+	writer := bufio.NewWriterSize(&recordingChunkWriter{stream: stream},
+		common.MaxDatagramSize)
+	err := recorder.Export(req.RecordingId, req.Format, req.Direction, writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		return status.Errorf(codes.Internal, err.Error())
+	}
+
+	return nil
+}
+
+// RecordingVerify is a gRPC function that will check recordings
+// against their integrity hashes and stream the result for each.
+func (s *AdminServiceServer) RecordingVerify(req *as.RecordingVerifyRequest,
+	stream as.AdminService_RecordingVerifyServer) error {
+	log.Printf("[*] RecordingVerify called")
+
+	recorder := s.gServer.GetRecorder()
+	if recorder == nil {
+		return status.Error(codes.FailedPrecondition, "Recording is not enabled")
+	}
+
+	results, err := recorder.Verify(req.RecordingId)
+	if err != nil {
+		return status.Errorf(codes.Internal, err.Error())
+	}
+
+	ids := make([]string, 0, len(results))
+	for id := range results {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		result := results[id]
+		verification := new(as.RecordingVerification)
+		verification.RecordingId = id
+		verification.Ok = result == nil
+		if result != nil {
+			verification.ErrorMessage = result.Error()
+		}
+
+		if err := stream.Send(verification); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // Start will start the grpc server
 func (s *AdminServiceServer) Start(port int) {
 	log.Printf("[*] Starting admin grpc server on port: %d\n", port)
@@ -193,16 +706,54 @@ func (s *AdminServiceServer) TunnelAdd(ctx context.Context, req *as.TunnelAddReq
 		req.Tunnel.Id = common.GenerateString(8)
 	}
 
-	err := s.gServer.AddTunnel(
+	var limits common.ListenerLimits
+	sources, err := common.ParseSources(req.Tunnel.AllowedSources)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, err.Error())
+	}
+	limits.AllowedSources = sources
+	limits.MaxConnections = req.Tunnel.MaxConnections
+	limits.MaxAcceptRate = req.Tunnel.MaxAcceptRate
+
+	var destinations *common.DestinationSet
+	if len(req.Tunnel.Destinations) != 0 {
+		var list []*common.TunnelDestination
+		for _, destination := range req.Tunnel.Destinations {
+			port := destination.Port
+			if port == 0 {
+				port = req.Tunnel.DestinationPort
+			}
+			if destination.Host == "" || port == 0 {
+				return nil, status.Errorf(codes.InvalidArgument,
+					"destinations need a host and port")
+			}
+			list = append(list, common.NewTunnelDestination(destination.Host, port))
+		}
+		destinations = common.NewDestinationSet(list, req.Tunnel.DestinationStrategy)
+	}
+
+	err = s.gServer.AddTunnel(
 		req.ClientId,
 		req.Tunnel.Id,
 		req.Tunnel.Direction,
-		common.Int32ToIP(req.Tunnel.ListenIp),
+		req.Tunnel.Protocol,
+		common.BytesToIP(req.Tunnel.ListenAddress, req.Tunnel.ListenIp),
 		req.Tunnel.ListenPort,
-		common.Int32ToIP(req.Tunnel.DestinationIp),
-		req.Tunnel.DestinationPort)
-
-	if err != nil {
+		common.BytesToIP(req.Tunnel.DestinationAddress, req.Tunnel.DestinationIp),
+		req.Tunnel.DestinationHost,
+		req.Tunnel.DestinationPort,
+		destinations,
+		req.Tunnel.Relay,
+		req.Tunnel.EgressClientId,
+		req.Tunnel.PortCount,
+		req.Tunnel.Compression,
+		req.Tunnel.BandwidthLimit,
+		limits)
+
+	var policyErr *common.PolicyError
+	if errors.As(err, &policyErr) {
+		return nil, status.Errorf(codes.PermissionDenied, err.Error())
+	} else if err != nil {
 		return nil, status.Errorf(codes.Internal, err.Error())
 	}
 
@@ -247,10 +798,52 @@ func (s *AdminServiceServer) TunnelList(req *as.TunnelListRequest,
 		newTun := new(as.Tunnel)
 		newTun.Id = id
 		newTun.Direction = tunnel.GetDirection()
+		newTun.Protocol = tunnel.GetProtocol()
 		newTun.ListenIp = common.IpToInt32(tunnel.GetListenIP())
+		newTun.ListenAddress = common.IPToBytes(tunnel.GetListenIP())
 		newTun.ListenPort = tunnel.GetListenPort()
 		newTun.DestinationIp = common.IpToInt32(tunnel.GetDestinationIP())
+		newTun.DestinationAddress = common.IPToBytes(tunnel.GetDestinationIP())
+		newTun.DestinationHost = tunnel.GetDestinationHost()
+		newTun.LastError = tunnel.GetLastError()
+		newTun.Compression = tunnel.GetCompression()
+		newTun.UncompressedBytes = tunnel.GetCompressionStats().GetUncompressedBytes()
+		newTun.CompressedBytes = tunnel.GetCompressionStats().GetCompressedBytes()
+		newTun.BandwidthLimit = tunnel.GetBandwidthLimit().GetLimit()
+		newTun.BytesRx = tunnel.GetStats().GetBytesRx()
+		newTun.BytesTx = tunnel.GetStats().GetBytesTx()
+		newTun.ConnectionCount = uint32(len(tunnel.GetConnections()))
+		limits := tunnel.GetListenerLimits()
+		newTun.AllowedSources = common.FormatSources(limits.AllowedSources)
+		newTun.MaxConnections = limits.MaxConnections
+		newTun.MaxAcceptRate = limits.MaxAcceptRate
+		newTun.RejectedConnections = tunnel.GetStats().GetRejectedConnections()
+		newTun.PortCount = tunnel.GetPortCount()
 		newTun.DestinationPort = tunnel.GetDestinationPort()
+		newTun.ReceiveWindow = tunnel.GetReceiveWindow()
+		newTun.Relay = s.gServer.isRelay(clientID, id)
+		ingressID, egressID := s.gServer.getBridgeClients(clientID, id)
+		if ingressID == clientID {
+			newTun.EgressClientId = egressID
+		} else if egressID == clientID {
+			newTun.IngressClientId = ingressID
+		}
+		destinations := tunnel.GetDestinations()
+		newTun.DestinationStrategy = destinations.GetStrategy()
+		for _, destination := range destinations.GetDestinations() {
+			health := destination.GetHealth()
+			newDestination := new(as.TunnelDestination)
+			newDestination.Host = destination.Host
+			newDestination.Port = destination.Port
+			newDestination.Healthy = health.Healthy
+			newDestination.Successes = health.Successes
+			newDestination.Failures = health.Failures
+			newDestination.LastError = health.LastError
+			if !health.LastFailure.IsZero() {
+				newDestination.LastFailure = health.LastFailure.UnixNano()
+			}
+			newTun.Destinations = append(newTun.Destinations, newDestination)
+		}
 
 		stream.Send(newTun)
 	}
@@ -0,0 +1,154 @@
+package gserverlib
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/hotnops/gTunnel/common"
+)
+
+// A bridge is a tunnel between two gClients. The ingress client
+// listens like it would for any reverse tunnel, but the gServer
+// connects each accepted connection to a dynamic tunnel with the same
+// ID on the egress client, which dials the destination. The gServer
+// only carries the bytes between the two and never opens a port.
+
+// bridge records the two clients of a client to client tunnel.
+type bridge struct {
+	ingressID string
+	egressID  string
+}
+
+// getBridge returns the bridge the client's tunnel belongs to, or nil
+// if the tunnel is not part of one.
+func (c *ConnectedClient) getBridge(tunnelID string) *bridge {
+	c.tunnelMutex.Lock()
+	defer c.tunnelMutex.Unlock()
+
+	return c.bridges[tunnelID]
+}
+
+// setBridge records the bridge the client's tunnel belongs to. A nil
+// bridge removes it.
+func (c *ConnectedClient) setBridge(tunnelID string, b *bridge) {
+	c.tunnelMutex.Lock()
+	defer c.tunnelMutex.Unlock()
+
+	if b == nil {
+		delete(c.bridges, tunnelID)
+		return
+	}
+	if c.bridges == nil {
+		c.bridges = make(map[string]*bridge)
+	}
+	c.bridges[tunnelID] = b
+}
+
+// getBridges returns the bridges of all of the client's tunnels.
+func (c *ConnectedClient) getBridges() map[string]*bridge {
+	c.tunnelMutex.Lock()
+	defer c.tunnelMutex.Unlock()
+
+	bridges := make(map[string]*bridge, len(c.bridges))
+	for tunnelID, b := range c.bridges {
+		bridges[tunnelID] = b
+	}
+	return bridges
+}
+
+// addBridge will add the egress end of a client to client tunnel and
+// point the ingress tunnel at it.
+func (s *GServer) addBridge(
+	ingress *ConnectedClient,
+	egress *ConnectedClient,
+	tunnelID string,
+	ingressTunnel *common.Tunnel) error {
+
+	egressTunnel := common.NewTunnel(tunnelID,
+		common.TunnelDirectionForward, nil, 0, nil, 0)
+	s.configureTunnel(egress, egressTunnel)
+	egressTunnel.SetDynamic(true)
+	egressTunnel.SetPolicy(egress.endpoint.GetPolicy())
+	egressTunnel.ConnectionHandler = s.newConnectionHandler(egress.uniqueID,
+		tunnelID)
+
+	if err := s.addDynamicTunnel(egress, tunnelID, egressTunnel); err != nil {
+		log.Printf("[!] Failed to add egress tunnel to client %s: %s",
+			egress.uniqueID, err)
+		return err
+	}
+
+	b := &bridge{ingressID: ingress.uniqueID, egressID: egress.uniqueID}
+	ingress.setBridge(tunnelID, b)
+	egress.setBridge(tunnelID, b)
+	ingressTunnel.SetDialFunc(s.dialEgress(egress.uniqueID, tunnelID))
+	return nil
+}
+
+// removeBridge will delete the other end of the client's tunnel if it
+// is part of a bridge.
+func (s *GServer) removeBridge(client *ConnectedClient, tunnelID string) {
+	b := client.getBridge(tunnelID)
+	if b == nil {
+		return
+	}
+
+	partnerID := b.egressID
+	if partnerID == client.uniqueID {
+		partnerID = b.ingressID
+	}
+	client.setBridge(tunnelID, nil)
+
+	partner, ok := s.connectedClients[partnerID]
+	if !ok || partner.getBridge(tunnelID) != b {
+		return
+	}
+	partner.setBridge(tunnelID, nil)
+	if err := s.deleteTunnel(partner, tunnelID); err != nil {
+		log.Printf("[!] Failed to delete tunnel %s on client %s: %s",
+			tunnelID, partnerID, err)
+	}
+}
+
+// removeBridges will delete the other end of every bridge the client
+// is part of.
+func (s *GServer) removeBridges(client *ConnectedClient) {
+	for tunnelID := range client.getBridges() {
+		s.removeBridge(client, tunnelID)
+	}
+}
+
+// dialEgress returns a DialFunc that opens connections through the
+// egress tunnel of a bridge. The egress client is looked up on every
+// dial since it may have disconnected.
+func (s *GServer) dialEgress(egressID string, tunnelID string) common.DialFunc {
+	return func(network string, address string) (net.Conn, error) {
+		egress, ok := s.connectedClients[egressID]
+		if !ok {
+			return nil, fmt.Errorf("egress client %s is not connected", egressID)
+		}
+		egressTunnel, ok := egress.endpoint.GetTunnel(tunnelID)
+		if !ok {
+			return nil, fmt.Errorf("egress client %s has no tunnel %s",
+				egressID, tunnelID)
+		}
+		return egressTunnel.Dial(network, address)
+	}
+}
+
+// getBridgeClients returns the ingress and egress client IDs of the
+// client's tunnel, or empty strings if it is not part of a bridge.
+func (s *GServer) getBridgeClients(clientID string,
+	tunnelID string) (string, string) {
+
+	client, ok := s.connectedClients[clientID]
+	if !ok {
+		return "", ""
+	}
+	b := client.getBridge(tunnelID)
+	if b == nil {
+		return "", ""
+	}
+	return b.ingressID, b.egressID
+}
@@ -0,0 +1,126 @@
+package gserverlib
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hotnops/gTunnel/common"
+	cs "github.com/hotnops/gTunnel/grpc/client"
+)
+
+// answerTestRequests acknowledges every endpoint request sent to the
+// client, as a gClient that carries them all out would.
+func answerTestRequests(t *testing.T, client *ConnectedClient) {
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	go func() {
+		for {
+			select {
+			case message := <-client.endpointInput:
+				client.acknowledgeRequest(&cs.EndpointControlMessage{
+					Operation: common.EndpointCtrlAck,
+					RequestId: message.RequestId,
+				})
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// answerTestDial connects the next connection the gServer opens on a
+// dynamic tunnel, as the gClient does once it has dialed the
+// destination. The connect message is returned along with the
+// gClient's end of the connection's byte stream.
+func answerTestDial(t *testing.T, tunnel *common.Tunnel,
+	ctrl *testControlStream) (*cs.TunnelControlMessage, *testByteStream) {
+
+	connect := ctrl.next(t)
+	if connect.Operation != common.TunnelCtrlConnect {
+		t.Fatalf("gServer sent %v; want a connect", connect)
+	}
+	ctrl.in <- &cs.TunnelControlMessage{
+		Operation:    common.TunnelCtrlAck,
+		TunnelId:     connect.TunnelId,
+		ConnectionId: connect.ConnectionId,
+		RemoteAddress: net.JoinHostPort(connect.DestinationHost,
+			strconv.Itoa(int(connect.DestinationPort))),
+	}
+	return connect, openTestByteStream(tunnel, connect.ConnectionId)
+}
+
+// waitForKill fails the test if the connection is not closed.
+func waitForKill(t *testing.T, name string, conn *common.Connection) {
+	select {
+	case <-conn.Kill:
+	case <-time.After(5 * time.Second):
+		t.Errorf("%s connection is still open", name)
+	}
+}
+
+func TestBridgeCarriesConnectionBetweenClients(t *testing.T) {
+	s := newTestServer()
+	ingress := newTestClient(s, "ingress")
+	egress := newTestClient(s, "egress")
+	answerTestRequests(t, ingress)
+	answerTestRequests(t, egress)
+
+	err := s.AddTunnel(ingress.uniqueID, "bridge", common.TunnelDirectionReverse,
+		common.TunnelProtocolTCP, net.IPv4(127, 0, 0, 1), 8080,
+		net.IPv4(10, 0, 0, 5), "", 80, nil, false, egress.uniqueID, 1,
+		common.CompressionNone, 0, common.ListenerLimits{})
+	if err != nil {
+		t.Fatalf("AddTunnel failed: %s", err)
+	}
+	ingressTunnel, _ := ingress.endpoint.GetTunnel("bridge")
+	egressTunnel, ok := egress.endpoint.GetTunnel("bridge")
+	if !ok {
+		t.Fatalf("no egress tunnel was added")
+	}
+	ingressCtrl := startTestTunnel(t, s, ingress, ingressTunnel)
+	egressCtrl := startTestTunnel(t, s, egress, egressTunnel)
+
+	// A connection accepted by the ingress client is dialed by the
+	// egress client
+	ingressCtrl.in <- &cs.TunnelControlMessage{
+		Operation:    common.TunnelCtrlConnect,
+		TunnelId:     "bridge",
+		ConnectionId: "conn",
+	}
+	connect, egressPeer := answerTestDial(t, egressTunnel, egressCtrl)
+	if connect.DestinationHost != "10.0.0.5" || connect.DestinationPort != 80 {
+		t.Errorf("egress client was asked to dial %s:%d; want 10.0.0.5:80",
+			connect.DestinationHost, connect.DestinationPort)
+	}
+	ack, ingressPeer := receiveTestAck(t, ingressTunnel, ingressCtrl)
+	if ingressPeer == nil {
+		t.Fatalf("bridged connection failed: %s", ack.ErrorMessage)
+	}
+
+	ingressPeer.Send(&cs.BytesMessage{Content: []byte("request")})
+	if got := egressPeer.recvContent(t); got != "request" {
+		t.Errorf("egress client received %q; want request", got)
+	}
+	egressPeer.Send(&cs.BytesMessage{Content: []byte("response")})
+	if got := ingressPeer.recvContent(t); got != "response" {
+		t.Errorf("ingress client received %q; want response", got)
+	}
+
+	// Deleting the tunnel removes the bridge and closes both ends
+	// of its connection
+	ingressConn := ingressTunnel.GetConnection("conn")
+	egressConn := egressTunnel.GetConnection(connect.ConnectionId)
+	if err := s.DeleteTunnel(ingress.uniqueID, "bridge"); err != nil {
+		t.Fatalf("DeleteTunnel failed: %s", err)
+	}
+	waitForKill(t, "ingress", ingressConn)
+	waitForKill(t, "egress", egressConn)
+	if _, ok := egress.endpoint.GetTunnel("bridge"); ok {
+		t.Errorf("egress tunnel was not deleted")
+	}
+	if ingress.getBridge("bridge") != nil || egress.getBridge("bridge") != nil {
+		t.Errorf("bridge is still recorded")
+	}
+}
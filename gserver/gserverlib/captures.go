@@ -0,0 +1,108 @@
+package gserverlib
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/hotnops/gTunnel/common"
+)
+
+// DefaultCaptureDir is where pcapng files are written unless
+// another directory is configured.
+const DefaultCaptureDir = "captures"
+
+// captureEntry is a capture started by an admin, along with the
+// tunnel or connection it records.
+type captureEntry struct {
+	capture    *common.Capture
+	tunnel     *common.Tunnel
+	connection *common.Connection
+}
+
+// Captures keeps track of the captures that are running.
+type Captures struct {
+	dir     string
+	entries map[string]*captureEntry
+	mutex   sync.Mutex
+}
+
+// NewCaptures is a constructor for the Captures struct.
+func NewCaptures() *Captures {
+	c := new(Captures)
+	c.dir = DefaultCaptureDir
+	c.entries = make(map[string]*captureEntry)
+	return c
+}
+
+// SetDir sets the directory pcapng files are written to.
+func (c *Captures) SetDir(dir string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.dir = dir
+}
+
+// Start will record the traffic of a tunnel, or of a single one
+// of its connections if connection is not nil, to a new pcapng file.
+func (c *Captures) Start(tunnel *common.Tunnel,
+	connection *common.Connection) (*common.Capture, error) {
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if connection != nil && connection.GetCapture() != nil {
+		return nil, fmt.Errorf("connection %s is already being captured", connection.ID)
+	}
+	if connection == nil && tunnel.GetCapture() != nil {
+		return nil, fmt.Errorf("tunnel is already being captured by %s",
+			tunnel.GetCapture().GetID())
+	}
+
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return nil, err
+	}
+
+	id := common.GenerateString(common.TunnelIDSize)
+	capture, err := common.NewCapture(id, filepath.Join(c.dir, id+".pcapng"))
+	if err != nil {
+		return nil, err
+	}
+
+	if connection != nil {
+		connection.SetCapture(capture)
+	} else {
+		tunnel.SetCapture(capture)
+	}
+	c.entries[id] = &captureEntry{capture: capture, tunnel: tunnel,
+		connection: connection}
+	log.Printf("[*] Capture %s started, writing to %s", id, capture.GetPath())
+	return capture, nil
+}
+
+// Stop will stop a capture and close its pcapng file.
+func (c *Captures) Stop(id string) (*common.Capture, error) {
+	c.mutex.Lock()
+	entry, ok := c.entries[id]
+	delete(c.entries, id)
+	c.mutex.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("capture %s does not exist", id)
+	}
+
+	if entry.connection != nil {
+		if entry.connection.GetCapture() == entry.capture {
+			entry.connection.SetCapture(nil)
+		}
+	} else if entry.tunnel.GetCapture() == entry.capture {
+		entry.tunnel.SetCapture(nil)
+	}
+
+	packets, bytes := entry.capture.GetStats()
+	log.Printf("[*] Capture %s stopped after %d packets and %d bytes",
+		id, packets, bytes)
+	return entry.capture, entry.capture.Close()
+}
@@ -3,6 +3,7 @@ package gserverlib
 import (
 	"context"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"time"
@@ -60,6 +61,12 @@ func (s *ClientServiceServer) GetConfigurationMessage(ctx context.Context, req *
 	connectedclient.connectDate = time.Now()
 	connectedclient.endpoint = common.NewEndpoint()
 	connectedclient.endpointInput = make(chan *cs.EndpointControlMessage)
+	connectedclient.bandwidthLimit = common.NewBandwidthLimit(0)
+	connectedclient.requests = make(map[string]chan *cs.EndpointControlMessage)
+	connectedclient.disconnected = make(chan bool)
+	if addr, ok := peerInfo.Addr.(*relayAddr); ok {
+		connectedclient.hops = addr.hops
+	}
 
 	s.gServer.AddConnectedClient(uuid, connectedclient)
 
@@ -91,6 +98,7 @@ func (s *ClientServiceServer) CreateEndpointControlStream(
 		log.Printf("[!] UUID does not exist to create control stream")
 		return fmt.Errorf("uuid does not exist")
 	}
+	client.setCapabilities(ctrlMessage.Capabilities)
 
 	for {
 		select {
@@ -110,12 +118,85 @@ func (s *ClientServiceServer) CreateEndpointControlStream(
 					uuid)
 			}
 			client.endpoint.Stop()
+			client.stopVPNs()
+			close(client.disconnected)
 			delete(s.gServer.connectedClients, uuid)
+			go s.gServer.removeBridges(client)
 			return nil
 		}
 	}
 }
 
+// CreateEndpointAckStream is a gRPC function that the client calls
+// to acknowledge the control messages sent on its endpoint control
+// stream, reporting whether each operation succeeded.
+func (s *ClientServiceServer) CreateEndpointAckStream(
+	stream cs.ClientService_CreateEndpointAckStreamServer) error {
+
+	_, uuid, err := GetClientInfoFromCtx(stream.Context())
+
+	if err != nil {
+		return err
+	}
+
+	client, ok := s.gServer.connectedClients[uuid]
+
+	if !ok {
+		log.Printf("[!] UUID does not exist to create ack stream")
+		return fmt.Errorf("uuid does not exist")
+	}
+
+	for {
+		ack, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(new(cs.EndpointAckStreamResponse))
+		} else if err != nil {
+			return err
+		}
+		client.acknowledgeRequest(ack)
+	}
+}
+
+// CreateProxyLogStream is a gRPC function that the client will call
+// to report the requests made through the proxies it runs.
+func (s *ClientServiceServer) CreateProxyLogStream(
+	stream cs.ClientService_CreateProxyLogStreamServer) error {
+
+	_, uuid, err := GetClientInfoFromCtx(stream.Context())
+
+	if err != nil {
+		return err
+	}
+
+	if _, ok := s.gServer.connectedClients[uuid]; !ok {
+		log.Printf("[!] UUID does not exist to create proxy log stream")
+		return fmt.Errorf("uuid does not exist")
+	}
+
+	for {
+		message, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(new(cs.ProxyLogStreamResponse))
+		} else if err != nil {
+			return err
+		}
+
+		request := new(common.ProxyRequest)
+		request.ProxyID = message.ProxyId
+		request.Protocol = message.Protocol
+		request.Command = message.Command
+		request.Source = message.Source
+		request.Host = message.Host
+		request.ResolvedAddress = message.ResolvedAddress
+		request.BytesSent = message.BytesSent
+		request.BytesReceived = message.BytesReceived
+		request.StartTime = time.Unix(0, message.StartTime)
+		request.Duration = time.Duration(message.Duration)
+		request.Error = message.ErrorMessage
+		s.gServer.proxyLog.Add(uuid, request)
+	}
+}
+
 //CreateTunnelControlStream is a gRPC function that the client will call to
 // establish a bi-directional stream to relay control messages about new
 // and disconnected TCP connections.
@@ -147,6 +228,8 @@ func (s *ClientServiceServer) CreateTunnelControlStream(
 		return fmt.Errorf("failed to establish tunnel")
 	}
 
+	// The client replies with the compression it agreed to use
+	tun.SetCompression(tunMessage.Compression)
 	tun.SetControlStream(stream)
 	tun.Start()
 	<-tun.Kill
@@ -190,6 +273,58 @@ func (s *ClientServiceServer) CreateConnectionStream(
 	return nil
 }
 
+// CreateMultiplexStream is a gRPC function that the client will call to
+// create a single bi-directional data stream that carries the data for
+// every TCP connection on the endpoint.
+func (s *ClientServiceServer) CreateMultiplexStream(
+	stream cs.ClientService_CreateMultiplexStreamServer) error {
+
+	_, uuid, err := GetClientInfoFromCtx(stream.Context())
+
+	if err != nil {
+		return err
+	}
+
+	client, ok := s.gServer.connectedClients[uuid]
+
+	if !ok {
+		log.Printf("[!] CreateMultiplexStream: uuid doesn't exist: %s\n", uuid)
+		return fmt.Errorf("uuid does not exist")
+	}
+
+	mux := common.NewMuxStream(stream)
+
+	return mux.Run(func(tunnelID string, connID string) {
+		tunnel, ok := client.endpoint.GetTunnel(tunnelID)
+
+		if !ok {
+			log.Printf("[!] Got a ByteMessage for a non-existent tunnel: %s\n",
+				tunnelID)
+			return
+		}
+
+		conn := tunnel.GetConnection(connID)
+
+		if conn == nil {
+			log.Printf("[!] Got a ByteMessage for a non-existent connection: %s\n",
+				connID)
+			return
+		}
+
+		conn.SetStream(mux.Open(tunnelID, connID))
+		close(conn.Connected)
+
+		go func() {
+			select {
+			case <-conn.Kill:
+			case <-mux.Done:
+			}
+			mux.Remove(tunnelID, connID)
+			tunnel.RemoveConnection(conn.ID)
+		}()
+	})
+}
+
 // Start starts the grpc client service.
 func (s *ClientServiceServer) Start(
 	port int,
@@ -226,6 +361,8 @@ func (s *ClientServiceServer) Start(
 
 	cs.RegisterClientServiceServer(grpcServer, s)
 
+	// gClients connected through a relay arrive here
+	go grpcServer.Serve(s.gServer.relayListener)
 	grpcServer.Serve(lis)
 
 }
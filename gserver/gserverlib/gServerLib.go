@@ -2,9 +2,12 @@ package gserverlib
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hotnops/gTunnel/common"
@@ -37,6 +40,16 @@ type ConnectedClient struct {
 	connectDate      time.Time
 	endpoint         *common.Endpoint
 	endpointInput    chan *cs.EndpointControlMessage
+	requests         map[string]chan *cs.EndpointControlMessage
+	requestMutex     sync.Mutex
+	disconnected     chan bool
+	bandwidthLimit   *common.BandwidthLimit
+	hops             []string
+	relays           map[string]bool
+	bridges          map[string]*bridge
+	vpns             map[string]*VPN
+	tunnelMutex      sync.Mutex
+	capabilities     atomic.Uint32
 }
 
 type GServer struct {
@@ -46,6 +59,12 @@ type GServer struct {
 	clientServer     *ClientServiceServer
 	adminServer      *AdminServiceServer
 	connectedClients map[string]*ConnectedClient
+	receiveWindow    uint32
+	bandwidthLimit   *common.BandwidthLimit
+	proxyLog         *ProxyLog
+	captures         *Captures
+	recorder         *Recorder
+	relayListener    *relayListener
 }
 
 // ServerConnectionHandler TODO
@@ -55,6 +74,12 @@ type ServerConnectionHandler struct {
 	tunnelID   string
 }
 
+// EndpointRequestTimeout is the amount of time to wait for a
+// gClient to acknowledge an endpoint control message.
+var EndpointRequestTimeout = 15 * time.Second
+
+var errClientDisconnected = errors.New("client disconnected")
+
 // NewGServer is a constructor that will initialize
 // all gServer internal data structures and load any
 // existing configuration files.
@@ -69,6 +94,11 @@ func NewGServer() *GServer {
 	newServer.clientServer = NewClientServiceServer(newServer)
 	newServer.adminServer = NewAdminServiceServer(newServer)
 	newServer.connectedClients = make(map[string]*ConnectedClient)
+	newServer.receiveWindow = common.DefaultReceiveWindow
+	newServer.bandwidthLimit = common.NewBandwidthLimit(0)
+	newServer.proxyLog = NewProxyLog()
+	newServer.captures = NewCaptures()
+	newServer.relayListener = newRelayListener()
 
 	return newServer
 }
@@ -83,6 +113,27 @@ func NewConfiguredClient(clientData map[string]interface{}) *ConfiguredClient {
 	return c
 }
 
+// hasCapability returns true if the client advertised the
+// provided capability.
+func (c *ConnectedClient) hasCapability(capability uint32) bool {
+	return c.capabilities.Load()&capability != 0
+}
+
+// checkAddress refuses an IPv6 address if the client only reads
+// the IPv4 uint32 address fields, which would carry it as 0.0.0.0.
+func (c *ConnectedClient) checkAddress(ip net.IP) error {
+	if ip == nil || ip.To4() != nil ||
+		c.hasCapability(common.CapabilityIPAddresses) {
+		return nil
+	}
+	return fmt.Errorf("client does not support IPv6 address %s", ip)
+}
+
+// setCapabilities records the capabilities the client advertised.
+func (c *ConnectedClient) setCapabilities(capabilities uint32) {
+	c.capabilities.Store(capabilities)
+}
+
 // AddConnectedClient will take in a unique ID and a ConnectedClient structure
 // and insert them into the connectedClients map with the unique ID as the key.
 func (s *GServer) AddConnectedClient(uuid string, client *ConnectedClient) bool {
@@ -163,15 +214,28 @@ func (s *GServer) UnaryAuthInterceptor(ctx context.Context,
 }
 
 // AddTunnel adds a tunnel to the gRPC server and then messages the gclient
-// to perform actions on the other end.
+// to perform actions on the other end. A nil destinations forwards the
+// tunnel to its single destination IP or host and port. A relay tunnel
+// connects the gClients it accepts to the gServer instead. A reverse
+// tunnel with an egressClientID connects to its destinations from
+// that client rather than from the gServer.
 func (s *GServer) AddTunnel(
 	clientID string,
 	tunnelID string,
 	direction uint32,
+	protocol uint32,
 	listenIP net.IP,
 	listenPort uint32,
 	destinationIP net.IP,
-	destinationPort uint32) error {
+	destinationHost string,
+	destinationPort uint32,
+	destinations *common.DestinationSet,
+	relay bool,
+	egressClientID string,
+	portCount uint32,
+	compression uint32,
+	bandwidthLimit uint64,
+	limits common.ListenerLimits) error {
 
 	client, ok := s.connectedClients[clientID]
 
@@ -180,20 +244,125 @@ func (s *GServer) AddTunnel(
 		return fmt.Errorf("addtunnel failed - client does not exist")
 	}
 
+	if relay && (direction != common.TunnelDirectionReverse ||
+		protocol != common.TunnelProtocolTCP || portCount > 1) {
+		return fmt.Errorf("relays must be single port tcp reverse tunnels")
+	}
+	if relay {
+		if err := client.checkRelayHops(); err != nil {
+			return err
+		}
+	}
+
+	// The client is sent the address it listens on or dials
+	clientIP := destinationIP
+	if direction == common.TunnelDirectionReverse {
+		clientIP = listenIP
+	}
+	if err := client.checkAddress(clientIP); err != nil {
+		return err
+	}
+
+	var egress *ConnectedClient
+	if egressClientID != "" {
+		if egress, ok = s.connectedClients[egressClientID]; !ok {
+			return fmt.Errorf("addtunnel failed - egress client does not exist")
+		}
+		if egressClientID == clientID || relay ||
+			direction != common.TunnelDirectionReverse {
+			return fmt.Errorf("client to client tunnels must be reverse tunnels " +
+				"with a different egress client")
+		}
+	}
+
+	if relay {
+		destinations = common.NewDestinationSet([]*common.TunnelDestination{
+			common.NewTunnelDestination("relay", 0)},
+			common.DestinationStrategyFailover)
+	} else if destinations == nil {
+		host := destinationHost
+		if host == "" {
+			host = destinationIP.String()
+		}
+		destinations = common.NewDestinationSet([]*common.TunnelDestination{
+			common.NewTunnelDestination(host, destinationPort)},
+			common.DestinationStrategyFailover)
+	}
+
+	if portCount == 0 {
+		portCount = 1
+	}
+	if uint64(listenPort)+uint64(portCount) > 65536 {
+		return fmt.Errorf("port range of %d ports is out of bounds", portCount)
+	}
+	for _, destination := range destinations.GetDestinations() {
+		if portCount > 1 && (listenPort == 0 || destination.Port == 0) {
+			return fmt.Errorf("port ranges need a listen and destination port")
+		}
+		if uint64(destination.Port)+uint64(portCount) > 65536 {
+			return fmt.Errorf("port range of %d ports is out of bounds for %s",
+				portCount, destination)
+		}
+	}
+
+	_, exists := client.endpoint.GetTunnel(tunnelID)
+	if egress != nil {
+		if _, ok := egress.endpoint.GetTunnel(tunnelID); ok {
+			exists = true
+		}
+	}
+	if exists {
+		log.Printf("Tunnel ID already exists for this endpoint. Generating ID instead")
+		tunnelID = common.GenerateString(common.TunnelIDSize)
+	}
+
 	controlMessage := new(cs.EndpointControlMessage)
 	controlMessage.Operation = common.EndpointCtrlAddTunnel
 	controlMessage.TunnelId = tunnelID
+	controlMessage.Protocol = protocol
+	controlMessage.Compression = compression
+	controlMessage.PortCount = portCount
 	newTunnel := common.NewTunnel(tunnelID,
 		direction,
 		listenIP,
 		uint32(listenPort),
 		destinationIP,
 		uint32(destinationPort))
+	s.configureTunnel(client, newTunnel)
+	controlMessage.ReceiveWindow = newTunnel.GetReceiveWindow()
+	newTunnel.SetProtocol(protocol)
+	newTunnel.SetDestinationHost(destinationHost)
+	newTunnel.SetDestinations(destinations)
+	newTunnel.GetBandwidthLimit().SetLimit(bandwidthLimit)
+	newTunnel.SetListenerLimits(limits)
+	newTunnel.SetPortCount(portCount)
+
+	// The dialing client checks again once the host is resolved
+	if direction == common.TunnelDirectionForward || egress != nil {
+		policy := client.endpoint.GetPolicy()
+		if egress != nil {
+			policy = egress.endpoint.GetPolicy()
+		}
+		for _, destination := range destinations.GetDestinations() {
+			if err := policy.Check(destination.Host,
+				net.ParseIP(destination.Host), destination.Port); err != nil {
+				return err
+			}
+		}
+	}
 
-	if direction == common.TunnelDirectionForward {
+	if relay {
+		newTunnel.SetDialFunc(s.relayListener.dial(client))
+		client.setRelay(tunnelID, true)
+	}
 
-		controlMessage.DestinationIp = common.IpToInt32(destinationIP)
-		controlMessage.DestinationPort = uint32(destinationPort)
+	if direction == common.TunnelDirectionForward {
+		controlMessage.DestinationIp = common.IpToInt32(newTunnel.GetDestinationIP())
+		controlMessage.DestinationAddress = common.IPToBytes(newTunnel.GetDestinationIP())
+		controlMessage.DestinationHost = newTunnel.GetDestinationHost()
+		controlMessage.DestinationPort = newTunnel.GetDestinationPort()
+		controlMessage.Destinations = destinations.ToMessage()
+		controlMessage.DestinationStrategy = destinations.GetStrategy()
 		// The client doesn't need to know what port and IP we are
 		// listening on
 		controlMessage.ListenIp = 0
@@ -205,22 +374,22 @@ func (s *GServer) AddTunnel(
 		controlMessage.DestinationIp = 0
 		controlMessage.DestinationPort = 0
 		controlMessage.ListenIp = common.IpToInt32(listenIP)
+		controlMessage.ListenAddress = common.IPToBytes(listenIP)
 		controlMessage.ListenPort = uint32(listenPort)
+		controlMessage.AllowedSources = common.FormatSources(limits.AllowedSources)
+		controlMessage.MaxConnections = limits.MaxConnections
+		controlMessage.MaxAcceptRate = limits.MaxAcceptRate
 	} else {
 		return fmt.Errorf("invalid tunnel direction")
 	}
 
-	if _, ok := client.endpoint.GetTunnel(tunnelID); ok {
-		log.Printf("Tunnel ID already exists for this endpoint. Generating ID instead")
-		tunnelID = common.GenerateString(common.TunnelIDSize)
-	}
-
-	f := new(ServerConnectionHandler)
-	f.server = s
-	f.endpointID = clientID
-	f.tunnelID = tunnelID
+	newTunnel.ConnectionHandler = s.newConnectionHandler(clientID, tunnelID)
 
-	newTunnel.ConnectionHandler = f
+	if egress != nil {
+		if err := s.addBridge(client, egress, tunnelID, newTunnel); err != nil {
+			return err
+		}
+	}
 
 	if direction == common.TunnelDirectionForward {
 
@@ -232,11 +401,46 @@ func (s *GServer) AddTunnel(
 
 	client.endpoint.AddTunnel(tunnelID, newTunnel)
 
-	client.endpointInput <- controlMessage
+	if err := client.sendEndpointRequest(controlMessage); err != nil {
+		client.endpoint.StopAndDeleteTunnel(tunnelID)
+		client.setRelay(tunnelID, false)
+		s.removeBridge(client, tunnelID)
+		return err
+	}
 
 	return nil
 }
 
+// configureTunnel applies the server wide settings and the
+// client's shared limits and counters to a new tunnel.
+func (s *GServer) configureTunnel(client *ConnectedClient,
+	tunnel *common.Tunnel) {
+
+	// Clients that can not send credit get no flow control
+	if client.hasCapability(common.CapabilityFlowControl) {
+		tunnel.SetReceiveWindow(s.receiveWindow)
+	} else {
+		tunnel.SetReceiveWindow(0)
+	}
+	tunnel.SetSharedBandwidthLimits(client.bandwidthLimit, s.bandwidthLimit)
+	tunnel.SetSharedStats(client.endpoint.GetStats())
+	if s.recorder != nil {
+		tunnel.SetRecorder(s.recorder.ForTunnel(client.uniqueID, tunnel.GetID()))
+	}
+}
+
+// newConnectionHandler returns the handler for connections on
+// a tunnel belonging to the provided client.
+func (s *GServer) newConnectionHandler(clientID string,
+	tunnelID string) *ServerConnectionHandler {
+
+	f := new(ServerConnectionHandler)
+	f.server = s
+	f.endpointID = clientID
+	f.tunnelID = tunnelID
+	return f
+}
+
 // DeleteTunnel will kill all TCP connections under the tunnel
 // and remove them from the list of managed tunnels.
 func (s *GServer) DeleteTunnel(
@@ -250,17 +454,23 @@ func (s *GServer) DeleteTunnel(
 		return fmt.Errorf("deletetunnel failed - client does not exist")
 	}
 
+	s.removeBridge(client, tunnelID)
+	return s.deleteTunnel(client, tunnelID)
+}
+
+// deleteTunnel will stop one of the client's tunnels and tell the
+// client to remove its end.
+func (s *GServer) deleteTunnel(client *ConnectedClient, tunnelID string) error {
 	if !client.endpoint.StopAndDeleteTunnel(tunnelID) {
 		return fmt.Errorf("failed to delete tunnel")
 	}
+	client.setRelay(tunnelID, false)
 
 	controlMessage := new(cs.EndpointControlMessage)
 	controlMessage.Operation = common.EndpointCtrlDeleteTunnel
 	controlMessage.TunnelId = tunnelID
 
-	client.endpointInput <- controlMessage
-
-	return nil
+	return client.sendEndpointRequest(controlMessage)
 }
 
 // DisconnectEndpoint will send a control message to the
@@ -280,8 +490,12 @@ func (s *GServer) DisconnectEndpoint(
 	controlMessage := new(cs.EndpointControlMessage)
 	controlMessage.Operation = common.EndpointCtrlDisconnect
 
-	client.endpointInput <- controlMessage
-	return nil
+	// The client may go away before its acknowledgement arrives
+	err := client.sendEndpointRequest(controlMessage)
+	if err == errClientDisconnected {
+		return nil
+	}
+	return err
 }
 
 // RegisterClient is responsible for building
@@ -315,6 +529,71 @@ func (s *GServer) GetEndpoint(clientID string) (*common.Endpoint, bool) {
 	return client.endpoint, ok
 }
 
+// SetBandwidthLimit will set the number of bytes per second allowed
+// for a tunnel, for all tunnels on a client, or for the whole server.
+// An empty clientID sets the server wide limit and an empty tunnelID
+// sets the limit for the client.
+func (s *GServer) SetBandwidthLimit(
+	clientID string,
+	tunnelID string,
+	bytesPerSecond uint64) error {
+
+	if clientID == "" {
+		s.bandwidthLimit.SetLimit(bytesPerSecond)
+		return nil
+	}
+
+	client, ok := s.connectedClients[clientID]
+
+	if !ok {
+		log.Printf("[!] client with uuuid: %s does not exist\n", clientID)
+		return fmt.Errorf("setbandwidthlimit failed - client does not exist")
+	}
+
+	if tunnelID == "" {
+		client.bandwidthLimit.SetLimit(bytesPerSecond)
+		return nil
+	}
+
+	tunnel, ok := client.endpoint.GetTunnel(tunnelID)
+
+	if !ok {
+		return fmt.Errorf("setbandwidthlimit failed - tunnel does not exist")
+	}
+
+	tunnel.GetBandwidthLimit().SetLimit(bytesPerSecond)
+	return nil
+}
+
+// SetCaptureDir sets the directory that pcapng files of
+// captured traffic are written to.
+func (s *GServer) SetCaptureDir(dir string) {
+	s.captures.SetDir(dir)
+}
+
+// SetRecordDir enables recording of every tunneled connection to
+// the store in the provided directory.
+func (s *GServer) SetRecordDir(dir string) error {
+	recorder, err := OpenRecorder(dir)
+	if err != nil {
+		return err
+	}
+	s.recorder = recorder
+	return nil
+}
+
+// GetRecorder returns the recording store, or nil if connections
+// are not recorded.
+func (s *GServer) GetRecorder() *Recorder {
+	return s.recorder
+}
+
+// SetReceiveWindow sets the maximum number of bytes buffered for
+// each direction of a tunneled connection.
+func (s *GServer) SetReceiveWindow(size uint32) {
+	s.receiveWindow = size
+}
+
 // Start will start the client and admin gprc servers.
 func (s *GServer) Start(
 	clientPort int,
@@ -327,31 +606,83 @@ func (s *GServer) Start(
 	s.adminServer.Start(adminPort)
 }
 
-// StartProxy starts a proxy on the provided endpoint ID
+// localProxy is a proxy that listens on the gServer and dials
+// its destinations through a gClient.
+type localProxy interface {
+	SetDial(dial common.DialFunc)
+	SetRequestLog(requestLog common.RequestLogFunc)
+	GetBindAddress() net.IP
+	Start() bool
+	Stop()
+}
+
+// StartProxy starts a socks proxy for the provided endpoint ID and
+// returns the ID of the proxy. By default the proxy listens on the
+// gServer and every connection is dialed by the gClient through a
+// dynamic tunnel with the same ID. If clientSide is set, the proxy
+// listens on the gClient host instead. A nil bindAddress listens on
+// 127.0.0.1 and an empty username allows clients to connect without
+// authenticating.
 func (s *GServer) StartProxy(
 	clientID string,
-	socksPort uint32) error {
+	socksID string,
+	socksPort uint32,
+	clientSide bool,
+	bindAddress net.IP,
+	username string,
+	password string) (string, error) {
 
 	client, ok := s.connectedClients[clientID]
 
 	if !ok {
 		log.Printf("[!] client with uuuid: %s does not exist\n", clientID)
-		return fmt.Errorf("startproxy failed - client does not exist")
+		return "", fmt.Errorf("startproxy failed - client does not exist")
 	}
 
-	log.Printf("Starting socks proxy on : %d", socksPort)
-	controlMessage := new(cs.EndpointControlMessage)
-	controlMessage.Operation = common.EndpointCtrlSocksProxy
-	controlMessage.ListenPort = uint32(socksPort)
+	_, exists := client.endpoint.GetSocksServer(socksID)
+	if _, ok := client.endpoint.GetTunnel(socksID); ok || exists || socksID == "" {
+		socksID = common.GenerateString(common.SocksIDSize)
+	}
 
-	client.endpointInput <- controlMessage
+	socksServer := common.NewSocksServer(socksID, socksPort)
+	socksServer.SetCredentials(username, password)
+	if bindAddress != nil {
+		socksServer.SetBindAddress(bindAddress)
+	}
 
-	return nil
+	if clientSide {
+		log.Printf("Starting socks proxy on client port: %d", socksPort)
+		socksServer.SetRemote(true)
+
+		controlMessage := new(cs.EndpointControlMessage)
+		controlMessage.Operation = common.EndpointCtrlSocksProxy
+		controlMessage.SocksId = socksID
+		controlMessage.ListenPort = uint32(socksPort)
+		controlMessage.ListenAddress = common.IPToBytes(bindAddress)
+		controlMessage.Username = username
+		controlMessage.Password = password
+
+		if err := client.sendEndpointRequest(controlMessage); err != nil {
+			return "", err
+		}
+	} else {
+		log.Printf("Starting socks proxy on : %d", socksPort)
+
+		err := s.startLocalProxy(client, clientID, socksID, socksPort, socksServer)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	client.endpoint.AddSocksServer(socksID, socksServer)
+	return socksID, nil
 }
 
-// StopProxy stops a proxy on the provided endpointID
+// StopProxy stops the socks proxy with the provided ID on the
+// provided endpointID. An empty socksID stops every proxy.
 func (s *GServer) StopProxy(
-	clientID string) error {
+	clientID string,
+	socksID string) error {
 
 	client, ok := s.connectedClients[clientID]
 
@@ -360,20 +691,395 @@ func (s *GServer) StopProxy(
 		return fmt.Errorf("stopproxy failed - client does not exist")
 	}
 
+	socksIDs := []string{socksID}
+	if socksID == "" {
+		socksIDs = nil
+		for id := range client.endpoint.GetSocksServers() {
+			socksIDs = append(socksIDs, id)
+		}
+	}
+
+	for _, id := range socksIDs {
+		socksServer, ok := client.endpoint.GetSocksServer(id)
+		if !ok {
+			return fmt.Errorf("stopproxy failed - socks proxy does not exist")
+		}
+
+		client.endpoint.StopAndDeleteSocksServer(id)
+
+		if !socksServer.IsRemote() {
+			if err := s.DeleteTunnel(clientID, id); err != nil {
+				return err
+			}
+			continue
+		}
+
+		controlMessage := new(cs.EndpointControlMessage)
+		controlMessage.Operation = common.EndpointCtrlSocksKill
+		controlMessage.SocksId = id
+
+		if err := client.sendEndpointRequest(controlMessage); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// StartHTTPProxy starts an http proxy for the provided endpoint ID
+// and returns the ID of the proxy. Where the proxy listens and how
+// clients authenticate work the same as for StartProxy.
+func (s *GServer) StartHTTPProxy(
+	clientID string,
+	proxyID string,
+	proxyPort uint32,
+	clientSide bool,
+	bindAddress net.IP,
+	username string,
+	password string) (string, error) {
+
+	client, ok := s.connectedClients[clientID]
+
+	if !ok {
+		log.Printf("[!] client with uuuid: %s does not exist\n", clientID)
+		return "", fmt.Errorf("starthttpproxy failed - client does not exist")
+	}
+
+	_, exists := client.endpoint.GetHTTPProxy(proxyID)
+	if _, ok := client.endpoint.GetTunnel(proxyID); ok || exists || proxyID == "" {
+		proxyID = common.GenerateString(common.HTTPProxyIDSize)
+	}
+
+	proxyServer := common.NewHTTPProxyServer(proxyID, proxyPort)
+	proxyServer.SetCredentials(username, password)
+	if bindAddress != nil {
+		proxyServer.SetBindAddress(bindAddress)
+	}
+
+	if clientSide {
+		log.Printf("Starting http proxy on client port: %d", proxyPort)
+		proxyServer.SetRemote(true)
+
+		controlMessage := new(cs.EndpointControlMessage)
+		controlMessage.Operation = common.EndpointCtrlHTTPProxy
+		controlMessage.HttpProxyId = proxyID
+		controlMessage.ListenPort = uint32(proxyPort)
+		controlMessage.ListenAddress = common.IPToBytes(bindAddress)
+		controlMessage.Username = username
+		controlMessage.Password = password
+
+		if err := client.sendEndpointRequest(controlMessage); err != nil {
+			return "", err
+		}
+	} else {
+		log.Printf("Starting http proxy on : %d", proxyPort)
+
+		err := s.startLocalProxy(client, clientID, proxyID, proxyPort, proxyServer)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	client.endpoint.AddHTTPProxy(proxyID, proxyServer)
+	return proxyID, nil
+}
+
+// StopHTTPProxy stops the http proxy with the provided ID on the
+// provided endpointID. An empty proxyID stops every http proxy.
+func (s *GServer) StopHTTPProxy(
+	clientID string,
+	proxyID string) error {
+
+	client, ok := s.connectedClients[clientID]
+
+	if !ok {
+		log.Printf("[!] client with uuuid: %s does not exist\n", clientID)
+		return fmt.Errorf("stophttpproxy failed - client does not exist")
+	}
+
+	proxyIDs := []string{proxyID}
+	if proxyID == "" {
+		proxyIDs = nil
+		for id := range client.endpoint.GetHTTPProxies() {
+			proxyIDs = append(proxyIDs, id)
+		}
+	}
+
+	for _, id := range proxyIDs {
+		proxyServer, ok := client.endpoint.GetHTTPProxy(id)
+		if !ok {
+			return fmt.Errorf("stophttpproxy failed - http proxy does not exist")
+		}
+
+		client.endpoint.StopAndDeleteHTTPProxy(id)
+
+		if !proxyServer.IsRemote() {
+			if err := s.DeleteTunnel(clientID, id); err != nil {
+				return err
+			}
+			continue
+		}
+
+		controlMessage := new(cs.EndpointControlMessage)
+		controlMessage.Operation = common.EndpointCtrlHTTPProxyKill
+		controlMessage.HttpProxyId = id
+
+		if err := client.sendEndpointRequest(controlMessage); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// StartVPN starts a VPN on the gServer for the provided endpoint ID
+// and returns the ID of the VPN. The VPN creates a TUN device with
+// the provided name and MTU, routes the provided networks to it and
+// carries every flow through a dynamic tunnel with the same ID, which
+// the gClient dials out of.
+func (s *GServer) StartVPN(
+	clientID string,
+	vpnID string,
+	device string,
+	mtu uint32,
+	routes []*net.IPNet) (string, error) {
+
+	client, ok := s.connectedClients[clientID]
+
+	if !ok {
+		log.Printf("[!] client with uuuid: %s does not exist\n", clientID)
+		return "", fmt.Errorf("startvpn failed - client does not exist")
+	}
+
+	if len(routes) == 0 {
+		return "", fmt.Errorf("startvpn failed - no routes provided")
+	}
+
+	_, exists := client.getVPN(vpnID)
+	if _, ok := client.endpoint.GetTunnel(vpnID); ok || exists || vpnID == "" {
+		vpnID = common.GenerateString(common.VPNIDSize)
+	}
+
+	vpn := NewVPN(vpnID, routes)
+	if device != "" {
+		vpn.SetDevice(device)
+	}
+	if mtu != 0 {
+		vpn.SetMTU(mtu)
+	}
+	vpn.SetICMP(client.hasCapability(common.CapabilityICMP))
+
+	log.Printf("Starting vpn on device: %s", vpn.GetDevice())
+
+	if err := s.startLocalProxy(client, clientID, vpnID, 0, vpn); err != nil {
+		return "", fmt.Errorf("failed to start vpn on device %s", vpn.GetDevice())
+	}
+
+	client.addVPN(vpnID, vpn)
+	return vpnID, nil
+}
+
+// StopVPN stops the VPN with the provided ID on the provided
+// endpointID. An empty vpnID stops every VPN.
+func (s *GServer) StopVPN(
+	clientID string,
+	vpnID string) error {
+
+	client, ok := s.connectedClients[clientID]
+
+	if !ok {
+		log.Printf("[!] client with uuuid: %s does not exist\n", clientID)
+		return fmt.Errorf("stopvpn failed - client does not exist")
+	}
+
+	vpnIDs := []string{vpnID}
+	if vpnID == "" {
+		vpnIDs = nil
+		for id := range client.getVPNs() {
+			vpnIDs = append(vpnIDs, id)
+		}
+	}
+
+	for _, id := range vpnIDs {
+		if !client.stopAndDeleteVPN(id) {
+			return fmt.Errorf("stopvpn failed - vpn does not exist")
+		}
+		if err := s.DeleteTunnel(clientID, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// startLocalProxy will start a proxy listening on the gServer.
+// Its connections are carried by a dynamic tunnel with the same
+// ID as the proxy, which the client dials out of.
+func (s *GServer) startLocalProxy(
+	client *ConnectedClient,
+	clientID string,
+	proxyID string,
+	proxyPort uint32,
+	proxy localProxy) error {
+
+	newTunnel := common.NewTunnel(proxyID,
+		common.TunnelDirectionForward,
+		proxy.GetBindAddress(),
+		proxyPort,
+		nil,
+		0)
+	s.configureTunnel(client, newTunnel)
+	newTunnel.SetDynamic(true)
+	newTunnel.SetPolicy(client.endpoint.GetPolicy())
+	newTunnel.ConnectionHandler = s.newConnectionHandler(clientID, proxyID)
+
+	proxy.SetDial(newTunnel.Dial)
+	proxy.SetRequestLog(func(request *common.ProxyRequest) {
+		s.proxyLog.Add(clientID, request)
+	})
+	if !proxy.Start() {
+		return fmt.Errorf("failed to listen on port: %d", proxyPort)
+	}
+
+	if err := s.addDynamicTunnel(client, proxyID, newTunnel); err != nil {
+		proxy.Stop()
+		return err
+	}
+
+	return nil
+}
+
+// addDynamicTunnel will add a dynamic tunnel to the client and tell
+// the client to dial the destination carried by each connection.
+func (s *GServer) addDynamicTunnel(
+	client *ConnectedClient,
+	tunnelID string,
+	tunnel *common.Tunnel) error {
+
+	client.endpoint.AddTunnel(tunnelID, tunnel)
+
 	controlMessage := new(cs.EndpointControlMessage)
-	controlMessage.Operation = common.EndpointCtrlSocksKill
+	controlMessage.Operation = common.EndpointCtrlAddTunnel
+	controlMessage.TunnelId = tunnelID
+	controlMessage.ReceiveWindow = tunnel.GetReceiveWindow()
+	controlMessage.Protocol = common.TunnelProtocolTCP
+	controlMessage.Dynamic = true
 
-	client.endpointInput <- controlMessage
+	if err := client.sendEndpointRequest(controlMessage); err != nil {
+		client.endpoint.StopAndDeleteTunnel(tunnelID)
+		return err
+	}
 
 	return nil
 }
 
+// SetPolicy replaces the policy deciding which destinations the
+// provided client may connect to. The client enforces it once the
+// destinations are resolved, and the gServer refuses what it can
+// decide before sending them to the client.
+func (s *GServer) SetPolicy(
+	clientID string,
+	rules []*common.PolicyRule,
+	defaultDeny bool) error {
+
+	client, ok := s.connectedClients[clientID]
+
+	if !ok {
+		log.Printf("[!] client with uuuid: %s does not exist\n", clientID)
+		return fmt.Errorf("setpolicy failed - client does not exist")
+	}
+
+	controlMessage := new(cs.EndpointControlMessage)
+	controlMessage.Operation = common.EndpointCtrlPolicy
+	controlMessage.PolicyDefaultDeny = defaultDeny
+	for _, rule := range rules {
+		controlMessage.PolicyRules = append(controlMessage.PolicyRules,
+			rule.ToMessage())
+	}
+
+	if err := client.sendEndpointRequest(controlMessage); err != nil {
+		return err
+	}
+
+	client.endpoint.GetPolicy().SetRules(rules, defaultDeny)
+	return nil
+}
+
+// sendEndpointRequest will send a control message to the client
+// and wait for the client to acknowledge it. An error is returned
+// if the client reports a failure or does not answer in time.
+func (c *ConnectedClient) sendEndpointRequest(
+	message *cs.EndpointControlMessage) error {
+
+	message.RequestId = common.GenerateString(common.RequestIDSize)
+	ack := make(chan *cs.EndpointControlMessage, 1)
+
+	c.requestMutex.Lock()
+	c.requests[message.RequestId] = ack
+	c.requestMutex.Unlock()
+
+	defer func() {
+		c.requestMutex.Lock()
+		delete(c.requests, message.RequestId)
+		c.requestMutex.Unlock()
+	}()
+
+	timer := time.NewTimer(EndpointRequestTimeout)
+	defer timer.Stop()
+
+	select {
+	case c.endpointInput <- message:
+	case <-c.disconnected:
+		return errClientDisconnected
+	case <-timer.C:
+		return fmt.Errorf("timed out sending request to client")
+	}
+
+	select {
+	case reply := <-ack:
+		if reply.ErrorStatus == 0 {
+			return nil
+		}
+		if reply.ErrorMessage == "" {
+			return fmt.Errorf("client failed request with status: %d",
+				reply.ErrorStatus)
+		}
+		return errors.New(reply.ErrorMessage)
+	case <-c.disconnected:
+		return errClientDisconnected
+	case <-timer.C:
+		return fmt.Errorf("timed out waiting for client")
+	}
+}
+
+// acknowledgeRequest will hand an acknowledgement from the
+// client to the request waiting on it.
+func (c *ConnectedClient) acknowledgeRequest(reply *cs.EndpointControlMessage) {
+	c.requestMutex.Lock()
+	ack, ok := c.requests[reply.RequestId]
+	c.requestMutex.Unlock()
+
+	if !ok {
+		log.Printf("[!] received acknowledgement for unknown request: %s",
+			reply.RequestId)
+		return
+	}
+
+	select {
+	case ack <- reply:
+	default:
+	}
+}
+
 // Acknowledge is called  when the remote client acknowledges that a tcp connection can
 // be established on the remote side.
 func (s *ServerConnectionHandler) Acknowledge(tunnel *common.Tunnel,
 	ctrlMessage *cs.TunnelControlMessage) common.ByteStream {
 
 	conn := tunnel.GetConnection(ctrlMessage.ConnectionId)
+	if conn == nil {
+		return nil
+	}
 
 	<-conn.Connected
 	return conn.GetStream()
@@ -382,26 +1088,28 @@ func (s *ServerConnectionHandler) Acknowledge(tunnel *common.Tunnel,
 //CloseStream will kill a TCP connection locally
 func (s *ServerConnectionHandler) CloseStream(tunnel *common.Tunnel, connID string) {
 
-	conn := tunnel.GetConnection(connID)
-
-	close(conn.Kill)
-
+	if conn := tunnel.GetConnection(connID); conn != nil {
+		conn.Close()
+	}
 }
 
 // GetByteStream will return the gRPC stream associated with a particular TCP connection.
 func (s *ServerConnectionHandler) GetByteStream(tunnel *common.Tunnel,
 	ctrlMessage *cs.TunnelControlMessage) common.ByteStream {
 
-	stream := tunnel.GetControlStream()
 	conn := tunnel.GetConnection(ctrlMessage.ConnectionId)
 
 	message := new(cs.TunnelControlMessage)
 	message.Operation = common.TunnelCtrlAck
 	message.TunnelId = s.tunnelID
 	message.ConnectionId = ctrlMessage.ConnectionId
+	// The client records the destinations tried and where we
+	// connected
+	message.Attempts = ctrlMessage.Attempts
+	message.RemoteAddress = ctrlMessage.RemoteAddress
 	// Since gRPC is always client to server, we need
 	// to get the client to make the byte stream connection.
-	stream.Send(message)
+	tunnel.SendControlMessage(message)
 	<-conn.Connected
 	return conn.GetStream()
 }
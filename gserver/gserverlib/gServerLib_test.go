@@ -0,0 +1,162 @@
+package gserverlib
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hotnops/gTunnel/common"
+	cs "github.com/hotnops/gTunnel/grpc/client"
+)
+
+// testDestination returns the address of a listener that accepts
+// connections until the test ends.
+func testDestination(t *testing.T) *net.TCPAddr {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr)
+}
+
+func TestServerAckCarriesAttemptsAndRemoteAddress(t *testing.T) {
+	s := newTestServer()
+	client := newTestClient(s, "client")
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %s", err)
+	}
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+	destination := testDestination(t)
+
+	tunnel := common.NewTunnel("tunnel", common.TunnelDirectionReverse,
+		net.IPv4(127, 0, 0, 1), 0, nil, 0)
+	s.configureTunnel(client, tunnel)
+	tunnel.SetDestinations(common.NewDestinationSet([]*common.TunnelDestination{
+		common.NewTunnelDestination("127.0.0.1", uint32(closedPort)),
+		common.NewTunnelDestination("127.0.0.1", uint32(destination.Port))},
+		common.DestinationStrategyFailover))
+	ctrl := startTestTunnel(t, s, client, tunnel)
+
+	ack, peer := connectTestTunnel(t, tunnel, ctrl, "conn")
+	if peer == nil {
+		t.Fatalf("connection failed: %s", ack.ErrorMessage)
+	}
+	if ack.RemoteAddress != destination.String() {
+		t.Errorf("ack remote address = %q; want %s", ack.RemoteAddress, destination)
+	}
+	if len(ack.Attempts) != 2 || ack.Attempts[0].ErrorMessage == "" ||
+		ack.Attempts[1].Index != 1 || ack.Attempts[1].ErrorMessage != "" {
+		t.Errorf("ack attempts = %v; want a failure and then the second destination",
+			ack.Attempts)
+	}
+}
+
+func TestEndpointRequestsMatchAcksByRequestID(t *testing.T) {
+	s := newTestServer()
+	client := newTestClient(s, "client")
+
+	results := make(map[string]chan error)
+	for _, tunnelID := range []string{"first", "second"} {
+		result := make(chan error, 1)
+		results[tunnelID] = result
+		go func(tunnelID string) {
+			result <- client.sendEndpointRequest(&cs.EndpointControlMessage{
+				Operation: common.EndpointCtrlDeleteTunnel,
+				TunnelId:  tunnelID,
+			})
+		}(tunnelID)
+	}
+
+	requests := make(map[string]*cs.EndpointControlMessage)
+	for len(requests) < 2 {
+		select {
+		case message := <-client.endpointInput:
+			requests[message.TunnelId] = message
+		case <-time.After(5 * time.Second):
+			t.Fatalf("requests were not sent to the client")
+		}
+	}
+	if requests["first"].RequestId == requests["second"].RequestId {
+		t.Fatalf("requests share the ID %s", requests["first"].RequestId)
+	}
+
+	// Acks for unknown requests are ignored and the others are
+	// answered out of order
+	client.acknowledgeRequest(&cs.EndpointControlMessage{
+		Operation: common.EndpointCtrlAck,
+		RequestId: "unknown",
+	})
+	client.acknowledgeRequest(&cs.EndpointControlMessage{
+		Operation: common.EndpointCtrlAck,
+		RequestId: requests["second"].RequestId,
+	})
+	client.acknowledgeRequest(&cs.EndpointControlMessage{
+		Operation:    common.EndpointCtrlAck,
+		RequestId:    requests["first"].RequestId,
+		ErrorStatus:  1,
+		ErrorMessage: "tunnel does not exist: first",
+	})
+
+	if err := <-results["second"]; err != nil {
+		t.Errorf("second request failed: %s", err)
+	}
+	if err := <-results["first"]; err == nil || err.Error() != "tunnel does not exist: first" {
+		t.Errorf("first request = %v; want the client's error", err)
+	}
+	client.requestMutex.Lock()
+	pending := len(client.requests)
+	client.requestMutex.Unlock()
+	if pending != 0 {
+		t.Errorf("%d requests are still waiting", pending)
+	}
+}
+
+func TestEndpointRequestTimesOut(t *testing.T) {
+	defer func(timeout time.Duration) {
+		EndpointRequestTimeout = timeout
+	}(EndpointRequestTimeout)
+	EndpointRequestTimeout = 50 * time.Millisecond
+
+	s := newTestServer()
+	client := newTestClient(s, "client")
+	request := &cs.EndpointControlMessage{Operation: common.EndpointCtrlDeleteTunnel}
+
+	// Nothing reads the request
+	if err := client.sendEndpointRequest(request); err == nil ||
+		!strings.Contains(err.Error(), "timed out sending") {
+		t.Errorf("unread request = %v; want a timeout", err)
+	}
+
+	// The request is read but never acknowledged
+	go func() { <-client.endpointInput }()
+	if err := client.sendEndpointRequest(request); err == nil ||
+		!strings.Contains(err.Error(), "timed out waiting") {
+		t.Errorf("unacknowledged request = %v; want a timeout", err)
+	}
+
+	// A late ack is not delivered to anyone
+	client.acknowledgeRequest(&cs.EndpointControlMessage{
+		Operation: common.EndpointCtrlAck,
+		RequestId: request.RequestId,
+	})
+
+	close(client.disconnected)
+	if err := client.sendEndpointRequest(request); err != errClientDisconnected {
+		t.Errorf("request to a disconnected client = %v; want %v",
+			err, errClientDisconnected)
+	}
+}
@@ -0,0 +1,73 @@
+package gserverlib
+
+import (
+	"log"
+	"sync"
+
+	"github.com/hotnops/gTunnel/common"
+)
+
+// MaxProxyLogEntries is the number of proxied requests kept by
+// the gServer. Once it is reached the oldest are dropped.
+const MaxProxyLogEntries = 100000
+
+// ProxyLogEntry is a request made through one of a client's
+// socks or http proxies.
+type ProxyLogEntry struct {
+	ClientID string
+	Request  *common.ProxyRequest
+}
+
+// ProxyLog keeps a record of every request made through the
+// proxies of every client, including those that have since
+// disconnected.
+type ProxyLog struct {
+	entries []*ProxyLogEntry
+	mutex   sync.Mutex
+}
+
+// NewProxyLog is a constructor for the ProxyLog struct.
+func NewProxyLog() *ProxyLog {
+	return new(ProxyLog)
+}
+
+// Add will record a request made through a proxy of the
+// provided client.
+func (l *ProxyLog) Add(clientID string, request *common.ProxyRequest) {
+	result := "success"
+	if request.Error != "" {
+		result = request.Error
+	}
+	log.Printf("[*] %s proxy %s %s %s from %s to %s (%s): sent %d, received %d, %s: %s",
+		clientID, request.ProxyID, request.Protocol, request.Command,
+		request.Source, request.Host, request.ResolvedAddress,
+		request.BytesSent, request.BytesReceived, request.Duration, result)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if len(l.entries) == MaxProxyLogEntries {
+		l.entries[0] = nil
+		l.entries = l.entries[1:]
+	}
+	l.entries = append(l.entries, &ProxyLogEntry{ClientID: clientID, Request: request})
+}
+
+// List returns the recorded requests, oldest first. An empty
+// clientID or proxyID matches every client or proxy.
+func (l *ProxyLog) List(clientID string, proxyID string) []*ProxyLogEntry {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var entries []*ProxyLogEntry
+	for _, entry := range l.entries {
+		if clientID != "" && entry.ClientID != clientID {
+			continue
+		}
+		if proxyID != "" && entry.Request.ProxyID != proxyID {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
@@ -0,0 +1,524 @@
+package gserverlib
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hotnops/gTunnel/common"
+)
+
+// RecordingIDSize is the length of generated recording IDs.
+const RecordingIDSize = 16
+
+// recordingIndexName is the name of the index file in a recording
+// directory.
+const recordingIndexName = "index.jsonl"
+
+// recordingMagic starts every recording file and seeds its hash
+// chain.
+var recordingMagic = []byte("GTUNREC1")
+
+const (
+	recordingFrameData = iota
+	recordingFrameFin
+)
+
+const (
+	recordingFromSource = iota
+	recordingFromDestination
+)
+
+// recordingFrameHeaderSize is the size of a frame's type,
+// direction, timestamp and length.
+const recordingFrameHeaderSize = 14
+
+// Recorder keeps an append-only record of everything sent in both
+// directions over tunneled connections. Each connection is written
+// to a file of its own as a series of timestamped frames, and every
+// frame extends a SHA-256 hash chain that starts from the file's
+// magic. An index file gets a line when a recording starts and
+// another when it ends, which carries the head of the chain. Every
+// index line holds the hash of the line before it, so removing or
+// changing a line, a frame or a whole recording can be detected.
+//
+// The chains are not keyed, so anyone who can write to the store
+// can also rewrite them to match. The head of the index chain is
+// logged each time a recording ends so that it can be kept
+// elsewhere; a store whose index no longer leads to a head kept
+// elsewhere has been rewritten.
+type Recorder struct {
+	dir       string
+	index     *os.File
+	indexHash string
+	entries   map[string]*RecordingEntry
+	sessions  map[*common.Connection]*recordingSession
+	live      map[string]*recordingSession
+	// mutex guards the maps and the index. Recordings are
+	// written under the lock of their own session.
+	mutex sync.Mutex
+}
+
+// RecordingEntry describes a recorded connection. The source is the
+// side of the gServer's socket that opened the connection and the
+// destination is the side that accepted it. The remote address is
+// where the remote endpoint connected to, if it reported one.
+type RecordingEntry struct {
+	ID                   string    `json:"id"`
+	ClientID             string    `json:"client_id"`
+	TunnelID             string    `json:"tunnel_id"`
+	ConnectionID         string    `json:"connection_id"`
+	Protocol             string    `json:"protocol"`
+	Source               string    `json:"source"`
+	Destination          string    `json:"destination"`
+	RemoteAddress        string    `json:"remote_address,omitempty"`
+	File                 string    `json:"file"`
+	StartTime            time.Time `json:"start_time"`
+	EndTime              time.Time `json:"end_time,omitempty"`
+	Frames               uint64    `json:"frames"`
+	BytesFromSource      uint64    `json:"bytes_from_source"`
+	BytesFromDestination uint64    `json:"bytes_from_destination"`
+	Hash                 string    `json:"hash,omitempty"`
+	// Interrupted is true if the gServer stopped before the
+	// connection closed.
+	Interrupted bool `json:"interrupted,omitempty"`
+}
+
+// IsFinished returns true once the recorded connection has closed.
+func (e *RecordingEntry) IsFinished() bool {
+	return !e.EndTime.IsZero()
+}
+
+// RecordingFilter selects recordings. Empty fields match every
+// recording. The address matches the source, destination or remote
+// address, either as a whole or by its host.
+type RecordingFilter struct {
+	ClientID     string
+	TunnelID     string
+	ConnectionID string
+	Protocol     string
+	Address      string
+}
+
+// matches returns true if the entry is selected by the filter.
+func (f *RecordingFilter) matches(e *RecordingEntry) bool {
+	if (f.ClientID != "" && f.ClientID != e.ClientID) ||
+		(f.TunnelID != "" && f.TunnelID != e.TunnelID) ||
+		(f.ConnectionID != "" && f.ConnectionID != e.ConnectionID) ||
+		(f.Protocol != "" && f.Protocol != e.Protocol) {
+		return false
+	}
+	if f.Address == "" {
+		return true
+	}
+	for _, address := range []string{e.Source, e.Destination, e.RemoteAddress} {
+		host, _, err := net.SplitHostPort(address)
+		if address == f.Address || (err == nil && host == f.Address) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordingIndexLine is a line of the index file.
+type recordingIndexLine struct {
+	Event string          `json:"event"`
+	Entry *RecordingEntry `json:"entry"`
+	Prev  string          `json:"prev"`
+}
+
+// recordingSession is a connection being recorded.
+type recordingSession struct {
+	entry *RecordingEntry
+	file  *os.File
+	hash  []byte
+	// dialed is true if the gServer opened the connection
+	dialed bool
+	closed bool
+	mutex  sync.Mutex
+}
+
+// recordingSource records a tunnel's connections to a Recorder.
+type recordingSource struct {
+	recorder *Recorder
+	clientID string
+	tunnelID string
+}
+
+// OpenRecorder opens the recording store in the provided directory,
+// creating it if it does not exist.
+func OpenRecorder(dir string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, recordingIndexName)
+	lines, indexHash, err := readRecordingIndex(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	index, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	r := new(Recorder)
+	r.dir = dir
+	r.index = index
+	r.indexHash = indexHash
+	r.entries = make(map[string]*RecordingEntry)
+	r.sessions = make(map[*common.Connection]*recordingSession)
+	r.live = make(map[string]*recordingSession)
+	for _, line := range lines {
+		r.entries[line.Entry.ID] = line.Entry
+	}
+
+	// Recordings the gServer was stopped in the middle of are
+	// finished with what made it to disk
+	for _, entry := range r.entries {
+		if !entry.IsFinished() {
+			r.finishInterrupted(entry)
+		}
+	}
+	if r.indexHash != "" {
+		log.Printf("[*] Recording index head: %s", r.indexHash)
+	}
+	return r, nil
+}
+
+// finishInterrupted will finish the recording of a connection that
+// was still open when the gServer stopped.
+func (r *Recorder) finishInterrupted(entry *RecordingEntry) {
+	path := filepath.Join(r.dir, entry.File)
+	frames, hash, err := readRecordingFrames(path)
+	if err != nil {
+		log.Printf("[!] Interrupted recording %s is damaged: %s", entry.ID, err)
+	}
+
+	entry.Interrupted = true
+	entry.EndTime = entry.StartTime
+	entry.Hash = hash
+	entry.Frames = uint64(len(frames))
+	for _, frame := range frames {
+		if frame.direction == recordingFromSource {
+			entry.BytesFromSource += uint64(len(frame.data))
+		} else {
+			entry.BytesFromDestination += uint64(len(frame.data))
+		}
+		entry.EndTime = frame.time
+	}
+	os.Chmod(path, 0400)
+	r.appendIndex("end", entry)
+}
+
+// ForTunnel returns the recorder for the connections of the
+// provided client's tunnel.
+func (r *Recorder) ForTunnel(clientID string, tunnelID string) common.ConnectionRecorder {
+	return &recordingSource{recorder: r, clientID: clientID, tunnelID: tunnelID}
+}
+
+// GetHead returns the hash of the last line of the index, which can
+// be kept elsewhere to detect the store being rewritten.
+func (r *Recorder) GetHead() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.indexHash
+}
+
+// GetDir returns the directory of the recording store.
+func (r *Recorder) GetDir() string {
+	return r.dir
+}
+
+// List returns the recordings selected by the filter, oldest first.
+func (r *Recorder) List(filter RecordingFilter) []*RecordingEntry {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var entries []*RecordingEntry
+	for _, entry := range r.entries {
+		if copied := r.copyEntry(entry); filter.matches(copied) {
+			entries = append(entries, copied)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].StartTime.Before(entries[j].StartTime)
+	})
+	return entries
+}
+
+// Get returns the recording with the provided ID.
+func (r *Recorder) Get(id string) (*RecordingEntry, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	entry, ok := r.entries[id]
+	if !ok {
+		return nil, false
+	}
+	return r.copyEntry(entry), true
+}
+
+// copyEntry returns a copy of an entry. The caller holds the
+// recorder's mutex. Entries of recordings in progress are updated
+// under the lock of their session.
+func (r *Recorder) copyEntry(entry *RecordingEntry) *RecordingEntry {
+	if session, ok := r.live[entry.ID]; ok {
+		session.mutex.Lock()
+		defer session.mutex.Unlock()
+	}
+	copied := *entry
+	return &copied
+}
+
+// Close will finish every recording in progress and close the index.
+func (r *Recorder) Close() error {
+	r.mutex.Lock()
+	sessions := r.sessions
+	r.sessions = make(map[*common.Connection]*recordingSession)
+	r.mutex.Unlock()
+
+	for _, session := range sessions {
+		r.finish(session)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.index.Close()
+}
+
+// RecordStart will start recording a connection that has just been
+// connected.
+func (s *recordingSource) RecordStart(conn *common.Connection,
+	remoteAddress string) {
+
+	s.recorder.recordStart(s, conn, remoteAddress)
+}
+
+// RecordData will add data carried by conn to its recording.
+// fromLocal is true for data read from the local socket.
+func (s *recordingSource) RecordData(conn *common.Connection, fromLocal bool,
+	data []byte) {
+
+	if session := s.recorder.getSession(conn); session != nil {
+		session.writeFrame(recordingFrameData, fromLocal, data)
+	}
+}
+
+// RecordFin will note in conn's recording that one side finished
+// sending.
+func (s *recordingSource) RecordFin(conn *common.Connection, fromLocal bool) {
+	if session := s.recorder.getSession(conn); session != nil {
+		session.writeFrame(recordingFrameFin, fromLocal, nil)
+	}
+}
+
+// RecordClose will finish conn's recording.
+func (s *recordingSource) RecordClose(conn *common.Connection) {
+	r := s.recorder
+	r.mutex.Lock()
+	session, ok := r.sessions[conn]
+	delete(r.sessions, conn)
+	r.mutex.Unlock()
+
+	if ok {
+		r.finish(session)
+	}
+}
+
+// recordStart will start recording a connection that has just been
+// connected.
+func (r *Recorder) recordStart(source *recordingSource, conn *common.Connection,
+	remoteAddress string) {
+
+	if r.getSession(conn) != nil {
+		return
+	}
+
+	entry := new(RecordingEntry)
+	entry.ID = common.GenerateString(RecordingIDSize)
+	entry.ClientID = source.clientID
+	entry.TunnelID = source.tunnelID
+	entry.ConnectionID = conn.ID
+	entry.Protocol = "tcp"
+	if conn.IsDatagram() {
+		entry.Protocol = "udp"
+	}
+	entry.Source = addrString(conn.Conn.RemoteAddr())
+	entry.Destination = addrString(conn.Conn.LocalAddr())
+	if conn.IsDialed() {
+		entry.Source, entry.Destination = entry.Destination, entry.Source
+	}
+	entry.RemoteAddress = remoteAddress
+	entry.File = entry.ID + ".rec"
+	entry.StartTime = time.Now()
+
+	file, err := os.OpenFile(filepath.Join(r.dir, entry.File),
+		os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		log.Printf("[!] Failed to start recording %s: %s", entry.ID, err)
+		return
+	}
+	if _, err := file.Write(recordingMagic); err != nil {
+		log.Printf("[!] Failed to start recording %s: %s", entry.ID, err)
+		file.Close()
+		return
+	}
+
+	session := new(recordingSession)
+	session.entry = entry
+	session.file = file
+	session.dialed = conn.IsDialed()
+	hash := sha256.Sum256(recordingMagic)
+	session.hash = hash[:]
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.sessions[conn] = session
+	r.live[entry.ID] = session
+	r.entries[entry.ID] = entry
+	r.appendIndex("start", entry)
+}
+
+// getSession returns the recording of conn, or nil if it is not
+// being recorded.
+func (r *Recorder) getSession(conn *common.Connection) *recordingSession {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.sessions[conn]
+}
+
+// writeFrame appends a frame to a recording and extends its hash
+// chain.
+func (s *recordingSession) writeFrame(frameType byte, fromLocal bool,
+	data []byte) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	// The local socket's peer is the source unless the gServer
+	// dialed it
+	direction := byte(recordingFromSource)
+	if fromLocal == s.dialed {
+		direction = recordingFromDestination
+	}
+
+	frame := make([]byte, recordingFrameHeaderSize, recordingFrameHeaderSize+len(data))
+	frame[0] = frameType
+	frame[1] = direction
+	binary.BigEndian.PutUint64(frame[2:], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint32(frame[10:], uint32(len(data)))
+	frame = append(frame, data...)
+
+	if _, err := s.file.Write(frame); err != nil {
+		log.Printf("[!] Recording %s failed to write: %s", s.entry.ID, err)
+		return
+	}
+
+	hash := sha256.Sum256(append(s.hash, frame...))
+	s.hash = hash[:]
+	s.entry.Frames++
+	if direction == recordingFromSource {
+		s.entry.BytesFromSource += uint64(len(data))
+	} else {
+		s.entry.BytesFromDestination += uint64(len(data))
+	}
+}
+
+// finish will close a recording's file, leave it read only and
+// write its hash to the index.
+func (r *Recorder) finish(session *recordingSession) {
+	session.mutex.Lock()
+	if session.closed {
+		session.mutex.Unlock()
+		return
+	}
+	session.closed = true
+	session.file.Close()
+	os.Chmod(session.file.Name(), 0400)
+	session.entry.EndTime = time.Now()
+	session.entry.Hash = hex.EncodeToString(session.hash)
+	session.mutex.Unlock()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.live, session.entry.ID)
+	r.appendIndex("end", session.entry)
+	log.Printf("[*] Recording index head: %s", r.indexHash)
+}
+
+// appendIndex adds a line for an entry to the index. The caller
+// holds the recorder's mutex.
+func (r *Recorder) appendIndex(event string, entry *RecordingEntry) {
+	line, err := json.Marshal(&recordingIndexLine{Event: event, Entry: entry,
+		Prev: r.indexHash})
+	if err != nil {
+		log.Printf("[!] Failed to index recording %s: %s", entry.ID, err)
+		return
+	}
+	if _, err := r.index.Write(append(line, '\n')); err != nil {
+		log.Printf("[!] Failed to index recording %s: %s", entry.ID, err)
+		return
+	}
+	hash := sha256.Sum256(line)
+	r.indexHash = hex.EncodeToString(hash[:])
+}
+
+// readRecordingIndex reads the lines of an index file, checking that
+// each one holds the hash of the one before it. It returns the hash
+// of the last line.
+func readRecordingIndex(path string) ([]*recordingIndexLine, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+
+	var lines []*recordingIndexLine
+	hash := ""
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	for number := 1; scanner.Scan(); number++ {
+		line := new(recordingIndexLine)
+		if err := json.Unmarshal(scanner.Bytes(), line); err != nil ||
+			line.Entry == nil {
+			return nil, "", fmt.Errorf("index line %d is corrupt", number)
+		}
+		if line.Prev != hash {
+			return nil, "", fmt.Errorf("index line %d does not follow line %d",
+				number, number-1)
+		}
+		sum := sha256.Sum256(scanner.Bytes())
+		hash = hex.EncodeToString(sum[:])
+		lines = append(lines, line)
+	}
+	return lines, hash, scanner.Err()
+}
+
+// addrString formats an address, which may be nil.
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
@@ -0,0 +1,127 @@
+package gserverlib
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hotnops/gTunnel/common"
+)
+
+func TestRecorderRecordsAndVerifies(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	local, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+
+	dir := t.TempDir()
+	recorder, err := OpenRecorder(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := common.NewConnection(local)
+	conn.ID = "conn"
+	source := recorder.ForTunnel("client", "tunnel")
+	source.RecordStart(conn, "10.0.0.1:22")
+	source.RecordData(conn, true, []byte("request"))
+	source.RecordData(conn, false, []byte("response"))
+	source.RecordFin(conn, true)
+	source.RecordClose(conn)
+
+	entries := recorder.List(RecordingFilter{ClientID: "client",
+		Address: "10.0.0.1"})
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 recording, got %d", len(entries))
+	}
+	entry := entries[0]
+	if entry.Source != local.RemoteAddr().String() || entry.ConnectionID != "conn" ||
+		entry.BytesFromSource != 7 || entry.BytesFromDestination != 8 {
+		t.Errorf("unexpected entry: %+v", entry)
+	}
+	if len(recorder.List(RecordingFilter{TunnelID: "other"})) != 0 {
+		t.Errorf("filter matched another tunnel")
+	}
+
+	var raw bytes.Buffer
+	if err := recorder.Export(entry.ID, common.RecordingFormatRaw,
+		common.RecordingDirectionSource, &raw); err != nil || raw.String() != "request" {
+		t.Errorf("unexpected raw export %q: %v", raw.String(), err)
+	}
+
+	var cast bytes.Buffer
+	if err := recorder.Export(entry.ID, common.RecordingFormatAsciicast,
+		common.RecordingDirectionBoth, &cast); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(cast.String()), "\n")
+	var event []interface{}
+	if len(lines) != 3 || json.Unmarshal([]byte(lines[1]), &event) != nil ||
+		event[1] != "i" || event[2] != "request" {
+		t.Errorf("unexpected cast: %s", cast.String())
+	}
+
+	// The store is read back when it is opened again
+	recorder.Close()
+	if recorder, err = OpenRecorder(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer recorder.Close()
+	results, err := recorder.Verify("")
+	if err != nil || len(results) != 1 || results[entry.ID] != nil {
+		t.Fatalf("verification failed: %v %v", results, err)
+	}
+
+	// Changing a byte of the recording breaks its hash chain
+	path := filepath.Join(dir, entry.File)
+	os.Chmod(path, 0600)
+	data, _ := os.ReadFile(path)
+	data[len(data)-1] ^= 0xff
+	os.WriteFile(path, data, 0600)
+	if results, err := recorder.Verify(entry.ID); err != nil || results[entry.ID] == nil {
+		t.Errorf("tampered recording verified: %v", err)
+	}
+}
+
+func TestRecorderFinishesInterruptedRecordings(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+
+	dir := t.TempDir()
+	recorder, err := OpenRecorder(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := common.NewConnection(local)
+	source := recorder.ForTunnel("client", "tunnel")
+	source.RecordStart(conn, "")
+	source.RecordData(conn, true, []byte("request"))
+
+	// The gServer stops without closing the recorder
+	if recorder, err = OpenRecorder(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer recorder.Close()
+
+	entries := recorder.List(RecordingFilter{})
+	if len(entries) != 1 || !entries[0].IsFinished() || !entries[0].Interrupted ||
+		entries[0].BytesFromSource != 7 {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+	results, err := recorder.Verify("")
+	if err != nil || results[entries[0].ID] != nil {
+		t.Fatalf("verification failed: %v %v", results, err)
+	}
+}
@@ -0,0 +1,208 @@
+package gserverlib
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hotnops/gTunnel/common"
+)
+
+// recordingFrame is a frame read back from a recording file.
+type recordingFrame struct {
+	frameType byte
+	direction byte
+	time      time.Time
+	data      []byte
+}
+
+// Export will write a recording to w. The raw format is the data
+// sent in the selected direction, in the order it was sent. The
+// asciicast format is an asciinema v2 cast of both directions, with
+// data from the destination as output and data from the source as
+// input, which replays text protocols such as shells.
+func (r *Recorder) Export(id string, format uint32, direction uint32,
+	w io.Writer) error {
+
+	entry, ok := r.Get(id)
+	if !ok {
+		return fmt.Errorf("recording %s does not exist", id)
+	}
+	frames, _, err := readRecordingFrames(filepath.Join(r.dir, entry.File))
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case common.RecordingFormatRaw:
+		for _, frame := range frames {
+			if frame.frameType != recordingFrameData ||
+				(direction == common.RecordingDirectionSource &&
+					frame.direction != recordingFromSource) ||
+				(direction == common.RecordingDirectionDestination &&
+					frame.direction != recordingFromDestination) {
+				continue
+			}
+			if _, err := w.Write(frame.data); err != nil {
+				return err
+			}
+		}
+		return nil
+	case common.RecordingFormatAsciicast:
+		return exportAsciicast(entry, frames, w)
+	}
+	return fmt.Errorf("unknown export format %d", format)
+}
+
+// exportAsciicast writes the frames of a recording as an asciinema
+// v2 cast. Bytes that are not valid UTF-8 are replaced.
+func exportAsciicast(entry *RecordingEntry, frames []*recordingFrame,
+	w io.Writer) error {
+
+	header := map[string]interface{}{
+		"version":   2,
+		"width":     80,
+		"height":    24,
+		"timestamp": entry.StartTime.Unix(),
+		"title": fmt.Sprintf("%s %s -> %s", entry.Protocol, entry.Source,
+			entry.Destination),
+	}
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(header); err != nil {
+		return err
+	}
+
+	for _, frame := range frames {
+		if frame.frameType != recordingFrameData {
+			continue
+		}
+		eventType := "o"
+		if frame.direction == recordingFromSource {
+			eventType = "i"
+		}
+		offset := frame.time.Sub(entry.StartTime).Seconds()
+		if offset < 0 {
+			offset = 0
+		}
+		event := []interface{}{offset, eventType, string(frame.data)}
+		if err := encoder.Encode(event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Verify checks the index of the recording store and the recording
+// with the provided ID against their hash chains. An empty ID checks
+// every recording. It returns the recordings that were checked, each
+// with the error found, or nil if it is intact.
+func (r *Recorder) Verify(id string) (map[string]error, error) {
+	// The index on disk is checked rather than the one in memory
+	r.mutex.Lock()
+	lines, _, err := readRecordingIndex(r.index.Name())
+	r.mutex.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]*RecordingEntry)
+	for _, line := range lines {
+		if line.Event == "end" || entries[line.Entry.ID] == nil {
+			entries[line.Entry.ID] = line.Entry
+		}
+	}
+
+	results := make(map[string]error)
+	for entryID, entry := range entries {
+		if id == "" || id == entryID {
+			results[entryID] = r.verifyEntry(entry)
+		}
+	}
+	if id != "" && len(results) == 0 {
+		return nil, fmt.Errorf("recording %s does not exist", id)
+	}
+	return results, nil
+}
+
+// verifyEntry checks a recording file against its entry in the
+// index.
+func (r *Recorder) verifyEntry(entry *RecordingEntry) error {
+	frames, hash, err := readRecordingFrames(filepath.Join(r.dir, entry.File))
+	if err != nil {
+		return err
+	}
+	if !entry.IsFinished() {
+		return fmt.Errorf("recording has not finished")
+	}
+	if hash != entry.Hash {
+		return fmt.Errorf("hash %s does not match the index", hash)
+	}
+
+	var fromSource, fromDestination uint64
+	for _, frame := range frames {
+		if frame.direction == recordingFromSource {
+			fromSource += uint64(len(frame.data))
+		} else {
+			fromDestination += uint64(len(frame.data))
+		}
+	}
+	if uint64(len(frames)) != entry.Frames || fromSource != entry.BytesFromSource ||
+		fromDestination != entry.BytesFromDestination {
+		return fmt.Errorf("frames do not match the index")
+	}
+	return nil
+}
+
+// readRecordingFrames reads the frames of a recording file and
+// returns them along with the head of their hash chain.
+func readRecordingFrames(path string) ([]*recordingFrame, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+
+	magic := make([]byte, len(recordingMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil ||
+		!bytes.Equal(magic, recordingMagic) {
+		return nil, "", fmt.Errorf("%s is not a recording", path)
+	}
+	sum := sha256.Sum256(recordingMagic)
+	hash := sum[:]
+
+	var frames []*recordingFrame
+	header := make([]byte, recordingFrameHeaderSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, "", fmt.Errorf("frame %d is truncated", len(frames)+1)
+		}
+
+		frame := new(recordingFrame)
+		frame.frameType = header[0]
+		frame.direction = header[1]
+		frame.time = time.Unix(0, int64(binary.BigEndian.Uint64(header[2:])))
+		size := binary.BigEndian.Uint32(header[10:])
+		if size > common.MaxDatagramSize {
+			return nil, "", fmt.Errorf("frame %d is corrupt", len(frames)+1)
+		}
+		frame.data = make([]byte, size)
+		if _, err := io.ReadFull(reader, frame.data); err != nil {
+			return nil, "", fmt.Errorf("frame %d is truncated", len(frames)+1)
+		}
+
+		sum := sha256.Sum256(append(append(hash, header...), frame.data...))
+		hash = sum[:]
+		frames = append(frames, frame)
+	}
+	return frames, hex.EncodeToString(hash), nil
+}
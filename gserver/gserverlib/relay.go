@@ -0,0 +1,147 @@
+package gserverlib
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hotnops/gTunnel/common"
+)
+
+// A relay is a reverse tunnel on a gClient whose listener accepts
+// connections from downstream gClients that can not reach the
+// gServer. Instead of dialing a destination, the gServer hands each
+// relayed connection to its own client service, so the downstream
+// gClient speaks to the gServer end to end through the relay and
+// every tunnel on it works like any other. Relays can be chained up
+// to MaxRelayHops deep.
+
+// MaxRelayHops is the largest number of relays a gClient can be
+// connected through.
+const MaxRelayHops = 8
+
+// relayAddr is the address of a gClient that connected through a
+// relay. The hop path lists the IDs of the relaying gClients,
+// starting with the one connected directly to the gServer.
+type relayAddr struct {
+	hops []string
+}
+
+func (a *relayAddr) Network() string { return "relay" }
+func (a *relayAddr) String() string {
+	return "relay:" + strings.Join(a.hops, ">")
+}
+
+// relayConn is a connection handed to the client service by a relay.
+type relayConn struct {
+	net.Conn
+	addr *relayAddr
+}
+
+// RemoteAddr returns the relay the connection came through.
+func (c *relayConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// relayListener is the listener the client service accepts relayed
+// connections from.
+type relayListener struct {
+	conns     chan net.Conn
+	done      chan bool
+	closeOnce sync.Once
+}
+
+// newRelayListener is a constructor for the relayListener struct.
+func newRelayListener() *relayListener {
+	l := new(relayListener)
+	l.conns = make(chan net.Conn)
+	l.done = make(chan bool)
+	return l
+}
+
+// Accept waits for the next relayed connection.
+func (l *relayListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting relayed connections.
+func (l *relayListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+// Addr returns an address with an empty hop path.
+func (l *relayListener) Addr() net.Addr {
+	return &relayAddr{}
+}
+
+// dial returns a DialFunc that hands a new connection from a relay
+// on the provided client to the client service, ignoring the
+// address it is given. Connections that would take a gClient past
+// MaxRelayHops are refused.
+func (l *relayListener) dial(client *ConnectedClient) common.DialFunc {
+	return func(network string, address string) (net.Conn, error) {
+		if err := client.checkRelayHops(); err != nil {
+			return nil, err
+		}
+		addr := new(relayAddr)
+		addr.hops = append(append([]string{}, client.hops...), client.uniqueID)
+
+		local, remote := common.Pipe()
+		select {
+		case l.conns <- &relayConn{Conn: remote, addr: addr}:
+			return local, nil
+		case <-l.done:
+		case <-time.After(common.DialTimeout):
+		}
+		local.Close()
+		remote.Close()
+		return nil, fmt.Errorf("the client service is not accepting relayed connections")
+	}
+}
+
+// checkRelayHops returns an error if a gClient connecting through a
+// relay on the client would be more than MaxRelayHops deep.
+func (c *ConnectedClient) checkRelayHops() error {
+	if len(c.hops)+1 > MaxRelayHops {
+		return fmt.Errorf("relays are limited to %d hops", MaxRelayHops)
+	}
+	return nil
+}
+
+// isRelay returns true if the client's tunnel is a relay.
+func (c *ConnectedClient) isRelay(tunnelID string) bool {
+	c.tunnelMutex.Lock()
+	defer c.tunnelMutex.Unlock()
+
+	return c.relays[tunnelID]
+}
+
+// setRelay records whether the client's tunnel is a relay.
+func (c *ConnectedClient) setRelay(tunnelID string, relay bool) {
+	c.tunnelMutex.Lock()
+	defer c.tunnelMutex.Unlock()
+
+	if !relay {
+		delete(c.relays, tunnelID)
+		return
+	}
+	if c.relays == nil {
+		c.relays = make(map[string]bool)
+	}
+	c.relays[tunnelID] = true
+}
+
+// isRelay returns true if the tunnel of the provided client is a
+// relay.
+func (s *GServer) isRelay(clientID string, tunnelID string) bool {
+	client, ok := s.connectedClients[clientID]
+	return ok && client.isRelay(tunnelID)
+}
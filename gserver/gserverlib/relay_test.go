@@ -0,0 +1,284 @@
+package gserverlib
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hotnops/gTunnel/common"
+	cs "github.com/hotnops/gTunnel/grpc/client"
+)
+
+// testControlStream is an in-memory TunnelControlStream. Messages
+// written to in are received by the tunnel and messages the tunnel
+// sends are read from out.
+type testControlStream struct {
+	in  chan *cs.TunnelControlMessage
+	out chan *cs.TunnelControlMessage
+}
+
+func newTestControlStream() *testControlStream {
+	s := new(testControlStream)
+	s.in = make(chan *cs.TunnelControlMessage, 16)
+	s.out = make(chan *cs.TunnelControlMessage, 16)
+	return s
+}
+
+func (s *testControlStream) Send(message *cs.TunnelControlMessage) error {
+	s.out <- message
+	return nil
+}
+
+func (s *testControlStream) Recv() (*cs.TunnelControlMessage, error) {
+	message, ok := <-s.in
+	if !ok {
+		return nil, io.EOF
+	}
+	return message, nil
+}
+
+// next returns the next message the tunnel sent.
+func (s *testControlStream) next(t *testing.T) *cs.TunnelControlMessage {
+	select {
+	case message := <-s.out:
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no control message sent")
+		return nil
+	}
+}
+
+// testByteStream is one end of an in-memory ByteStream.
+type testByteStream struct {
+	in  chan *cs.BytesMessage
+	out chan *cs.BytesMessage
+}
+
+func newTestByteStreams() (*testByteStream, *testByteStream) {
+	a := make(chan *cs.BytesMessage, 16)
+	b := make(chan *cs.BytesMessage, 16)
+	return &testByteStream{in: a, out: b}, &testByteStream{in: b, out: a}
+}
+
+func (s *testByteStream) Send(message *cs.BytesMessage) error {
+	s.out <- message
+	return nil
+}
+
+func (s *testByteStream) Recv() (*cs.BytesMessage, error) {
+	message, ok := <-s.in
+	if !ok {
+		return nil, io.EOF
+	}
+	return message, nil
+}
+
+// recvContent returns the content of the next data message on the
+// stream, skipping credit messages.
+func (s *testByteStream) recvContent(t *testing.T) string {
+	for {
+		select {
+		case message := <-s.in:
+			if message.Operation == common.ByteStreamCredit {
+				continue
+			}
+			return string(message.Content)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no data received")
+			return ""
+		}
+	}
+}
+
+// newTestServer returns a gServer without a configuration store or
+// gRPC services.
+func newTestServer() *GServer {
+	s := new(GServer)
+	s.connectedClients = make(map[string]*ConnectedClient)
+	s.receiveWindow = common.DefaultReceiveWindow
+	s.bandwidthLimit = common.NewBandwidthLimit(0)
+	s.proxyLog = NewProxyLog()
+	s.captures = NewCaptures()
+	s.relayListener = newRelayListener()
+	return s
+}
+
+// newTestClient adds a connected client to the server the way the
+// client service does for a new gClient.
+func newTestClient(s *GServer, uuid string) *ConnectedClient {
+	client := new(ConnectedClient)
+	client.uniqueID = uuid
+	client.connectDate = time.Now()
+	client.endpoint = common.NewEndpoint()
+	client.endpointInput = make(chan *cs.EndpointControlMessage)
+	client.bandwidthLimit = common.NewBandwidthLimit(0)
+	client.requests = make(map[string]chan *cs.EndpointControlMessage)
+	client.disconnected = make(chan bool)
+	s.AddConnectedClient(uuid, client)
+	return client
+}
+
+// startTestTunnel starts the gServer's end of a tunnel of the client,
+// adding it to the client's endpoint if needed, and returns the
+// control stream its gClient end would use.
+func startTestTunnel(t *testing.T, s *GServer, client *ConnectedClient,
+	tunnel *common.Tunnel) *testControlStream {
+
+	if _, ok := client.endpoint.GetTunnel(tunnel.GetID()); !ok {
+		client.endpoint.AddTunnel(tunnel.GetID(), tunnel)
+	}
+	ctrl := newTestControlStream()
+	tunnel.ConnectionHandler = s.newConnectionHandler(client.uniqueID,
+		tunnel.GetID())
+	tunnel.SetControlStream(ctrl)
+	tunnel.Start()
+	t.Cleanup(func() {
+		close(ctrl.in)
+		client.endpoint.StopAndDeleteTunnel(tunnel.GetID())
+	})
+	return ctrl
+}
+
+// connectTestTunnel reports a connection accepted by the gClient's
+// listener to a tunnel started with startTestTunnel. The gServer's
+// ack is returned along with the gClient's end of the connection's
+// byte stream, which is nil if the gServer failed to connect.
+func connectTestTunnel(t *testing.T, tunnel *common.Tunnel,
+	ctrl *testControlStream, connID string) (*cs.TunnelControlMessage, *testByteStream) {
+
+	ctrl.in <- &cs.TunnelControlMessage{
+		Operation:    common.TunnelCtrlConnect,
+		TunnelId:     tunnel.GetID(),
+		ConnectionId: connID,
+	}
+	return receiveTestAck(t, tunnel, ctrl)
+}
+
+// receiveTestAck waits for the gServer's ack of a connection the
+// gClient reported. If it succeeded, the gClient's end of the
+// connection's byte stream is opened and returned.
+func receiveTestAck(t *testing.T, tunnel *common.Tunnel,
+	ctrl *testControlStream) (*cs.TunnelControlMessage, *testByteStream) {
+
+	ack := ctrl.next(t)
+	if ack.Operation != common.TunnelCtrlAck || ack.ErrorStatus != 0 {
+		return ack, nil
+	}
+	return ack, openTestByteStream(tunnel, ack.ConnectionId)
+}
+
+// openTestByteStream opens the byte stream of a connection from
+// the gClient, as the client service does for a new connection
+// stream, and returns the gClient's end.
+func openTestByteStream(tunnel *common.Tunnel, connID string) *testByteStream {
+	stream, peer := newTestByteStreams()
+	conn := tunnel.GetConnection(connID)
+	conn.SetStream(stream)
+	close(conn.Connected)
+	return peer
+}
+
+// newTestRelay starts a relay tunnel on the client.
+func newTestRelay(t *testing.T, s *GServer,
+	client *ConnectedClient) (*common.Tunnel, *testControlStream) {
+
+	tunnel := common.NewTunnel("relay", common.TunnelDirectionReverse,
+		net.IPv4(127, 0, 0, 1), 0, nil, 0)
+	s.configureTunnel(client, tunnel)
+	tunnel.SetDestinations(common.NewDestinationSet([]*common.TunnelDestination{
+		common.NewTunnelDestination("relay", 0)},
+		common.DestinationStrategyFailover))
+	tunnel.SetDialFunc(s.relayListener.dial(client))
+	return tunnel, startTestTunnel(t, s, client, tunnel)
+}
+
+func TestRelayCarriesDownstreamClient(t *testing.T) {
+	s := newTestServer()
+	defer s.relayListener.Close()
+	intermediate := newTestClient(s, "intermediate")
+	intermediate.hops = []string{"top"}
+	tunnel, ctrl := newTestRelay(t, s, intermediate)
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := s.relayListener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	ack, peer := connectTestTunnel(t, tunnel, ctrl, "downstream")
+	if peer == nil {
+		t.Fatalf("relayed connection failed: %s", ack.ErrorMessage)
+	}
+	var conn net.Conn
+	select {
+	case conn = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("client service was not handed the relayed connection")
+	}
+	defer conn.Close()
+
+	// The downstream gClient is one hop below the intermediate one
+	if got := conn.RemoteAddr().String(); got != "relay:top>intermediate" {
+		t.Errorf("relayed connection came from %s; want relay:top>intermediate", got)
+	}
+
+	peer.Send(&cs.BytesMessage{Content: []byte("from downstream")})
+	buffer := make([]byte, 64)
+	n, err := conn.Read(buffer)
+	if err != nil || string(buffer[:n]) != "from downstream" {
+		t.Fatalf("client service read %q, %v; want from downstream", buffer[:n], err)
+	}
+
+	conn.Write([]byte("from server"))
+	if got := peer.recvContent(t); got != "from server" {
+		t.Errorf("downstream read %q; want from server", got)
+	}
+}
+
+func TestRelayHopLimit(t *testing.T) {
+	s := newTestServer()
+	defer s.relayListener.Close()
+	deepest := newTestClient(s, "deepest")
+	for i := 0; i < MaxRelayHops; i++ {
+		deepest.hops = append(deepest.hops, "hop")
+	}
+
+	// A relay on a gClient already at the limit is refused
+	err := s.AddTunnel(deepest.uniqueID, "relay", common.TunnelDirectionReverse,
+		common.TunnelProtocolTCP, net.IPv4(127, 0, 0, 1), 0, nil, "", 0, nil,
+		true, "", 1, common.CompressionNone, 0, common.ListenerLimits{})
+	if err == nil {
+		t.Errorf("added a relay past the hop limit")
+	}
+	if deepest.isRelay("relay") || s.isRelay(deepest.uniqueID, "relay") {
+		t.Errorf("refused tunnel is marked as a relay")
+	}
+
+	// and so are connections through one
+	tunnel, ctrl := newTestRelay(t, s, deepest)
+	ack, peer := connectTestTunnel(t, tunnel, ctrl, "downstream")
+	if peer != nil || !strings.Contains(ack.ErrorMessage, "hops") {
+		t.Errorf("ack = %v; want the hop limit", ack)
+	}
+}
+
+func TestSetRelay(t *testing.T) {
+	s := newTestServer()
+	client := newTestClient(s, "client")
+
+	client.setRelay("relay", true)
+	if !s.isRelay("client", "relay") {
+		t.Errorf("tunnel is not a relay after setRelay")
+	}
+	client.setRelay("relay", false)
+	if s.isRelay("client", "relay") {
+		t.Errorf("tunnel is still a relay after clearing it")
+	}
+	if s.isRelay("missing", "relay") {
+		t.Errorf("missing client has a relay")
+	}
+}
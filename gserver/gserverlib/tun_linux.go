@@ -0,0 +1,171 @@
+//go:build linux
+
+package gserverlib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+	"gvisor.dev/gvisor/pkg/tcpip/link/fdbased"
+	"gvisor.dev/gvisor/pkg/tcpip/link/tun"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// OpenTUN creates a TUN device with the provided name, brings it up
+// with the provided MTU and routes the provided networks to it. The
+// device and its routes go away once the returned closer is closed.
+// Creating a TUN device needs CAP_NET_ADMIN.
+func OpenTUN(name string, mtu uint32,
+	routes []*net.IPNet) (stack.LinkEndpoint, io.Closer, error) {
+
+	fd, err := tun.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	device := tunDevice(fd)
+
+	endpoint, err := fdbased.New(&fdbased.Options{FDs: []int{fd}, MTU: mtu})
+	if err != nil {
+		device.Close()
+		return nil, nil, err
+	}
+
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		device.Close()
+		return nil, nil, err
+	}
+	if err := setLinkUp(iface.Index, mtu); err != nil {
+		device.Close()
+		return nil, nil, fmt.Errorf("failed to bring up %s: %s", name, err)
+	}
+	for _, route := range routes {
+		if err := addRoute(iface.Index, route); err != nil {
+			device.Close()
+			return nil, nil, fmt.Errorf("failed to route %s to %s: %s",
+				route, name, err)
+		}
+	}
+
+	return endpoint, device, nil
+}
+
+// tunDevice is the file descriptor of a TUN device.
+type tunDevice int
+
+// Close will close the file descriptor, which removes the device.
+func (d tunDevice) Close() error {
+	return unix.Close(int(d))
+}
+
+// nativeEndian is the byte order netlink messages are encoded with.
+var nativeEndian = func() interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+} {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// setLinkUp will set the MTU of an interface and bring it up.
+func setLinkUp(index int, mtu uint32) error {
+	msg := make([]byte, unix.SizeofIfInfomsg)
+	msg[0] = unix.AF_UNSPEC
+	nativeEndian.PutUint32(msg[4:], uint32(index))
+	nativeEndian.PutUint32(msg[8:], unix.IFF_UP)
+	nativeEndian.PutUint32(msg[12:], unix.IFF_UP)
+	msg = appendAttribute(msg, unix.IFLA_MTU, nativeEndian.AppendUint32(nil, mtu))
+
+	return netlinkRequest(unix.RTM_NEWLINK, 0, msg)
+}
+
+// addRoute will route a network to an interface in the main table.
+func addRoute(index int, route *net.IPNet) error {
+	family := byte(unix.AF_INET)
+	ip := route.IP.To4()
+	if ip == nil {
+		family = unix.AF_INET6
+		ip = route.IP.To16()
+	}
+	ones, _ := route.Mask.Size()
+
+	msg := make([]byte, unix.SizeofRtMsg)
+	msg[0] = family
+	msg[1] = byte(ones)
+	msg[4] = unix.RT_TABLE_MAIN
+	msg[5] = unix.RTPROT_STATIC
+	msg[6] = unix.RT_SCOPE_LINK
+	msg[7] = unix.RTN_UNICAST
+	msg = appendAttribute(msg, unix.RTA_DST, ip)
+	msg = appendAttribute(msg, unix.RTA_OIF,
+		nativeEndian.AppendUint32(nil, uint32(index)))
+
+	return netlinkRequest(unix.RTM_NEWROUTE,
+		unix.NLM_F_CREATE|unix.NLM_F_EXCL, msg)
+}
+
+// appendAttribute appends a netlink route attribute to a message.
+func appendAttribute(msg []byte, attrType uint16, data []byte) []byte {
+	length := unix.SizeofRtAttr + len(data)
+	msg = nativeEndian.AppendUint16(msg, uint16(length))
+	msg = nativeEndian.AppendUint16(msg, attrType)
+	msg = append(msg, data...)
+	for length%unix.NLMSG_ALIGNTO != 0 {
+		msg = append(msg, 0)
+		length++
+	}
+	return msg
+}
+
+// netlinkRequest sends a single request to the kernel's routing
+// socket and waits for it to be acknowledged.
+func netlinkRequest(msgType uint16, flags uint16, body []byte) error {
+	sock, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC,
+		unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(sock)
+
+	if err := unix.Bind(sock, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	msg := nativeEndian.AppendUint32(nil, uint32(unix.NLMSG_HDRLEN+len(body)))
+	msg = nativeEndian.AppendUint16(msg, msgType)
+	msg = nativeEndian.AppendUint16(msg, flags|unix.NLM_F_REQUEST|unix.NLM_F_ACK)
+	msg = nativeEndian.AppendUint32(msg, 1)
+	msg = nativeEndian.AppendUint32(msg, 0)
+	msg = append(msg, body...)
+	if err := unix.Sendto(sock, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	reply := make([]byte, unix.Getpagesize())
+	n, _, err := unix.Recvfrom(sock, reply, 0)
+	if err != nil {
+		return err
+	}
+	messages, err := syscall.ParseNetlinkMessage(reply[:n])
+	if err != nil {
+		return err
+	}
+	for _, m := range messages {
+		if m.Header.Type != unix.NLMSG_ERROR || len(m.Data) < 4 {
+			continue
+		}
+		if errno := int32(nativeEndian.Uint32(m.Data)); errno != 0 {
+			return syscall.Errno(-errno)
+		}
+		return nil
+	}
+	return fmt.Errorf("no acknowledgement from the kernel")
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package gserverlib
+
+import (
+	"fmt"
+	"io"
+	"net"
+
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// OpenTUN is only supported on Linux. Elsewhere a VPN needs a link
+// endpoint to be set.
+func OpenTUN(name string, mtu uint32,
+	routes []*net.IPNet) (stack.LinkEndpoint, io.Closer, error) {
+
+	return nil, nil, fmt.Errorf("tun devices are only supported on linux")
+}
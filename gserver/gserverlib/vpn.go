@@ -0,0 +1,463 @@
+package gserverlib
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hotnops/gTunnel/common"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const (
+	vpnNICID = 1
+	// The number of TCP handshakes waiting on a dial at once
+	vpnMaxInFlight = 1024
+)
+
+// VPN gives layer 3 reachability to a set of routes through a
+// gClient. The packets routed to it are handed to a userspace
+// network stack, which terminates every TCP connection and UDP flow
+// and opens it again with the dial function. The gClient makes those
+// connections with ordinary sockets, so it needs no privileges. A TCP
+// handshake only completes once the dial succeeds and is reset
+// otherwise, so connect scans see closed ports as closed. If ICMP is
+// enabled, echo requests are carried to the gClient as well, so ping
+// reaches the routes. Other ICMP messages are not carried.
+type VPN struct {
+	id         string
+	device     string
+	mtu        uint32
+	routes     []*net.IPNet
+	endpoint   stack.LinkEndpoint
+	closer     io.Closer
+	stack      *stack.Stack
+	dial       common.DialFunc
+	requestLog common.RequestLogFunc
+	icmp       bool
+	flows      map[net.Conn]bool
+	echoFlows  map[echoFlowKey]*echoConn
+	stats      common.TrafficStats
+	mutex      sync.Mutex
+}
+
+// NewVPN is a constructor for the VPN struct. Only destinations in
+// the provided routes are carried.
+func NewVPN(id string, routes []*net.IPNet) *VPN {
+	v := new(VPN)
+	v.id = id
+	v.device = common.DefaultVPNDevice
+	v.mtu = common.DefaultVPNMTU
+	v.routes = routes
+	v.flows = make(map[net.Conn]bool)
+	v.echoFlows = make(map[echoFlowKey]*echoConn)
+	d := net.Dialer{Timeout: 10 * time.Second}
+	v.dial = d.Dial
+	return v
+}
+
+// SetDevice sets the name of the TUN device the VPN creates.
+func (v *VPN) SetDevice(device string) {
+	v.device = device
+}
+
+// SetMTU sets the MTU of the VPN's TUN device.
+func (v *VPN) SetMTU(mtu uint32) {
+	v.mtu = mtu
+}
+
+// SetLinkEndpoint will make the VPN read and write packets with the
+// provided link endpoint instead of creating a TUN device, so that
+// it runs entirely in userspace.
+func (v *VPN) SetLinkEndpoint(endpoint stack.LinkEndpoint) {
+	v.endpoint = endpoint
+}
+
+// SetDial will change how the VPN connects to destinations. By
+// default they are dialed directly.
+func (v *VPN) SetDial(dial common.DialFunc) {
+	v.dial = dial
+}
+
+// SetICMP sets whether ICMP echo requests are carried. The dial
+// function must support the icmp network, which needs a gClient
+// with CapabilityICMP.
+func (v *VPN) SetICMP(icmp bool) {
+	v.icmp = icmp
+}
+
+// SetRequestLog will set the function that every flow carried by
+// the VPN is reported to once it is finished.
+func (v *VPN) SetRequestLog(requestLog common.RequestLogFunc) {
+	v.requestLog = requestLog
+}
+
+// GetID returns the ID of the VPN.
+func (v *VPN) GetID() string {
+	return v.id
+}
+
+// GetDevice returns the name of the VPN's TUN device, or an empty
+// string if it uses another link endpoint.
+func (v *VPN) GetDevice() string {
+	if v.endpoint != nil && v.closer == nil {
+		return ""
+	}
+	return v.device
+}
+
+// GetMTU returns the MTU of the VPN's TUN device.
+func (v *VPN) GetMTU() uint32 {
+	return v.mtu
+}
+
+// GetRoutes returns the networks carried by the VPN.
+func (v *VPN) GetRoutes() []*net.IPNet {
+	return v.routes
+}
+
+// GetBindAddress returns nil, since the VPN does not listen on an
+// address.
+func (v *VPN) GetBindAddress() net.IP {
+	return nil
+}
+
+// GetFlowCount returns the number of flows currently carried.
+func (v *VPN) GetFlowCount() int {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	return len(v.flows)
+}
+
+// GetStats returns the number of bytes exchanged with the network
+// stack.
+func (v *VPN) GetStats() *common.TrafficStats {
+	return &v.stats
+}
+
+// Start will create the VPN's TUN device, unless a link endpoint is
+// set, and begin carrying the flows routed to it.
+func (v *VPN) Start() bool {
+	if v.endpoint == nil {
+		endpoint, closer, err := OpenTUN(v.device, v.mtu, v.routes)
+		if err != nil {
+			log.Printf("[!] VPN %s failed to open %s: %s", v.id, v.device, err)
+			return false
+		}
+		v.endpoint = endpoint
+		v.closer = closer
+	}
+
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocolFactory{ipv4.NewProtocol,
+			ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol,
+			udp.NewProtocol},
+	})
+	link := v.endpoint
+	if v.icmp {
+		link = newVPNLink(v, v.endpoint)
+	}
+	if err := s.CreateNIC(vpnNICID, link); err != nil {
+		log.Printf("[!] VPN %s failed to create NIC: %s", v.id, err)
+		s.Close()
+		v.closeDevice()
+		return false
+	}
+	v.mutex.Lock()
+	v.stack = s
+	v.mutex.Unlock()
+
+	// Accept packets for every address and answer from them
+	s.SetPromiscuousMode(vpnNICID, true)
+	s.SetSpoofing(vpnNICID, true)
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: header.IPv4EmptySubnet, NIC: vpnNICID},
+		{Destination: header.IPv6EmptySubnet, NIC: vpnNICID},
+	})
+
+	tcpForwarder := tcp.NewForwarder(s, 0, vpnMaxInFlight, v.handleTCP)
+	s.SetTransportProtocolHandler(tcp.ProtocolNumber, tcpForwarder.HandlePacket)
+	udpForwarder := udp.NewForwarder(s, v.handleUDP)
+	s.SetTransportProtocolHandler(udp.ProtocolNumber, udpForwarder.HandlePacket)
+	return true
+}
+
+// Stop will close every flow, the network stack and the TUN device.
+func (v *VPN) Stop() {
+	v.mutex.Lock()
+	s := v.stack
+	v.stack = nil
+	for conn := range v.flows {
+		conn.Close()
+	}
+	v.mutex.Unlock()
+
+	if s == nil {
+		return
+	}
+	// Removing the NIC waits for the device to stop being read
+	s.RemoveNIC(vpnNICID)
+	s.Close()
+	v.closeDevice()
+}
+
+// closeDevice closes the TUN device, if the VPN created one.
+func (v *VPN) closeDevice() {
+	if v.closer != nil {
+		v.closer.Close()
+	}
+}
+
+// routed returns true if the address is in one of the VPN's routes.
+func (v *VPN) routed(address tcpip.Address) bool {
+	ip := net.IP(address.AsSlice())
+	for _, route := range v.routes {
+		if route.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleTCP dials the destination of a TCP handshake and, if that
+// succeeds, completes the handshake and relays the connection.
+func (v *VPN) handleTCP(r *tcp.ForwarderRequest) {
+	id := r.ID()
+	if !v.routed(id.LocalAddress) {
+		r.Complete(true)
+		return
+	}
+
+	request := v.newRequest("tcp", id)
+	target, err := v.dial("tcp", request.Host)
+	if err != nil {
+		r.Complete(true)
+		v.logRequest(request, err)
+		return
+	}
+
+	var wq waiter.Queue
+	ep, tcpErr := r.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		r.Complete(true)
+		target.Close()
+		v.logRequest(request, fmt.Errorf("%s", tcpErr))
+		return
+	}
+	r.Complete(false)
+	ep.SocketOptions().SetKeepAlive(true)
+
+	request.ResolvedAddress = common.ResolvedAddress(target)
+	conn := gonet.NewTCPConn(&wq, ep)
+	request.BytesSent, request.BytesReceived = v.relay(conn, target)
+	v.logRequest(request, nil)
+}
+
+// handleUDP accepts the first datagram of a UDP flow and relays the
+// flow to its destination until it goes idle.
+func (v *VPN) handleUDP(r *udp.ForwarderRequest) {
+	id := r.ID()
+	if !v.routed(id.LocalAddress) {
+		return
+	}
+
+	var wq waiter.Queue
+	ep, tcpErr := r.CreateEndpoint(&wq)
+	if tcpErr != nil {
+		log.Printf("[!] VPN %s failed to accept udp flow: %s", v.id, tcpErr)
+		return
+	}
+
+	v.mutex.Lock()
+	s := v.stack
+	v.mutex.Unlock()
+	if s == nil {
+		ep.Close()
+		return
+	}
+	conn := gonet.NewUDPConn(s, &wq, ep)
+
+	go func() {
+		request := v.newRequest("udp", id)
+		target, err := v.dial("udp", request.Host)
+		if err != nil {
+			conn.Close()
+			v.logRequest(request, err)
+			return
+		}
+		request.ResolvedAddress = common.ResolvedAddress(target)
+
+		activity := new(atomic.Int64)
+		activity.Store(time.Now().UnixNano())
+		request.BytesSent, request.BytesReceived = v.relay(
+			&idleConn{Conn: conn, activity: activity},
+			&idleConn{Conn: target, activity: activity})
+		v.logRequest(request, nil)
+	}()
+}
+
+// relay tracks a flow for as long as its data is copied to and
+// from the destination.
+func (v *VPN) relay(conn net.Conn, target net.Conn) (uint64, uint64) {
+	v.mutex.Lock()
+	if v.stack == nil {
+		v.mutex.Unlock()
+		conn.Close()
+		target.Close()
+		return 0, 0
+	}
+	v.flows[conn] = true
+	v.mutex.Unlock()
+
+	defer func() {
+		v.mutex.Lock()
+		delete(v.flows, conn)
+		v.mutex.Unlock()
+	}()
+
+	return common.PipeConnections(common.NewCountedConn(conn, &v.stats), target)
+}
+
+// newRequest returns a record of a flow carried by the VPN,
+// starting now.
+func (v *VPN) newRequest(protocol string,
+	id stack.TransportEndpointID) *common.ProxyRequest {
+
+	request := new(common.ProxyRequest)
+	request.ProxyID = v.id
+	request.Protocol = "vpn"
+	request.Command = protocol
+	request.Source = net.JoinHostPort(id.RemoteAddress.String(),
+		strconv.Itoa(int(id.RemotePort)))
+	request.Host = net.JoinHostPort(id.LocalAddress.String(),
+		strconv.Itoa(int(id.LocalPort)))
+	request.StartTime = time.Now()
+	return request
+}
+
+// logRequest will finish the record of a flow with its result and
+// hand it to the request log, if one is set.
+func (v *VPN) logRequest(request *common.ProxyRequest, err error) {
+	request.Duration = time.Since(request.StartTime)
+	if err != nil {
+		request.Error = err.Error()
+	}
+	if v.requestLog != nil {
+		v.requestLog(request)
+	}
+}
+
+// idleConn is one side of a UDP flow. Reads fail once neither side
+// of the flow has received a datagram for common.UDPSessionTimeout.
+type idleConn struct {
+	net.Conn
+	activity *atomic.Int64
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	for {
+		c.Conn.SetReadDeadline(time.Now().Add(common.UDPSessionTimeout))
+		n, err := c.Conn.Read(b)
+		if err == nil {
+			c.activity.Store(time.Now().UnixNano())
+			return n, nil
+		}
+
+		// The other side may have been busy in the meantime
+		last := time.Unix(0, c.activity.Load())
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() &&
+			time.Since(last) < common.UDPSessionTimeout {
+			continue
+		}
+		return n, err
+	}
+}
+
+// GetVPN returns the VPN with the provided ID on the provided client.
+func (s *GServer) GetVPN(clientID string, vpnID string) (*VPN, bool) {
+	client, ok := s.connectedClients[clientID]
+	if !ok {
+		return nil, false
+	}
+	return client.getVPN(vpnID)
+}
+
+// GetVPNs returns the VPNs of the provided client, or false if the
+// client does not exist.
+func (s *GServer) GetVPNs(clientID string) (map[string]*VPN, bool) {
+	client, ok := s.connectedClients[clientID]
+	if !ok {
+		log.Printf("[!] client with uuuid: %s does not exist\n", clientID)
+		return nil, false
+	}
+	return client.getVPNs(), true
+}
+
+// addVPN records a VPN started for the client.
+func (c *ConnectedClient) addVPN(id string, v *VPN) {
+	c.tunnelMutex.Lock()
+	defer c.tunnelMutex.Unlock()
+
+	if c.vpns == nil {
+		c.vpns = make(map[string]*VPN)
+	}
+	c.vpns[id] = v
+}
+
+// getVPN returns the client's VPN with the provided ID.
+func (c *ConnectedClient) getVPN(id string) (*VPN, bool) {
+	c.tunnelMutex.Lock()
+	defer c.tunnelMutex.Unlock()
+
+	v, ok := c.vpns[id]
+	return v, ok
+}
+
+// getVPNs returns a copy of the client's VPNs.
+func (c *ConnectedClient) getVPNs() map[string]*VPN {
+	c.tunnelMutex.Lock()
+	defer c.tunnelMutex.Unlock()
+
+	vpns := make(map[string]*VPN, len(c.vpns))
+	for id, v := range c.vpns {
+		vpns[id] = v
+	}
+	return vpns
+}
+
+// stopAndDeleteVPN stops the client's VPN with the provided ID and
+// forgets about it. Returns true if successful and false otherwise.
+func (c *ConnectedClient) stopAndDeleteVPN(id string) bool {
+	c.tunnelMutex.Lock()
+	v, ok := c.vpns[id]
+	delete(c.vpns, id)
+	c.tunnelMutex.Unlock()
+
+	if !ok {
+		return false
+	}
+	v.Stop()
+	return true
+}
+
+// stopVPNs stops every VPN of a client that disconnected.
+func (c *ConnectedClient) stopVPNs() {
+	for id := range c.getVPNs() {
+		c.stopAndDeleteVPN(id)
+	}
+}
@@ -0,0 +1,254 @@
+package gserverlib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hotnops/gTunnel/common"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+// startTestVPN starts a VPN for 10.99.0.0/24 and returns a network
+// stack standing in for the operator's host, whose packets are
+// carried to and from the VPN.
+func startTestVPN(t *testing.T, dial common.DialFunc) *stack.Stack {
+	_, route, _ := net.ParseCIDR("10.99.0.0/24")
+	vpnLink := channel.New(256, common.DefaultVPNMTU, "")
+	vpn := NewVPN("test", []*net.IPNet{route})
+	vpn.SetLinkEndpoint(vpnLink)
+	vpn.SetDial(dial)
+	if !vpn.Start() {
+		t.Fatal("failed to start vpn")
+	}
+
+	hostLink := channel.New(256, common.DefaultVPNMTU, "")
+	host := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+	host.CreateNIC(1, hostLink)
+	host.AddProtocolAddress(1, tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddrFrom4([4]byte{10, 98, 0, 1}).WithPrefix(),
+	}, stack.AddressProperties{})
+	host.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: 1}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go carryPackets(ctx, hostLink, vpnLink)
+	go carryPackets(ctx, vpnLink, hostLink)
+	t.Cleanup(func() {
+		cancel()
+		vpn.Stop()
+		host.Close()
+	})
+	return host
+}
+
+// carryPackets copies the packets written to one link endpoint to
+// the other.
+func carryPackets(ctx context.Context, from *channel.Endpoint, to *channel.Endpoint) {
+	for {
+		pkt := from.ReadContext(ctx)
+		if pkt.IsNil() {
+			return
+		}
+		view := pkt.ToView()
+		pkt.DecRef()
+		inbound := stack.NewPacketBuffer(stack.PacketBufferOptions{
+			Payload: buffer.MakeWithView(view),
+		})
+		to.InjectInbound(ipv4.ProtocolNumber, inbound)
+		inbound.DecRef()
+	}
+}
+
+func TestVPNForwardsTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	dialed := make(chan string, 1)
+	host := startTestVPN(t, func(network string, address string) (net.Conn, error) {
+		if address != "10.99.0.5:80" {
+			return nil, fmt.Errorf("connection refused")
+		}
+		dialed <- network + " " + address
+		return net.Dial("tcp", ln.Addr().String())
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := gonet.DialContextTCP(ctx, host, tcpip.FullAddress{
+		Addr: tcpip.AddrFrom4([4]byte{10, 99, 0, 5}), Port: 80}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := <-dialed; got != "tcp 10.99.0.5:80" {
+		t.Errorf("unexpected dial: %s", got)
+	}
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 5)
+	if _, err := io.ReadFull(conn, reply); err != nil || string(reply) != "hello" {
+		t.Fatalf("unexpected reply %q: %v", reply, err)
+	}
+
+	// Failed dials and destinations outside the routes are reset
+	for _, addr := range [][4]byte{{10, 99, 0, 6}, {10, 100, 0, 5}} {
+		_, err := gonet.DialContextTCP(ctx, host, tcpip.FullAddress{
+			Addr: tcpip.AddrFrom4(addr), Port: 80}, ipv4.ProtocolNumber)
+		if err == nil {
+			t.Errorf("connected to %v", addr)
+		}
+	}
+}
+
+func TestVPNForwardsUDP(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			n, addr, err := echo.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buffer[:n], addr)
+		}
+	}()
+
+	host := startTestVPN(t, func(network string, address string) (net.Conn, error) {
+		return net.Dial(network, echo.LocalAddr().String())
+	})
+
+	conn, err := gonet.DialUDP(host, nil, &tcpip.FullAddress{
+		Addr: tcpip.AddrFrom4([4]byte{10, 99, 0, 5}), Port: 53}, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, message := range []string{"first", "second"} {
+		if _, err := conn.Write([]byte(message)); err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reply := make([]byte, 1500)
+		n, err := conn.Read(reply)
+		if err != nil || string(reply[:n]) != message {
+			t.Fatalf("unexpected reply %q: %v", reply[:n], err)
+		}
+	}
+}
+
+func TestVPNForwardsICMPEcho(t *testing.T) {
+	_, route, _ := net.ParseCIDR("10.99.0.0/24")
+	link := channel.New(256, common.DefaultVPNMTU, "")
+	vpn := NewVPN("test", []*net.IPNet{route})
+	vpn.SetLinkEndpoint(link)
+	vpn.SetICMP(true)
+
+	// The echo session answers with its own identifier, as ping
+	// sockets do
+	dialed := make(chan string, 1)
+	vpn.SetDial(func(network string, address string) (net.Conn, error) {
+		dialed <- network + " " + address
+		local, remote := common.Pipe()
+		go func() {
+			message := make([]byte, 1500)
+			n, err := remote.Read(message)
+			if err != nil {
+				return
+			}
+			reply := header.ICMPv4(message[:n])
+			reply.SetType(header.ICMPv4EchoReply)
+			reply.SetIdent(999)
+			remote.Write(reply)
+		}()
+		return local, nil
+	})
+	if !vpn.Start() {
+		t.Fatal("failed to start vpn")
+	}
+	defer vpn.Stop()
+
+	host := tcpip.AddrFrom4([4]byte{10, 98, 0, 1})
+	target := tcpip.AddrFrom4([4]byte{10, 99, 0, 5})
+	request := make([]byte, header.IPv4MinimumSize+header.ICMPv4MinimumSize+4)
+	ip := header.IPv4(request)
+	ip.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(request)),
+		TTL:         64,
+		Protocol:    uint8(header.ICMPv4ProtocolNumber),
+		SrcAddr:     host,
+		DstAddr:     target,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	icmp := header.ICMPv4(ip.Payload())
+	icmp.SetType(header.ICMPv4Echo)
+	icmp.SetIdent(7)
+	icmp.SetSequence(1)
+	copy(icmp.Payload(), "ping")
+	icmp.SetChecksum(header.ICMPv4Checksum(icmp, 0))
+
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithData(request),
+	})
+	link.InjectInbound(ipv4.ProtocolNumber, pkt)
+	pkt.DecRef()
+
+	if got := <-dialed; got != "icmp 10.99.0.5:0" {
+		t.Errorf("unexpected dial: %s", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	replyPkt := link.ReadContext(ctx)
+	if replyPkt.IsNil() {
+		t.Fatal("no echo reply")
+	}
+	view := replyPkt.ToView()
+	replyPkt.DecRef()
+	reply := header.IPv4(view.AsSlice())
+	if !reply.IsValid(len(reply)) || reply.SourceAddress() != target ||
+		reply.DestinationAddress() != host {
+		t.Fatalf("unexpected reply packet: %v", reply)
+	}
+	echo := header.ICMPv4(reply.Payload())
+	if echo.Type() != header.ICMPv4EchoReply || echo.Ident() != 7 ||
+		echo.Sequence() != 1 || string(echo.Payload()) != "ping" {
+		t.Errorf("unexpected echo reply: %v", echo)
+	}
+	if header.ICMPv4Checksum(echo, 0) != echo.Checksum() {
+		t.Errorf("invalid icmp checksum")
+	}
+}
@@ -0,0 +1,290 @@
+package gserverlib
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hotnops/gTunnel/common"
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/nested"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// vpnEchoBacklog is the number of echo requests queued for a flow
+// while its echo session is being opened. Requests beyond it are
+// dropped, as a congested network would.
+const vpnEchoBacklog = 16
+
+// vpnLink sits between a VPN's link endpoint and its network stack
+// and takes the ICMP echo requests routed to the VPN, which the
+// stack has no sockets for.
+type vpnLink struct {
+	nested.Endpoint
+	vpn *VPN
+}
+
+// newVPNLink wraps the provided link endpoint for the VPN.
+func newVPNLink(v *VPN, child stack.LinkEndpoint) *vpnLink {
+	l := new(vpnLink)
+	l.vpn = v
+	l.Init(child, l)
+	return l
+}
+
+// DeliverNetworkPacket hands echo requests to the VPN and every
+// other packet to the network stack.
+func (l *vpnLink) DeliverNetworkPacket(protocol tcpip.NetworkProtocolNumber,
+	pkt stack.PacketBufferPtr) {
+
+	view := pkt.ToView()
+	handled := l.vpn.handleEcho(view.AsSlice())
+	view.Release()
+	if !handled {
+		l.Endpoint.DeliverNetworkPacket(protocol, pkt)
+	}
+}
+
+// echoFlowKey identifies a ping: the host sending it, the host
+// being pinged and the echo identifier.
+type echoFlowKey struct {
+	src tcpip.Address
+	dst tcpip.Address
+	id  uint16
+}
+
+// parseEchoRequest returns the flow and ICMP message of an IP
+// packet if it is an unfragmented echo request.
+func parseEchoRequest(packet []byte) (echoFlowKey, []byte, bool) {
+	var key echoFlowKey
+	if len(packet) == 0 {
+		return key, nil, false
+	}
+
+	switch header.IPVersion(packet) {
+	case header.IPv4Version:
+		ip := header.IPv4(packet)
+		if !ip.IsValid(len(packet)) || ip.More() || ip.FragmentOffset() != 0 ||
+			ip.TransportProtocol() != header.ICMPv4ProtocolNumber {
+			return key, nil, false
+		}
+		icmp := header.ICMPv4(ip.Payload())
+		if len(icmp) < header.ICMPv4MinimumSize || icmp.Type() != header.ICMPv4Echo {
+			return key, nil, false
+		}
+		key = echoFlowKey{ip.SourceAddress(), ip.DestinationAddress(), icmp.Ident()}
+		return key, icmp, true
+	case header.IPv6Version:
+		ip := header.IPv6(packet)
+		if !ip.IsValid(len(packet)) ||
+			ip.TransportProtocol() != header.ICMPv6ProtocolNumber {
+			return key, nil, false
+		}
+		icmp := header.ICMPv6(ip.Payload())
+		if len(icmp) < header.ICMPv6MinimumSize ||
+			icmp.Type() != header.ICMPv6EchoRequest {
+			return key, nil, false
+		}
+		key = echoFlowKey{ip.SourceAddress(), ip.DestinationAddress(), icmp.Ident()}
+		return key, icmp, true
+	}
+	return key, nil, false
+}
+
+// buildEchoReply returns the IP packet answering the echo request
+// of a flow with the provided ICMP echo reply, which is given the
+// flow's identifier.
+func buildEchoReply(key echoFlowKey, message []byte) ([]byte, error) {
+	if key.dst.Len() == header.IPv4AddressSize {
+		if len(message) < header.ICMPv4MinimumSize ||
+			header.ICMPv4(message).Type() != header.ICMPv4EchoReply {
+			return nil, fmt.Errorf("not an icmp echo reply")
+		}
+		packet := make([]byte, header.IPv4MinimumSize+len(message))
+		ip := header.IPv4(packet)
+		ip.Encode(&header.IPv4Fields{
+			TotalLength: uint16(len(packet)),
+			TTL:         64,
+			Protocol:    uint8(header.ICMPv4ProtocolNumber),
+			SrcAddr:     key.dst,
+			DstAddr:     key.src,
+		})
+		ip.SetChecksum(^ip.CalculateChecksum())
+
+		icmp := header.ICMPv4(ip.Payload())
+		copy(icmp, message)
+		icmp.SetIdent(key.id)
+		icmp.SetChecksum(header.ICMPv4Checksum(icmp, 0))
+		return packet, nil
+	}
+
+	if len(message) < header.ICMPv6MinimumSize ||
+		header.ICMPv6(message).Type() != header.ICMPv6EchoReply {
+		return nil, fmt.Errorf("not an icmp echo reply")
+	}
+	packet := make([]byte, header.IPv6MinimumSize+len(message))
+	ip := header.IPv6(packet)
+	ip.Encode(&header.IPv6Fields{
+		PayloadLength:     uint16(len(message)),
+		TransportProtocol: header.ICMPv6ProtocolNumber,
+		HopLimit:          64,
+		SrcAddr:           key.dst,
+		DstAddr:           key.src,
+	})
+
+	icmp := header.ICMPv6(ip.Payload())
+	copy(icmp, message)
+	icmp.SetIdent(key.id)
+	icmp.SetChecksum(header.ICMPv6Checksum(header.ICMPv6ChecksumParams{
+		Header: icmp,
+		Src:    key.dst,
+		Dst:    key.src,
+	}))
+	return packet, nil
+}
+
+// handleEcho takes a packet if it is an echo request routed to the
+// VPN and queues it on the flow's echo session, opening one if
+// needed. It returns false for packets the stack should handle.
+func (v *VPN) handleEcho(packet []byte) bool {
+	key, message, ok := parseEchoRequest(packet)
+	if !ok || !v.routed(key.dst) {
+		return false
+	}
+
+	v.mutex.Lock()
+	if v.stack == nil {
+		v.mutex.Unlock()
+		return true
+	}
+	flow, ok := v.echoFlows[key]
+	if !ok {
+		flow = newEchoConn(v, key)
+		v.echoFlows[key] = flow
+		go v.relayEcho(flow)
+	}
+	v.mutex.Unlock()
+
+	select {
+	case flow.requests <- append([]byte{}, message...):
+	default:
+	}
+	return true
+}
+
+// relayEcho opens an echo session with the host being pinged and
+// relays the flow until it goes idle.
+func (v *VPN) relayEcho(flow *echoConn) {
+	defer v.removeEchoFlow(flow)
+
+	request := v.newRequest("icmp", stack.TransportEndpointID{
+		LocalAddress:  flow.key.dst,
+		RemoteAddress: flow.key.src,
+	})
+	target, err := v.dial("icmp", request.Host)
+	if err != nil {
+		flow.Close()
+		v.logRequest(request, err)
+		return
+	}
+	request.ResolvedAddress = common.ResolvedAddress(target)
+
+	request.BytesSent, request.BytesReceived = v.relay(flow,
+		&idleConn{Conn: target, activity: flow.activity})
+	v.logRequest(request, nil)
+}
+
+// writeEcho writes an IP packet to the VPN's link endpoint, beneath
+// the network stack.
+func (v *VPN) writeEcho(packet []byte) error {
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithData(packet),
+	})
+	defer pkt.DecRef()
+
+	var pkts stack.PacketBufferList
+	pkts.PushBack(pkt)
+	if _, err := v.endpoint.WritePackets(pkts); err != nil {
+		return fmt.Errorf("%s", err)
+	}
+	return nil
+}
+
+// removeEchoFlow forgets about a flow once it is no longer relayed.
+func (v *VPN) removeEchoFlow(flow *echoConn) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if v.echoFlows[flow.key] == flow {
+		delete(v.echoFlows, flow.key)
+	}
+}
+
+// echoConn is the network stack's side of a ping flow. Reads return
+// the echo requests sent by the host and writes answer it with echo
+// replies.
+type echoConn struct {
+	vpn       *VPN
+	key       echoFlowKey
+	requests  chan []byte
+	activity  *atomic.Int64
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newEchoConn is a constructor for the echoConn struct.
+func newEchoConn(v *VPN, key echoFlowKey) *echoConn {
+	c := new(echoConn)
+	c.vpn = v
+	c.key = key
+	c.requests = make(chan []byte, vpnEchoBacklog)
+	c.activity = new(atomic.Int64)
+	c.activity.Store(time.Now().UnixNano())
+	c.done = make(chan struct{})
+	return c
+}
+
+func (c *echoConn) Read(b []byte) (int, error) {
+	select {
+	case message := <-c.requests:
+		c.activity.Store(time.Now().UnixNano())
+		return copy(b, message), nil
+	case <-c.done:
+		return 0, io.EOF
+	}
+}
+
+func (c *echoConn) Write(b []byte) (int, error) {
+	packet, err := buildEchoReply(c.key, b)
+	if err != nil {
+		return 0, err
+	}
+	if err := c.vpn.writeEcho(packet); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *echoConn) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	return nil
+}
+
+func (c *echoConn) LocalAddr() net.Addr {
+	return &net.IPAddr{IP: net.IP(c.key.dst.AsSlice())}
+}
+
+func (c *echoConn) RemoteAddr() net.Addr {
+	return &net.IPAddr{IP: net.IP(c.key.src.AsSlice())}
+}
+
+// Deadlines are not supported, since the flow only ends once its
+// echo session goes idle or the VPN stops.
+func (c *echoConn) SetDeadline(t time.Time) error      { return nil }
+func (c *echoConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *echoConn) SetWriteDeadline(t time.Time) error { return nil }
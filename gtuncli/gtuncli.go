@@ -11,6 +11,8 @@ import (
 	"net"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/hotnops/gTunnel/common"
 	as "github.com/hotnops/gTunnel/grpc/admin"
@@ -40,6 +42,19 @@ var commands = []string{
 	"connectionlist",
 	"socksstart",
 	"socksstop",
+	"bandwidthlimit",
+	"sockslist",
+	"httpproxystart",
+	"httpproxystop",
+	"httpproxylist",
+	"proxylog",
+	"policyset",
+	"policyget",
+	"capture",
+	"vpnstart",
+	"vpnstop",
+	"vpnlist",
+	"recording",
 	"help"}
 
 func printCommands(progName string) {
@@ -72,7 +87,7 @@ func clientList(ctx context.Context, adminClient as.AdminServiceClient) {
 		log.Fatalf("[!] ClientList failed: %s", err)
 	}
 	table := tablewriter.NewWriter(os.Stdout)
-	table.SetHeader([]string{"Name", "Unique ID", "Status", "Remote Address", "Hostname", "Date Connected"})
+	table.SetHeader([]string{"Name", "Unique ID", "Status", "Remote Address", "Hostname", "Date Connected", "Bandwidth Limit", "Bytes Rx", "Bytes Tx", "Relay", "Hop Path"})
 	for {
 		message, err := stream.Recv()
 		if err == io.EOF {
@@ -87,7 +102,12 @@ func clientList(ctx context.Context, adminClient as.AdminServiceClient) {
 				status,
 				message.RemoteAddress,
 				message.Hostname,
-				message.ConnectDate}
+				message.ConnectDate,
+				formatBandwidth(message.BandwidthLimit),
+				fmt.Sprintf("%d", message.BytesRx),
+				fmt.Sprintf("%d", message.BytesTx),
+				message.ParentId,
+				strings.Join(message.HopPath, " > ")}
 			table.Append(row)
 		}
 	}
@@ -101,7 +121,7 @@ func clientRegister(ctx context.Context,
 	clientPlatform := clientCreateCmd.String("platform", "",
 		"The operating system platform")
 	serverIP := clientCreateCmd.String("ip", "",
-		"Address to which the client will connect.")
+		"Address to which the client will connect. For a client behind a relay, the address of the relay's listener")
 	serverPort := clientCreateCmd.Int("port", 443,
 		"The port to which the client will connect")
 	name := clientCreateCmd.String("name", "",
@@ -170,21 +190,47 @@ func tunnelAdd(ctx context.Context,
 		"The ID of the client that will get the new tunnel")
 	direction := tunnelAddCmd.String("direction", "forward",
 		"The direction of the tunnel")
+	protocol := tunnelAddCmd.String("proto", "tcp",
+		"The protocol of the tunnel. Should be 'tcp' or 'udp'")
 	listenIP := tunnelAddCmd.String("listenip", "0.0.0.0",
 		"The IP address on which the listen port will bind to")
-	listenPort := tunnelAddCmd.Int("listenport", 0,
-		"The port on which to accept connections.")
+	listenPort := tunnelAddCmd.String("listenport", "0",
+		"The port on which to accept connections. A range such as 8000-8010 listens on every port in it")
 	destinationIP := tunnelAddCmd.String("destinationip", "",
-		"The IP to which connections will be forwarded")
-	destinationPort := tunnelAddCmd.Int("destinationport", 0,
-		"The port to which the connection will be forwarded")
+		"The IP or hostname to which connections will be forwarded. Hostnames are resolved by the endpoint that makes the connection. A comma separated list of host or host:port destinations are tried in the order chosen by -strategy")
+	destinationPort := tunnelAddCmd.String("destinationport", "0",
+		"The port to which the connection will be forwarded. For a listen range, the start of the destination range")
+	bandwidth := tunnelAddCmd.String("bandwidth", "0",
+		"The bandwidth limit for the tunnel in bytes per second. Accepts K, M and G suffixes. 0 is unlimited")
+	compression := tunnelAddCmd.String("compression", "none",
+		"The compression used for tunneled data. Should be 'none' or 'snappy'")
 	tunnelID := tunnelAddCmd.String("tunnelid", "",
 		"A friendly name for the tunnel. A random string will be generated if none is provided")
+	allowedSources := tunnelAddCmd.String("allowsrc", "",
+		"A comma separated list of CIDRs allowed to connect to the listener. Empty allows every source")
+	maxConnections := tunnelAddCmd.Int("maxconns", 0,
+		"The maximum number of concurrent connections accepted by the listener. 0 is unlimited")
+	maxAcceptRate := tunnelAddCmd.Int("maxrate", 0,
+		"The maximum number of connections accepted by the listener per second. 0 is unlimited")
+	relay := tunnelAddCmd.Bool("relay", false,
+		"Accept downstream gClients on the listener and connect them to the server. Implies a tcp reverse tunnel without a destination")
+	egressClientID := tunnelAddCmd.String("egressclientid", "",
+		"The client that connects to the destination. The server bridges it to the listener on -clientid without opening a port. Implies a reverse tunnel")
+	strategy := tunnelAddCmd.String("strategy", "failover",
+		"How connections pick one of several destinations. Should be 'failover', 'roundrobin' or 'random'")
 
 	tunnelAddCmd.Parse(args)
 
 	tunnelAddReq := new(as.TunnelAddRequest)
 	tunnel := new(as.Tunnel)
+	if *relay {
+		*direction = "reverse"
+		tunnel.Relay = true
+	}
+	if *egressClientID != "" {
+		*direction = "reverse"
+		tunnel.EgressClientId = *egressClientID
+	}
 	if *direction == "forward" {
 		tunnel.Direction = common.TunnelDirectionForward
 	} else if *direction == "reverse" {
@@ -192,12 +238,58 @@ func tunnelAdd(ctx context.Context,
 	} else {
 		log.Fatalf("Invalid direction. Should be 'forward' or 'reverse'")
 	}
-	lIP := net.ParseIP(*listenIP)
-	dIP := net.ParseIP(*destinationIP)
+	algorithm, err := common.ParseCompression(*compression)
+	if err != nil {
+		log.Fatalf("[!] %s", err)
+	}
+	tunnel.Compression = algorithm
+	tunnel.BandwidthLimit = parseBandwidth(*bandwidth)
+
+	if *protocol == "tcp" {
+		tunnel.Protocol = common.TunnelProtocolTCP
+	} else if *protocol == "udp" {
+		tunnel.Protocol = common.TunnelProtocolUDP
+	} else {
+		log.Fatalf("Invalid protocol. Should be 'tcp' or 'udp'")
+	}
+	lIP := parseIP(*listenIP)
+	lPort, lCount := parsePortRange(*listenPort)
+	dPort, dCount := parsePortRange(*destinationPort)
+	if dCount != 1 && dCount != lCount {
+		log.Fatalf("[!] The destination range must have as many ports as the listen range")
+	}
+	tunnel.DestinationPort = dPort
+
+	destinations := strings.Split(*destinationIP, ",")
+	if len(destinations) > 1 {
+		for _, entry := range destinations {
+			destination, err := common.ParseTunnelDestination(entry, dPort)
+			if err != nil {
+				log.Fatalf("[!] %s", err)
+			}
+			tunnel.Destinations = append(tunnel.Destinations,
+				&as.TunnelDestination{Host: destination.Host, Port: destination.Port})
+		}
+		tunnel.DestinationStrategy, err = common.ParseDestinationStrategy(*strategy)
+		if err != nil {
+			log.Fatalf("[!] %s", err)
+		}
+	}
+	dIP := net.ParseIP(destinations[0])
+	if dIP == nil {
+		tunnel.DestinationHost = destinations[0]
+	}
 	tunnel.DestinationIp = common.IpToInt32(dIP)
-	tunnel.DestinationPort = uint32(*destinationPort)
+	tunnel.DestinationAddress = common.IPToBytes(dIP)
 	tunnel.ListenIp = common.IpToInt32(lIP)
-	tunnel.ListenPort = uint32(*listenPort)
+	tunnel.ListenAddress = common.IPToBytes(lIP)
+	tunnel.ListenPort = lPort
+	tunnel.PortCount = lCount
+	if *allowedSources != "" {
+		tunnel.AllowedSources = strings.Split(*allowedSources, ",")
+	}
+	tunnel.MaxConnections = uint32(*maxConnections)
+	tunnel.MaxAcceptRate = uint32(*maxAcceptRate)
 
 	if len(*tunnelID) == 0 {
 		tunnel.Id = common.GenerateString(common.TunnelIDSize)
@@ -208,7 +300,7 @@ func tunnelAdd(ctx context.Context,
 	tunnelAddReq.ClientId = *clientID
 	tunnelAddReq.Tunnel = tunnel
 
-	_, err := adminClient.TunnelAdd(ctx, tunnelAddReq)
+	_, err = adminClient.TunnelAdd(ctx, tunnelAddReq)
 
 	if err != nil {
 		log.Fatalf("[!] TunnelAdd failed: %s", err)
@@ -216,6 +308,67 @@ func tunnelAdd(ctx context.Context,
 
 }
 
+// formatDestinationHealth returns the health of each destination
+// of a tunnel, one per line, after the strategy if there are several.
+func formatDestinationHealth(tunnel *as.Tunnel) string {
+	var lines []string
+	if len(tunnel.Destinations) > 1 {
+		lines = append(lines, common.DestinationStrategyName(tunnel.DestinationStrategy))
+	}
+	for _, destination := range tunnel.Destinations {
+		state := "up"
+		if !destination.Healthy {
+			state = fmt.Sprintf("down since %s",
+				time.Unix(0, destination.LastFailure).Format(time.RFC3339))
+		}
+		lines = append(lines, fmt.Sprintf("%s %s (%d ok, %d failed)",
+			net.JoinHostPort(destination.Host, strconv.Itoa(int(destination.Port))),
+			state, destination.Successes, destination.Failures))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parsePortRange will parse a port or a range of ports such as
+// 8000-8010, exiting if it is invalid. It returns the first port
+// and the number of ports.
+func parsePortRange(ports string) (uint32, uint32) {
+	start, end, isRange := strings.Cut(ports, "-")
+	first, err := strconv.ParseUint(start, 10, 16)
+	if err != nil {
+		log.Fatalf("[!] Invalid port: %s", ports)
+	}
+	if !isRange {
+		return uint32(first), 1
+	}
+	last, err := strconv.ParseUint(end, 10, 16)
+	if err != nil || last < first {
+		log.Fatalf("[!] Invalid port range: %s", ports)
+	}
+	return uint32(first), uint32(last-first) + 1
+}
+
+// formatPortRange returns the range of count ports starting at
+// port, or just the port if there is only one.
+func formatPortRange(port uint32, count uint32) string {
+	if count <= 1 {
+		return fmt.Sprintf("%d", port)
+	}
+	return fmt.Sprintf("%d-%d", port, port+count-1)
+}
+
+// parseIP will parse an IPv4 or IPv6 literal, exiting if the
+// address is invalid. An empty string returns a nil IP.
+func parseIP(address string) net.IP {
+	if address == "" {
+		return nil
+	}
+	ip := net.ParseIP(address)
+	if ip == nil {
+		log.Fatalf("[!] Invalid IP address: %s", address)
+	}
+	return ip
+}
+
 func tunnelDelete(ctx context.Context,
 	adminClient as.AdminServiceClient,
 	args []string) {
@@ -260,10 +413,20 @@ func tunnelList(ctx context.Context,
 	table.SetHeader([]string{"Client ID",
 		"Tunnel ID",
 		"Direction",
+		"Protocol",
 		"Listen IP",
 		"Listen Port",
-		"Destination IP",
-		"Destination Port"})
+		"Destination",
+		"Destination Port",
+		"Receive Window",
+		"Compression",
+		"Bandwidth Limit",
+		"Connections",
+		"Bytes Rx",
+		"Bytes Tx",
+		"Rejected",
+		"Destination Health",
+		"Last Error"})
 
 	for {
 		message, err := stream.Recv()
@@ -279,18 +442,51 @@ func tunnelList(ctx context.Context,
 				direction = "reverse"
 			}
 
-			listenIP := common.Int32ToIP(message.ListenIp)
-			destIP := common.Int32ToIP(message.DestinationIp)
-			listenPort := fmt.Sprintf("%d", message.ListenPort)
-			destPort := fmt.Sprintf("%d", message.DestinationPort)
+			protocol := "tcp"
+			if message.Protocol == common.TunnelProtocolUDP {
+				protocol = "udp"
+			}
+
+			listenIP := common.BytesToIP(message.ListenAddress, message.ListenIp)
+			destination := common.BytesToIP(message.DestinationAddress, message.DestinationIp).String()
+			if message.DestinationHost != "" {
+				destination = message.DestinationHost
+			}
+			if message.Relay {
+				destination = "relay"
+			}
+			if message.EgressClientId != "" {
+				destination = fmt.Sprintf("%s via %s", destination,
+					message.EgressClientId)
+			} else if message.IngressClientId != "" {
+				destination = fmt.Sprintf("bridge from %s", message.IngressClientId)
+			}
+			listenPort := formatPortRange(message.ListenPort, message.PortCount)
+			destPort := formatPortRange(message.DestinationPort, message.PortCount)
+			window := fmt.Sprintf("%d", message.ReceiveWindow)
+			compression := common.CompressionName(message.Compression)
+			if message.UncompressedBytes > 0 {
+				compression = fmt.Sprintf("%s (%.1f%%)", compression,
+					100*float64(message.CompressedBytes)/float64(message.UncompressedBytes))
+			}
 
 			row := []string{*clientID,
 				message.Id,
 				direction,
+				protocol,
 				listenIP.String(),
 				listenPort,
-				destIP.String(),
-				destPort}
+				destination,
+				destPort,
+				window,
+				compression,
+				formatBandwidth(message.BandwidthLimit),
+				fmt.Sprintf("%d", message.ConnectionCount),
+				fmt.Sprintf("%d", message.BytesRx),
+				fmt.Sprintf("%d", message.BytesTx),
+				fmt.Sprintf("%d", message.RejectedConnections),
+				formatDestinationHealth(message),
+				message.LastError}
 			table.Append(row)
 
 		}
@@ -318,6 +514,17 @@ func connectionList(ctx context.Context,
 	if err != nil {
 		log.Fatalf("[!] ConnectionList failed: %s", err)
 	}
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Connection ID",
+		"Source",
+		"Destination",
+		"Bytes Rx",
+		"Bytes Tx",
+		"Started",
+		"Last Activity",
+		"Receive Window",
+		"Send Credit"})
+
 	for {
 		message, err := stream.Recv()
 		if err == io.EOF {
@@ -326,59 +533,849 @@ func connectionList(ctx context.Context,
 			log.Fatalf("[!] Error receiving: %s", err)
 		} else {
 
-			sourceIP := common.Int32ToIP(message.SourceIp)
-			destIP := common.Int32ToIP(message.DestinationIp)
-
-			log.Printf("%s\t%d\t%s\t%d\n",
-				sourceIP,
-				message.SourcePort,
-				destIP,
-				message.DestinationPort)
+			sourceIP := common.BytesToIP(message.SourceAddress, message.SourceIp)
+			destIP := common.BytesToIP(message.DestinationAddress, message.DestinationIp)
+
+			row := []string{message.Id,
+				net.JoinHostPort(sourceIP.String(), fmt.Sprint(message.SourcePort)),
+				net.JoinHostPort(destIP.String(), fmt.Sprint(message.DestinationPort)),
+				fmt.Sprintf("%d", message.BytesRx),
+				fmt.Sprintf("%d", message.BytesTx),
+				message.StartTime,
+				message.LastActivity,
+				fmt.Sprintf("%d", message.ReceiveWindow),
+				fmt.Sprintf("%d", message.SendCredit)}
+			table.Append(row)
 		}
 	}
+
+	table.Render()
 }
 
 func socksStart(ctx context.Context,
 	adminClient as.AdminServiceClient,
 	args []string) {
 
-	socksStartCmd := flag.NewFlagSet(commands[6], flag.ExitOnError)
+	socksStartCmd := flag.NewFlagSet(commands[7], flag.ExitOnError)
 	clientID := socksStartCmd.String("clientid", "",
 		"The ID of the client")
 	socksPort := socksStartCmd.Int("port", 0,
 		"The port on which to start the socks server")
+	socksID := socksStartCmd.String("socksid", "",
+		"The ID of the socks server, generated if empty")
+	clientSide := socksStartCmd.Bool("clientside", false,
+		"Listen on the gClient host instead of the gServer")
+	bindIP := socksStartCmd.String("bindip", "",
+		"The IP address on which to listen, 127.0.0.1 if empty")
+	username := socksStartCmd.String("username", "",
+		"The username clients must authenticate with, generated if empty")
+	password := socksStartCmd.String("password", "",
+		"The password clients must authenticate with, generated if empty")
+	noAuth := socksStartCmd.Bool("noauth", false,
+		"Allow clients to connect without authenticating")
 
 	socksStartCmd.Parse(args)
 
 	req := new(as.SocksStartRequest)
 	req.ClientId = *clientID
 	req.SocksPort = uint32(*socksPort)
+	req.ClientSide = *clientSide
+	req.BindAddress = common.IPToBytes(parseIP(*bindIP))
+	req.Username = *username
+	req.Password = *password
+	req.NoAuth = *noAuth
+	req.SocksId = *socksID
 
-	_, err := adminClient.SocksStart(ctx, req)
+	resp, err := adminClient.SocksStart(ctx, req)
 
 	if err != nil {
 		log.Fatalf("[!] Failed to start socks server: %s", err)
 	}
+
+	fmt.Printf("[*] Socks ID: %s\n", resp.SocksId)
+	if resp.Username != "" {
+		fmt.Printf("[*] Username: %s\n", resp.Username)
+		fmt.Printf("[*] Password: %s\n", resp.Password)
+	}
 }
 
 func socksStop(ctx context.Context,
 	adminClient as.AdminServiceClient,
 	args []string) {
 
-	socksStopCmd := flag.NewFlagSet(commands[6], flag.ExitOnError)
+	socksStopCmd := flag.NewFlagSet(commands[8], flag.ExitOnError)
 	clientID := socksStopCmd.String("clientid", "",
 		"The ID of the client")
+	socksID := socksStopCmd.String("socksid", "",
+		"The ID of the socks server, all socks servers if empty")
 
 	socksStopCmd.Parse(args)
 
 	req := new(as.SocksStopRequest)
 	req.ClientId = *clientID
+	req.SocksId = *socksID
 
 	_, err := adminClient.SocksStop(ctx, req)
 
 	if err != nil {
-		log.Fatalf("[!] Failed to start socks server: %s", err)
+		log.Fatalf("[!] Failed to stop socks server: %s", err)
+	}
+}
+
+func socksList(ctx context.Context,
+	adminClient as.AdminServiceClient,
+	args []string) {
+
+	socksListCmd := flag.NewFlagSet(commands[10], flag.ExitOnError)
+	clientID := socksListCmd.String("clientid", "",
+		"Socks servers will be listed for this client ID")
+
+	socksListCmd.Parse(args)
+	req := new(as.SocksListRequest)
+	req.ClientId = *clientID
+
+	stream, err := adminClient.SocksList(ctx, req)
+	if err != nil {
+		log.Fatalf("[!] SocksList failed: %s", err)
+	}
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Socks ID",
+		"Location",
+		"Bind Address",
+		"Port",
+		"Username",
+		"Connections",
+		"Bytes Rx",
+		"Bytes Tx"})
+
+	for {
+		message, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Fatalf("[!] Error receiving: %s", err)
+		}
+
+		location := "server"
+		connections := fmt.Sprintf("%d", message.ConnectionCount)
+		bytesRx := fmt.Sprintf("%d", message.BytesRx)
+		bytesTx := fmt.Sprintf("%d", message.BytesTx)
+		if message.ClientSide {
+			location = "client"
+			connections, bytesRx, bytesTx = "-", "-", "-"
+		}
+
+		row := []string{message.Id,
+			location,
+			common.BytesToIP(message.BindAddress, 0).String(),
+			fmt.Sprintf("%d", message.Port),
+			message.Username,
+			connections,
+			bytesRx,
+			bytesTx}
+		table.Append(row)
+	}
+
+	table.Render()
+}
+
+func httpProxyStart(ctx context.Context,
+	adminClient as.AdminServiceClient,
+	args []string) {
+
+	httpProxyStartCmd := flag.NewFlagSet(commands[11], flag.ExitOnError)
+	clientID := httpProxyStartCmd.String("clientid", "",
+		"The ID of the client")
+	proxyPort := httpProxyStartCmd.Int("port", 0,
+		"The port on which to start the http proxy")
+	proxyID := httpProxyStartCmd.String("proxyid", "",
+		"The ID of the http proxy, generated if empty")
+	clientSide := httpProxyStartCmd.Bool("clientside", false,
+		"Listen on the gClient host instead of the gServer")
+	bindIP := httpProxyStartCmd.String("bindip", "",
+		"The IP address on which to listen, 127.0.0.1 if empty")
+	username := httpProxyStartCmd.String("username", "",
+		"The username clients must authenticate with, generated if empty")
+	password := httpProxyStartCmd.String("password", "",
+		"The password clients must authenticate with, generated if empty")
+	noAuth := httpProxyStartCmd.Bool("noauth", false,
+		"Allow clients to connect without authenticating")
+
+	httpProxyStartCmd.Parse(args)
+
+	req := new(as.HTTPProxyStartRequest)
+	req.ClientId = *clientID
+	req.Port = uint32(*proxyPort)
+	req.ProxyId = *proxyID
+	req.ClientSide = *clientSide
+	req.BindAddress = common.IPToBytes(parseIP(*bindIP))
+	req.Username = *username
+	req.Password = *password
+	req.NoAuth = *noAuth
+
+	resp, err := adminClient.HTTPProxyStart(ctx, req)
+
+	if err != nil {
+		log.Fatalf("[!] Failed to start http proxy: %s", err)
+	}
+
+	fmt.Printf("[*] HTTP proxy ID: %s\n", resp.ProxyId)
+	if resp.Username != "" {
+		fmt.Printf("[*] Username: %s\n", resp.Username)
+		fmt.Printf("[*] Password: %s\n", resp.Password)
+	}
+}
+
+func httpProxyStop(ctx context.Context,
+	adminClient as.AdminServiceClient,
+	args []string) {
+
+	httpProxyStopCmd := flag.NewFlagSet(commands[12], flag.ExitOnError)
+	clientID := httpProxyStopCmd.String("clientid", "",
+		"The ID of the client")
+	proxyID := httpProxyStopCmd.String("proxyid", "",
+		"The ID of the http proxy, all http proxies if empty")
+
+	httpProxyStopCmd.Parse(args)
+
+	req := new(as.HTTPProxyStopRequest)
+	req.ClientId = *clientID
+	req.ProxyId = *proxyID
+
+	_, err := adminClient.HTTPProxyStop(ctx, req)
+
+	if err != nil {
+		log.Fatalf("[!] Failed to stop http proxy: %s", err)
+	}
+}
+
+func httpProxyList(ctx context.Context,
+	adminClient as.AdminServiceClient,
+	args []string) {
+
+	httpProxyListCmd := flag.NewFlagSet(commands[13], flag.ExitOnError)
+	clientID := httpProxyListCmd.String("clientid", "",
+		"HTTP proxies will be listed for this client ID")
+
+	httpProxyListCmd.Parse(args)
+	req := new(as.HTTPProxyListRequest)
+	req.ClientId = *clientID
+
+	stream, err := adminClient.HTTPProxyList(ctx, req)
+	if err != nil {
+		log.Fatalf("[!] HTTPProxyList failed: %s", err)
+	}
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Proxy ID",
+		"Location",
+		"Bind Address",
+		"Port",
+		"Username",
+		"Connections",
+		"Bytes Rx",
+		"Bytes Tx"})
+
+	for {
+		message, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Fatalf("[!] Error receiving: %s", err)
+		}
+
+		location := "server"
+		connections := fmt.Sprintf("%d", message.ConnectionCount)
+		bytesRx := fmt.Sprintf("%d", message.BytesRx)
+		bytesTx := fmt.Sprintf("%d", message.BytesTx)
+		if message.ClientSide {
+			location = "client"
+			connections, bytesRx, bytesTx = "-", "-", "-"
+		}
+
+		row := []string{message.Id,
+			location,
+			common.BytesToIP(message.BindAddress, 0).String(),
+			fmt.Sprintf("%d", message.Port),
+			message.Username,
+			connections,
+			bytesRx,
+			bytesTx}
+		table.Append(row)
+	}
+
+	table.Render()
+}
+
+func proxyLog(ctx context.Context,
+	adminClient as.AdminServiceClient,
+	args []string) {
+
+	proxyLogCmd := flag.NewFlagSet(commands[14], flag.ExitOnError)
+	clientID := proxyLogCmd.String("clientid", "",
+		"Requests will be listed for this client ID, or every client if empty")
+	proxyID := proxyLogCmd.String("proxyid", "",
+		"Requests will be listed for this socks or http proxy ID")
+
+	proxyLogCmd.Parse(args)
+	req := new(as.ProxyLogListRequest)
+	req.ClientId = *clientID
+	req.ProxyId = *proxyID
+
+	stream, err := adminClient.ProxyLogList(ctx, req)
+	if err != nil {
+		log.Fatalf("[!] ProxyLogList failed: %s", err)
+	}
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Client ID",
+		"Proxy ID",
+		"Protocol",
+		"Command",
+		"Source",
+		"Host",
+		"Resolved Address",
+		"Bytes Sent",
+		"Bytes Received",
+		"Started",
+		"Duration",
+		"Result"})
+
+	for {
+		message, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Fatalf("[!] Error receiving: %s", err)
+		}
+
+		result := "success"
+		if message.ErrorMessage != "" {
+			result = message.ErrorMessage
+		}
+
+		row := []string{message.ClientId,
+			message.ProxyId,
+			message.Protocol,
+			message.Command,
+			message.Source,
+			message.Host,
+			message.ResolvedAddress,
+			fmt.Sprintf("%d", message.BytesSent),
+			fmt.Sprintf("%d", message.BytesReceived),
+			time.Unix(0, message.StartTime).Format(time.RFC3339),
+			time.Duration(message.Duration).Round(time.Millisecond).String(),
+			result}
+		table.Append(row)
+	}
+
+	table.Render()
+}
+
+// policyRules collects the -rule flags of policyset in the
+// order they were provided.
+type policyRules []*common.PolicyRule
+
+func (r *policyRules) String() string {
+	return fmt.Sprint(*r)
+}
+
+func (r *policyRules) Set(value string) error {
+	rule, err := common.ParsePolicyRule(value)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, rule)
+	return nil
+}
+
+func policySet(ctx context.Context,
+	adminClient as.AdminServiceClient,
+	args []string) {
+
+	var rules policyRules
+	policySetCmd := flag.NewFlagSet(commands[15], flag.ExitOnError)
+	clientID := policySetCmd.String("clientid", "",
+		"The client for which the policy will be set")
+	policySetCmd.Var(&rules, "rule",
+		"A rule such as \"allow cidr=10.0.0.0/8 port=80-443\" or "+
+			"\"deny host=*.example.com\". Can be repeated, the first match decides")
+	defaultDeny := policySetCmd.Bool("defaultdeny", false,
+		"Deny destinations that match no rule")
+
+	policySetCmd.Parse(args)
+	req := new(as.PolicySetRequest)
+	req.ClientId = *clientID
+	req.DefaultDeny = *defaultDeny
+	for _, rule := range rules {
+		ruleMessage := new(as.PolicyRule)
+		ruleMessage.Allow = rule.Allow
+		ruleMessage.Cidr = rule.GetCIDR()
+		ruleMessage.Hostname = rule.Hostname
+		ruleMessage.PortStart = rule.PortStart
+		ruleMessage.PortEnd = rule.PortEnd
+		req.Rules = append(req.Rules, ruleMessage)
+	}
+
+	_, err := adminClient.PolicySet(ctx, req)
+	if err != nil {
+		log.Fatalf("[!] PolicySet failed: %s", err)
+	}
+}
+
+func policyGet(ctx context.Context,
+	adminClient as.AdminServiceClient,
+	args []string) {
+
+	policyGetCmd := flag.NewFlagSet(commands[16], flag.ExitOnError)
+	clientID := policyGetCmd.String("clientid", "",
+		"The client for which the policy will be shown")
+
+	policyGetCmd.Parse(args)
+	req := new(as.PolicyGetRequest)
+	req.ClientId = *clientID
+
+	resp, err := adminClient.PolicyGet(ctx, req)
+	if err != nil {
+		log.Fatalf("[!] PolicyGet failed: %s", err)
+	}
+
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Rule", "Action", "CIDR", "Host", "Ports"})
+
+	for i, rule := range resp.Rules {
+		action := "deny"
+		if rule.Allow {
+			action = "allow"
+		}
+		ports := ""
+		if rule.PortStart != 0 || rule.PortEnd != 0 {
+			ports = fmt.Sprintf("%d-%d", rule.PortStart, rule.PortEnd)
+		}
+
+		row := []string{fmt.Sprintf("%d", i+1),
+			action,
+			rule.Cidr,
+			rule.Hostname,
+			ports}
+		table.Append(row)
+	}
+
+	defaultAction := "allow"
+	if resp.DefaultDeny {
+		defaultAction = "deny"
+	}
+	table.Append([]string{"default", defaultAction, "", "", ""})
+	table.Render()
+}
+
+func capture(ctx context.Context,
+	adminClient as.AdminServiceClient,
+	args []string) {
+
+	captureCmd := flag.NewFlagSet(commands[17], flag.ExitOnError)
+	clientID := captureCmd.String("clientid", "",
+		"The client that owns the tunnel to capture")
+	tunnelID := captureCmd.String("tunnelid", "",
+		"The tunnel to capture")
+	connectionID := captureCmd.String("connectionid", "",
+		"A single connection to capture. Every connection on the tunnel is captured if empty")
+	stop := captureCmd.String("stop", "",
+		"The ID of a capture to stop instead of starting one")
+
+	captureCmd.Parse(args)
+
+	if *stop != "" {
+		req := new(as.CaptureStopRequest)
+		req.CaptureId = *stop
+
+		resp, err := adminClient.CaptureStop(ctx, req)
+		if err != nil {
+			log.Fatalf("[!] CaptureStop failed: %s", err)
+		}
+		fmt.Printf("[*] Captured %d packets carrying %d bytes to %s on the server\n",
+			resp.Packets, resp.Bytes, resp.Path)
+		return
+	}
+
+	req := new(as.CaptureStartRequest)
+	req.ClientId = *clientID
+	req.TunnelId = *tunnelID
+	req.ConnectionId = *connectionID
+
+	resp, err := adminClient.CaptureStart(ctx, req)
+	if err != nil {
+		log.Fatalf("[!] CaptureStart failed: %s", err)
+	}
+	fmt.Printf("[*] Capture ID: %s\n", resp.CaptureId)
+	fmt.Printf("[*] Writing to %s on the server\n", resp.Path)
+}
+
+func vpnStart(ctx context.Context,
+	adminClient as.AdminServiceClient,
+	args []string) {
+
+	vpnStartCmd := flag.NewFlagSet(commands[18], flag.ExitOnError)
+	clientID := vpnStartCmd.String("clientid", "",
+		"The ID of the client that carries the VPN's traffic")
+	vpnID := vpnStartCmd.String("vpnid", "",
+		"The ID of the VPN, generated if empty")
+	device := vpnStartCmd.String("device", common.DefaultVPNDevice,
+		"The name of the TUN device created on the server. Needs CAP_NET_ADMIN")
+	mtu := vpnStartCmd.Int("mtu", common.DefaultVPNMTU,
+		"The MTU of the TUN device")
+	routes := vpnStartCmd.String("routes", "",
+		"A comma separated list of CIDRs routed through the client")
+
+	vpnStartCmd.Parse(args)
+
+	if *routes == "" {
+		log.Fatalf("[!] At least one route must be provided")
+	}
+
+	req := new(as.VPNStartRequest)
+	req.ClientId = *clientID
+	req.VpnId = *vpnID
+	req.Device = *device
+	req.Mtu = uint32(*mtu)
+	req.Routes = strings.Split(*routes, ",")
+
+	resp, err := adminClient.VPNStart(ctx, req)
+
+	if err != nil {
+		log.Fatalf("[!] Failed to start vpn: %s", err)
+	}
+
+	fmt.Printf("[*] VPN ID: %s\n", resp.VpnId)
+	fmt.Printf("[*] Device: %s\n", resp.Device)
+}
+
+func vpnStop(ctx context.Context,
+	adminClient as.AdminServiceClient,
+	args []string) {
+
+	vpnStopCmd := flag.NewFlagSet(commands[19], flag.ExitOnError)
+	clientID := vpnStopCmd.String("clientid", "",
+		"The ID of the client")
+	vpnID := vpnStopCmd.String("vpnid", "",
+		"The ID of the VPN, all VPNs if empty")
+
+	vpnStopCmd.Parse(args)
+
+	req := new(as.VPNStopRequest)
+	req.ClientId = *clientID
+	req.VpnId = *vpnID
+
+	_, err := adminClient.VPNStop(ctx, req)
+
+	if err != nil {
+		log.Fatalf("[!] Failed to stop vpn: %s", err)
+	}
+}
+
+func vpnList(ctx context.Context,
+	adminClient as.AdminServiceClient,
+	args []string) {
+
+	vpnListCmd := flag.NewFlagSet(commands[20], flag.ExitOnError)
+	clientID := vpnListCmd.String("clientid", "",
+		"VPNs will be listed for this client ID")
+
+	vpnListCmd.Parse(args)
+	req := new(as.VPNListRequest)
+	req.ClientId = *clientID
+
+	stream, err := adminClient.VPNList(ctx, req)
+	if err != nil {
+		log.Fatalf("[!] VPNList failed: %s", err)
+	}
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"VPN ID",
+		"Device",
+		"MTU",
+		"Routes",
+		"Flows",
+		"Bytes Rx",
+		"Bytes Tx"})
+
+	for {
+		message, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Fatalf("[!] Error receiving: %s", err)
+		}
+
+		row := []string{message.Id,
+			message.Device,
+			fmt.Sprintf("%d", message.Mtu),
+			strings.Join(message.Routes, ","),
+			fmt.Sprintf("%d", message.FlowCount),
+			fmt.Sprintf("%d", message.BytesRx),
+			fmt.Sprintf("%d", message.BytesTx)}
+		table.Append(row)
+	}
+
+	table.Render()
+}
+
+// recordingSubcommands are the subcommands of the recording command.
+var recordingSubcommands = []string{
+	"list",
+	"export",
+	"verify"}
+
+func recording(ctx context.Context,
+	adminClient as.AdminServiceClient,
+	args []string) {
+
+	if len(args) == 0 {
+		log.Fatalf("[!] A subcommand is required: %s",
+			strings.Join(recordingSubcommands, ", "))
+	}
+
+	switch args[0] {
+	case recordingSubcommands[0]:
+		recordingList(ctx, adminClient, args[1:])
+	case recordingSubcommands[1]:
+		recordingExport(ctx, adminClient, args[1:])
+	case recordingSubcommands[2]:
+		recordingVerify(ctx, adminClient, args[1:])
+	default:
+		log.Fatalf("[!] Subcommand: %s not recognized. Should be one of: %s",
+			args[0], strings.Join(recordingSubcommands, ", "))
+	}
+}
+
+func recordingList(ctx context.Context,
+	adminClient as.AdminServiceClient,
+	args []string) {
+
+	recordingListCmd := flag.NewFlagSet(commands[21]+" "+recordingSubcommands[0],
+		flag.ExitOnError)
+	clientID := recordingListCmd.String("clientid", "",
+		"Only list recordings of this client")
+	tunnelID := recordingListCmd.String("tunnelid", "",
+		"Only list recordings of this tunnel")
+	connectionID := recordingListCmd.String("connectionid", "",
+		"Only list recordings of this connection")
+	protocol := recordingListCmd.String("proto", "",
+		"Only list recordings of this protocol, tcp or udp")
+	address := recordingListCmd.String("address", "",
+		"Only list recordings with this host or host:port as an endpoint")
+
+	recordingListCmd.Parse(args)
+	req := new(as.RecordingListRequest)
+	req.ClientId = *clientID
+	req.TunnelId = *tunnelID
+	req.ConnectionId = *connectionID
+	req.Protocol = *protocol
+	req.Address = *address
+
+	stream, err := adminClient.RecordingList(ctx, req)
+	if err != nil {
+		log.Fatalf("[!] RecordingList failed: %s", err)
+	}
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Recording ID",
+		"Client ID",
+		"Tunnel ID",
+		"Connection ID",
+		"Proto",
+		"Source",
+		"Destination",
+		"Remote Address",
+		"Start Time",
+		"Duration",
+		"Bytes From Source",
+		"Bytes From Destination"})
+
+	for {
+		message, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Fatalf("[!] Error receiving: %s", err)
+		}
+
+		duration := "recording"
+		if message.EndTime != 0 {
+			duration = time.Duration(message.EndTime - message.StartTime).Round(
+				time.Millisecond).String()
+		}
+		row := []string{message.Id,
+			message.ClientId,
+			message.TunnelId,
+			message.ConnectionId,
+			message.Protocol,
+			message.Source,
+			message.Destination,
+			message.RemoteAddress,
+			time.Unix(0, message.StartTime).Format(time.RFC3339),
+			duration,
+			fmt.Sprintf("%d", message.BytesFromSource),
+			fmt.Sprintf("%d", message.BytesFromDestination)}
+		table.Append(row)
+	}
+
+	table.Render()
+}
+
+func recordingExport(ctx context.Context,
+	adminClient as.AdminServiceClient,
+	args []string) {
+
+	recordingExportCmd := flag.NewFlagSet(commands[21]+" "+recordingSubcommands[1],
+		flag.ExitOnError)
+	recordingID := recordingExportCmd.String("id", "",
+		"The ID of the recording to export")
+	format := recordingExportCmd.String("format", "raw",
+		"The export format, raw or asciicast")
+	direction := recordingExportCmd.String("direction", "both",
+		"The data exported in the raw format, both, source or destination")
+	out := recordingExportCmd.String("out", "",
+		"The file the recording is written to. Written to stdout if empty")
+
+	recordingExportCmd.Parse(args)
+
+	if *recordingID == "" {
+		log.Fatalf("[!] A recording ID must be provided")
+	}
+
+	req := new(as.RecordingExportRequest)
+	req.RecordingId = *recordingID
+	var err error
+	if req.Format, err = common.ParseRecordingFormat(*format); err != nil {
+		log.Fatalf("[!] %s", err)
+	}
+	if req.Direction, err = common.ParseRecordingDirection(*direction); err != nil {
+		log.Fatalf("[!] %s", err)
+	}
+
+	writer := io.Writer(os.Stdout)
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			log.Fatalf("[!] Failed to create %s: %s", *out, err)
+		}
+		defer file.Close()
+		writer = file
+	}
+
+	stream, err := adminClient.RecordingExport(ctx, req)
+	if err != nil {
+		log.Fatalf("[!] RecordingExport failed: %s", err)
+	}
+
+	for {
+		message, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Fatalf("[!] Error receiving: %s", err)
+		}
+
+		if _, err := writer.Write(message.Data); err != nil {
+			log.Fatalf("[!] Failed to write recording: %s", err)
+		}
+	}
+}
+
+func recordingVerify(ctx context.Context,
+	adminClient as.AdminServiceClient,
+	args []string) {
+
+	recordingVerifyCmd := flag.NewFlagSet(commands[21]+" "+recordingSubcommands[2],
+		flag.ExitOnError)
+	recordingID := recordingVerifyCmd.String("id", "",
+		"The ID of the recording to verify. Every recording is verified if empty")
+
+	recordingVerifyCmd.Parse(args)
+	req := new(as.RecordingVerifyRequest)
+	req.RecordingId = *recordingID
+
+	stream, err := adminClient.RecordingVerify(ctx, req)
+	if err != nil {
+		log.Fatalf("[!] RecordingVerify failed: %s", err)
+	}
+
+	failed := 0
+	for {
+		message, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Fatalf("[!] Error receiving: %s", err)
+		}
+
+		if message.Ok {
+			fmt.Printf("[*] %s: OK\n", message.RecordingId)
+		} else {
+			fmt.Printf("[!] %s: %s\n", message.RecordingId, message.ErrorMessage)
+			failed++
+		}
+	}
+
+	if failed != 0 {
+		log.Fatalf("[!] %d recordings failed verification", failed)
+	}
+}
+
+func bandwidthLimit(ctx context.Context,
+	adminClient as.AdminServiceClient,
+	args []string) {
+
+	bandwidthCmd := flag.NewFlagSet(commands[9], flag.ExitOnError)
+	clientID := bandwidthCmd.String("clientid", "",
+		"The client to limit. The server wide limit is set if empty")
+	tunnelID := bandwidthCmd.String("tunnelid", "",
+		"The tunnel to limit. The limit for the whole client is set if empty")
+	limit := bandwidthCmd.String("limit", "0",
+		"The limit in bytes per second. Accepts K, M and G suffixes. 0 is unlimited")
+
+	bandwidthCmd.Parse(args)
+
+	req := new(as.BandwidthLimitSetRequest)
+	req.ClientId = *clientID
+	req.TunnelId = *tunnelID
+	req.BytesPerSecond = parseBandwidth(*limit)
+
+	_, err := adminClient.BandwidthLimitSet(ctx, req)
+
+	if err != nil {
+		log.Fatalf("[!] Failed to set bandwidth limit: %s", err)
+	}
+}
+
+// formatBandwidth returns a printable bandwidth limit.
+func formatBandwidth(bytesPerSecond uint64) string {
+	if bytesPerSecond == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d B/s", bytesPerSecond)
+}
+
+// parseBandwidth will parse a number of bytes per second with an
+// optional K, M or G suffix, exiting if the value is invalid.
+func parseBandwidth(limit string) uint64 {
+	multiplier := uint64(1)
+	if len(limit) > 0 {
+		switch strings.ToUpper(limit[len(limit)-1:]) {
+		case "K":
+			multiplier = 1024
+		case "M":
+			multiplier = 1024 * 1024
+		case "G":
+			multiplier = 1024 * 1024 * 1024
+		}
+		if multiplier != 1 {
+			limit = limit[:len(limit)-1]
+		}
+	}
+
+	value, err := strconv.ParseUint(limit, 10, 64)
+	if err != nil {
+		log.Fatalf("[!] Invalid bandwidth limit: %s", limit)
 	}
+	return value * multiplier
 }
 
 func loadConfiguration(hostname *string, port *int) {
@@ -486,6 +1483,32 @@ func main() {
 	case commands[8]:
 		socksStop(ctx, adminClient, os.Args[2:])
 	case commands[9]:
+		bandwidthLimit(ctx, adminClient, os.Args[2:])
+	case commands[10]:
+		socksList(ctx, adminClient, os.Args[2:])
+	case commands[11]:
+		httpProxyStart(ctx, adminClient, os.Args[2:])
+	case commands[12]:
+		httpProxyStop(ctx, adminClient, os.Args[2:])
+	case commands[13]:
+		httpProxyList(ctx, adminClient, os.Args[2:])
+	case commands[14]:
+		proxyLog(ctx, adminClient, os.Args[2:])
+	case commands[15]:
+		policySet(ctx, adminClient, os.Args[2:])
+	case commands[16]:
+		policyGet(ctx, adminClient, os.Args[2:])
+	case commands[17]:
+		capture(ctx, adminClient, os.Args[2:])
+	case commands[18]:
+		vpnStart(ctx, adminClient, os.Args[2:])
+	case commands[19]:
+		vpnStop(ctx, adminClient, os.Args[2:])
+	case commands[20]:
+		vpnList(ctx, adminClient, os.Args[2:])
+	case commands[21]:
+		recording(ctx, adminClient, os.Args[2:])
+	case commands[22]:
 		printCommands(os.Args[0])
 		os.Exit(1)
 	default: